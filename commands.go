@@ -0,0 +1,502 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"tblocker/config"
+	"tblocker/logging"
+	"tblocker/storage"
+	"tblocker/utils"
+	"time"
+)
+
+var commands = map[string]func(args []string) int{
+	"replay":  runReplay,
+	"status":  runStatus,
+	"doctor":  runDoctor,
+	"config":  runConfig,
+	"entries": runEntries,
+	"export":  runExport,
+	"import":  runImport,
+}
+
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	configPath := fs.String("c", "", "Path to the configuration file")
+	sourceLabel := fs.String("source", "", "Label of the log source whose parser and tag to use")
+	explain := fs.Bool("explain", false, "Treat arguments as log lines and explain the decision for each")
+	config.RegisterFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s replay [-c config] [-source label] <file...>\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "       %s replay [-c config] [-source label] -explain <line...>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	if err := config.LoadConfig(resolveConfigPath(*configPath)); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+
+	var err error
+	if *explain {
+		err = utils.Explain(fs.Args(), *sourceLabel, os.Stdout)
+	} else {
+		err = utils.Replay(fs.Args(), *sourceLabel, os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Replay failed: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+func runStatus(args []string) int {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	configPath := fs.String("c", "", "Path to the configuration file")
+	config.RegisterFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s status [-c config]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if err := config.LoadConfig(resolveConfigPath(*configPath)); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+
+	status, err := utils.ReadStatus(config.StorageDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read status from %s: %v\n", config.StorageDir, err)
+		return 1
+	}
+
+	utils.WriteStatusReport(status, time.Now(), os.Stdout)
+	return 0
+}
+
+func runDoctor(args []string) int {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	configPath := fs.String("c", "", "Path to the configuration file")
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	wait := fs.Duration("wait", 5*time.Second, "How long to watch log files for new lines")
+	config.RegisterFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s doctor [-c config] [-json] [-wait duration] [-<key> value...]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	logging.Setup("error", "text", os.Stderr)
+
+	path := resolveConfigPath(*configPath)
+	var checks []utils.DoctorCheck
+	if err := config.LoadConfig(path); err != nil {
+		checks = append(checks, utils.DoctorCheck{
+			Name:   "config",
+			Status: utils.CheckFail,
+			Detail: err.Error(),
+			Hint:   "Fix the configuration file, see config.yaml.example for all options.",
+		})
+	} else {
+		checks = append(checks, utils.DoctorCheck{Name: "config", Status: utils.CheckPass, Detail: "loaded " + path})
+		checks = append(checks, utils.RunDoctor(*wait)...)
+	}
+
+	if !utils.WriteDoctorReport(checks, *asJSON, os.Stdout) {
+		return 1
+	}
+	return 0
+}
+
+func runConfig(args []string) int {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintf(os.Stderr, "Usage: %s config check [-c config]\n", os.Args[0])
+		return 2
+	}
+
+	fs := flag.NewFlagSet("config check", flag.ExitOnError)
+	configPath := fs.String("c", "", "Path to the configuration file")
+	config.RegisterFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s config check [-c config] [-<key> value...]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args[1:])
+
+	path := resolveConfigPath(*configPath)
+	err := config.LoadConfig(path)
+	var validationErr *config.ValidationError
+	if errors.As(err, &validationErr) {
+		fmt.Fprintf(os.Stderr, "Configuration %s is invalid:\n", path)
+		for _, fieldErr := range validationErr.Errors {
+			fmt.Fprintf(os.Stderr, "  - %s\n", fieldErr)
+		}
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Configuration %s is valid\n", path)
+	return 0
+}
+
+func runEntries(args []string) int {
+	subcommands := map[string]func(args []string) int{
+		"list":   runEntriesList,
+		"add":    runEntriesAdd,
+		"remove": runEntriesRemove,
+	}
+	if len(args) == 0 || subcommands[args[0]] == nil {
+		fmt.Fprintf(os.Stderr, "Usage: %s entries list|add|remove [flags]\n", os.Args[0])
+		return 2
+	}
+	return subcommands[args[0]](args[1:])
+}
+
+func runEntriesList(args []string) int {
+	fs := flag.NewFlagSet("entries list", flag.ExitOnError)
+	configPath := fs.String("c", "", "Path to the configuration file")
+	kind := fs.String("kind", "", "Only list entries of this kind: block, ban or allow")
+	asJSON := fs.Bool("json", false, "Print the entries as JSON")
+	config.RegisterFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s entries list [-c config] [-kind kind] [-json]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if err := config.LoadConfig(resolveConfigPath(*configPath)); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+
+	store, _, err := utils.OpenEntryStore(config.StorageDir)
+	var entries []storage.BlockedIP
+	if err == nil {
+		defer store.Close()
+		entries, err = store.ListEntries()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to list entries: %v\n", err)
+		return 1
+	}
+
+	filtered := entries[:0]
+	for _, entry := range entries {
+		if *kind == "" || entry.Kind == *kind {
+			filtered = append(filtered, entry)
+		}
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(filtered)
+		return 0
+	}
+	utils.WriteEntries(filtered, time.Now(), os.Stdout)
+	return 0
+}
+
+func runEntriesAdd(args []string) int {
+	fs := flag.NewFlagSet("entries add", flag.ExitOnError)
+	configPath := fs.String("c", "", "Path to the configuration file")
+	kind := fs.String("kind", storage.KindBlock, "Kind of entry: block, ban or allow")
+	duration := fs.Duration("duration", 0, "How long a block or allow entry lasts (blocks default to BlockDuration)")
+	reason := fs.String("reason", "", "Why the entry was added")
+	author := fs.String("author", defaultAuthor(), "Who added the entry")
+	action := fs.String("action", "", "Firewall action of a block or ban: drop or throttle")
+	force := fs.Bool("force", false, "Replace a ban with a temporary block")
+	config.RegisterFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s entries add [-c config] [-kind kind] [-duration d] [-reason text] [-author name] [-force] <ip | user:name>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	if err := config.LoadConfig(resolveConfigPath(*configPath)); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+
+	if *duration == 0 && *kind == storage.KindAllow {
+		fmt.Fprintln(os.Stderr, "Allow entries need a -duration")
+		return 2
+	}
+
+	ip, username := utils.ParseEntryTarget(fs.Arg(0))
+	entry := storage.BlockedIP{
+		IP:       ip,
+		Username: username,
+		Kind:     *kind,
+		Reason:   *reason,
+		Author:   *author,
+		Action:   *action,
+	}
+	if *duration == 0 && *kind == storage.KindBlock {
+		*duration = time.Duration(config.BlockDuration) * time.Minute
+	}
+	if *duration > 0 {
+		entry.BlockedUntil = time.Now().Add(*duration)
+	}
+
+	store, offline, err := utils.OpenEntryStore(config.StorageDir)
+	if err == nil {
+		defer store.Close()
+		err = store.AddEntry(entry, true, *force)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to add entry: %v\n", err)
+		return 1
+	}
+	if offline {
+		fmt.Println("Service is not running, the entry was saved and will be applied on start")
+	}
+	return 0
+}
+
+func runEntriesRemove(args []string) int {
+	fs := flag.NewFlagSet("entries remove", flag.ExitOnError)
+	configPath := fs.String("c", "", "Path to the configuration file")
+	kind := fs.String("kind", storage.KindBlock, "Kind of entry: block, ban or allow")
+	config.RegisterFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s entries remove [-c config] [-kind kind] <ip | user:name>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	if err := config.LoadConfig(resolveConfigPath(*configPath)); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+
+	store, _, err := utils.OpenEntryStore(config.StorageDir)
+	if err == nil {
+		defer store.Close()
+		err = store.RemoveEntry(*kind, fs.Arg(0))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to remove entry: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func runExport(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	configPath := fs.String("c", "", "Path to the configuration file")
+	format := fs.String("format", "", "Output format: json, csv or txt (default from the file extension, json for stdout)")
+	kind := fs.String("kind", "", "Only export entries of this kind: block, ban or allow")
+	output := fs.String("o", "-", "File to write, - for stdout")
+	config.RegisterFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s export [-c config] [-format format] [-kind kind] [-o file]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *format == "" {
+		*format = utils.FormatJSON
+		if *output != "-" {
+			*format = utils.FormatFromPath(*output)
+		}
+	}
+
+	if err := config.LoadConfig(resolveConfigPath(*configPath)); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+
+	store, _, err := utils.OpenEntryStore(config.StorageDir)
+	var entries []storage.BlockedIP
+	if err == nil {
+		defer store.Close()
+		entries, err = store.ListEntries()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to list entries: %v\n", err)
+		return 1
+	}
+
+	now := time.Now()
+	active := []storage.BlockedIP{}
+	for _, entry := range entries {
+		// Mirrored blocks are left to the feeds of their peers.
+		if entry.Active(now) && entry.Origin == "" && (*kind == "" || entry.Kind == *kind) {
+			active = append(active, entry)
+		}
+	}
+
+	out := os.Stdout
+	if *output != "-" {
+		file, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create %s: %v\n", *output, err)
+			return 1
+		}
+		defer file.Close()
+		out = file
+	}
+
+	if err := utils.ExportEntries(active, *format, out); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to export entries: %v\n", err)
+		return 1
+	}
+	if *output != "-" {
+		fmt.Fprintf(os.Stderr, "Exported %d entries to %s\n", len(active), *output)
+	}
+	return 0
+}
+
+func runImport(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	configPath := fs.String("c", "", "Path to the configuration file")
+	format := fs.String("format", "", "Input format: json, csv or txt (default from the file extension, json for stdin)")
+	mode := fs.String("mode", utils.ImportMerge, "merge adds to the existing entries, replace also removes the entries missing from the file")
+	conflict := fs.String("conflict", utils.ConflictLonger, "Entry kept when both sides have one: longer, existing or imported")
+	kind := fs.String("kind", storage.KindBlock, "Kind of the entries that do not name one")
+	duration := fs.Duration("duration", 0, "How long entries without an expiry last (blocks default to BlockDuration)")
+	reason := fs.String("reason", "", "Reason of the entries that do not give one")
+	author := fs.String("author", defaultAuthor(), "Author of the entries that do not name one")
+	dryRun := fs.Bool("dry-run", false, "Only print what the import would change")
+	config.RegisterFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s import [-c config] [-format format] [-mode merge|replace] [-conflict policy] [-dry-run] <file | ->\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	path := fs.Arg(0)
+	if *format == "" {
+		*format = utils.FormatJSON
+		if path != "-" {
+			*format = utils.FormatFromPath(path)
+		}
+	}
+
+	if err := config.LoadConfig(resolveConfigPath(*configPath)); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+
+	in := os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open %s: %v\n", path, err)
+			return 1
+		}
+		defer file.Close()
+		in = file
+	}
+
+	imported, err := utils.ParseEntries(in, *format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read %s: %v\n", path, err)
+		return 1
+	}
+
+	now := time.Now()
+	if *duration == 0 {
+		*duration = time.Duration(config.BlockDuration) * time.Minute
+	}
+	for i := range imported {
+		entry := &imported[i]
+		if entry.Kind == "" {
+			entry.Kind = *kind
+		}
+		if entry.Reason == "" {
+			entry.Reason = *reason
+		}
+		if entry.Author == "" {
+			entry.Author = *author
+		}
+		if entry.Permanent() && entry.Kind != storage.KindBan {
+			entry.BlockedUntil = now.Add(*duration)
+		}
+	}
+
+	store, offline, err := utils.OpenEntryStore(config.StorageDir)
+	var existing []storage.BlockedIP
+	if err == nil {
+		defer store.Close()
+		existing, err = store.ListEntries()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to list entries: %v\n", err)
+		return 1
+	}
+
+	plan, err := utils.PlanImport(existing, imported, *mode, *conflict, now)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to import: %v\n", err)
+		return 2
+	}
+	for _, err := range plan.Invalid {
+		fmt.Fprintf(os.Stderr, "Skipping invalid entry: %v\n", err)
+	}
+
+	failed := false
+	if *dryRun {
+		for _, entry := range plan.Add {
+			fmt.Printf("add %s %s\n", entry.Kind, storage.AllowKey(entry))
+		}
+		for _, entry := range plan.Remove {
+			fmt.Printf("remove %s %s\n", entry.GetKind(), storage.AllowKey(entry))
+		}
+	} else {
+		for _, err := range utils.ApplyImport(store, plan) {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			failed = true
+		}
+	}
+
+	fmt.Printf("%d added, %d removed, %d kept, %d expired, %d invalid\n",
+		len(plan.Add), len(plan.Remove), plan.Kept, plan.Expired, len(plan.Invalid))
+	if offline && !*dryRun {
+		fmt.Println("Service is not running, the entries were saved and will be applied on start")
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+func defaultAuthor() string {
+	if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" {
+		return sudoUser
+	}
+	if current, err := user.Current(); err == nil {
+		return current.Username
+	}
+	return ""
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"tblocker/storage"
+	"tblocker/utils"
+	"testing"
+	"time"
+)
+
+func TestExportToStdoutRoundTrip(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "commands_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	configFile := filepath.Join(tempDir, "config.yaml")
+	configContent := "LogFile: /var/log/xray/access.log\nBlockDuration: 10\nTorrentTag: TORRENT\nBypassIPS:\n  - 10.0.0.1\n"
+	if err := os.WriteFile(configFile, []byte(configContent), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	store, err := storage.NewIPStorage(tempDir, func(string, time.Duration, string) {})
+	if err != nil {
+		t.Fatalf("Failed to create IP storage: %v", err)
+	}
+	if err := store.AddBlockedEntry(storage.BlockedIP{IP: "1.1.1.1", Kind: storage.KindBan, Reason: "abuse"}); err != nil {
+		t.Fatalf("Failed to add entry: %v", err)
+	}
+
+	exported, err := os.Create(filepath.Join(tempDir, "export.json"))
+	if err != nil {
+		t.Fatalf("Failed to create export file: %v", err)
+	}
+	defer exported.Close()
+
+	oldStdout := os.Stdout
+	os.Stdout = exported
+	// StorageDir comes from the override flag, like for the service.
+	code := runExport([]string{"-c", configFile, "-storage-dir", tempDir})
+	os.Stdout = oldStdout
+	if code != 0 {
+		t.Fatalf("Expected export to succeed, got exit code %d", code)
+	}
+
+	if _, err := exported.Seek(0, 0); err != nil {
+		t.Fatalf("Failed to rewind export file: %v", err)
+	}
+	entries, err := utils.ParseEntries(exported, utils.FormatJSON)
+	if err != nil {
+		t.Fatalf("Expected the exported document to parse: %v", err)
+	}
+	if len(entries) != 1 || entries[0].IP != "1.1.1.1" || entries[0].Kind != storage.KindBan {
+		t.Errorf("Unexpected exported entries %+v", entries)
+	}
+}
@@ -1,15 +1,26 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"regexp"
+	"sort"
+	"strings"
+	"tblocker/logging"
+	"tblocker/parser"
 
 	"gopkg.in/yaml.v2"
 )
 
 var (
 	LogFile       string
+	LogSources    []LogSource
+	Syslog        SyslogConfig
+	Feed          FeedConfig
+	Redis         RedisConfig
 	BlockDuration int
 	TorrentTag    string
 	BlockMode     string
@@ -21,26 +32,389 @@ var (
 	WebhookTemplate string
 	WebhookHeaders  map[string]string
 
+	DigestThreshold int
+	DigestWindow    int
+	DigestTemplate  string
+
 	UsernameRegex        *regexp.Regexp
 	DefaultUsernameRegex = `^(.+)$`
 
+	Threshold       int
+	ThresholdWindow int
+	UserPolicies    []UserPolicy
+
+	StrictTagMatch  bool
+	AllowedInbounds map[string]struct{}
+	DeniedInbounds  map[string]struct{}
+
+	TagRules []TagRule
+
+	// Rules and matcher of TorrentTag, used by sources not set up by LoadConfig.
+	defaultTagRules   []TagRule
+	defaultTagMatcher *parser.TagMatcher
+
+	BlockAction  string
+	ThrottleRate int
+
+	BlockScope     string
+	UserIPWindow   int
+	UserIPMaxUsers int
+
+	ConntrackMark     uint32
+	ConntrackMarkMask uint32
+	ConntrackZone     uint16
+	ConntrackMode     string
+
+	NetworkNamespace string
+
+	HealthAddr string
+
+	LogLevel  string
+	LogFormat string
+
+	DisableResume  bool
+	ResumeMaxAge   int
+	ResumeMaxBytes int64
+
 	Hostname string
 
 	EnablePerformanceMetrics bool
 )
 
 type Config struct {
-	LogFile         string            `yaml:"LogFile"`
-	BlockDuration   int               `yaml:"BlockDuration"`
-	TorrentTag      string            `yaml:"TorrentTag"`
-	UsernameRegex   string            `yaml:"UsernameRegex"`
-	BlockMode       string            `yaml:"BlockMode"`
-	BypassIPS       []string          `yaml:"BypassIPS"`
-	SendWebhook     bool              `yaml:"SendWebhook"`
-	WebhookURL      string            `yaml:"WebhookURL"`
-	WebhookTemplate string            `yaml:"WebhookTemplate"`
-	StorageDir      string            `yaml:"StorageDir"`
-	WebhookHeaders  map[string]string `yaml:"WebhookHeaders"`
+	Version           int               `yaml:"Version"`
+	LogFile           string            `yaml:"LogFile"`
+	LogSources        []LogSource       `yaml:"LogSources"`
+	Syslog            SyslogConfig      `yaml:"Syslog"`
+	Feed              FeedConfig        `yaml:"Feed"`
+	Redis             RedisConfig       `yaml:"Redis"`
+	BlockDuration     int               `yaml:"BlockDuration"`
+	TorrentTag        string            `yaml:"TorrentTag"`
+	UsernameRegex     string            `yaml:"UsernameRegex"`
+	BlockMode         string            `yaml:"BlockMode"`
+	BypassIPS         []string          `yaml:"BypassIPS"`
+	SendWebhook       bool              `yaml:"SendWebhook"`
+	WebhookURL        string            `yaml:"WebhookURL"`
+	WebhookTemplate   string            `yaml:"WebhookTemplate"`
+	StorageDir        string            `yaml:"StorageDir"`
+	WebhookHeaders    map[string]string `yaml:"WebhookHeaders"`
+	DigestThreshold   int               `yaml:"DigestThreshold"`
+	DigestWindow      int               `yaml:"DigestWindow"`
+	DigestTemplate    string            `yaml:"DigestTemplate"`
+	Threshold         int               `yaml:"Threshold"`
+	ThresholdWindow   int               `yaml:"ThresholdWindow"`
+	UserPolicies      []UserPolicy      `yaml:"UserPolicies"`
+	StrictTagMatch    bool              `yaml:"StrictTagMatch"`
+	AllowedInbounds   []string          `yaml:"AllowedInbounds"`
+	DeniedInbounds    []string          `yaml:"DeniedInbounds"`
+	DisableResume     bool              `yaml:"DisableResume"`
+	ResumeMaxAge      int               `yaml:"ResumeMaxAge"`
+	ResumeMaxBytes    int64             `yaml:"ResumeMaxBytes"`
+	TagRules          []TagRule         `yaml:"TagRules"`
+	BlockAction       string            `yaml:"BlockAction"`
+	ThrottleRate      int               `yaml:"ThrottleRate"`
+	BlockScope        string            `yaml:"BlockScope"`
+	UserIPWindow      int               `yaml:"UserIPWindow"`
+	UserIPMaxUsers    int               `yaml:"UserIPMaxUsers"`
+	ConntrackMark     uint32            `yaml:"ConntrackMark"`
+	ConntrackMarkMask uint32            `yaml:"ConntrackMarkMask"`
+	ConntrackZone     uint16            `yaml:"ConntrackZone"`
+	ConntrackMode     string            `yaml:"ConntrackMode"`
+	NetworkNamespace  string            `yaml:"NetworkNamespace"`
+	HealthAddr        string            `yaml:"HealthAddr"`
+	LogLevel          string            `yaml:"LogLevel"`
+	LogFormat         string            `yaml:"LogFormat"`
+}
+
+type LogSource struct {
+	Type             string `yaml:"Type"`
+	Path             string `yaml:"Path"`
+	Unit             string `yaml:"Unit"`
+	SyslogIdentifier string `yaml:"SyslogIdentifier"`
+	Label            string `yaml:"Label"`
+	TorrentTag       string `yaml:"TorrentTag"`
+	UsernameRegex    string `yaml:"UsernameRegex"`
+	Parser           string `yaml:"Parser"`
+	ParserPattern    string `yaml:"ParserPattern"`
+
+	usernameRegex *regexp.Regexp
+	tagRules      []TagRule
+	tagMatcher    *parser.TagMatcher
+}
+
+func (s *LogSource) GetTorrentTag() string {
+	if s.TorrentTag != "" {
+		return s.TorrentTag
+	}
+	return TorrentTag
+}
+
+func (s *LogSource) GetUsernameRegex() *regexp.Regexp {
+	if s.usernameRegex != nil {
+		return s.usernameRegex
+	}
+	return UsernameRegex
+}
+
+// GetTagRules returns the rules of the source built by LoadConfig: the
+// implicit rule for its TorrentTag followed by TagRules.
+func (s *LogSource) GetTagRules() []TagRule {
+	if s.tagMatcher != nil {
+		return s.tagRules
+	}
+	return defaultTagRules
+}
+
+// GetTagMatcher returns the matcher for the tags of GetTagRules, in the
+// same order.
+func (s *LogSource) GetTagMatcher() *parser.TagMatcher {
+	if s.tagMatcher != nil {
+		return s.tagMatcher
+	}
+	return defaultTagMatcher
+}
+
+// buildTagRules returns the implicit rule for torrentTag followed by the
+// configured TagRules. A configured rule for the same tag replaces the
+// implicit one.
+func buildTagRules(torrentTag string) ([]TagRule, *parser.TagMatcher) {
+	rules := make([]TagRule, 0, len(TagRules)+1)
+
+	if torrentTag != "" {
+		implicit := true
+		for _, rule := range TagRules {
+			if rule.Tag == torrentTag {
+				implicit = false
+				break
+			}
+		}
+		if implicit {
+			rules = append(rules, TagRule{Tag: torrentTag, Reason: TorrentReason})
+		}
+	}
+	rules = append(rules, TagRules...)
+
+	patterns := make([][]byte, len(rules))
+	for i, rule := range rules {
+		patterns[i] = []byte(rule.Tag)
+	}
+	return rules, parser.NewTagMatcher(patterns)
+}
+
+type SyslogConfig struct {
+	Enabled       bool         `yaml:"Enabled"`
+	UDPAddr       string       `yaml:"UDPAddr"`
+	TCPAddr       string       `yaml:"TCPAddr"`
+	TLSAddr       string       `yaml:"TLSAddr"`
+	TLSCertFile   string       `yaml:"TLSCertFile"`
+	TLSKeyFile    string       `yaml:"TLSKeyFile"`
+	TorrentTag    string       `yaml:"TorrentTag"`
+	UsernameRegex string       `yaml:"UsernameRegex"`
+	Parser        string       `yaml:"Parser"`
+	ParserPattern string       `yaml:"ParserPattern"`
+	Nodes         []SyslogNode `yaml:"Nodes"`
+	MaxNodes      int          `yaml:"MaxNodes"`
+
+	usernameRegex *regexp.Regexp
+	tagRules      []TagRule
+	tagMatcher    *parser.TagMatcher
+}
+
+// SyslogNode names the sender addresses of one node. Addresses are IPs or
+// CIDR ranges.
+type SyslogNode struct {
+	Name      string   `yaml:"Name"`
+	Addresses []string `yaml:"Addresses"`
+
+	networks []*net.IPNet
+}
+
+// NodeFor returns the configured node a sender address belongs to.
+func (c *SyslogConfig) NodeFor(ip net.IP) (string, bool) {
+	for _, node := range c.Nodes {
+		for _, network := range node.networks {
+			if network.Contains(ip) {
+				return node.Name, true
+			}
+		}
+	}
+	return "", false
+}
+
+func parseNetwork(address string) (*net.IPNet, error) {
+	if strings.Contains(address, "/") {
+		_, network, err := net.ParseCIDR(address)
+		return network, err
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", address)
+	}
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip, bits = ip.To4(), 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func (c *SyslogConfig) SourceFor(node string) LogSource {
+	return LogSource{
+		Type:          "syslog",
+		Label:         node,
+		TorrentTag:    c.TorrentTag,
+		UsernameRegex: c.UsernameRegex,
+		Parser:        c.Parser,
+		ParserPattern: c.ParserPattern,
+		usernameRegex: c.usernameRegex,
+		tagRules:      c.tagRules,
+		tagMatcher:    c.tagMatcher,
+	}
+}
+
+// FeedConfig publishes the blocks of this node to its peers and mirrors the
+// blocks published by them.
+type FeedConfig struct {
+	Addr        string     `yaml:"Addr"`
+	Token       string     `yaml:"Token"`
+	TLSCertFile string     `yaml:"TLSCertFile"`
+	TLSKeyFile  string     `yaml:"TLSKeyFile"`
+	Origin      string     `yaml:"Origin"`
+	Interval    int        `yaml:"Interval"`
+	Peers       []FeedPeer `yaml:"Peers"`
+}
+
+type FeedPeer struct {
+	Name  string `yaml:"Name"`
+	URL   string `yaml:"URL"`
+	Token string `yaml:"Token"`
+}
+
+// RedisConfig shares the blocks of all nodes through a Redis server. Blocks
+// are stored with their remaining time as TTL and announced over pub/sub.
+type RedisConfig struct {
+	Addr     string `yaml:"Addr"`
+	Username string `yaml:"Username"`
+	Password string `yaml:"Password"`
+	DB       int    `yaml:"DB"`
+	TLS      bool   `yaml:"TLS"`
+	Prefix   string `yaml:"Prefix"`
+	Origin   string `yaml:"Origin"`
+}
+
+// TorrentReason is the reason of the implicit rule created for TorrentTag.
+const TorrentReason = "torrent"
+
+type TagRule struct {
+	Tag             string `yaml:"Tag"`
+	BlockDuration   int    `yaml:"BlockDuration"`
+	Scope           string `yaml:"Scope"`
+	WebhookTemplate string `yaml:"WebhookTemplate"`
+	Reason          string `yaml:"Reason"`
+	Action          string `yaml:"Action"`
+}
+
+// GetScope returns the scope of the rule, falling back to BlockScope.
+func (r *TagRule) GetScope() string {
+	if r.Scope != "" {
+		return r.Scope
+	}
+	return BlockScope
+}
+
+// UserScopeEnabled reports whether any detection can block all recent IPs
+// of a user, which requires tracking the IPs of every access line.
+func UserScopeEnabled() bool {
+	if BlockScope == "user" {
+		return true
+	}
+	for _, rule := range TagRules {
+		if rule.Scope == "user" {
+			return true
+		}
+	}
+	return false
+}
+
+// GetAction returns the action of the rule, falling back to BlockAction.
+func (r *TagRule) GetAction() string {
+	if r.Action != "" {
+		return r.Action
+	}
+	return BlockAction
+}
+
+// FindTagRule returns the configured rule with the given reason label.
+func FindTagRule(reason string) *TagRule {
+	for i := range TagRules {
+		if TagRules[i].Reason == reason {
+			return &TagRules[i]
+		}
+	}
+	return nil
+}
+
+type UserPolicy struct {
+	Name          string `yaml:"Name"`
+	Regex         string `yaml:"Regex"`
+	Exempt        bool   `yaml:"Exempt"`
+	BlockDuration int    `yaml:"BlockDuration"`
+	Threshold     int    `yaml:"Threshold"`
+	NotifyOnly    bool   `yaml:"NotifyOnly"`
+
+	regex *regexp.Regexp
+}
+
+func (p *UserPolicy) Matches(username string) bool {
+	if p.Name != "" && p.Name == username {
+		return true
+	}
+	return p.regex != nil && p.regex.MatchString(username)
+}
+
+// CurrentVersion is the configuration schema version this build understands.
+// Files without a Version are treated as version 1.
+const CurrentVersion = 1
+
+// FieldError is a problem with a single configuration field.
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e FieldError) String() string {
+	if e.Field == "" {
+		return e.Message
+	}
+	return e.Field + ": " + e.Message
+}
+
+// ValidationError lists every problem found in a configuration file.
+type ValidationError struct {
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	problems := make([]string, len(e.Errors))
+	for i, fieldErr := range e.Errors {
+		problems[i] = fieldErr.String()
+	}
+	return "invalid configuration: " + strings.Join(problems, "; ")
+}
+
+func (e *ValidationError) add(field, format string, args ...any) {
+	e.Errors = append(e.Errors, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+var unknownFieldPattern = regexp.MustCompile(`^line (\d+): field (\S+) not found in type \S+$`)
+
+func (e *ValidationError) addYAML(typeErr *yaml.TypeError) {
+	for _, msg := range typeErr.Errors {
+		if m := unknownFieldPattern.FindStringSubmatch(msg); m != nil {
+			e.add(m[2], "unknown field (line %s)", m[1])
+		} else {
+			e.add("", "%s", msg)
+		}
+	}
 }
 
 func LoadConfig(configPath string) error {
@@ -49,18 +423,57 @@ func LoadConfig(configPath string) error {
 		return err
 	}
 
+	errs := &ValidationError{}
+
 	var cfg Config
-	err = yaml.Unmarshal(configFile, &cfg)
-	if err != nil {
+	err = yaml.UnmarshalStrict(configFile, &cfg)
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		errs.addYAML(typeErr)
+	} else if err != nil {
 		return err
 	}
+	applyOverrides(&cfg, errs)
+
+	if cfg.Version < 0 || cfg.Version > CurrentVersion {
+		errs.add("Version", "unsupported version %d, this build supports up to %d", cfg.Version, CurrentVersion)
+	}
 
 	LogFile = cfg.LogFile
 	BlockDuration = cfg.BlockDuration
+	if BlockDuration <= 0 {
+		errs.add("BlockDuration", "must be greater than 0")
+	}
 	TorrentTag = cfg.TorrentTag
+	if TorrentTag == "" {
+		errs.add("TorrentTag", "must not be empty")
+	}
 	SendWebhook = cfg.SendWebhook
-	WebhookURL = cfg.WebhookURL
-	WebhookHeaders = cfg.WebhookHeaders
+	WebhookURL, err = resolveSecret(cfg.WebhookURL)
+	if err != nil {
+		errs.add("WebhookURL", "failed to read secret: %v", err)
+	}
+	if SendWebhook && WebhookURL == "" {
+		errs.add("WebhookURL", "must be set when SendWebhook is enabled")
+	}
+	if WebhookURL != "" && err == nil {
+		if u, err := url.Parse(WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs.add("WebhookURL", "must be an http or https URL")
+		}
+	}
+	WebhookHeaders = make(map[string]string, len(cfg.WebhookHeaders))
+	headerNames := make([]string, 0, len(cfg.WebhookHeaders))
+	for name := range cfg.WebhookHeaders {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+	for _, name := range headerNames {
+		value, err := resolveSecret(cfg.WebhookHeaders[name])
+		if err != nil {
+			errs.add("WebhookHeaders."+name, "failed to read secret: %v", err)
+		}
+		WebhookHeaders[name] = value
+	}
 
 	if cfg.UsernameRegex != "" {
 		UsernameRegex, err = regexp.Compile(cfg.UsernameRegex)
@@ -68,27 +481,26 @@ func LoadConfig(configPath string) error {
 		UsernameRegex, err = regexp.Compile(DefaultUsernameRegex)
 	}
 	if err != nil {
-		return fmt.Errorf("invalid UsernameRegex pattern: %v", err)
+		errs.add("UsernameRegex", "invalid pattern: %v", err)
 	}
 
-	Hostname, err = os.Hostname()
 	if cfg.BlockMode != "" {
 		BlockMode = cfg.BlockMode
 	} else {
 		BlockMode = "iptables"
 	}
+	if BlockMode != "iptables" && BlockMode != "nft" {
+		errs.add("BlockMode", "unknown mode %q, expected iptables or nft", BlockMode)
+	}
+	BypassIPSet = make(map[string]struct{})
 	if cfg.BypassIPS != nil {
-		fmt.Println("Bypass IPS list:")
-		BypassIPSet = make(map[string]struct{})
-		for _, ip := range cfg.BypassIPS {
+		for i, ip := range cfg.BypassIPS {
+			if net.ParseIP(ip) == nil {
+				errs.add(fmt.Sprintf("BypassIPS[%d]", i), "invalid IP address %q", ip)
+				continue
+			}
 			BypassIPSet[ip] = struct{}{}
-			fmt.Printf("- %s\n", ip)
 		}
-	} else {
-		BypassIPSet = make(map[string]struct{})
-	}
-	if WebhookHeaders == nil {
-		WebhookHeaders = make(map[string]string)
 	}
 	if cfg.WebhookTemplate != "" {
 		WebhookTemplate = cfg.WebhookTemplate
@@ -96,10 +508,406 @@ func LoadConfig(configPath string) error {
 		WebhookTemplate = `{"username":"%s","ip":"%s","server":"%s","action":"%s","duration":%d,"timestamp":"%s"}`
 	}
 
+	DigestThreshold = cfg.DigestThreshold
+	DigestWindow = cfg.DigestWindow
+	if DigestWindow <= 0 {
+		DigestWindow = 60
+	}
+	if cfg.DigestTemplate != "" {
+		DigestTemplate = cfg.DigestTemplate
+	} else {
+		DigestTemplate = `{"server":"{server}","action":"digest","count":{count},"counts":{counts},"users":{users},"top_users":{top_users},"ips":{ips},"start":"{start}","end":"{end}"}`
+	}
+
+	LogSources = make([]LogSource, 0, len(cfg.LogSources)+1)
+	labels := make(map[string]struct{}, len(cfg.LogSources))
+	for i, source := range cfg.LogSources {
+		field := fmt.Sprintf("LogSources[%d]", i)
+		// Sources are looked up by label, so they must not share one.
+		if _, exists := labels[source.Label]; exists {
+			if source.Label == "" {
+				errs.add(field+".Label", "must be set when more than one source has no label")
+			} else {
+				errs.add(field+".Label", "duplicate label %q", source.Label)
+			}
+		}
+		labels[source.Label] = struct{}{}
+		switch source.Type {
+		case "", "file":
+			source.Type = "file"
+			if source.Path == "" {
+				errs.add(field+".Path", "must be set for file sources")
+			}
+		case "journal":
+			if source.Unit == "" && source.SyslogIdentifier == "" {
+				errs.add(field, "journal source must set Unit or SyslogIdentifier")
+			}
+		default:
+			errs.add(field+".Type", "unknown type %q, expected file or journal", source.Type)
+		}
+		if source.UsernameRegex != "" {
+			re, err := regexp.Compile(source.UsernameRegex)
+			if err != nil {
+				errs.add(field+".UsernameRegex", "invalid pattern: %v", err)
+			}
+			source.usernameRegex = re
+		}
+		if _, err := parser.New(source.Parser, source.ParserPattern); err != nil {
+			errs.add(field+".Parser", "%v", err)
+		}
+		LogSources = append(LogSources, source)
+	}
+	Syslog = cfg.Syslog
+	if Syslog.Enabled {
+		if Syslog.UDPAddr == "" && Syslog.TCPAddr == "" && Syslog.TLSAddr == "" {
+			errs.add("Syslog", "receiver requires at least one of UDPAddr, TCPAddr or TLSAddr")
+		}
+		if Syslog.TLSAddr != "" && (Syslog.TLSCertFile == "" || Syslog.TLSKeyFile == "") {
+			errs.add("Syslog.TLSAddr", "requires TLSCertFile and TLSKeyFile")
+		}
+		if Syslog.UsernameRegex != "" {
+			re, err := regexp.Compile(Syslog.UsernameRegex)
+			if err != nil {
+				errs.add("Syslog.UsernameRegex", "invalid pattern: %v", err)
+			}
+			Syslog.usernameRegex = re
+		}
+		if _, err := parser.New(Syslog.Parser, Syslog.ParserPattern); err != nil {
+			errs.add("Syslog.Parser", "%v", err)
+		}
+		checkNotNegative(errs, map[string]int64{"Syslog.MaxNodes": int64(Syslog.MaxNodes)})
+		if Syslog.MaxNodes <= 0 {
+			Syslog.MaxNodes = 100
+		}
+		loadSyslogNodes(errs)
+		if len(Syslog.Nodes) == 0 {
+			checkSyslogLoopback(errs, map[string]string{
+				"Syslog.UDPAddr": Syslog.UDPAddr,
+				"Syslog.TCPAddr": Syslog.TCPAddr,
+				"Syslog.TLSAddr": Syslog.TLSAddr,
+			})
+		}
+		for i, node := range Syslog.Nodes {
+			if _, exists := labels[node.Name]; exists {
+				errs.add(fmt.Sprintf("Syslog.Nodes[%d].Name", i), "already used as the label of a log source")
+			}
+		}
+	}
+
+	Hostname, err = os.Hostname()
+	if err != nil {
+		return fmt.Errorf("failed to get hostname: %v", err)
+	}
+	Feed = cfg.Feed
+	if Feed.Origin == "" {
+		Feed.Origin = Hostname
+	}
+	loadFeed(errs)
+	Redis = cfg.Redis
+	if Redis.Origin == "" {
+		Redis.Origin = Feed.Origin
+	}
+	loadRedis(errs)
+
+	if len(LogSources) == 0 && LogFile != "" {
+		LogSources = append(LogSources, LogSource{Type: "file", Path: LogFile})
+	}
+	if len(LogSources) == 0 && !Syslog.Enabled {
+		errs.add("LogFile", "no input configured, set LogFile, LogSources or enable Syslog")
+	}
+
 	StorageDir = cfg.StorageDir
 	if StorageDir == "" {
 		StorageDir = "/opt/tblocker"
 	}
 
-	return err
+	checkNotNegative(errs, map[string]int64{
+		"DigestThreshold": int64(cfg.DigestThreshold),
+		"DigestWindow":    int64(cfg.DigestWindow),
+		"Threshold":       int64(cfg.Threshold),
+		"ThresholdWindow": int64(cfg.ThresholdWindow),
+		"ResumeMaxAge":    int64(cfg.ResumeMaxAge),
+		"ResumeMaxBytes":  cfg.ResumeMaxBytes,
+		"ThrottleRate":    int64(cfg.ThrottleRate),
+		"UserIPWindow":    int64(cfg.UserIPWindow),
+		"UserIPMaxUsers":  int64(cfg.UserIPMaxUsers),
+	})
+
+	Threshold = cfg.Threshold
+	if Threshold <= 0 {
+		Threshold = 1
+	}
+	ThresholdWindow = cfg.ThresholdWindow
+	if ThresholdWindow <= 0 {
+		ThresholdWindow = 60
+	}
+
+	StrictTagMatch = cfg.StrictTagMatch
+	AllowedInbounds = toSet(cfg.AllowedInbounds)
+	DeniedInbounds = toSet(cfg.DeniedInbounds)
+
+	DisableResume = cfg.DisableResume
+	ResumeMaxAge = cfg.ResumeMaxAge
+	if ResumeMaxAge <= 0 {
+		ResumeMaxAge = 60
+	}
+	ResumeMaxBytes = cfg.ResumeMaxBytes
+	if ResumeMaxBytes <= 0 {
+		ResumeMaxBytes = 100 * 1024 * 1024
+	}
+
+	UserPolicies = make([]UserPolicy, 0, len(cfg.UserPolicies))
+	for i, policy := range cfg.UserPolicies {
+		field := fmt.Sprintf("UserPolicies[%d]", i)
+		if policy.Name == "" && policy.Regex == "" {
+			errs.add(field, "must set Name or Regex")
+		}
+		if policy.Regex != "" {
+			re, err := regexp.Compile(policy.Regex)
+			if err != nil {
+				errs.add(field+".Regex", "invalid pattern: %v", err)
+			}
+			policy.regex = re
+		}
+		checkNotNegative(errs, map[string]int64{
+			field + ".BlockDuration": int64(policy.BlockDuration),
+			field + ".Threshold":     int64(policy.Threshold),
+		})
+		UserPolicies = append(UserPolicies, policy)
+	}
+
+	BlockAction = cfg.BlockAction
+	if BlockAction == "" {
+		BlockAction = "drop"
+	}
+	if !isValidAction(BlockAction) {
+		errs.add("BlockAction", "unknown action %q, expected drop or throttle", BlockAction)
+	}
+	ThrottleRate = cfg.ThrottleRate
+	if ThrottleRate <= 0 {
+		ThrottleRate = 256
+	}
+
+	BlockScope = cfg.BlockScope
+	if BlockScope == "" {
+		BlockScope = "ip"
+	}
+	if !isValidScope(BlockScope) {
+		errs.add("BlockScope", "unknown scope %q, expected ip or user", BlockScope)
+	}
+	UserIPWindow = cfg.UserIPWindow
+	if UserIPWindow <= 0 {
+		UserIPWindow = 600
+	}
+	UserIPMaxUsers = cfg.UserIPMaxUsers
+	if UserIPMaxUsers <= 0 {
+		UserIPMaxUsers = 10000
+	}
+
+	ConntrackMark = cfg.ConntrackMark
+	ConntrackMarkMask = cfg.ConntrackMarkMask
+	ConntrackZone = cfg.ConntrackZone
+	if ConntrackMark != 0 && ConntrackMarkMask == 0 {
+		ConntrackMarkMask = 0xffffffff
+	}
+	ConntrackMode = cfg.ConntrackMode
+	if ConntrackMode == "" {
+		ConntrackMode = "optional"
+	}
+	if ConntrackMode != "required" && ConntrackMode != "optional" && ConntrackMode != "off" {
+		errs.add("ConntrackMode", "unknown mode %q, expected required, optional or off", ConntrackMode)
+	}
+
+	NetworkNamespace = cfg.NetworkNamespace
+	HealthAddr = cfg.HealthAddr
+
+	LogLevel = cfg.LogLevel
+	if LogLevel == "" {
+		LogLevel = "info"
+	}
+	if _, err := logging.ParseLevel(LogLevel); err != nil {
+		errs.add("LogLevel", "%v", err)
+	}
+	LogFormat = cfg.LogFormat
+	if LogFormat == "" {
+		LogFormat = "text"
+	}
+	if LogFormat != "text" && LogFormat != "json" {
+		errs.add("LogFormat", "unknown format %q, expected text or json", LogFormat)
+	}
+
+	TagRules = make([]TagRule, 0, len(cfg.TagRules))
+	seenTags := make(map[string]struct{}, len(cfg.TagRules))
+	for i, rule := range cfg.TagRules {
+		field := fmt.Sprintf("TagRules[%d]", i)
+		if rule.Tag == "" {
+			errs.add(field+".Tag", "must not be empty")
+		} else if _, exists := seenTags[rule.Tag]; exists {
+			errs.add(field+".Tag", "duplicate tag %q", rule.Tag)
+		}
+		seenTags[rule.Tag] = struct{}{}
+		if rule.Scope != "" && !isValidScope(rule.Scope) {
+			errs.add(field+".Scope", "unknown scope %q, expected ip or user", rule.Scope)
+		}
+		if rule.Reason == "" {
+			rule.Reason = strings.ToLower(rule.Tag)
+		}
+		if rule.Action != "" && !isValidAction(rule.Action) {
+			errs.add(field+".Action", "unknown action %q, expected drop or throttle", rule.Action)
+		}
+		checkNotNegative(errs, map[string]int64{field + ".BlockDuration": int64(rule.BlockDuration)})
+		TagRules = append(TagRules, rule)
+	}
+
+	if len(errs.Errors) > 0 {
+		return errs
+	}
+
+	defaultTagRules, defaultTagMatcher = buildTagRules(TorrentTag)
+	for i := range LogSources {
+		LogSources[i].tagRules, LogSources[i].tagMatcher = buildTagRules(LogSources[i].GetTorrentTag())
+	}
+	syslogSource := Syslog.SourceFor("")
+	Syslog.tagRules, Syslog.tagMatcher = buildTagRules(syslogSource.GetTorrentTag())
+
+	return nil
+}
+
+func loadSyslogNodes(errs *ValidationError) {
+	seen := make(map[string]struct{}, len(Syslog.Nodes))
+	for i := range Syslog.Nodes {
+		node := &Syslog.Nodes[i]
+		field := fmt.Sprintf("Syslog.Nodes[%d]", i)
+		if node.Name == "" {
+			errs.add(field+".Name", "must not be empty")
+		} else if _, exists := seen[node.Name]; exists {
+			errs.add(field+".Name", "duplicate node %q", node.Name)
+		}
+		seen[node.Name] = struct{}{}
+
+		if len(node.Addresses) == 0 {
+			errs.add(field+".Addresses", "must list at least one address")
+		}
+		node.networks = nil
+		for j, address := range node.Addresses {
+			network, err := parseNetwork(address)
+			if err != nil {
+				errs.add(fmt.Sprintf("%s.Addresses[%d]", field, j), "%v", err)
+				continue
+			}
+			node.networks = append(node.networks, network)
+		}
+	}
+}
+
+// checkSyslogLoopback reports the syslog listeners that accept senders from
+// other hosts. Without Syslog.Nodes any sender is trusted, so anyone who can
+// reach the listener could inject forged log lines and get users blocked.
+func checkSyslogLoopback(errs *ValidationError, addrs map[string]string) {
+	fields := make([]string, 0, len(addrs))
+	for field := range addrs {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		addr := addrs[field]
+		if addr == "" {
+			continue
+		}
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			errs.add(field, "must be host:port")
+			continue
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			errs.add(field, "listens beyond loopback, list the senders in Syslog.Nodes")
+		}
+	}
+}
+
+func loadFeed(errs *ValidationError) {
+	var err error
+	Feed.Token, err = resolveSecret(Feed.Token)
+	if err != nil {
+		errs.add("Feed.Token", "failed to read secret: %v", err)
+	}
+	if Feed.Addr != "" && Feed.Token == "" && err == nil {
+		errs.add("Feed.Token", "must be set when Feed.Addr is set")
+	}
+	if (Feed.TLSCertFile == "") != (Feed.TLSKeyFile == "") {
+		errs.add("Feed.TLSCertFile", "TLSCertFile and TLSKeyFile must be set together")
+	}
+	checkNotNegative(errs, map[string]int64{"Feed.Interval": int64(Feed.Interval)})
+	if Feed.Interval <= 0 {
+		Feed.Interval = 30
+	}
+
+	seen := make(map[string]struct{}, len(Feed.Peers))
+	for i := range Feed.Peers {
+		peer := &Feed.Peers[i]
+		field := fmt.Sprintf("Feed.Peers[%d]", i)
+		if peer.Name == "" {
+			errs.add(field+".Name", "must not be empty")
+		} else if _, exists := seen[peer.Name]; exists {
+			errs.add(field+".Name", "duplicate peer %q", peer.Name)
+		} else if peer.Name == Feed.Origin {
+			errs.add(field+".Name", "must differ from Feed.Origin")
+		} else if strings.Contains(peer.Name, ":") {
+			errs.add(field+".Name", "must not contain ':'")
+		}
+		seen[peer.Name] = struct{}{}
+		if u, err := url.Parse(peer.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs.add(field+".URL", "must be an http or https URL")
+		}
+		if peer.Token, err = resolveSecret(peer.Token); err != nil {
+			errs.add(field+".Token", "failed to read secret: %v", err)
+		}
+	}
+}
+
+func loadRedis(errs *ValidationError) {
+	var err error
+	if Redis.Password, err = resolveSecret(Redis.Password); err != nil {
+		errs.add("Redis.Password", "failed to read secret: %v", err)
+	}
+	if Redis.Addr != "" {
+		if _, _, err := net.SplitHostPort(Redis.Addr); err != nil {
+			errs.add("Redis.Addr", "must be host:port")
+		}
+	}
+	checkNotNegative(errs, map[string]int64{"Redis.DB": int64(Redis.DB)})
+	if Redis.Prefix == "" {
+		Redis.Prefix = "tblocker"
+	}
+}
+
+// checkNotNegative reports fields whose zero value selects a default but
+// which were set to a negative number.
+func checkNotNegative(errs *ValidationError, fields map[string]int64) {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if fields[name] < 0 {
+			errs.add(name, "must not be negative")
+		}
+	}
+}
+
+func isValidAction(action string) bool {
+	return action == "drop" || action == "throttle"
+}
+
+func isValidScope(scope string) bool {
+	return scope == "ip" || scope == "user"
+}
+
+func toSet(values []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(values))
+	for _, value := range values {
+		set[value] = struct{}{}
+	}
+	return set
 }
@@ -1,7 +1,9 @@
 package config
 
 import (
+	"errors"
 	"os"
+	"reflect"
 	"testing"
 )
 
@@ -149,3 +151,639 @@ BlockDuration: "invalid"
 		t.Error("Expected error when loading invalid YAML")
 	}
 }
+
+func TestLoadConfigUserPolicies(t *testing.T) {
+	configContent := `
+LogFile: "/var/log/test.log"
+BlockDuration: 10
+TorrentTag: "TORRENT"
+Threshold: 2
+UserPolicies:
+  - Name: "staff@example.com"
+    Exempt: true
+  - Regex: "^premium_"
+    BlockDuration: 3
+    Threshold: 5
+`
+
+	tmpFile, err := os.CreateTemp("", "config_test_*.yaml")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.WriteString(configContent); err != nil {
+		t.Fatalf("Failed to write config content: %v", err)
+	}
+	tmpFile.Close()
+
+	if err := LoadConfig(tmpFile.Name()); err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if Threshold != 2 {
+		t.Errorf("Expected Threshold 2, got %d", Threshold)
+	}
+
+	if ThresholdWindow != 60 {
+		t.Errorf("Expected default ThresholdWindow 60, got %d", ThresholdWindow)
+	}
+
+	if len(UserPolicies) != 2 {
+		t.Fatalf("Expected 2 user policies, got %d", len(UserPolicies))
+	}
+
+	if !UserPolicies[0].Matches("staff@example.com") || UserPolicies[0].Matches("staff") {
+		t.Error("Expected exact name match for first policy")
+	}
+
+	if !UserPolicies[1].Matches("premium_alice") || UserPolicies[1].Matches("alice") {
+		t.Error("Expected regex match for second policy")
+	}
+}
+
+func TestLoadConfigInvalidUserPolicy(t *testing.T) {
+	configContent := `
+LogFile: "/var/log/test.log"
+BlockDuration: 10
+TorrentTag: "TORRENT"
+UserPolicies:
+  - Regex: "(["
+`
+
+	tmpFile, err := os.CreateTemp("", "config_test_*.yaml")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.WriteString(configContent); err != nil {
+		t.Fatalf("Failed to write config content: %v", err)
+	}
+	tmpFile.Close()
+
+	if err := LoadConfig(tmpFile.Name()); err == nil {
+		t.Error("Expected error for invalid user policy regex")
+	}
+}
+
+func TestLoadConfigLogSources(t *testing.T) {
+	configContent := `
+BlockDuration: 10
+TorrentTag: "TORRENT"
+LogSources:
+  - Path: "/var/log/xray/access.log"
+    Label: "xray-main"
+  - Path: "/var/log/xray2/access.log"
+    Label: "xray-second"
+    TorrentTag: "BT"
+    UsernameRegex: "^\\d+\\.(.+)$"
+`
+
+	tmpFile, err := os.CreateTemp("", "config_test_*.yaml")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.WriteString(configContent); err != nil {
+		t.Fatalf("Failed to write config content: %v", err)
+	}
+	tmpFile.Close()
+
+	if err := LoadConfig(tmpFile.Name()); err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if len(LogSources) != 2 {
+		t.Fatalf("Expected 2 log sources, got %d", len(LogSources))
+	}
+
+	if LogSources[0].GetTorrentTag() != "TORRENT" {
+		t.Errorf("Expected inherited TorrentTag 'TORRENT', got '%s'", LogSources[0].GetTorrentTag())
+	}
+
+	if LogSources[1].GetTorrentTag() != "BT" {
+		t.Errorf("Expected TorrentTag 'BT', got '%s'", LogSources[1].GetTorrentTag())
+	}
+
+	if LogSources[0].GetUsernameRegex() != UsernameRegex {
+		t.Error("Expected first source to use the global UsernameRegex")
+	}
+
+	if LogSources[1].GetUsernameRegex().String() != `^\d+\.(.+)$` {
+		t.Errorf("Unexpected UsernameRegex for second source: %s", LogSources[1].GetUsernameRegex())
+	}
+}
+
+func TestLoadConfigLogFileAsSource(t *testing.T) {
+	configContent := `
+LogFile: "/var/log/test.log"
+BlockDuration: 10
+TorrentTag: "TORRENT"
+`
+
+	tmpFile, err := os.CreateTemp("", "config_test_*.yaml")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.WriteString(configContent); err != nil {
+		t.Fatalf("Failed to write config content: %v", err)
+	}
+	tmpFile.Close()
+
+	if err := LoadConfig(tmpFile.Name()); err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if len(LogSources) != 1 || LogSources[0].Path != "/var/log/test.log" {
+		t.Errorf("Expected LogFile to be used as the only log source, got %+v", LogSources)
+	}
+}
+
+func TestLoadConfigJournalSource(t *testing.T) {
+	testCases := []struct {
+		content string
+		valid   bool
+	}{
+		{content: "LogSources:\n  - Type: journal\n    Unit: xray.service\n", valid: true},
+		{content: "LogSources:\n  - Type: journal\n    SyslogIdentifier: xray\n", valid: true},
+		{content: "LogSources:\n  - Type: journal\n", valid: false},
+		{content: "LogSources:\n  - Type: pipe\n    Path: /tmp/x\n", valid: false},
+		{content: "LogSources:\n  - Path: /tmp/a.log\n    Label: a\n  - Path: /tmp/b.log\n    Label: b\n", valid: true},
+		{content: "LogSources:\n  - Path: /tmp/a.log\n    Label: a\n  - Type: journal\n    Unit: xray.service\n    Label: a\n", valid: false},
+		{content: "LogSources:\n  - Path: /tmp/a.log\n  - Path: /tmp/b.log\n", valid: false},
+		{content: "LogSources:\n  - Path: /tmp/a.log\n    Label: a\nSyslog:\n  Enabled: true\n  UDPAddr: \":5514\"\n  Nodes:\n    - Name: a\n      Addresses: [10.0.0.1]\n", valid: false},
+	}
+
+	for _, tc := range testCases {
+		tmpFile, err := os.CreateTemp("", "config_test_*.yaml")
+		if err != nil {
+			t.Fatalf("Failed to create temp file: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+
+		if _, err := tmpFile.WriteString("LogFile: /var/log/xray/access.log\nBlockDuration: 10\nTorrentTag: TORRENT\n" + tc.content); err != nil {
+			t.Fatalf("Failed to write config content: %v", err)
+		}
+		tmpFile.Close()
+
+		err = LoadConfig(tmpFile.Name())
+		if tc.valid && err != nil {
+			t.Errorf("Expected config to load, got %v:\n%s", err, tc.content)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("Expected error for config:\n%s", tc.content)
+		}
+	}
+}
+
+func TestLoadConfigSyslog(t *testing.T) {
+	testCases := []struct {
+		content string
+		valid   bool
+	}{
+		{content: "Syslog:\n  Enabled: true\n  UDPAddr: \"127.0.0.1:5514\"\n  TCPAddr: \"localhost:5514\"\n", valid: true},
+		{content: "Syslog:\n  Enabled: true\n  UDPAddr: \":5514\"\n", valid: false},
+		{content: "Syslog:\n  Enabled: true\n  TCPAddr: \"[::1]:5514\"\n  TLSAddr: \"0.0.0.0:6514\"\n  TLSCertFile: a.crt\n  TLSKeyFile: a.key\n", valid: false},
+		{content: "Syslog:\n  Enabled: true\n  UDPAddr: \"5514\"\n", valid: false},
+		{content: "Syslog:\n  Enabled: true\n", valid: false},
+		{content: "Syslog:\n  Enabled: true\n  TLSAddr: \":6514\"\n", valid: false},
+		{content: "Syslog:\n  Enabled: false\n", valid: true},
+		{content: "Syslog:\n  Enabled: true\n  UDPAddr: \":5514\"\n  MaxNodes: 10\n  Nodes:\n    - Name: a\n      Addresses: [10.0.0.1, \"10.1.0.0/16\", \"::1\"]\n", valid: true},
+		{content: "Syslog:\n  Enabled: true\n  UDPAddr: \"127.0.0.1:5514\"\n  MaxNodes: -1\n", valid: false},
+		{content: "Syslog:\n  Enabled: true\n  UDPAddr: \":5514\"\n  Nodes:\n    - Name: a\n", valid: false},
+		{content: "Syslog:\n  Enabled: true\n  UDPAddr: \":5514\"\n  Nodes:\n    - Name: a\n      Addresses: [host.example]\n", valid: false},
+		{content: "Syslog:\n  Enabled: true\n  UDPAddr: \":5514\"\n  Nodes:\n    - Name: a\n      Addresses: [10.0.0.1]\n    - Name: a\n      Addresses: [10.0.0.2]\n", valid: false},
+	}
+
+	for _, tc := range testCases {
+		tmpFile, err := os.CreateTemp("", "config_test_*.yaml")
+		if err != nil {
+			t.Fatalf("Failed to create temp file: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+
+		if _, err := tmpFile.WriteString("LogFile: /var/log/xray/access.log\nBlockDuration: 10\nTorrentTag: TORRENT\n" + tc.content); err != nil {
+			t.Fatalf("Failed to write config content: %v", err)
+		}
+		tmpFile.Close()
+
+		err = LoadConfig(tmpFile.Name())
+		if tc.valid && err != nil {
+			t.Errorf("Expected config to load, got %v:\n%s", err, tc.content)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("Expected error for config:\n%s", tc.content)
+		}
+	}
+}
+
+func TestLoadConfigParser(t *testing.T) {
+	testCases := []struct {
+		content string
+		valid   bool
+	}{
+		{content: "LogSources:\n  - Path: /tmp/a.log\n    Parser: sing-box\n", valid: true},
+		{content: "LogSources:\n  - Path: /tmp/a.log\n    Parser: regex\n    ParserPattern: '(?P<ip>\\S+) (?P<user>\\S+)'\n", valid: true},
+		{content: "LogSources:\n  - Path: /tmp/a.log\n    Parser: regex\n    ParserPattern: '(?P<ip>\\S+)'\n", valid: false},
+		{content: "LogSources:\n  - Path: /tmp/a.log\n    Parser: unknown\n", valid: false},
+		{content: "Syslog:\n  Enabled: true\n  UDPAddr: \":5514\"\n  Parser: unknown\n", valid: false},
+	}
+
+	for _, tc := range testCases {
+		tmpFile, err := os.CreateTemp("", "config_test_*.yaml")
+		if err != nil {
+			t.Fatalf("Failed to create temp file: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+
+		if _, err := tmpFile.WriteString("LogFile: /var/log/xray/access.log\nBlockDuration: 10\nTorrentTag: TORRENT\n" + tc.content); err != nil {
+			t.Fatalf("Failed to write config content: %v", err)
+		}
+		tmpFile.Close()
+
+		err = LoadConfig(tmpFile.Name())
+		if tc.valid && err != nil {
+			t.Errorf("Expected config to load, got %v:\n%s", err, tc.content)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("Expected error for config:\n%s", tc.content)
+		}
+	}
+}
+
+func TestLoadConfigInboundFilters(t *testing.T) {
+	configContent := `
+LogFile: "/var/log/test.log"
+BlockDuration: 10
+TorrentTag: "TORRENT"
+StrictTagMatch: true
+AllowedInbounds:
+  - "public"
+DeniedInbounds:
+  - "relay"
+`
+
+	tmpFile, err := os.CreateTemp("", "config_test_*.yaml")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.WriteString(configContent); err != nil {
+		t.Fatalf("Failed to write config content: %v", err)
+	}
+	tmpFile.Close()
+
+	if err := LoadConfig(tmpFile.Name()); err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if !StrictTagMatch {
+		t.Error("Expected StrictTagMatch to be true")
+	}
+
+	if _, exists := AllowedInbounds["public"]; !exists {
+		t.Error("Expected 'public' in AllowedInbounds")
+	}
+
+	if _, exists := DeniedInbounds["relay"]; !exists {
+		t.Error("Expected 'relay' in DeniedInbounds")
+	}
+}
+
+func TestLoadConfigTagRules(t *testing.T) {
+	configContent := `
+LogFile: "/var/log/test.log"
+BlockDuration: 10
+TorrentTag: "TORRENT"
+TagRules:
+  - Tag: "SPAM"
+    BlockDuration: 1440
+    WebhookTemplate: '{"user":"%s","ip":"%s","server":"%s","action":"%s","duration":%d,"ts":"%s","reason":"{reason}"}'
+  - Tag: "SCAN"
+    Reason: "scanner"
+`
+
+	tmpFile, err := os.CreateTemp("", "config_test_*.yaml")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.WriteString(configContent); err != nil {
+		t.Fatalf("Failed to write config content: %v", err)
+	}
+	tmpFile.Close()
+
+	if err := LoadConfig(tmpFile.Name()); err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if len(TagRules) != 2 {
+		t.Fatalf("Expected 2 tag rules, got %d", len(TagRules))
+	}
+
+	if TagRules[0].Reason != "spam" || TagRules[0].GetScope() != "ip" || TagRules[0].BlockDuration != 1440 {
+		t.Errorf("Unexpected defaults for first rule: %+v", TagRules[0])
+	}
+
+	if rule := FindTagRule("scanner"); rule == nil || rule.Tag != "SCAN" {
+		t.Errorf("Expected to find rule by reason 'scanner', got %+v", rule)
+	}
+}
+
+func TestLoadConfigTagMatcher(t *testing.T) {
+	configContent := `
+BlockDuration: 10
+TorrentTag: "TORRENT"
+LogSources:
+  - Path: "/var/log/a.log"
+  - Path: "/var/log/b.log"
+    Label: "b"
+    TorrentTag: "SPAM"
+Syslog:
+  TorrentTag: "BT"
+TagRules:
+  - Tag: "SPAM"
+    Reason: "spam"
+`
+
+	tmpFile, err := os.CreateTemp("", "config_test_*.yaml")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.WriteString(configContent); err != nil {
+		t.Fatalf("Failed to write config content: %v", err)
+	}
+	tmpFile.Close()
+
+	if err := LoadConfig(tmpFile.Name()); err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	line := []byte("[in -> SPAM] email: TORRENT_fan")
+	testCases := []struct {
+		name     string
+		source   LogSource
+		tags     []string
+		expected []int
+	}{
+		{name: "global tag", source: LogSources[0], tags: []string{"TORRENT", "SPAM"}, expected: []int{0, 1}},
+		{name: "tag of a rule", source: LogSources[1], tags: []string{"SPAM"}, expected: []int{0}},
+		{name: "syslog node", source: Syslog.SourceFor("node-1"), tags: []string{"BT", "SPAM"}, expected: []int{1}},
+		{name: "not loaded", source: LogSource{}, tags: []string{"TORRENT", "SPAM"}, expected: []int{0, 1}},
+	}
+
+	for _, tc := range testCases {
+		var tags []string
+		for _, rule := range tc.source.GetTagRules() {
+			tags = append(tags, rule.Tag)
+		}
+		if !reflect.DeepEqual(tags, tc.tags) {
+			t.Errorf("%s: expected tags %v, got %v", tc.name, tc.tags, tags)
+		}
+		if found := tc.source.GetTagMatcher().Match(line); !reflect.DeepEqual(found, tc.expected) {
+			t.Errorf("%s: expected matches %v, got %v", tc.name, tc.expected, found)
+		}
+	}
+
+	first, second := Syslog.SourceFor("a"), Syslog.SourceFor("b")
+	if first.GetTagMatcher() != second.GetTagMatcher() {
+		t.Error("Expected syslog nodes to share the matcher built by LoadConfig")
+	}
+}
+
+func TestLoadConfigInvalidTagRules(t *testing.T) {
+	testCases := []string{
+		"TagRules:\n  - Reason: spam\n",
+		"TagRules:\n  - Tag: SPAM\n  - Tag: SPAM\n",
+		"TagRules:\n  - Tag: SPAM\n    Scope: node\n",
+	}
+
+	for _, content := range testCases {
+		tmpFile, err := os.CreateTemp("", "config_test_*.yaml")
+		if err != nil {
+			t.Fatalf("Failed to create temp file: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+
+		if _, err := tmpFile.WriteString("LogFile: /var/log/xray/access.log\nBlockDuration: 10\nTorrentTag: TORRENT\n" + content); err != nil {
+			t.Fatalf("Failed to write config content: %v", err)
+		}
+		tmpFile.Close()
+
+		if err := LoadConfig(tmpFile.Name()); err == nil {
+			t.Errorf("Expected error for config:\n%s", content)
+		}
+	}
+}
+
+func TestLoadConfigBlockAction(t *testing.T) {
+	testCases := []struct {
+		content string
+		action  string
+		rate    int
+		valid   bool
+	}{
+		{content: "", action: "drop", rate: 256, valid: true},
+		{content: "BlockAction: throttle\nThrottleRate: 512\n", action: "throttle", rate: 512, valid: true},
+		{content: "BlockAction: tarpit\n", valid: false},
+		{content: "TagRules:\n  - Tag: SPAM\n    Action: tarpit\n", valid: false},
+	}
+
+	for _, tc := range testCases {
+		tmpFile, err := os.CreateTemp("", "config_test_*.yaml")
+		if err != nil {
+			t.Fatalf("Failed to create temp file: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+
+		if _, err := tmpFile.WriteString("LogFile: /var/log/xray/access.log\nBlockDuration: 10\nTorrentTag: TORRENT\n" + tc.content); err != nil {
+			t.Fatalf("Failed to write config content: %v", err)
+		}
+		tmpFile.Close()
+
+		err = LoadConfig(tmpFile.Name())
+		if !tc.valid {
+			if err == nil {
+				t.Errorf("Expected error for config:\n%s", tc.content)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected config to load, got %v:\n%s", err, tc.content)
+			continue
+		}
+
+		if BlockAction != tc.action || ThrottleRate != tc.rate {
+			t.Errorf("Expected action %s at %d kbit/s, got %s at %d", tc.action, tc.rate, BlockAction, ThrottleRate)
+		}
+	}
+
+	rule := TagRule{Tag: "SPAM"}
+	BlockAction = "throttle"
+	if rule.GetAction() != "throttle" {
+		t.Errorf("Expected rule to inherit BlockAction, got %s", rule.GetAction())
+	}
+	rule.Action = "drop"
+	if rule.GetAction() != "drop" {
+		t.Errorf("Expected rule action to override BlockAction, got %s", rule.GetAction())
+	}
+}
+
+func TestLoadConfigConntrackMode(t *testing.T) {
+	testCases := []struct {
+		content string
+		mode    string
+		valid   bool
+	}{
+		{content: "", mode: "optional", valid: true},
+		{content: "ConntrackMode: required\n", mode: "required", valid: true},
+		{content: "ConntrackMode: off\n", mode: "off", valid: true},
+		{content: "ConntrackMode: maybe\n", valid: false},
+	}
+
+	for _, tc := range testCases {
+		tmpFile, err := os.CreateTemp("", "config_test_*.yaml")
+		if err != nil {
+			t.Fatalf("Failed to create temp file: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+
+		if _, err := tmpFile.WriteString("LogFile: /var/log/xray/access.log\nBlockDuration: 10\nTorrentTag: TORRENT\n" + tc.content); err != nil {
+			t.Fatalf("Failed to write config content: %v", err)
+		}
+		tmpFile.Close()
+
+		err = LoadConfig(tmpFile.Name())
+		if !tc.valid {
+			if err == nil {
+				t.Errorf("Expected error for config:\n%s", tc.content)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected config to load, got %v:\n%s", err, tc.content)
+			continue
+		}
+
+		if ConntrackMode != tc.mode {
+			t.Errorf("Expected ConntrackMode %s, got %s", tc.mode, ConntrackMode)
+		}
+	}
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	testCases := []struct {
+		content string
+		fields  []string
+	}{
+		{content: "BlockDuration: 10\nTorrentTag: TORRENT\nVersion: 1\n"},
+		{content: "BlockDuration: 0\nTorrentTag: \"\"\n", fields: []string{"BlockDuration", "TorrentTag"}},
+		{content: "BlockDuration: 10\nTorrentTag: TORRENT\nUnknownKey: 1\n", fields: []string{"UnknownKey"}},
+		{content: "BlockDuration: 10\nTorrentTag: TORRENT\nLogSources:\n  - Path: /tmp/a.log\n    Lable: a\n", fields: []string{"Lable"}},
+		{content: "BlockDuration: 10\nTorrentTag: TORRENT\nVersion: 2\n", fields: []string{"Version"}},
+		{content: "BlockDuration: 10\nTorrentTag: TORRENT\nBypassIPS: [\"127.0.0.1\", \"10.0.0\"]\n", fields: []string{"BypassIPS[1]"}},
+		{content: "BlockDuration: 10\nTorrentTag: TORRENT\nBlockMode: pf\nThreshold: -1\n", fields: []string{"BlockMode", "Threshold"}},
+		{content: "BlockDuration: 10\nTorrentTag: TORRENT\nSendWebhook: true\n", fields: []string{"WebhookURL"}},
+		{content: "BlockDuration: 10\nTorrentTag: TORRENT\nTagRules:\n  - Tag: X\n    Action: ban\n  - Tag: X\n", fields: []string{"TagRules[0].Action", "TagRules[1].Tag"}},
+		{content: "BlockDuration: 10\nTorrentTag: TORRENT\nFeed:\n  Addr: \":9300\"\n  Token: secret\n  Peers:\n    - Name: b\n      URL: https://b.example:9300/feed\n"},
+		{content: "BlockDuration: 10\nTorrentTag: TORRENT\nFeed:\n  Addr: \":9300\"\n  Origin: a\n  Peers:\n    - Name: a\n      URL: b.example\n    - Name: a\n      URL: http://c\n", fields: []string{"Feed.Token", "Feed.Peers[0].Name", "Feed.Peers[0].URL", "Feed.Peers[1].Name"}},
+		{content: "BlockDuration: 10\nTorrentTag: TORRENT\nRedis:\n  Addr: redis.example.com:6379\n  DB: 2\n"},
+		{content: "BlockDuration: 10\nTorrentTag: TORRENT\nRedis:\n  Addr: redis.example.com\n  DB: -1\n", fields: []string{"Redis.Addr", "Redis.DB"}},
+		{content: "BlockDuration: 10\nTorrentTag: TORRENT\nDigestThreshold: 20\nDigestWindow: 30\n"},
+		{content: "BlockDuration: 10\nTorrentTag: TORRENT\nDigestThreshold: -1\nDigestWindow: -5\n", fields: []string{"DigestThreshold", "DigestWindow"}},
+	}
+
+	for _, tc := range testCases {
+		tmpFile, err := os.CreateTemp("", "config_test_*.yaml")
+		if err != nil {
+			t.Fatalf("Failed to create temp file: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+
+		if _, err := tmpFile.WriteString("LogFile: /var/log/xray/access.log\n" + tc.content); err != nil {
+			t.Fatalf("Failed to write config content: %v", err)
+		}
+		tmpFile.Close()
+
+		err = LoadConfig(tmpFile.Name())
+		if len(tc.fields) == 0 {
+			if err != nil {
+				t.Errorf("Expected config to load, got %v:\n%s", err, tc.content)
+			}
+			continue
+		}
+
+		var validationErr *ValidationError
+		if !errors.As(err, &validationErr) {
+			t.Errorf("Expected validation error, got %v:\n%s", err, tc.content)
+			continue
+		}
+		var fields []string
+		for _, fieldErr := range validationErr.Errors {
+			fields = append(fields, fieldErr.Field)
+		}
+		if !reflect.DeepEqual(fields, tc.fields) {
+			t.Errorf("Expected errors for %v, got %v:\n%s", tc.fields, validationErr.Errors, tc.content)
+		}
+	}
+}
+
+func TestLoadConfigInputsAndOrigin(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatalf("Failed to get hostname: %v", err)
+	}
+
+	testCases := []struct {
+		content string
+		fields  []string
+	}{
+		{content: "", fields: []string{"LogFile"}},
+		{content: "Syslog:\n  Enabled: true\n  UDPAddr: \"127.0.0.1:5514\"\n"},
+		{content: "LogSources:\n  - Path: /var/log/a.log\n"},
+		{content: "LogFile: /var/log/xray/access.log\nFeed:\n  Peers:\n    - Name: " + hostname + "\n      URL: https://b.example:9300/feed\n", fields: []string{"Feed.Peers[0].Name"}},
+		{content: "LogFile: /var/log/xray/access.log\nFeed:\n  Origin: a\n  Peers:\n    - Name: " + hostname + "\n      URL: https://b.example:9300/feed\n"},
+	}
+
+	for _, tc := range testCases {
+		tmpFile, err := os.CreateTemp("", "config_test_*.yaml")
+		if err != nil {
+			t.Fatalf("Failed to create temp file: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+
+		if _, err := tmpFile.WriteString("BlockDuration: 10\nTorrentTag: TORRENT\n" + tc.content); err != nil {
+			t.Fatalf("Failed to write config content: %v", err)
+		}
+		tmpFile.Close()
+
+		err = LoadConfig(tmpFile.Name())
+		if len(tc.fields) == 0 {
+			if err != nil {
+				t.Errorf("Expected config to load, got %v:\n%s", err, tc.content)
+			}
+			continue
+		}
+
+		var validationErr *ValidationError
+		if !errors.As(err, &validationErr) {
+			t.Errorf("Expected validation error, got %v:\n%s", err, tc.content)
+			continue
+		}
+		var fields []string
+		for _, fieldErr := range validationErr.Errors {
+			fields = append(fields, fieldErr.Field)
+		}
+		if !reflect.DeepEqual(fields, tc.fields) {
+			t.Errorf("Expected errors for %v, got %v:\n%s", tc.fields, validationErr.Errors, tc.content)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"gopkg.in/yaml.v2"
+)
+
+// EnvPrefix is the prefix of the environment variables overriding config keys.
+const EnvPrefix = "TBLOCKER_"
+
+const secretFilePrefix = "file:"
+
+// flagOverrides holds the values of the flags defined by RegisterFlags,
+// keyed by field path.
+var flagOverrides = make(map[string]string)
+
+// setting is a configuration key that can be overridden. Nested structs
+// such as Syslog are flattened, other values are set as a whole.
+type setting struct {
+	path  string
+	words []string
+	index []int
+	kind  reflect.Type
+}
+
+func (s setting) envName() string {
+	return EnvPrefix + strings.ToUpper(strings.Join(s.words, "_"))
+}
+
+func (s setting) flagName() string {
+	return strings.ToLower(strings.Join(s.words, "-"))
+}
+
+func settings() []setting {
+	return collectSettings(reflect.TypeOf(Config{}), "", nil, nil)
+}
+
+func collectSettings(t reflect.Type, prefix string, words []string, index []int) []setting {
+	var result []setting
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Tag.Get("yaml")
+		// Version describes the file itself rather than a setting.
+		if name == "" || name == "Version" {
+			continue
+		}
+
+		path := prefix + name
+		fieldWords := append(append([]string(nil), words...), splitWords(name)...)
+		fieldIndex := append(append([]int(nil), index...), i)
+		if field.Type.Kind() == reflect.Struct {
+			result = append(result, collectSettings(field.Type, path+".", fieldWords, fieldIndex)...)
+			continue
+		}
+		result = append(result, setting{path: path, words: fieldWords, index: fieldIndex, kind: field.Type})
+	}
+	return result
+}
+
+// splitWords splits a CamelCase key into words, keeping acronyms together:
+// BypassIPS becomes Bypass IPS and UDPAddr becomes UDP Addr.
+func splitWords(name string) []string {
+	runes := []rune(name)
+	var words []string
+	start := 0
+	for i := 1; i < len(runes); i++ {
+		if !unicode.IsUpper(runes[i]) {
+			continue
+		}
+		prev := runes[i-1]
+		nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+		if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+			words = append(words, string(runes[start:i]))
+			start = i
+		}
+	}
+	return append(words, string(runes[start:]))
+}
+
+// RegisterFlags defines a flag for every configuration key, for example
+// -webhook-url or -syslog-udp-addr. Flags take precedence over environment
+// variables, which take precedence over the configuration file.
+func RegisterFlags(fs *flag.FlagSet) {
+	for _, s := range settings() {
+		path := s.path
+		usage := fmt.Sprintf("Override %s (env %s)", s.path, s.envName())
+		if s.kind.Kind() == reflect.Bool {
+			fs.BoolFunc(s.flagName(), usage, func(value string) error {
+				flagOverrides[path] = value
+				return nil
+			})
+			continue
+		}
+		fs.Func(s.flagName(), usage, func(value string) error {
+			flagOverrides[path] = value
+			return nil
+		})
+	}
+}
+
+// applyOverrides sets the keys given by flags and TBLOCKER_* environment
+// variables. A key can also be read from a file named by TBLOCKER_<KEY>_FILE.
+func applyOverrides(cfg *Config, errs *ValidationError) {
+	target := reflect.ValueOf(cfg).Elem()
+	for _, s := range settings() {
+		value, source, err := lookupOverride(s)
+		if err != nil {
+			errs.add(s.path, "%v", err)
+			continue
+		}
+		if source == "" {
+			continue
+		}
+		if err := setValue(target.FieldByIndex(s.index), value); err != nil {
+			errs.add(s.path, "invalid value from %s: %v", source, err)
+		}
+	}
+}
+
+func lookupOverride(s setting) (string, string, error) {
+	if value, exists := flagOverrides[s.path]; exists {
+		return value, "-" + s.flagName(), nil
+	}
+
+	envName := s.envName()
+	value, exists := os.LookupEnv(envName)
+	path, fileExists := os.LookupEnv(envName + "_FILE")
+	switch {
+	case exists && fileExists:
+		return "", "", fmt.Errorf("both %s and %s_FILE are set", envName, envName)
+	case exists:
+		return value, envName, nil
+	case fileExists:
+		value, err := readSecretFile(path)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to read %s_FILE: %v", envName, err)
+		}
+		return value, envName + "_FILE", nil
+	}
+	return "", "", nil
+}
+
+// setValue parses an override into a field. Strings are taken as is, string
+// lists may be comma separated, anything else is parsed as YAML, so lists and
+// maps use flow syntax such as [a, b] or {Key: value}.
+func setValue(field reflect.Value, value string) error {
+	switch {
+	case field.Kind() == reflect.String:
+		field.SetString(value)
+		return nil
+	case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(value), "["):
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+		return nil
+	}
+
+	parsed := reflect.New(field.Type())
+	if err := yaml.UnmarshalStrict([]byte(value), parsed.Interface()); err != nil {
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) {
+			return errors.New(strings.TrimPrefix(strings.Join(typeErr.Errors, "; "), "line 1: "))
+		}
+		return err
+	}
+	field.Set(parsed.Elem())
+	return nil
+}
+
+// resolveSecret returns the contents of the file for values written as
+// file:/path/to/secret, so tokens need not be stored in the configuration.
+func resolveSecret(value string) (string, error) {
+	path, isFile := strings.CutPrefix(value, secretFilePrefix)
+	if !isFile {
+		return value, nil
+	}
+	return readSecretFile(path)
+}
+
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
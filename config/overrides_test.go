@@ -0,0 +1,127 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSettingNames(t *testing.T) {
+	testCases := map[string][2]string{
+		"WebhookURL":        {"TBLOCKER_WEBHOOK_URL", "webhook-url"},
+		"BypassIPS":         {"TBLOCKER_BYPASS_IPS", "bypass-ips"},
+		"UserIPMaxUsers":    {"TBLOCKER_USER_IP_MAX_USERS", "user-ip-max-users"},
+		"Syslog.UDPAddr":    {"TBLOCKER_SYSLOG_UDP_ADDR", "syslog-udp-addr"},
+		"Syslog.TLSKeyFile": {"TBLOCKER_SYSLOG_TLS_KEY_FILE", "syslog-tls-key-file"},
+	}
+
+	found := make(map[string]setting)
+	for _, s := range settings() {
+		found[s.path] = s
+	}
+	if _, exists := found["Version"]; exists {
+		t.Error("Expected Version not to be overridable")
+	}
+	for path, names := range testCases {
+		s, exists := found[path]
+		if !exists {
+			t.Errorf("Expected setting %s", path)
+			continue
+		}
+		if s.envName() != names[0] || s.flagName() != names[1] {
+			t.Errorf("Expected %s to map to %s and -%s, got %s and -%s", path, names[0], names[1], s.envName(), s.flagName())
+		}
+	}
+}
+
+func TestLoadConfigOverrides(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "config_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	configFile := filepath.Join(tempDir, "config.yaml")
+	configContent := "BlockDuration: 10\nTorrentTag: TORRENT\nLogFile: /var/log/file.log\nWebhookURL: https://file.example/hook\n"
+	if err := os.WriteFile(configFile, []byte(configContent), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	tokenFile := filepath.Join(tempDir, "token")
+	if err := os.WriteFile(tokenFile, []byte("Bearer secret\n"), 0600); err != nil {
+		t.Fatalf("Failed to write token file: %v", err)
+	}
+	templateFile := filepath.Join(tempDir, "template")
+	if err := os.WriteFile(templateFile, []byte(`{"ip":"%s"}`+"\n"), 0600); err != nil {
+		t.Fatalf("Failed to write template file: %v", err)
+	}
+
+	t.Setenv("TBLOCKER_BLOCK_DURATION", "30")
+	t.Setenv("TBLOCKER_WEBHOOK_URL", "https://env.example/hook")
+	t.Setenv("TBLOCKER_BYPASS_IPS", "127.0.0.1, ::1")
+	t.Setenv("TBLOCKER_SYSLOG_UDP_ADDR", ":5514")
+	t.Setenv("TBLOCKER_WEBHOOK_HEADERS", "{Authorization: 'file:"+tokenFile+"'}")
+	t.Setenv("TBLOCKER_WEBHOOK_TEMPLATE_FILE", templateFile)
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	RegisterFlags(fs)
+	defer func() { flagOverrides = make(map[string]string) }()
+	if err := fs.Parse([]string{"-webhook-url", "https://flag.example/hook", "-send-webhook", "-tag-rules", "[{Tag: P2P, Action: throttle}]"}); err != nil {
+		t.Fatalf("Failed to parse flags: %v", err)
+	}
+
+	if err := LoadConfig(configFile); err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if LogFile != "/var/log/file.log" {
+		t.Errorf("Expected LogFile from the file, got %s", LogFile)
+	}
+	if BlockDuration != 30 {
+		t.Errorf("Expected BlockDuration from the environment, got %d", BlockDuration)
+	}
+	if WebhookURL != "https://flag.example/hook" || !SendWebhook {
+		t.Errorf("Expected webhook settings from flags, got %s %v", WebhookURL, SendWebhook)
+	}
+	if !reflect.DeepEqual(BypassIPSet, map[string]struct{}{"127.0.0.1": {}, "::1": {}}) {
+		t.Errorf("Unexpected BypassIPSet %v", BypassIPSet)
+	}
+	if Syslog.UDPAddr != ":5514" {
+		t.Errorf("Expected nested Syslog.UDPAddr override, got %s", Syslog.UDPAddr)
+	}
+	if WebhookHeaders["Authorization"] != "Bearer secret" {
+		t.Errorf("Expected header read from file, got %q", WebhookHeaders["Authorization"])
+	}
+	if WebhookTemplate != `{"ip":"%s"}` {
+		t.Errorf("Expected template read from _FILE, got %q", WebhookTemplate)
+	}
+	if len(TagRules) != 1 || TagRules[0].Tag != "P2P" || TagRules[0].Action != "throttle" {
+		t.Errorf("Unexpected TagRules %+v", TagRules)
+	}
+}
+
+func TestLoadConfigInvalidOverrides(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "config_test_*.yaml")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.WriteString("LogFile: /var/log/xray/access.log\nBlockDuration: 10\nTorrentTag: TORRENT\n"); err != nil {
+		t.Fatalf("Failed to write config content: %v", err)
+	}
+	tmpFile.Close()
+
+	t.Setenv("TBLOCKER_THRESHOLD", "many")
+	t.Setenv("TBLOCKER_LOG_FILE", "/a.log")
+	t.Setenv("TBLOCKER_LOG_FILE_FILE", "/b")
+
+	err = LoadConfig(tmpFile.Name())
+	validationErr, ok := err.(*ValidationError)
+	if !ok || len(validationErr.Errors) != 2 {
+		t.Fatalf("Expected two validation errors, got %v", err)
+	}
+	if validationErr.Errors[0].Field != "LogFile" || validationErr.Errors[1].Field != "Threshold" {
+		t.Errorf("Unexpected errors %v", validationErr.Errors)
+	}
+}
@@ -1,11 +1,14 @@
 package firewall
 
 import (
-	"log"
+	"errors"
 	"os/exec"
 	"strings"
+	"tblocker/logging"
 )
 
+var logger = logging.For("firewall")
+
 type Firewall interface {
 	Initialize() error
 	BlockIP(ip string) error
@@ -13,16 +16,47 @@ type Firewall interface {
 
 	GetBlockedIPs() (map[string]bool, error)
 
+	ThrottleIP(ip string, rateKbit int) error
+	UnthrottleIP(ip string) error
+	GetThrottledIPs() (map[string]bool, error)
+
 	IsAvailable() bool
 
+	// Verify checks that the chains and rules created by Initialize are in
+	// place, without changing anything.
+	Verify() error
+
 	GetName() string
 }
 
+var ErrNoBackend = errors.New("neither iptables nor nftables is available")
+
 type Manager struct {
 	firewall Firewall
 }
 
 func NewManager(blockMode string) (*Manager, error) {
+	firewall := selectFirewall(blockMode)
+
+	if err := firewall.Initialize(); err != nil {
+		logger.Error("Error initializing firewall", "error", err)
+		return nil, err
+	}
+
+	return &Manager{firewall: firewall}, nil
+}
+
+// Probe returns the name of the backend NewManager would pick for the block
+// mode and checks its rules are in place, without initializing it.
+func Probe(blockMode string) (string, error) {
+	firewall := selectFirewall(blockMode)
+	if !firewall.IsAvailable() {
+		return firewall.GetName(), ErrNoBackend
+	}
+	return firewall.GetName(), firewall.Verify()
+}
+
+func selectFirewall(blockMode string) Firewall {
 	var firewall Firewall
 
 	switch strings.ToLower(blockMode) {
@@ -31,12 +65,12 @@ func NewManager(blockMode string) (*Manager, error) {
 	case "nft":
 		firewall = NewNFTFirewall()
 	default:
-		log.Printf("Unknown firewall mode: %s, falling back to iptables", blockMode)
+		logger.Warn("Unknown firewall mode, falling back to iptables", "mode", blockMode)
 		firewall = NewIPTablesFirewall()
 	}
 
 	if !firewall.IsAvailable() {
-		log.Printf("Firewall %s is not available, trying alternatives", firewall.GetName())
+		logger.Warn("Firewall is not available, trying alternatives", "firewall", firewall.GetName())
 
 		alternatives := []Firewall{
 			NewIPTablesFirewall(),
@@ -46,18 +80,13 @@ func NewManager(blockMode string) (*Manager, error) {
 		for _, alt := range alternatives {
 			if alt.IsAvailable() {
 				firewall = alt
-				log.Printf("Using %s as fallback", alt.GetName())
+				logger.Info("Using fallback firewall", "firewall", alt.GetName())
 				break
 			}
 		}
 	}
 
-	if err := firewall.Initialize(); err != nil {
-		log.Printf("Error initializing firewall: %v", err)
-		return nil, err
-	}
-
-	return &Manager{firewall: firewall}, nil
+	return firewall
 }
 
 func (m *Manager) BlockIP(ip string) error {
@@ -72,6 +101,18 @@ func (m *Manager) GetBlockedIPs() (map[string]bool, error) {
 	return m.firewall.GetBlockedIPs()
 }
 
+func (m *Manager) ThrottleIP(ip string, rateKbit int) error {
+	return m.firewall.ThrottleIP(ip, rateKbit)
+}
+
+func (m *Manager) UnthrottleIP(ip string) error {
+	return m.firewall.UnthrottleIP(ip)
+}
+
+func (m *Manager) GetThrottledIPs() (map[string]bool, error) {
+	return m.firewall.GetThrottledIPs()
+}
+
 func (m *Manager) GetFirewallName() string {
 	return m.firewall.GetName()
 }
@@ -1,7 +1,10 @@
 package firewall
 
 import (
+	"net"
 	"testing"
+
+	"github.com/google/nftables/expr"
 )
 
 func TestNewManager(t *testing.T) {
@@ -60,3 +63,33 @@ func TestFirewallNames(t *testing.T) {
 		}
 	}
 }
+
+func TestThrottleExprs(t *testing.T) {
+	ip := net.ParseIP("1.2.3.4").To4()
+
+	for _, offset := range []uint32{12, 16} {
+		exprs := throttleExprs(offset, ip, 256*125)
+		if len(exprs) != 6 {
+			t.Fatalf("Expected 6 expressions, got %d", len(exprs))
+		}
+
+		payload, ok := exprs[2].(*expr.Payload)
+		if !ok || payload.Offset != offset || payload.Len != 4 {
+			t.Errorf("Unexpected address payload: %+v", exprs[2])
+		}
+
+		cmp, ok := exprs[3].(*expr.Cmp)
+		if !ok || !net.IP(cmp.Data).Equal(ip) {
+			t.Errorf("Unexpected address comparison: %+v", exprs[3])
+		}
+
+		limit, ok := exprs[4].(*expr.Limit)
+		if !ok || !limit.Over || limit.Type != expr.LimitTypePktBytes || limit.Rate != 32000 || limit.Unit != expr.LimitTimeSecond {
+			t.Errorf("Unexpected limit: %+v", exprs[4])
+		}
+
+		if verdict, ok := exprs[5].(*expr.Verdict); !ok || verdict.Kind != expr.VerdictDrop {
+			t.Errorf("Unexpected verdict: %+v", exprs[5])
+		}
+	}
+}
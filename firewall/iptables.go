@@ -2,24 +2,72 @@ package firewall
 
 import (
 	"fmt"
-	"log"
 	"regexp"
 	"strings"
+	"tblocker/netns"
 
 	"github.com/coreos/go-iptables/iptables"
 )
 
+const iptablesThrottleOutChain = "TBLOCKER_THROTTLE_OUT"
+
 type IPTablesFirewall struct {
 	ipRegex     *regexp.Regexp
-	ipt         *iptables.IPTables
+	ipt         *nsIPTables
 	chainName   string
 	initialized bool
 }
 
+// nsIPTables runs the iptables commands inside the configured network
+// namespace.
+type nsIPTables struct {
+	ipt *iptables.IPTables
+}
+
+func (t *nsIPTables) List(table, chain string) (rules []string, err error) {
+	err = netns.Do(func() error {
+		rules, err = t.ipt.List(table, chain)
+		return err
+	})
+	return rules, err
+}
+
+func (t *nsIPTables) ChainExists(table, chain string) (exists bool, err error) {
+	err = netns.Do(func() error {
+		exists, err = t.ipt.ChainExists(table, chain)
+		return err
+	})
+	return exists, err
+}
+
+func (t *nsIPTables) NewChain(table, chain string) error {
+	return netns.Do(func() error { return t.ipt.NewChain(table, chain) })
+}
+
+func (t *nsIPTables) ClearChain(table, chain string) error {
+	return netns.Do(func() error { return t.ipt.ClearChain(table, chain) })
+}
+
+func (t *nsIPTables) DeleteChain(table, chain string) error {
+	return netns.Do(func() error { return t.ipt.DeleteChain(table, chain) })
+}
+
+func (t *nsIPTables) Insert(table, chain string, pos int, rulespec ...string) error {
+	return netns.Do(func() error { return t.ipt.Insert(table, chain, pos, rulespec...) })
+}
+
+func (t *nsIPTables) Append(table, chain string, rulespec ...string) error {
+	return netns.Do(func() error { return t.ipt.Append(table, chain, rulespec...) })
+}
+
+func (t *nsIPTables) Delete(table, chain string, rulespec ...string) error {
+	return netns.Do(func() error { return t.ipt.Delete(table, chain, rulespec...) })
+}
+
 func NewIPTablesFirewall() *IPTablesFirewall {
 	ipt, err := iptables.New()
 	if err != nil {
-		log.Printf("Error creating iptables instance: %v", err)
+		logger.Error("Error creating iptables instance", "error", err)
 		return &IPTablesFirewall{
 			ipRegex:     regexp.MustCompile(`(\d+\.\d+\.\d+\.\d+)`),
 			ipt:         nil,
@@ -30,7 +78,7 @@ func NewIPTablesFirewall() *IPTablesFirewall {
 
 	return &IPTablesFirewall{
 		ipRegex:     regexp.MustCompile(`(\d+\.\d+\.\d+\.\d+)`),
-		ipt:         ipt,
+		ipt:         &nsIPTables{ipt},
 		chainName:   "TBLOCKER_BLOCKED",
 		initialized: false,
 	}
@@ -47,52 +95,103 @@ func (f *IPTablesFirewall) Initialize() error {
 
 	_, err := f.ipt.List("raw", "PREROUTING")
 	if err != nil {
-		log.Printf("IPTables is not available on this system: %v", err)
+		logger.Error("IPTables is not available on this system", "error", err)
 		return fmt.Errorf("iptables not available: %v", err)
 	}
 
-	log.Printf("Initializing iptables firewall...")
+	logger.Info("Initializing iptables firewall")
 
 	exists, err := f.ipt.ChainExists("raw", f.chainName)
 	if err != nil {
-		log.Printf("Error checking chain existence: %v", err)
+		logger.Error("Error checking chain existence", "error", err)
 		return err
 	}
 
 	if !exists {
 		err = f.ipt.NewChain("raw", f.chainName)
 		if err != nil {
-			log.Printf("Error creating chain %s: %v", f.chainName, err)
+			logger.Error("Error creating chain", "chain", f.chainName, "error", err)
 			return err
 		}
-		log.Printf("Created chain %s in raw table", f.chainName)
+		logger.Info("Created chain in raw table", "chain", f.chainName)
+	}
+
+	if err := f.ensureJump("PREROUTING", f.chainName); err != nil {
+		return err
 	}
 
-	rules, err := f.ipt.List("raw", "PREROUTING")
+	exists, err = f.ipt.ChainExists("raw", iptablesThrottleOutChain)
 	if err != nil {
-		log.Printf("Error listing PREROUTING rules: %v", err)
+		logger.Error("Error checking chain existence", "error", err)
+		return err
+	}
+	if !exists {
+		if err := f.ipt.NewChain("raw", iptablesThrottleOutChain); err != nil {
+			logger.Error("Error creating chain", "chain", iptablesThrottleOutChain, "error", err)
+			return err
+		}
+		logger.Info("Created chain in raw table", "chain", iptablesThrottleOutChain)
+	}
+
+	if err := f.ensureJump("OUTPUT", iptablesThrottleOutChain); err != nil {
+		return err
+	}
+
+	f.initialized = true
+	logger.Info("IPTables firewall initialized successfully", "chain", f.chainName)
+	return nil
+}
+
+func (f *IPTablesFirewall) ensureJump(parent, chain string) error {
+	rules, err := f.ipt.List("raw", parent)
+	if err != nil {
+		logger.Error("Error listing rules", "chain", parent, "error", err)
 		return err
 	}
 
-	jumpRuleExists := false
 	for _, rule := range rules {
-		if strings.Contains(rule, f.chainName) {
-			jumpRuleExists = true
-			break
+		if strings.Contains(rule, chain) {
+			return nil
 		}
 	}
 
-	if !jumpRuleExists {
-		err = f.ipt.Insert("raw", "PREROUTING", 1, "-j", f.chainName)
+	if err := f.ipt.Insert("raw", parent, 1, "-j", chain); err != nil {
+		logger.Error("Error adding jump rule", "chain", chain, "error", err)
+		return err
+	}
+	logger.Info("Added jump rule", "chain", chain, "parent", parent)
+	return nil
+}
+
+func (f *IPTablesFirewall) Verify() error {
+	if f.ipt == nil {
+		return fmt.Errorf("iptables not available")
+	}
+
+	for parent, chain := range map[string]string{"PREROUTING": f.chainName, "OUTPUT": iptablesThrottleOutChain} {
+		exists, err := f.ipt.ChainExists("raw", chain)
 		if err != nil {
-			log.Printf("Error adding jump rule to %s: %v", f.chainName, err)
-			return err
+			return fmt.Errorf("failed to check chain %s: %v", chain, err)
+		}
+		if !exists {
+			return fmt.Errorf("chain %s does not exist in raw table", chain)
+		}
+
+		rules, err := f.ipt.List("raw", parent)
+		if err != nil {
+			return fmt.Errorf("failed to list %s rules: %v", parent, err)
+		}
+		jump := false
+		for _, rule := range rules {
+			if strings.Contains(rule, "-j "+chain) {
+				jump = true
+			}
+		}
+		if !jump {
+			return fmt.Errorf("no jump rule to %s in raw %s chain", chain, parent)
 		}
-		log.Printf("Added jump rule to %s in PREROUTING chain", f.chainName)
 	}
 
-	f.initialized = true
-	log.Printf("IPTables firewall initialized successfully with custom chain %s", f.chainName)
 	return nil
 }
 
@@ -109,24 +208,24 @@ func (f *IPTablesFirewall) BlockIP(ip string) error {
 
 	rules, err := f.ipt.List("raw", f.chainName)
 	if err != nil {
-		log.Printf("Error getting rules from chain %s: %v", f.chainName, err)
+		logger.Error("Error getting rules from chain", "chain", f.chainName, "error", err)
 		return err
 	}
 
 	for _, rule := range rules {
-		if strings.Contains(rule, ip) && strings.Contains(rule, "DROP") {
-			log.Printf("IP %s is already blocked in chain %s", ip, f.chainName)
+		if strings.Contains(rule, ip) && strings.Contains(rule, "DROP") && !strings.Contains(rule, "hashlimit") {
+			logger.Debug("IP is already blocked", "ip", ip, "chain", f.chainName)
 			return nil
 		}
 	}
 
 	err = f.ipt.Append("raw", f.chainName, "-s", ip, "-j", "DROP")
 	if err != nil {
-		log.Printf("Error blocking IP %s in chain %s: %v", ip, f.chainName, err)
+		logger.Error("Error blocking IP", "ip", ip, "chain", f.chainName, "error", err)
 		return err
 	}
 
-	log.Printf("IP %s blocked in chain %s", ip, f.chainName)
+	logger.Info("IP blocked", "ip", ip, "chain", f.chainName)
 	return nil
 }
 
@@ -143,11 +242,11 @@ func (f *IPTablesFirewall) UnblockIP(ip string) error {
 
 	err := f.ipt.Delete("raw", f.chainName, "-s", ip, "-j", "DROP")
 	if err != nil {
-		log.Printf("Error unblocking IP %s from chain %s: %v", ip, f.chainName, err)
+		logger.Error("Error unblocking IP", "ip", ip, "chain", f.chainName, "error", err)
 		return err
 	}
 
-	log.Printf("IP %s unblocked from chain %s", ip, f.chainName)
+	logger.Info("IP unblocked", "ip", ip, "chain", f.chainName)
 	return nil
 }
 
@@ -164,14 +263,14 @@ func (f *IPTablesFirewall) GetBlockedIPs() (map[string]bool, error) {
 
 	rules, err := f.ipt.List("raw", f.chainName)
 	if err != nil {
-		log.Printf("Error getting rules from chain %s: %v", f.chainName, err)
+		logger.Error("Error getting rules from chain", "chain", f.chainName, "error", err)
 		return nil, err
 	}
 
 	blockedIPs := make(map[string]bool)
 
 	for _, rule := range rules {
-		if strings.Contains(rule, "DROP") {
+		if strings.Contains(rule, "DROP") && !strings.Contains(rule, "hashlimit") {
 			ip := f.ipRegex.FindString(rule)
 			if ip != "" && ip != "0.0.0.0" {
 				blockedIPs[ip] = true
@@ -182,6 +281,125 @@ func (f *IPTablesFirewall) GetBlockedIPs() (map[string]bool, error) {
 	return blockedIPs, nil
 }
 
+// ThrottleIP adds hashlimit rules dropping traffic from and to the IP above
+// the given rate in kbit/s.
+func (f *IPTablesFirewall) ThrottleIP(ip string, rateKbit int) error {
+	if f.ipt == nil {
+		return fmt.Errorf("iptables not available")
+	}
+
+	if !f.initialized {
+		if err := f.Initialize(); err != nil {
+			return err
+		}
+	}
+
+	throttled, err := f.GetThrottledIPs()
+	if err != nil {
+		return err
+	}
+	if throttled[ip] {
+		logger.Debug("IP is already throttled", "ip", ip, "chain", f.chainName)
+		return nil
+	}
+
+	rate := fmt.Sprintf("%db/s", rateKbit*125)
+	name := fmt.Sprintf("tb%d", rateKbit)
+
+	err = f.ipt.Append("raw", f.chainName, "-s", ip, "-m", "hashlimit",
+		"--hashlimit-above", rate, "--hashlimit-mode", "srcip", "--hashlimit-name", name+"in", "-j", "DROP")
+	if err != nil {
+		logger.Error("Error throttling IP", "ip", ip, "chain", f.chainName, "error", err)
+		return err
+	}
+
+	err = f.ipt.Append("raw", iptablesThrottleOutChain, "-d", ip, "-m", "hashlimit",
+		"--hashlimit-above", rate, "--hashlimit-mode", "dstip", "--hashlimit-name", name+"out", "-j", "DROP")
+	if err != nil {
+		logger.Error("Error throttling IP", "ip", ip, "chain", iptablesThrottleOutChain, "error", err)
+		return err
+	}
+
+	logger.Info("IP throttled", "ip", ip, "rate_kbit", rateKbit, "chain", f.chainName)
+	return nil
+}
+
+// UnthrottleIP deletes the throttle rules of the IP whatever rate they were
+// created with.
+func (f *IPTablesFirewall) UnthrottleIP(ip string) error {
+	if f.ipt == nil {
+		return fmt.Errorf("iptables not available")
+	}
+
+	if !f.initialized {
+		if err := f.Initialize(); err != nil {
+			return err
+		}
+	}
+
+	found := false
+	for _, chain := range []string{f.chainName, iptablesThrottleOutChain} {
+		rules, err := f.ipt.List("raw", chain)
+		if err != nil {
+			logger.Error("Error getting rules from chain", "chain", chain, "error", err)
+			return err
+		}
+
+		for _, rule := range rules {
+			if !strings.Contains(rule, "hashlimit") || f.ipRegex.FindString(rule) != ip {
+				continue
+			}
+
+			spec := strings.Fields(strings.TrimPrefix(rule, "-A "+chain+" "))
+			if err := f.ipt.Delete("raw", chain, spec...); err != nil {
+				logger.Error("Error unthrottling IP", "ip", ip, "chain", chain, "error", err)
+				return err
+			}
+			found = true
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("no rule found for IP %s", ip)
+	}
+
+	logger.Info("IP unthrottled", "ip", ip, "chain", f.chainName)
+	return nil
+}
+
+func (f *IPTablesFirewall) GetThrottledIPs() (map[string]bool, error) {
+	if f.ipt == nil {
+		return nil, fmt.Errorf("iptables not available")
+	}
+
+	if !f.initialized {
+		if err := f.Initialize(); err != nil {
+			return nil, err
+		}
+	}
+
+	// An IP is reported when either of its rules is left, so a half-applied
+	// throttle is still found and removed by UnthrottleIP.
+	throttledIPs := make(map[string]bool)
+	for _, chain := range []string{f.chainName, iptablesThrottleOutChain} {
+		rules, err := f.ipt.List("raw", chain)
+		if err != nil {
+			logger.Error("Error getting rules from chain", "chain", chain, "error", err)
+			return nil, err
+		}
+
+		for _, rule := range rules {
+			if strings.Contains(rule, "hashlimit") {
+				if ip := f.ipRegex.FindString(rule); ip != "" {
+					throttledIPs[ip] = true
+				}
+			}
+		}
+	}
+
+	return throttledIPs, nil
+}
+
 func (f *IPTablesFirewall) IsAvailable() bool {
 	if f.ipt == nil {
 		return false
@@ -204,13 +422,14 @@ func (f *IPTablesFirewall) FlushChain() error {
 		return nil
 	}
 
-	err := f.ipt.ClearChain("raw", f.chainName)
-	if err != nil {
-		log.Printf("Error flushing chain %s: %v", f.chainName, err)
-		return err
+	for _, chain := range []string{f.chainName, iptablesThrottleOutChain} {
+		if err := f.ipt.ClearChain("raw", chain); err != nil {
+			logger.Error("Error flushing chain", "chain", chain, "error", err)
+			return err
+		}
+		logger.Info("Chain flushed successfully", "chain", chain)
 	}
 
-	log.Printf("Chain %s flushed successfully", f.chainName)
 	return nil
 }
 
@@ -223,25 +442,30 @@ func (f *IPTablesFirewall) RemoveChain() error {
 		return nil
 	}
 
-	err := f.ipt.Delete("raw", "PREROUTING", "-j", f.chainName)
-	if err != nil {
-		log.Printf("Warning: Could not remove jump rule to %s: %v", f.chainName, err)
-	}
+	for _, jump := range []struct{ parent, chain string }{
+		{"PREROUTING", f.chainName},
+		{"OUTPUT", iptablesThrottleOutChain},
+	} {
+		err := f.ipt.Delete("raw", jump.parent, "-j", jump.chain)
+		if err != nil {
+			logger.Warn("Could not remove jump rule", "chain", jump.chain, "error", err)
+		}
 
-	err = f.ipt.ClearChain("raw", f.chainName)
-	if err != nil {
-		log.Printf("Error clearing chain %s: %v", f.chainName, err)
-		return err
-	}
+		err = f.ipt.ClearChain("raw", jump.chain)
+		if err != nil {
+			logger.Error("Error clearing chain", "chain", jump.chain, "error", err)
+			return err
+		}
 
-	err = f.ipt.DeleteChain("raw", f.chainName)
-	if err != nil {
-		log.Printf("Error deleting chain %s: %v", f.chainName, err)
-		return err
+		err = f.ipt.DeleteChain("raw", jump.chain)
+		if err != nil {
+			logger.Error("Error deleting chain", "chain", jump.chain, "error", err)
+			return err
+		}
+		logger.Info("Chain removed successfully", "chain", jump.chain)
 	}
 
 	f.initialized = false
-	log.Printf("Chain %s removed successfully", f.chainName)
 	return nil
 }
 
@@ -1,12 +1,21 @@
 package firewall
 
 import (
+	"bytes"
 	"fmt"
-	"log"
 	"net"
+	"strings"
+
+	"tblocker/netns"
 
 	"github.com/google/nftables"
 	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	nftThrottleOutChain = "TBLOCKER_THROTTLE_OUT"
+	nftThrottlePrefix   = "tblocker-throttle:"
 )
 
 type NFTFirewall struct {
@@ -16,7 +25,7 @@ type NFTFirewall struct {
 
 func NewNFTFirewall() *NFTFirewall {
 	return &NFTFirewall{
-		conn:        &nftables.Conn{},
+		conn:        &nftables.Conn{NetNS: netns.Fd()},
 		initialized: false,
 	}
 }
@@ -26,7 +35,7 @@ func (f *NFTFirewall) Initialize() error {
 		return nil
 	}
 
-	log.Printf("Initializing nftables firewall...")
+	logger.Info("Initializing nftables firewall")
 
 	table := &nftables.Table{
 		Family: nftables.TableFamilyINet,
@@ -45,6 +54,15 @@ func (f *NFTFirewall) Initialize() error {
 	}
 	f.conn.AddChain(chain)
 
+	f.conn.AddChain(&nftables.Chain{
+		Name:     nftThrottleOutChain,
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookOutput,
+		Priority: nftables.ChainPriorityFilter,
+		Policy:   &policy,
+	})
+
 	set := &nftables.Set{
 		Table:   table,
 		Name:    "TBLOCKER_BLOCKED_IPS",
@@ -74,18 +92,18 @@ func (f *NFTFirewall) Initialize() error {
 			},
 		}
 		f.conn.AddRule(rule)
-		log.Printf("Rule added to nftables")
+		logger.Info("Rule added to nftables")
 	} else {
-		log.Printf("Rule already exists in nftables")
+		logger.Debug("Rule already exists in nftables")
 	}
 
 	err := f.conn.Flush()
 	if err != nil {
-		log.Printf("Error initializing nftables: %v", err)
+		logger.Error("Error initializing nftables", "error", err)
 		return fmt.Errorf("failed to initialize nftables: %v", err)
 	}
 
-	log.Printf("Nftables firewall initialized successfully")
+	logger.Info("Nftables firewall initialized successfully")
 	f.initialized = true
 	return nil
 }
@@ -93,7 +111,7 @@ func (f *NFTFirewall) Initialize() error {
 func (f *NFTFirewall) ruleExists(table *nftables.Table, chain *nftables.Chain) bool {
 	rules, err := f.conn.GetRules(table, chain)
 	if err != nil {
-		log.Printf("Error checking existing rules: %v", err)
+		logger.Error("Error checking existing rules", "error", err)
 		return false
 	}
 
@@ -118,6 +136,40 @@ func (f *NFTFirewall) ruleExists(table *nftables.Table, chain *nftables.Chain) b
 	return false
 }
 
+func (f *NFTFirewall) Verify() error {
+	table, err := f.conn.ListTableOfFamily("tblocker", nftables.TableFamilyINet)
+	if err != nil {
+		return fmt.Errorf("table inet tblocker does not exist: %v", err)
+	}
+
+	chains, err := f.conn.ListChainsOfTableFamily(nftables.TableFamilyINet)
+	if err != nil {
+		return fmt.Errorf("failed to list chains: %v", err)
+	}
+	for _, name := range []string{"TBLOCKER_BLOCKED", nftThrottleOutChain} {
+		found := false
+		for _, chain := range chains {
+			if chain.Table.Name == table.Name && chain.Name == name {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("chain %s does not exist in table inet tblocker", name)
+		}
+	}
+
+	if _, err := f.conn.GetSetByName(table, "TBLOCKER_BLOCKED_IPS"); err != nil {
+		return fmt.Errorf("set TBLOCKER_BLOCKED_IPS does not exist: %v", err)
+	}
+
+	chain := &nftables.Chain{Name: "TBLOCKER_BLOCKED", Table: table}
+	if !f.ruleExists(table, chain) {
+		return fmt.Errorf("drop rule for TBLOCKER_BLOCKED_IPS is missing in chain TBLOCKER_BLOCKED")
+	}
+
+	return nil
+}
+
 func (f *NFTFirewall) BlockIP(ip string) error {
 	parsedIP := net.ParseIP(ip)
 	if parsedIP == nil {
@@ -145,11 +197,11 @@ func (f *NFTFirewall) BlockIP(ip string) error {
 	f.conn.SetAddElements(set, []nftables.SetElement{element})
 
 	if err := f.conn.Flush(); err != nil {
-		log.Printf("Error adding IP %s to nftables set: %v", ip, err)
+		logger.Error("Error adding IP to nftables set", "ip", ip, "error", err)
 		return fmt.Errorf("failed to add IP %s to nftables set: %v", ip, err)
 	}
 
-	log.Printf("IP %s blocked with nftables", ip)
+	logger.Info("IP blocked", "ip", ip)
 	return nil
 }
 
@@ -174,11 +226,11 @@ func (f *NFTFirewall) UnblockIP(ip string) error {
 	f.conn.SetDeleteElements(set, []nftables.SetElement{element})
 
 	if err := f.conn.Flush(); err != nil {
-		log.Printf("Error unblocking IP %s with nftables: %v", ip, err)
+		logger.Error("Error unblocking IP", "ip", ip, "error", err)
 		return fmt.Errorf("failed to unblock IP %s with nftables: %v", ip, err)
 	}
 
-	log.Printf("IP %s unblocked with nftables", ip)
+	logger.Info("IP unblocked", "ip", ip)
 	return nil
 }
 
@@ -190,7 +242,7 @@ func (f *NFTFirewall) GetBlockedIPs() (map[string]bool, error) {
 
 	sets, err := f.conn.GetSets(table)
 	if err != nil {
-		log.Printf("Error getting sets via API: %v", err)
+		logger.Error("Error getting nftables sets", "error", err)
 		return nil, fmt.Errorf("failed to get sets via API: %v", err)
 	}
 
@@ -199,7 +251,7 @@ func (f *NFTFirewall) GetBlockedIPs() (map[string]bool, error) {
 		if s.Name == "TBLOCKER_BLOCKED_IPS" {
 			elements, err := f.conn.GetSetElements(s)
 			if err != nil {
-				log.Printf("Error listing nftables set via API: %v", err)
+				logger.Error("Error listing nftables set", "error", err)
 				return nil, fmt.Errorf("failed to list nftables set via API: %v", err)
 			}
 
@@ -216,6 +268,144 @@ func (f *NFTFirewall) GetBlockedIPs() (map[string]bool, error) {
 	return blockedIPs, nil
 }
 
+// ThrottleIP adds rules dropping traffic from and to the IP above the given
+// rate in kbit/s. The rules are identified by their user data.
+func (f *NFTFirewall) ThrottleIP(ip string, rateKbit int) error {
+	parsedIP := net.ParseIP(ip).To4()
+	if parsedIP == nil {
+		return fmt.Errorf("invalid IP address: %s", ip)
+	}
+
+	if !f.initialized {
+		if err := f.Initialize(); err != nil {
+			return fmt.Errorf("failed to initialize firewall: %v", err)
+		}
+	}
+
+	existing, err := f.throttleRules(ip)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		logger.Debug("IP is already throttled", "ip", ip)
+		return nil
+	}
+
+	table := &nftables.Table{
+		Family: nftables.TableFamilyINet,
+		Name:   "tblocker",
+	}
+	bytesPerSecond := uint64(rateKbit) * 125
+
+	f.conn.AddRule(&nftables.Rule{
+		Table:    table,
+		Chain:    &nftables.Chain{Name: "TBLOCKER_BLOCKED", Table: table},
+		Exprs:    throttleExprs(12, parsedIP, bytesPerSecond),
+		UserData: []byte(nftThrottlePrefix + ip),
+	})
+	f.conn.AddRule(&nftables.Rule{
+		Table:    table,
+		Chain:    &nftables.Chain{Name: nftThrottleOutChain, Table: table},
+		Exprs:    throttleExprs(16, parsedIP, bytesPerSecond),
+		UserData: []byte(nftThrottlePrefix + ip),
+	})
+
+	if err := f.conn.Flush(); err != nil {
+		logger.Error("Error throttling IP", "ip", ip, "error", err)
+		return fmt.Errorf("failed to throttle IP %s with nftables: %v", ip, err)
+	}
+
+	logger.Info("IP throttled", "ip", ip, "rate_kbit", rateKbit)
+	return nil
+}
+
+func throttleExprs(addressOffset uint32, ip net.IP, bytesPerSecond uint64) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.NFPROTO_IPV4}},
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       addressOffset,
+			Len:          4,
+		},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip},
+		&expr.Limit{
+			Type:  expr.LimitTypePktBytes,
+			Rate:  bytesPerSecond,
+			Over:  true,
+			Unit:  expr.LimitTimeSecond,
+			Burst: uint32(bytesPerSecond),
+		},
+		&expr.Verdict{Kind: expr.VerdictDrop},
+	}
+}
+
+func (f *NFTFirewall) UnthrottleIP(ip string) error {
+	rules, err := f.throttleRules(ip)
+	if err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		return fmt.Errorf("no rule found for IP %s", ip)
+	}
+
+	for _, rule := range rules {
+		if err := f.conn.DelRule(rule); err != nil {
+			return fmt.Errorf("failed to delete throttle rule for IP %s: %v", ip, err)
+		}
+	}
+
+	if err := f.conn.Flush(); err != nil {
+		logger.Error("Error unthrottling IP", "ip", ip, "error", err)
+		return fmt.Errorf("failed to unthrottle IP %s with nftables: %v", ip, err)
+	}
+
+	logger.Info("IP unthrottled", "ip", ip)
+	return nil
+}
+
+func (f *NFTFirewall) GetThrottledIPs() (map[string]bool, error) {
+	rules, err := f.throttleRules("")
+	if err != nil {
+		return nil, err
+	}
+
+	throttledIPs := make(map[string]bool)
+	for _, rule := range rules {
+		throttledIPs[strings.TrimPrefix(string(rule.UserData), nftThrottlePrefix)] = true
+	}
+	return throttledIPs, nil
+}
+
+// throttleRules returns the throttle rules of the IP, or of all IPs if ip
+// is empty.
+func (f *NFTFirewall) throttleRules(ip string) ([]*nftables.Rule, error) {
+	table := &nftables.Table{
+		Family: nftables.TableFamilyINet,
+		Name:   "tblocker",
+	}
+
+	var result []*nftables.Rule
+	for _, chainName := range []string{"TBLOCKER_BLOCKED", nftThrottleOutChain} {
+		rules, err := f.conn.GetRules(table, &nftables.Chain{Name: chainName, Table: table})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list nftables rules of %s: %v", chainName, err)
+		}
+
+		for _, rule := range rules {
+			if !bytes.HasPrefix(rule.UserData, []byte(nftThrottlePrefix)) {
+				continue
+			}
+			if ip == "" || string(rule.UserData) == nftThrottlePrefix+ip {
+				result = append(result, rule)
+			}
+		}
+	}
+
+	return result, nil
+}
+
 func (f *NFTFirewall) IsAvailable() bool {
 	return isCommandAvailable("nft")
 }
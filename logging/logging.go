@@ -0,0 +1,129 @@
+// Package logging provides levelled, structured loggers for the components
+// of the service, writing either text or JSON.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	level   = new(slog.LevelVar)
+	handler atomic.Pointer[slog.Handler]
+)
+
+func init() {
+	setHandler(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+}
+
+// Setup configures the level (debug, info, warn, error) and format (text,
+// json) of all loggers, including those created before, and sends the
+// standard log package through them at info level.
+func Setup(levelName, format string, out io.Writer) error {
+	parsed, err := ParseLevel(levelName)
+	if err != nil {
+		return err
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(format) {
+	case "", "text":
+		setHandler(slog.NewTextHandler(out, options))
+	case "json":
+		setHandler(slog.NewJSONHandler(out, options))
+	default:
+		return fmt.Errorf("unknown log format %q, expected text or json", format)
+	}
+	level.Set(parsed)
+
+	slog.SetDefault(slog.New(&componentHandler{}))
+	return nil
+}
+
+// ParseLevel parses a level name, defaulting to info.
+func ParseLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", name)
+}
+
+func setHandler(h slog.Handler) {
+	handler.Store(&h)
+}
+
+// For returns the logger of a component. Its records carry a component
+// field and follow later changes made by Setup.
+func For(component string) *slog.Logger {
+	return slog.New(&componentHandler{}).With("component", component)
+}
+
+// Fatal logs at error level and exits, like log.Fatalf.
+func Fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// componentHandler resolves the configured handler on every record, so
+// loggers kept in package variables pick up the configuration. The chain of
+// WithAttrs and WithGroup calls is applied once per configured handler and
+// kept in built until Setup replaces the handler.
+type componentHandler struct {
+	with  []func(slog.Handler) slog.Handler
+	built atomic.Pointer[builtHandler]
+}
+
+type builtHandler struct {
+	base   *slog.Handler
+	target slog.Handler
+}
+
+func (h *componentHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= level.Level()
+}
+
+func (h *componentHandler) Handle(ctx context.Context, record slog.Record) error {
+	return h.target().Handle(ctx, record)
+}
+
+// target returns the chain applied to the configured handler, building it
+// again only if Setup changed the handler since.
+func (h *componentHandler) target() slog.Handler {
+	base := handler.Load()
+	if built := h.built.Load(); built != nil && built.base == base {
+		return built.target
+	}
+
+	target := *base
+	for _, with := range h.with {
+		target = with(target)
+	}
+	h.built.Store(&builtHandler{base: base, target: target})
+	return target
+}
+
+func (h *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.extend(func(target slog.Handler) slog.Handler { return target.WithAttrs(attrs) })
+}
+
+func (h *componentHandler) WithGroup(name string) slog.Handler {
+	return h.extend(func(target slog.Handler) slog.Handler { return target.WithGroup(name) })
+}
+
+func (h *componentHandler) extend(with func(slog.Handler) slog.Handler) slog.Handler {
+	extended := &componentHandler{with: append(h.with[:len(h.with):len(h.with)], with)}
+	extended.target()
+	return extended
+}
@@ -0,0 +1,102 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSetupJSON(t *testing.T) {
+	var out bytes.Buffer
+	logger := For("firewall")
+
+	if err := Setup("warn", "json", &out); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	defer Setup("info", "text", &bytes.Buffer{})
+
+	logger.Info("IP blocked", "ip", "1.2.3.4")
+	logger.Warn("User blocked", "ip", "1.2.3.4", "user", "bob", "duration", 10, "reason", "torrent")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected only the warning to be logged, got:\n%s", out.String())
+	}
+
+	var record map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("Failed to parse JSON record %q: %v", lines[0], err)
+	}
+
+	expected := map[string]any{
+		"level":     "WARN",
+		"msg":       "User blocked",
+		"component": "firewall",
+		"ip":        "1.2.3.4",
+		"user":      "bob",
+		"duration":  float64(10),
+		"reason":    "torrent",
+	}
+	for key, value := range expected {
+		if record[key] != value {
+			t.Errorf("Expected %s=%v, got %v", key, value, record[key])
+		}
+	}
+}
+
+func TestSetupInvalid(t *testing.T) {
+	if err := Setup("verbose", "text", &bytes.Buffer{}); err == nil {
+		t.Error("Expected error for unknown level")
+	}
+	if err := Setup("info", "xml", &bytes.Buffer{}); err == nil {
+		t.Error("Expected error for unknown format")
+	}
+}
+
+// countingHandler counts the records it handles and the WithAttrs calls
+// made on it and its derived handlers.
+type countingHandler struct {
+	withAttrs *int
+	records   *int
+}
+
+func (h countingHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h countingHandler) Handle(context.Context, slog.Record) error {
+	*h.records++
+	return nil
+}
+
+func (h countingHandler) WithAttrs([]slog.Attr) slog.Handler {
+	*h.withAttrs++
+	return h
+}
+
+func (h countingHandler) WithGroup(string) slog.Handler { return h }
+
+func TestComponentHandlerReusesChain(t *testing.T) {
+	defer Setup("info", "text", &bytes.Buffer{})
+
+	var withAttrs, records int
+	setHandler(countingHandler{withAttrs: &withAttrs, records: &records})
+
+	logger := For("firewall").With("chain", "TBLOCKER_BLOCKED")
+	built := withAttrs
+	for i := 0; i < 3; i++ {
+		logger.Info("IP blocked", "ip", "1.2.3.4")
+	}
+	if records != 3 || withAttrs != built {
+		t.Errorf("Expected 3 records without rebuilding the chain, got %d records and %d WithAttrs after %d", records, withAttrs, built)
+	}
+
+	var newWithAttrs, newRecords int
+	setHandler(countingHandler{withAttrs: &newWithAttrs, records: &newRecords})
+	logger.Info("IP blocked", "ip", "1.2.3.4")
+	logger.Info("IP blocked", "ip", "5.6.7.8")
+	if newRecords != 2 || newWithAttrs != 2 {
+		t.Errorf("Expected the chain to be rebuilt once for the new handler, got %d records and %d WithAttrs", newRecords, newWithAttrs)
+	}
+}
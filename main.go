@@ -3,24 +3,44 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
 	"tblocker/config"
 	"tblocker/firewall"
+	"tblocker/logging"
+	"tblocker/netns"
 	"tblocker/storage"
 	"tblocker/utils"
 )
 
 var Version string
 
+var logger = logging.For("main")
+
 func main() {
+	if len(os.Args) > 1 {
+		if command, exists := commands[os.Args[1]]; exists {
+			os.Exit(command(os.Args[2:]))
+		}
+	}
+
 	initConfig()
 
-	log.Printf("XRay torrent-blocker: %s", Version)
-	log.Printf("Service started on %s", config.Hostname)
+	logger.Info("XRay torrent-blocker", "version", Version)
+	logger.Info("Service started", "hostname", config.Hostname)
+	if len(config.BypassIPSet) > 0 {
+		logger.Info("Bypassing IPs", "ips", slices.Sorted(maps.Keys(config.BypassIPSet)))
+	}
 
 	utils.InitConntrackManager()
+	utils.StartStatusReporter(Version)
+	utils.StartWebhookDigest()
+	utils.StartControlServer()
+	utils.StartFeed()
+	utils.StartRedisSync()
+	utils.StartHealthMonitor()
 
 	utils.StartLogMonitor()
 }
@@ -33,6 +53,7 @@ func initConfig() {
 	flag.StringVar(&configPath, "c", "", "Path to the configuration file")
 	flag.BoolVar(&showVersion, "v", false, "Display version")
 	flag.BoolVar(&enablePerf, "perf", false, "Enable performance metrics collection")
+	config.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
 	if showVersion {
@@ -40,32 +61,47 @@ func initConfig() {
 		os.Exit(0)
 	}
 
-	if configPath == "" {
-		ex, err := os.Executable()
-		if err != nil {
-			log.Fatalf("Error getting executable path: %v", err)
-		}
-		configPath = filepath.Join(filepath.Dir(ex), "config.yaml")
+	if err := config.LoadConfig(resolveConfigPath(configPath)); err != nil {
+		logging.Fatal(logger, "Failed to load configuration", "error", err)
 	}
 
-	if err := config.LoadConfig(configPath); err != nil {
-		log.Fatalf("Failed to load configuration: %v", err)
+	if err := logging.Setup(config.LogLevel, config.LogFormat, os.Stderr); err != nil {
+		logging.Fatal(logger, "Failed to set up logging", "error", err)
 	}
 
 	config.EnablePerformanceMetrics = enablePerf
 
+	if err := netns.Init(config.NetworkNamespace); err != nil {
+		logging.Fatal(logger, "Failed to open network namespace", "error", err)
+	}
+
 	firewallManager, err := firewall.NewManager(config.BlockMode)
 	if err != nil {
-		log.Fatalf("Failed to initialize firewall manager: %v", err)
+		logging.Fatal(logger, "Failed to initialize firewall manager", "error", err)
 	}
-	log.Printf("Using firewall: %s", firewallManager.GetFirewallName())
+	logger.Info("Using firewall", "firewall", firewallManager.GetFirewallName())
 	utils.SetFirewallManager(firewallManager)
 
 	store, err := storage.NewIPStorage(config.StorageDir, utils.UnblockIPAfterDelay)
 	if err != nil {
-		log.Fatalf("Failed to initialize IP storage: %v", err)
+		logging.Fatal(logger, "Failed to initialize IP storage", "error", err)
 	}
 	utils.SetIPStorage(store)
 
 	utils.ScheduleBlockedIPsUpdate()
 }
+
+func resolveConfigPath(configPath string) string {
+	if configPath != "" {
+		return configPath
+	}
+	if envPath := os.Getenv(config.EnvPrefix + "CONFIG"); envPath != "" {
+		return envPath
+	}
+
+	ex, err := os.Executable()
+	if err != nil {
+		logging.Fatal(logger, "Error getting executable path", "error", err)
+	}
+	return filepath.Join(filepath.Dir(ex), "config.yaml")
+}
@@ -0,0 +1,161 @@
+// Package netns lets firewall and conntrack operations target the network
+// namespace of a containerized Xray instead of the host namespace.
+package netns
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"tblocker/logging"
+
+	"golang.org/x/sys/unix"
+)
+
+var logger = logging.For("netns")
+
+var (
+	target string
+	path   string
+	file   *os.File
+)
+
+// Init opens the network namespace given as a path to a namespace file,
+// "pid:<pid>" or "container:<name>". An empty target keeps the namespace of
+// the process.
+func Init(spec string) error {
+	if spec == "" {
+		return nil
+	}
+
+	resolved, err := Resolve(spec)
+	if err != nil {
+		return err
+	}
+
+	ns, err := os.Open(resolved)
+	if err != nil {
+		return fmt.Errorf("failed to open network namespace %s: %v", resolved, err)
+	}
+
+	var stat unix.Statfs_t
+	if err := unix.Fstatfs(int(ns.Fd()), &stat); err != nil || stat.Type != unix.NSFS_MAGIC {
+		ns.Close()
+		return fmt.Errorf("%s is not a network namespace", resolved)
+	}
+
+	if file != nil {
+		file.Close()
+	}
+	target, path, file = spec, resolved, ns
+
+	logger.Info("Using network namespace", "netns", Describe())
+	return nil
+}
+
+// Resolve returns the path of the namespace file for a target.
+func Resolve(spec string) (string, error) {
+	switch {
+	case strings.HasPrefix(spec, "pid:"):
+		pid, err := strconv.Atoi(strings.TrimPrefix(spec, "pid:"))
+		if err != nil || pid <= 0 {
+			return "", fmt.Errorf("invalid PID in network namespace %q", spec)
+		}
+		return pidNamespace(pid), nil
+	case strings.HasPrefix(spec, "container:"):
+		name := strings.TrimPrefix(spec, "container:")
+		if name == "" {
+			return "", fmt.Errorf("missing container name in network namespace %q", spec)
+		}
+		pid, err := containerPID(name)
+		if err != nil {
+			return "", err
+		}
+		return pidNamespace(pid), nil
+	}
+
+	if !filepath.IsAbs(spec) {
+		return "", fmt.Errorf("network namespace %q must be an absolute path, pid:<pid> or container:<name>", spec)
+	}
+	return spec, nil
+}
+
+func pidNamespace(pid int) string {
+	return fmt.Sprintf("/proc/%d/ns/net", pid)
+}
+
+func containerPID(name string) (int, error) {
+	output, err := exec.Command("docker", "inspect", "-f", "{{.State.Pid}}", name).Output()
+	if err != nil {
+		return 0, fmt.Errorf("failed to inspect container %s: %v", name, err)
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(output)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("container %s is not running", name)
+	}
+	return pid, nil
+}
+
+// Enabled reports whether a network namespace is targeted.
+func Enabled() bool {
+	return file != nil
+}
+
+// Fd returns the descriptor of the targeted namespace for netlink
+// connections, or 0 for the namespace of the process.
+func Fd() int {
+	if file == nil {
+		return 0
+	}
+	return int(file.Fd())
+}
+
+// Describe returns the target and its namespace file, or "" if no namespace
+// is targeted.
+func Describe() string {
+	if file == nil {
+		return ""
+	}
+	if target == path {
+		return path
+	}
+	return fmt.Sprintf("%s (%s)", target, path)
+}
+
+// Do runs fn on a thread switched to the targeted namespace, so commands
+// it executes run there too.
+func Do(fn func() error) error {
+	if file == nil {
+		return fn()
+	}
+
+	runtime.LockOSThread()
+
+	origin, err := os.Open("/proc/thread-self/ns/net")
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to open current network namespace: %v", err)
+	}
+	defer origin.Close()
+
+	if err := unix.Setns(Fd(), unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to enter network namespace %s: %v", path, err)
+	}
+
+	defer func() {
+		if err := unix.Setns(int(origin.Fd()), unix.CLONE_NEWNET); err != nil {
+			// The thread stays locked and exits with the goroutine rather
+			// than being reused in the wrong namespace.
+			logger.Error("Error returning from network namespace", "netns", path, "error", err)
+			return
+		}
+		runtime.UnlockOSThread()
+	}()
+
+	return fn()
+}
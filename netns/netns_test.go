@@ -0,0 +1,58 @@
+package netns
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	testCases := []struct {
+		spec     string
+		expected string
+		valid    bool
+	}{
+		{spec: "/run/netns/xray", expected: "/run/netns/xray", valid: true},
+		{spec: "pid:1234", expected: "/proc/1234/ns/net", valid: true},
+		{spec: "pid:abc", valid: false},
+		{spec: "pid:0", valid: false},
+		{spec: "container:", valid: false},
+		{spec: "run/netns/xray", valid: false},
+	}
+
+	for _, tc := range testCases {
+		path, err := Resolve(tc.spec)
+		if !tc.valid {
+			if err == nil {
+				t.Errorf("Expected error for %q, got %s", tc.spec, path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", tc.spec, err)
+			continue
+		}
+		if path != tc.expected {
+			t.Errorf("Expected %s for %q, got %s", tc.expected, tc.spec, path)
+		}
+	}
+}
+
+func TestDoWithoutNamespace(t *testing.T) {
+	if Enabled() || Fd() != 0 || Describe() != "" {
+		t.Fatal("Expected no namespace to be targeted")
+	}
+
+	expected := errors.New("done")
+	if err := Do(func() error { return expected }); err != expected {
+		t.Errorf("Expected error from fn, got %v", err)
+	}
+}
+
+func TestInitRejectsRegularFile(t *testing.T) {
+	if err := Init("/proc/self/status"); err == nil {
+		t.Error("Expected error for a file that is not a namespace")
+	}
+	if Enabled() {
+		t.Error("Expected no namespace to be targeted after a failed Init")
+	}
+}
@@ -0,0 +1,65 @@
+package parser
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// HysteriaParser parses the request lines of the Hysteria 2 server, e.g.
+//
+//	2024-01-01T00:00:00Z	INFO	TCP request	{"addr": "1.2.3.4:5555", "id": "alice", "reqAddr": "tracker.example:6969"}
+type HysteriaParser struct{}
+
+type hysteriaFields struct {
+	Addr    string `json:"addr"`
+	ID      string `json:"id"`
+	ReqAddr string `json:"reqAddr"`
+}
+
+func NewHysteriaParser() *HysteriaParser {
+	return &HysteriaParser{}
+}
+
+func (p *HysteriaParser) GetName() string {
+	return "hysteria2"
+}
+
+func (p *HysteriaParser) Parse(line string) (Event, bool) {
+	start := strings.IndexByte(line, '{')
+	if start < 0 {
+		return Event{}, false
+	}
+
+	var fields hysteriaFields
+	if err := json.Unmarshal([]byte(line[start:]), &fields); err != nil {
+		return Event{}, false
+	}
+
+	if fields.Addr == "" || fields.ID == "" {
+		return Event{}, false
+	}
+
+	host, _ := splitHostPort(fields.Addr)
+	if !isValidIPFormat(host) {
+		return Event{}, false
+	}
+
+	event := Event{
+		IP:          host,
+		Username:    fields.ID,
+		Destination: fields.ReqAddr,
+	}
+	if tab := strings.IndexAny(line, "\t "); tab > 0 {
+		if ts, err := time.Parse(time.RFC3339Nano, line[:tab]); err == nil {
+			event.Time = ts
+		}
+	}
+	if strings.Contains(line[:start], "TCP ") {
+		event.Network = "tcp"
+	} else if strings.Contains(line[:start], "UDP ") {
+		event.Network = "udp"
+	}
+
+	return event, true
+}
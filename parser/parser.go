@@ -0,0 +1,139 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+type Event struct {
+	IP          string
+	Username    string
+	Network     string
+	Destination string
+	Inbound     string
+	Outbound    string
+	Time        time.Time
+}
+
+type Parser interface {
+	Parse(line string) (Event, bool)
+
+	GetName() string
+}
+
+// StatefulParser is implemented by parsers that correlate several log lines
+// of one connection. Observe is called for lines that do not carry a tag.
+type StatefulParser interface {
+	Parser
+
+	Observe(line string)
+}
+
+func New(name, pattern string) (Parser, error) {
+	switch strings.ToLower(name) {
+	case "", "xray":
+		return NewXrayParser(), nil
+	case "v2fly", "v2ray":
+		return NewV2FlyParser(), nil
+	case "sing-box", "singbox":
+		return NewSingBoxParser(), nil
+	case "hysteria2", "hysteria":
+		return NewHysteriaParser(), nil
+	case "regex":
+		return NewRegexParser(pattern)
+	default:
+		return nil, fmt.Errorf("unknown parser: %s", name)
+	}
+}
+
+func (e Event) Route() string {
+	if e.Inbound == "" && e.Outbound == "" {
+		return ""
+	}
+	return e.Inbound + " -> " + e.Outbound
+}
+
+func indexBytes(haystack, needle []byte) int {
+	if len(needle) == 0 {
+		return 0
+	}
+	if len(needle) > len(haystack) {
+		return -1
+	}
+
+	first := needle[0]
+	for i := 0; i <= len(haystack)-len(needle); i++ {
+		if haystack[i] == first {
+			match := true
+			for j := 1; j < len(needle); j++ {
+				if haystack[i+j] != needle[j] {
+					match = false
+					break
+				}
+			}
+			if match {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func stringToBytes(s string) []byte {
+	return *(*[]byte)(unsafe.Pointer(&struct {
+		string
+		int
+	}{s, len(s)}))
+}
+
+func isValidIPFormat(ip string) bool {
+	parts := strings.Split(ip, ".")
+	if len(parts) != 4 {
+		return false
+	}
+
+	for _, part := range parts {
+		if len(part) == 0 || len(part) > 3 {
+			return false
+		}
+
+		for _, ch := range part {
+			if ch < '0' || ch > '9' {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func splitHostPort(addr string) (host, port string) {
+	if strings.HasPrefix(addr, "[") {
+		if end := strings.Index(addr, "]"); end > 0 {
+			host = addr[1:end]
+			port = strings.TrimPrefix(addr[end+1:], ":")
+			return host, port
+		}
+	}
+
+	colon := strings.LastIndexByte(addr, ':')
+	if colon < 0 {
+		return addr, ""
+	}
+	return addr[:colon], addr[colon+1:]
+}
+
+func parseLeadingTime(line, layout string, fields int) time.Time {
+	parts := strings.SplitN(line, " ", fields+1)
+	if len(parts) < fields {
+		return time.Time{}
+	}
+
+	ts, err := time.ParseInLocation(layout, strings.Join(parts[:fields], " "), time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+	return ts
+}
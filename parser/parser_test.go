@@ -0,0 +1,239 @@
+package parser
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	expectedNames := map[string]string{
+		"":          "xray",
+		"xray":      "xray",
+		"V2Fly":     "v2fly",
+		"sing-box":  "sing-box",
+		"hysteria2": "hysteria2",
+	}
+
+	for name, expected := range expectedNames {
+		p, err := New(name, "")
+		if err != nil {
+			t.Errorf("Failed to create parser %q: %v", name, err)
+			continue
+		}
+		if p.GetName() != expected {
+			t.Errorf("Expected parser name %s for %q, got %s", expected, name, p.GetName())
+		}
+	}
+
+	if _, err := New("unknown", ""); err == nil {
+		t.Error("Expected error for unknown parser")
+	}
+
+	if _, err := New("regex", ""); err == nil {
+		t.Error("Expected error for regex parser without pattern")
+	}
+}
+
+func TestXrayParser(t *testing.T) {
+	p := NewXrayParser()
+
+	testCases := []struct {
+		line     string
+		ip       string
+		username string
+		valid    bool
+	}{
+		{
+			line:     "2025/01/01 00:00:00.123456 from 1.2.3.4:5555 accepted tcp:example.com:443 [in -> TORRENT] email: alice",
+			ip:       "1.2.3.4",
+			username: "alice",
+			valid:    true,
+		},
+		{
+			line:     "2025/01/01 00:00:00 from tcp:10.0.0.1:5555 accepted udp:1.1.1.1:6881 [in -> TORRENT] email: 12.bob",
+			ip:       "10.0.0.1",
+			username: "12.bob",
+			valid:    true,
+		},
+		{line: "2025/01/01 00:00:00 from 1.2.3.4:5555 accepted tcp:example.com:443 [in -> TORRENT]", valid: false},
+		{line: "2025/01/01 00:00:00 from example:5555 accepted tcp:example.com:443 email: alice", valid: false},
+		{line: "garbage", valid: false},
+	}
+
+	for _, tc := range testCases {
+		event, valid := p.Parse(tc.line)
+		if valid != tc.valid {
+			t.Errorf("Expected valid=%v for %q", tc.valid, tc.line)
+			continue
+		}
+		if valid && (event.IP != tc.ip || event.Username != tc.username) {
+			t.Errorf("Unexpected event %+v for %q", event, tc.line)
+		}
+	}
+}
+
+func TestV2FlyParser(t *testing.T) {
+	p := NewV2FlyParser()
+
+	event, valid := p.Parse("2025/01/01 00:00:00 1.2.3.4:5555 accepted tcp:example.com:443 [in >> TORRENT] email: alice")
+	if !valid || event.IP != "1.2.3.4" || event.Username != "alice" {
+		t.Errorf("Unexpected event %+v, valid=%v", event, valid)
+	}
+
+	if _, valid := p.Parse("2025/01/01 00:00:00 1.2.3.4:5555 rejected  proxy/vmess: invalid user"); valid {
+		t.Error("Expected rejected line to be invalid")
+	}
+}
+
+func TestSingBoxParser(t *testing.T) {
+	p := NewSingBoxParser()
+
+	lines := []string{
+		"+0000 2025-01-01 00:00:00 INFO [3547182873 0ms] inbound/vless[vless-in]: [alice] inbound connection from 1.2.3.4:5555",
+		"+0000 2025-01-01 00:00:00 INFO [3547182873 0ms] inbound/vless[vless-in]: [alice] inbound connection to tracker.example:6969",
+		"+0000 2025-01-01 00:00:00 INFO [1111 0ms] inbound/vless[vless-in]: [carol] inbound connection from 9.9.9.9:1000",
+	}
+	for _, line := range lines {
+		p.Observe(line)
+	}
+
+	event, valid := p.Parse("+0000 2025-01-01 00:00:00 INFO [3547182873 1ms] outbound/block[TORRENT]: blocked connection to tracker.example:6969")
+	if !valid {
+		t.Fatal("Expected outbound line to complete the event")
+	}
+
+	expected := Event{
+		IP:          "1.2.3.4",
+		Username:    "alice",
+		Network:     "tcp",
+		Destination: "tracker.example:6969",
+		Inbound:     "vless-in",
+		Outbound:    "TORRENT",
+		Time:        time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	if !event.Time.Equal(expected.Time) {
+		t.Errorf("Expected time %v, got %v", expected.Time, event.Time)
+	}
+	event.Time = expected.Time
+	if event != expected {
+		t.Errorf("Expected %+v, got %+v", expected, event)
+	}
+
+	if _, valid := p.Parse("+0000 2025-01-01 00:00:00 INFO [3547182873 2ms] outbound/block[TORRENT]: blocked connection to tracker.example:6969"); valid {
+		t.Error("Expected connection state to be consumed")
+	}
+
+	if _, valid := p.Parse("+0000 2025-01-01 00:00:00 INFO [2222 1ms] outbound/block[TORRENT]: blocked connection to x:1"); valid {
+		t.Error("Expected unknown connection to be invalid")
+	}
+}
+
+func TestHysteriaParser(t *testing.T) {
+	p := NewHysteriaParser()
+
+	event, valid := p.Parse(`2025-01-01T00:00:00Z	INFO	TCP request	{"addr": "1.2.3.4:5555", "id": "alice", "reqAddr": "tracker.example:6969"}`)
+	if !valid || event.IP != "1.2.3.4" || event.Username != "alice" || event.Destination != "tracker.example:6969" || event.Network != "tcp" {
+		t.Errorf("Unexpected event %+v, valid=%v", event, valid)
+	}
+
+	if !event.Time.Equal(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected event time %v", event.Time)
+	}
+
+	if _, valid := p.Parse(`2025-01-01T00:00:00Z	INFO	server up and running	{"listen": ":443"}`); valid {
+		t.Error("Expected line without addr and id to be invalid")
+	}
+}
+
+func TestRegexParser(t *testing.T) {
+	p, err := NewRegexParser(`client=(?P<ip>[\d.]+):\d+ user=(?P<user>\S+) in=(?P<inbound>\S+) out=(?P<tag>\S+) to=(?P<dest>\S+)`)
+	if err != nil {
+		t.Fatalf("Failed to create regex parser: %v", err)
+	}
+
+	event, valid := p.Parse("panel: client=1.2.3.4:5555 user=alice in=public out=TORRENT to=tracker.example:6969")
+	expected := Event{
+		IP:          "1.2.3.4",
+		Username:    "alice",
+		Destination: "tracker.example:6969",
+		Inbound:     "public",
+		Outbound:    "TORRENT",
+	}
+	if !valid || event != expected {
+		t.Errorf("Expected %+v, got %+v (valid=%v)", expected, event, valid)
+	}
+
+	if _, valid := p.Parse("panel: nothing"); valid {
+		t.Error("Expected non-matching line to be invalid")
+	}
+
+	if _, err := NewRegexParser(`(?P<ip>\S+)`); err == nil {
+		t.Error("Expected error for pattern without user group")
+	}
+
+	if _, err := NewRegexParser(`(?P<ip>[`); err == nil {
+		t.Error("Expected error for invalid pattern")
+	}
+}
+
+func TestXrayParserRoutingDetails(t *testing.T) {
+	testCases := []struct {
+		parser   Parser
+		line     string
+		expected Event
+	}{
+		{
+			parser: NewXrayParser(),
+			line:   "2025/01/01 00:00:00.123456 from 1.2.3.4:5555 accepted udp:tracker.example:6969 [vless-in -> TORRENT] email: alice",
+			expected: Event{
+				IP:          "1.2.3.4",
+				Username:    "alice",
+				Network:     "udp",
+				Destination: "tracker.example:6969",
+				Inbound:     "vless-in",
+				Outbound:    "TORRENT",
+				Time:        time.Date(2025, 1, 1, 0, 0, 0, 123456000, time.Local),
+			},
+		},
+		{
+			parser: NewXrayParser(),
+			line:   "2025/01/01 00:00:00 from 1.2.3.4:5555 accepted tcp:[2001:db8::1]:443 [in] email: alice",
+			expected: Event{
+				IP:          "1.2.3.4",
+				Username:    "alice",
+				Network:     "tcp",
+				Destination: "[2001:db8::1]:443",
+				Inbound:     "in",
+				Time:        time.Date(2025, 1, 1, 0, 0, 0, 0, time.Local),
+			},
+		},
+		{
+			parser: NewV2FlyParser(),
+			line:   "2025/01/01 00:00:00 1.2.3.4:5555 accepted tcp:example.com:443 [in >> direct] email: alice",
+			expected: Event{
+				IP:          "1.2.3.4",
+				Username:    "alice",
+				Network:     "tcp",
+				Destination: "example.com:443",
+				Inbound:     "in",
+				Outbound:    "direct",
+				Time:        time.Date(2025, 1, 1, 0, 0, 0, 0, time.Local),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		event, valid := tc.parser.Parse(tc.line)
+		if !valid || event != tc.expected {
+			t.Errorf("Expected %+v, got %+v (valid=%v) for %q", tc.expected, event, valid, tc.line)
+		}
+	}
+
+	if event, valid := NewXrayParser().Parse("from 1.2.3.4:5555 accepted tcp:x:1 [in -> out] email: alice"); !valid || !event.Time.IsZero() {
+		t.Errorf("Expected zero time for line without timestamp, got %v", event.Time)
+	}
+
+	if route := (Event{Inbound: "in", Outbound: "TORRENT"}).Route(); route != "in -> TORRENT" {
+		t.Errorf("Unexpected route: %s", route)
+	}
+}
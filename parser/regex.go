@@ -0,0 +1,72 @@
+package parser
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// RegexParser extracts fields from named groups: ip and user are required,
+// dest, inbound and tag are optional.
+type RegexParser struct {
+	pattern *regexp.Regexp
+	groups  map[string]int
+}
+
+func NewRegexParser(pattern string) (*RegexParser, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("regex parser requires a pattern")
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid parser pattern: %v", err)
+	}
+
+	groups := make(map[string]int)
+	for i, name := range re.SubexpNames() {
+		if name != "" {
+			groups[name] = i
+		}
+	}
+
+	for _, required := range []string{"ip", "user"} {
+		if _, exists := groups[required]; !exists {
+			return nil, fmt.Errorf("parser pattern must contain named group (?P<%s>...)", required)
+		}
+	}
+
+	return &RegexParser{pattern: re, groups: groups}, nil
+}
+
+func (p *RegexParser) GetName() string {
+	return "regex"
+}
+
+func (p *RegexParser) Parse(line string) (Event, bool) {
+	matches := p.pattern.FindStringSubmatch(line)
+	if matches == nil {
+		return Event{}, false
+	}
+
+	event := Event{
+		IP:          p.group(matches, "ip"),
+		Username:    p.group(matches, "user"),
+		Destination: p.group(matches, "dest"),
+		Inbound:     p.group(matches, "inbound"),
+		Outbound:    p.group(matches, "tag"),
+	}
+
+	if event.Username == "" || !isValidIPFormat(event.IP) {
+		return Event{}, false
+	}
+
+	return event, true
+}
+
+func (p *RegexParser) group(matches []string, name string) string {
+	index, exists := p.groups[name]
+	if !exists {
+		return ""
+	}
+	return matches[index]
+}
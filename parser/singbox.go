@@ -0,0 +1,151 @@
+package parser
+
+import (
+	"strings"
+	"sync"
+)
+
+const maxSingBoxConnections = 65536
+
+type singBoxConnection struct {
+	ip          string
+	username    string
+	inbound     string
+	network     string
+	destination string
+}
+
+// SingBoxParser correlates the inbound, routing and outbound lines that
+// sing-box writes for one connection using the connection id, e.g.
+//
+//	INFO [3547182873 0ms] inbound/vless[vless-in]: [alice] inbound connection from 1.2.3.4:5555
+//	INFO [3547182873 0ms] inbound/vless[vless-in]: [alice] inbound connection to tracker.example:6969
+//	INFO [3547182873 1ms] outbound/block[TORRENT]: blocked connection to tracker.example:6969
+type SingBoxParser struct {
+	mu          sync.Mutex
+	connections map[string]*singBoxConnection
+}
+
+func NewSingBoxParser() *SingBoxParser {
+	return &SingBoxParser{
+		connections: make(map[string]*singBoxConnection),
+	}
+}
+
+func (p *SingBoxParser) GetName() string {
+	return "sing-box"
+}
+
+func (p *SingBoxParser) Observe(line string) {
+	p.Parse(line)
+}
+
+func (p *SingBoxParser) Parse(line string) (Event, bool) {
+	id, rest, ok := singBoxConnectionID(line)
+	if !ok {
+		return Event{}, false
+	}
+
+	component, message, ok := strings.Cut(rest, ": ")
+	if !ok {
+		return Event{}, false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch {
+	case strings.HasPrefix(component, "inbound/"):
+		conn := p.connection(id)
+		conn.inbound = bracketValue(component)
+
+		if strings.HasPrefix(message, "[") {
+			if end := strings.IndexByte(message, ']'); end > 0 {
+				conn.username = message[1:end]
+				message = strings.TrimPrefix(message[end+1:], " ")
+			}
+		}
+
+		if addr, found := strings.CutPrefix(message, "inbound connection from "); found {
+			host, _ := splitHostPort(addr)
+			conn.ip = host
+		} else if addr, found := strings.CutPrefix(message, "inbound connection to "); found {
+			conn.network = "tcp"
+			conn.destination = addr
+		} else if addr, found := strings.CutPrefix(message, "inbound packet connection to "); found {
+			conn.network = "udp"
+			conn.destination = addr
+		}
+		return Event{}, false
+
+	case strings.HasPrefix(component, "outbound/"):
+		conn, exists := p.connections[id]
+		if !exists || conn.ip == "" || conn.username == "" {
+			return Event{}, false
+		}
+		delete(p.connections, id)
+
+		event := Event{
+			IP:          conn.ip,
+			Username:    conn.username,
+			Network:     conn.network,
+			Destination: conn.destination,
+			Inbound:     conn.inbound,
+			Outbound:    bracketValue(component),
+			Time:        parseLeadingTime(line, "-0700 2006-01-02 15:04:05", 3),
+		}
+		if i := strings.LastIndex(message, " to "); i >= 0 && event.Destination == "" {
+			event.Destination = message[i+4:]
+		}
+		return event, true
+	}
+
+	return Event{}, false
+}
+
+func (p *SingBoxParser) connection(id string) *singBoxConnection {
+	conn, exists := p.connections[id]
+	if exists {
+		return conn
+	}
+
+	if len(p.connections) >= maxSingBoxConnections {
+		for key := range p.connections {
+			delete(p.connections, key)
+			break
+		}
+	}
+
+	conn = &singBoxConnection{}
+	p.connections[id] = conn
+	return conn
+}
+
+func singBoxConnectionID(line string) (id, rest string, ok bool) {
+	start := strings.IndexByte(line, '[')
+	if start < 0 {
+		return "", "", false
+	}
+
+	end := strings.IndexByte(line[start:], ']')
+	if end < 0 {
+		return "", "", false
+	}
+	end += start
+
+	fields := strings.Fields(line[start+1 : end])
+	if len(fields) == 0 {
+		return "", "", false
+	}
+
+	return fields[0], strings.TrimPrefix(line[end+1:], " "), true
+}
+
+func bracketValue(component string) string {
+	start := strings.IndexByte(component, '[')
+	end := strings.LastIndexByte(component, ']')
+	if start < 0 || end <= start {
+		return ""
+	}
+	return component[start+1 : end]
+}
@@ -0,0 +1,104 @@
+package parser
+
+import "bytes"
+
+// TagMatcher finds all tags occurring in a line in a single pass using an
+// Aho-Corasick automaton. A single tag is matched with bytes.Contains.
+type TagMatcher struct {
+	patterns [][]byte
+	next     [][256]int32
+	output   [][]int
+}
+
+// NewTagMatcher builds the automaton for the patterns. Empty patterns never
+// match.
+func NewTagMatcher(patterns [][]byte) *TagMatcher {
+	m := &TagMatcher{patterns: patterns}
+	if len(patterns) <= 1 {
+		return m
+	}
+
+	m.next = make([][256]int32, 1)
+	m.output = make([][]int, 1)
+
+	for i, pattern := range patterns {
+		if len(pattern) == 0 {
+			continue
+		}
+
+		state := int32(0)
+		for _, b := range pattern {
+			if m.next[state][b] == 0 {
+				m.next = append(m.next, [256]int32{})
+				m.output = append(m.output, nil)
+				m.next[state][b] = int32(len(m.next) - 1)
+			}
+			state = m.next[state][b]
+		}
+		m.output[state] = append(m.output[state], i)
+	}
+
+	fail := make([]int32, len(m.next))
+	var queue []int32
+	for b := 0; b < 256; b++ {
+		if child := m.next[0][b]; child != 0 {
+			queue = append(queue, child)
+		}
+	}
+
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+
+		m.output[state] = append(m.output[state], m.output[fail[state]]...)
+
+		for b := 0; b < 256; b++ {
+			if child := m.next[state][b]; child != 0 {
+				fail[child] = m.next[fail[state]][b]
+				queue = append(queue, child)
+			} else {
+				m.next[state][b] = m.next[fail[state]][b]
+			}
+		}
+	}
+
+	return m
+}
+
+// Match returns the indices of the patterns found in text, in pattern order.
+// It only allocates when something matches.
+func (m *TagMatcher) Match(text []byte) []int {
+	if m == nil || len(m.patterns) == 0 {
+		return nil
+	}
+	if m.next == nil {
+		if len(m.patterns[0]) > 0 && bytes.Contains(text, m.patterns[0]) {
+			return []int{0}
+		}
+		return nil
+	}
+
+	var found []int
+	state := int32(0)
+	for _, b := range text {
+		state = m.next[state][b]
+		for _, index := range m.output[state] {
+			found = insertIndex(found, index)
+		}
+	}
+	return found
+}
+
+func insertIndex(indices []int, index int) []int {
+	pos := 0
+	for pos < len(indices) && indices[pos] < index {
+		pos++
+	}
+	if pos < len(indices) && indices[pos] == index {
+		return indices
+	}
+	indices = append(indices, 0)
+	copy(indices[pos+1:], indices[pos:])
+	indices[pos] = index
+	return indices
+}
@@ -0,0 +1,47 @@
+package parser
+
+import "testing"
+
+func TestTagMatcher(t *testing.T) {
+	matcher := NewTagMatcher([][]byte{[]byte("SPAM"), []byte("SPAMMER"), []byte("AM"), []byte("SCAN")})
+
+	testCases := []struct {
+		line     string
+		expected []int
+	}{
+		{line: "[in -> SPAMMER]", expected: []int{0, 1, 2}},
+		{line: "[in -> SCAN] email: spam", expected: []int{3}},
+		{line: "[in -> SCA] email: SPA", expected: nil},
+		{line: "SCANSPAM", expected: []int{0, 2, 3}},
+	}
+
+	for _, tc := range testCases {
+		found := matcher.Match([]byte(tc.line))
+		if len(found) != len(tc.expected) {
+			t.Errorf("%q: expected %v, got %v", tc.line, tc.expected, found)
+			continue
+		}
+		for i := range found {
+			if found[i] != tc.expected[i] {
+				t.Errorf("%q: expected %v, got %v", tc.line, tc.expected, found)
+				break
+			}
+		}
+	}
+
+	single := NewTagMatcher([][]byte{[]byte("TORRENT")})
+	if found := single.Match([]byte("[in -> TORRENT]")); len(found) != 1 || found[0] != 0 {
+		t.Errorf("Expected single pattern to match, got %v", found)
+	}
+	if found := single.Match([]byte("[in -> direct]")); found != nil {
+		t.Errorf("Expected no match, got %v", found)
+	}
+
+	empty := NewTagMatcher([][]byte{[]byte("")})
+	if found := empty.Match([]byte("[in -> TORRENT]")); found != nil {
+		t.Errorf("Expected an empty tag to never match, got %v", found)
+	}
+	if found := NewTagMatcher(nil).Match([]byte("[in -> TORRENT]")); found != nil {
+		t.Errorf("Expected no patterns to never match, got %v", found)
+	}
+}
@@ -0,0 +1,41 @@
+package parser
+
+import "strings"
+
+var acceptedBytes = []byte(" accepted ")
+
+type V2FlyParser struct{}
+
+func NewV2FlyParser() *V2FlyParser {
+	return &V2FlyParser{}
+}
+
+func (p *V2FlyParser) GetName() string {
+	return "v2fly"
+}
+
+func (p *V2FlyParser) Parse(line string) (Event, bool) {
+	lineBytes := stringToBytes(line)
+
+	acceptedIndex := indexBytes(lineBytes, acceptedBytes)
+	if acceptedIndex <= 0 {
+		return Event{}, false
+	}
+
+	ipStart := strings.LastIndexByte(line[:acceptedIndex], ' ') + 1
+
+	ip, ok := parseSourceIP(line, ipStart)
+	if !ok {
+		return Event{}, false
+	}
+
+	username, ok := parseEmail(line, lineBytes)
+	if !ok {
+		return Event{}, false
+	}
+
+	event := Event{IP: ip, Username: username, Time: parseLeadingTime(line, xrayTimeLayout, 2)}
+	parseAccepted(line, lineBytes, &event)
+
+	return event, true
+}
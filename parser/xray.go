@@ -0,0 +1,144 @@
+package parser
+
+import "strings"
+
+const xrayTimeLayout = "2006/01/02 15:04:05"
+
+var (
+	fromBytes  = []byte("from ")
+	emailBytes = []byte("email: ")
+)
+
+type XrayParser struct{}
+
+func NewXrayParser() *XrayParser {
+	return &XrayParser{}
+}
+
+func (p *XrayParser) GetName() string {
+	return "xray"
+}
+
+func (p *XrayParser) Parse(line string) (Event, bool) {
+	lineBytes := stringToBytes(line)
+
+	fromIndex := indexBytes(lineBytes, fromBytes)
+	if fromIndex == -1 {
+		return Event{}, false
+	}
+
+	ip, ok := parseSourceIP(line, fromIndex+len(fromBytes))
+	if !ok {
+		return Event{}, false
+	}
+
+	username, ok := parseEmail(line, lineBytes)
+	if !ok {
+		return Event{}, false
+	}
+
+	event := Event{IP: ip, Username: username, Time: parseLeadingTime(line, xrayTimeLayout, 2)}
+	parseAccepted(line, lineBytes, &event)
+
+	return event, true
+}
+
+// parseAccepted fills the network, destination and routing segment from the
+// "accepted tcp:host:port [inbound -> outbound]" part of an access line.
+func parseAccepted(line string, lineBytes []byte, event *Event) {
+	acceptedIndex := indexBytes(lineBytes, acceptedBytes)
+	if acceptedIndex == -1 {
+		return
+	}
+
+	rest := line[acceptedIndex+len(acceptedBytes):]
+	destEnd := strings.IndexByte(rest, ' ')
+	if destEnd == -1 {
+		destEnd = len(rest)
+	}
+
+	destination := rest[:destEnd]
+	if network, address, found := strings.Cut(destination, ":"); found && (network == "tcp" || network == "udp") {
+		event.Network = network
+		destination = address
+	}
+	event.Destination = destination
+
+	rest = rest[destEnd:]
+	segmentStart := strings.IndexByte(rest, '[')
+	if segmentStart == -1 {
+		return
+	}
+	segmentEnd := strings.IndexByte(rest[segmentStart:], ']')
+	if segmentEnd == -1 {
+		return
+	}
+
+	event.Inbound, event.Outbound = splitRoutingSegment(rest[segmentStart+1 : segmentStart+segmentEnd])
+}
+
+func splitRoutingSegment(segment string) (inbound, outbound string) {
+	for _, separator := range []string{" -> ", " >> "} {
+		if in, out, found := strings.Cut(segment, separator); found {
+			return strings.TrimSpace(in), strings.TrimSpace(out)
+		}
+	}
+	return strings.TrimSpace(segment), ""
+}
+
+func parseSourceIP(line string, ipStart int) (string, bool) {
+	if ipStart >= len(line) {
+		return "", false
+	}
+
+	if ipStart+4 < len(line) {
+		if (line[ipStart] == 't' && line[ipStart+1] == 'c' && line[ipStart+2] == 'p' && line[ipStart+3] == ':') ||
+			(line[ipStart] == 'u' && line[ipStart+1] == 'd' && line[ipStart+2] == 'p' && line[ipStart+3] == ':') {
+			ipStart += 4
+		}
+	}
+
+	if ipStart >= len(line) {
+		return "", false
+	}
+
+	ipEnd := ipStart
+	for ipEnd < len(line) && line[ipEnd] != ':' {
+		ipEnd++
+	}
+
+	if ipEnd <= ipStart {
+		return "", false
+	}
+
+	ip := line[ipStart:ipEnd]
+
+	if !isValidIPFormat(ip) {
+		return "", false
+	}
+
+	return ip, true
+}
+
+func parseEmail(line string, lineBytes []byte) (string, bool) {
+	emailIndex := indexBytes(lineBytes, emailBytes)
+	if emailIndex == -1 {
+		return "", false
+	}
+
+	userStart := emailIndex + len(emailBytes)
+	if userStart >= len(line) {
+		return "", false
+	}
+
+	userEnd := userStart
+	for userEnd < len(line) && line[userEnd] != ' ' && line[userEnd] != '\t' && line[userEnd] != '\n' {
+		userEnd++
+	}
+
+	if userEnd <= userStart {
+		return "", false
+	}
+
+	return line[userStart:userEnd], true
+}
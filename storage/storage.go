@@ -8,17 +8,72 @@ import (
 	"time"
 )
 
+// Kinds of storage entries. Entries saved without a kind are blocks.
+const (
+	KindBlock = "block"
+	KindBan   = "ban"
+	KindAllow = "allow"
+)
+
+// BlockedIP is a storage entry. Blocks expire at BlockedUntil, bans have a
+// zero BlockedUntil and never expire, and allow entries exempt an IP or a
+// user from detection until BlockedUntil. Origin names the peer a block was
+// mirrored from and is empty for entries created on this node.
 type BlockedIP struct {
 	IP           string    `json:"ip"`
 	Username     string    `json:"username"`
 	BlockedUntil time.Time `json:"blocked_until"`
+	Kind         string    `json:"kind,omitempty"`
+	Author       string    `json:"author,omitempty"`
+	CreatedAt    time.Time `json:"created_at,omitzero"`
+	Origin       string    `json:"origin,omitempty"`
+	Source       string    `json:"source,omitempty"`
+	Network      string    `json:"network,omitempty"`
+	Destination  string    `json:"destination,omitempty"`
+	Inbound      string    `json:"inbound,omitempty"`
+	Outbound     string    `json:"outbound,omitempty"`
+	Reason       string    `json:"reason,omitempty"`
+	Action       string    `json:"action,omitempty"`
+	GroupID      string    `json:"group_id,omitempty"`
+}
+
+// GetKind returns the kind of the entry.
+func (b BlockedIP) GetKind() string {
+	if b.Kind == "" {
+		return KindBlock
+	}
+	return b.Kind
+}
+
+// Permanent reports whether the entry never expires.
+func (b BlockedIP) Permanent() bool {
+	return b.BlockedUntil.IsZero()
+}
+
+// Active reports whether the entry is in effect at the given time.
+func (b BlockedIP) Active(now time.Time) bool {
+	return b.Permanent() || now.Before(b.BlockedUntil)
+}
+
+// UserKeyPrefix marks allow keys that name a user rather than an IP.
+const UserKeyPrefix = "user:"
+
+// AllowKey returns the key of an allow entry: its IP, or the username
+// prefixed with "user:" for entries that allow a user on any IP.
+func AllowKey(entry BlockedIP) string {
+	if entry.IP != "" {
+		return entry.IP
+	}
+	return UserKeyPrefix + entry.Username
 }
 
 type IPStorage struct {
-	filepath  string
-	mu        sync.RWMutex
-	ips       map[string]BlockedIP
-	onUnblock func(ip string, delay time.Duration, username string)
+	filepath      string
+	allowFilepath string
+	mu            sync.RWMutex
+	ips           map[string]BlockedIP
+	allows        map[string]BlockedIP
+	onUnblock     func(ip string, delay time.Duration, username string)
 }
 
 func NewIPStorage(storageDir string, unblockFunc func(ip string, delay time.Duration, username string)) (*IPStorage, error) {
@@ -27,14 +82,19 @@ func NewIPStorage(storageDir string, unblockFunc func(ip string, delay time.Dura
 	}
 
 	storage := &IPStorage{
-		filepath:  filepath.Join(storageDir, "blocked_ips.json"),
-		ips:       make(map[string]BlockedIP),
-		onUnblock: unblockFunc,
+		filepath:      filepath.Join(storageDir, "blocked_ips.json"),
+		allowFilepath: filepath.Join(storageDir, "allowed.json"),
+		ips:           make(map[string]BlockedIP),
+		allows:        make(map[string]BlockedIP),
+		onUnblock:     unblockFunc,
 	}
 
 	if err := storage.load(); err != nil && !os.IsNotExist(err) {
 		return nil, err
 	}
+	if err := storage.loadAllows(); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
 
 	storage.initializeUnblocks()
 
@@ -47,6 +107,9 @@ func (s *IPStorage) initializeUnblocks() {
 	now := time.Now()
 	s.mu.RLock()
 	for ip, info := range s.ips {
+		if info.Permanent() {
+			continue
+		}
 		if now.Before(info.BlockedUntil) {
 			delay := info.BlockedUntil.Sub(now)
 			go s.onUnblock(ip, delay, info.Username)
@@ -69,6 +132,18 @@ func (s *IPStorage) load() error {
 	return json.Unmarshal(data, &s.ips)
 }
 
+func (s *IPStorage) loadAllows() error {
+	data, err := os.ReadFile(s.allowFilepath)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return json.Unmarshal(data, &s.allows)
+}
+
 func (s *IPStorage) save() error {
 	s.mu.RLock()
 	data, err := json.MarshalIndent(s.ips, "", "  ")
@@ -81,22 +156,102 @@ func (s *IPStorage) save() error {
 	return os.WriteFile(s.filepath, data, 0644)
 }
 
-func (s *IPStorage) AddBlockedIP(ip, username string, duration time.Duration) error {
-	blockedUntil := time.Now().Add(duration)
+func (s *IPStorage) saveAllows() error {
+	s.mu.RLock()
+	data, err := json.MarshalIndent(s.allows, "", "  ")
+	s.mu.RUnlock()
 
-	s.mu.Lock()
-	s.ips[ip] = BlockedIP{
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(s.allowFilepath, data, 0644)
+}
+
+func (s *IPStorage) AddBlockedIP(ip, username string, duration time.Duration) error {
+	return s.AddBlockedEntry(BlockedIP{
 		IP:           ip,
 		Username:     username,
-		BlockedUntil: blockedUntil,
+		BlockedUntil: time.Now().Add(duration),
+	})
+}
+
+func (s *IPStorage) AddBlockedEntry(entry BlockedIP) error {
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now()
 	}
+
+	s.mu.Lock()
+	s.ips[entry.IP] = entry
 	s.mu.Unlock()
 
-	go s.onUnblock(ip, duration, username)
+	if !entry.Permanent() {
+		go s.onUnblock(entry.IP, time.Until(entry.BlockedUntil), entry.Username)
+	}
 
 	return s.save()
 }
 
+// AddAllowEntry stores an allow entry, replacing one with the same key.
+func (s *IPStorage) AddAllowEntry(entry BlockedIP) error {
+	entry.Kind = KindAllow
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now()
+	}
+
+	s.mu.Lock()
+	s.allows[AllowKey(entry)] = entry
+	s.mu.Unlock()
+
+	return s.saveAllows()
+}
+
+// RemoveAllowEntry removes the allow entry with the given key and reports
+// whether it existed.
+func (s *IPStorage) RemoveAllowEntry(key string) (bool, error) {
+	s.mu.Lock()
+	_, exists := s.allows[key]
+	delete(s.allows, key)
+	s.mu.Unlock()
+
+	if !exists {
+		return false, nil
+	}
+	return true, s.saveAllows()
+}
+
+// FindAllow returns the active allow entry for the IP or for any of the
+// names of the user.
+func (s *IPStorage) FindAllow(ip string, usernames []string, now time.Time) (BlockedIP, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := []string{ip}
+	for _, username := range usernames {
+		if username != "" {
+			keys = append(keys, UserKeyPrefix+username)
+		}
+	}
+	for _, key := range keys {
+		if entry, exists := s.allows[key]; exists && entry.Active(now) {
+			return entry, true
+		}
+	}
+	return BlockedIP{}, false
+}
+
+func (s *IPStorage) GetAllowEntries() map[string]BlockedIP {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make(map[string]BlockedIP, len(s.allows))
+	for k, v := range s.allows {
+		result[k] = v
+	}
+
+	return result
+}
+
 func (s *IPStorage) RemoveBlockedIP(ip string) error {
 	s.mu.Lock()
 	delete(s.ips, ip)
@@ -114,11 +269,7 @@ func (s *IPStorage) IsBlocked(ip string) bool {
 		return false
 	}
 
-	if time.Now().After(blocked.BlockedUntil) {
-		return false
-	}
-
-	return true
+	return blocked.Active(time.Now())
 }
 
 func (s *IPStorage) GetBlockedIPs() map[string]BlockedIP {
@@ -146,7 +297,7 @@ func (s *IPStorage) cleanupRoutine() {
 
 		s.mu.RLock()
 		for ip, blocked := range s.ips {
-			if now.After(blocked.BlockedUntil) {
+			if !blocked.Active(now) {
 				ipsToCheck = append(ipsToCheck, struct {
 					ip       string
 					username string
@@ -158,5 +309,23 @@ func (s *IPStorage) cleanupRoutine() {
 		for _, item := range ipsToCheck {
 			go s.onUnblock(item.ip, 0, item.username)
 		}
+
+		s.pruneAllows(now)
+	}
+}
+
+func (s *IPStorage) pruneAllows(now time.Time) {
+	s.mu.Lock()
+	pruned := false
+	for key, entry := range s.allows {
+		if !entry.Active(now) {
+			delete(s.allows, key)
+			pruned = true
+		}
+	}
+	s.mu.Unlock()
+
+	if pruned {
+		s.saveAllows()
 	}
 }
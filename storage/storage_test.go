@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 )
@@ -234,3 +235,119 @@ func TestConcurrentAccess(t *testing.T) {
 		t.Errorf("Expected 10 blocked IPs, got %d", len(blockedIPs))
 	}
 }
+
+func TestAddBlockedEntryWithSource(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "storage_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	unblockFunc := func(ip string, delay time.Duration, username string) {
+	}
+
+	storage, err := NewIPStorage(tempDir, unblockFunc)
+	if err != nil {
+		t.Fatalf("Failed to create IP storage: %v", err)
+	}
+
+	err = storage.AddBlockedEntry(BlockedIP{
+		IP:           "192.168.1.100",
+		Username:     "testuser",
+		BlockedUntil: time.Now().Add(10 * time.Minute),
+		Source:       "xray-main",
+		Network:      "udp",
+		Destination:  "tracker.example:6969",
+		Inbound:      "vless-in",
+		Outbound:     "TORRENT",
+	})
+	if err != nil {
+		t.Fatalf("Failed to add blocked entry: %v", err)
+	}
+
+	reloaded, err := NewIPStorage(tempDir, unblockFunc)
+	if err != nil {
+		t.Fatalf("Failed to reload IP storage: %v", err)
+	}
+
+	blockedIP, exists := reloaded.GetBlockedIPs()["192.168.1.100"]
+	if !exists {
+		t.Fatal("Blocked IP not found after reload")
+	}
+
+	if blockedIP.Source != "xray-main" {
+		t.Errorf("Expected source 'xray-main', got '%s'", blockedIP.Source)
+	}
+
+	if blockedIP.Destination != "tracker.example:6969" || blockedIP.Network != "udp" {
+		t.Errorf("Unexpected destination %s:%s", blockedIP.Network, blockedIP.Destination)
+	}
+
+	if blockedIP.Inbound != "vless-in" || blockedIP.Outbound != "TORRENT" {
+		t.Errorf("Unexpected route %s -> %s", blockedIP.Inbound, blockedIP.Outbound)
+	}
+}
+
+func TestEntryKinds(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "storage_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	var scheduled []string
+	var mu sync.Mutex
+	unblockFunc := func(ip string, delay time.Duration, username string) {
+		mu.Lock()
+		scheduled = append(scheduled, ip)
+		mu.Unlock()
+	}
+
+	storage, err := NewIPStorage(tempDir, unblockFunc)
+	if err != nil {
+		t.Fatalf("Failed to create IP storage: %v", err)
+	}
+
+	if err := storage.AddBlockedEntry(BlockedIP{IP: "10.0.0.1", Kind: KindBan, Author: "admin", Reason: "abuse"}); err != nil {
+		t.Fatalf("Failed to add ban: %v", err)
+	}
+	now := time.Now()
+	if err := storage.AddAllowEntry(BlockedIP{Username: "bob", BlockedUntil: now.Add(time.Hour), Reason: "false positive"}); err != nil {
+		t.Fatalf("Failed to add allow entry: %v", err)
+	}
+	if err := storage.AddAllowEntry(BlockedIP{IP: "10.0.0.2", BlockedUntil: now.Add(-time.Minute)}); err != nil {
+		t.Fatalf("Failed to add allow entry: %v", err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	mu.Lock()
+	if len(scheduled) != 0 {
+		t.Errorf("Expected no unblock to be scheduled for a ban, got %v", scheduled)
+	}
+	mu.Unlock()
+
+	if !storage.IsBlocked("10.0.0.1") {
+		t.Error("Expected banned IP to be blocked")
+	}
+	if _, allowed := storage.FindAllow("10.0.0.9", []string{"1.bob", "bob"}, now); !allowed {
+		t.Error("Expected user bob to be allowed")
+	}
+	if _, allowed := storage.FindAllow("10.0.0.2", nil, now); allowed {
+		t.Error("Expected expired allow entry to be ignored")
+	}
+
+	storage.pruneAllows(now)
+	reloaded, err := NewIPStorage(tempDir, unblockFunc)
+	if err != nil {
+		t.Fatalf("Failed to reload storage: %v", err)
+	}
+
+	ban := reloaded.GetBlockedIPs()["10.0.0.1"]
+	if ban.GetKind() != KindBan || !ban.Permanent() || ban.Author != "admin" || ban.CreatedAt.IsZero() {
+		t.Errorf("Unexpected reloaded ban: %+v", ban)
+	}
+	allows := reloaded.GetAllowEntries()
+	if len(allows) != 1 || allows["user:bob"].Reason != "false positive" || allows["user:bob"].Kind != KindAllow {
+		t.Errorf("Unexpected reloaded allow entries: %+v", allows)
+	}
+}
@@ -0,0 +1,76 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if sent, err := Notify("READY=1"); sent || err != nil {
+		t.Errorf("Expected nothing to be sent without NOTIFY_SOCKET, got %v, %v", sent, err)
+	}
+
+	tempDir, err := os.MkdirTemp("", "notify_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	socket := filepath.Join(tempDir, "notify.sock")
+	listener, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("Failed to listen on %s: %v", socket, err)
+	}
+	defer listener.Close()
+
+	t.Setenv("NOTIFY_SOCKET", socket)
+	if sent, err := Notify("READY=1\nSTATUS=Running"); !sent || err != nil {
+		t.Fatalf("Expected notification to be sent, got %v, %v", sent, err)
+	}
+
+	buf := make([]byte, 256)
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := listener.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read notification: %v", err)
+	}
+	if string(buf[:n]) != "READY=1\nSTATUS=Running" {
+		t.Errorf("Unexpected notification %q", buf[:n])
+	}
+}
+
+func TestWatchdogTimeout(t *testing.T) {
+	testCases := []struct {
+		usec     string
+		pid      string
+		expected time.Duration
+		valid    bool
+	}{
+		{usec: "", expected: 0, valid: true},
+		{usec: "60000000", expected: time.Minute, valid: true},
+		{usec: "60000000", pid: strconv.Itoa(os.Getpid()), expected: time.Minute, valid: true},
+		{usec: "60000000", pid: "1", expected: 0, valid: true},
+		{usec: "abc", valid: false},
+	}
+
+	for _, tc := range testCases {
+		t.Setenv("WATCHDOG_USEC", tc.usec)
+		t.Setenv("WATCHDOG_PID", tc.pid)
+
+		timeout, err := WatchdogTimeout()
+		if !tc.valid {
+			if err == nil {
+				t.Errorf("Expected error for WATCHDOG_USEC %q", tc.usec)
+			}
+			continue
+		}
+		if err != nil || timeout != tc.expected {
+			t.Errorf("Expected %v for WATCHDOG_USEC %q and WATCHDOG_PID %q, got %v, %v", tc.expected, tc.usec, tc.pid, timeout, err)
+		}
+	}
+}
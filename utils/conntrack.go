@@ -1,54 +1,187 @@
 package utils
 
 import (
+	"encoding/binary"
 	"fmt"
-	"log"
-	"net"
 	"net/netip"
+	"os"
 	"os/exec"
-	"strings"
-
+	"sync"
+	"sync/atomic"
+	"tblocker/config"
+	"tblocker/logging"
+	"tblocker/netns"
+	"time"
+
+	"github.com/mdlayher/netlink"
 	"github.com/ti-mo/conntrack"
+	"github.com/ti-mo/netfilter"
+)
+
+const (
+	conntrackBatchDelay = 100 * time.Millisecond
+	conntrackBatchSize  = 256
+	// conntrackFilteredDumps is the largest batch dumped with one filtered
+	// dump per address and direction, larger batches dump the table once.
+	conntrackFilteredDumps = 4
+)
+
+// Netlink attributes for dumps filtered by the kernel, which the conntrack
+// package does not expose. Tuple filters need Linux 5.8, zone filters 6.1;
+// older kernels ignore them and the flows are matched in matchFlow.
+const (
+	ctnlMsgGet         = 1 // IPCTNL_MSG_CT_GET
+	ctaTupleOrig       = 1
+	ctaTupleIP         = 1
+	ctaIPv4Src         = 1
+	ctaIPv4Dst         = 2
+	ctaIPv6Src         = 3
+	ctaIPv6Dst         = 4
+	ctaMark            = 8
+	ctaZone            = 18
+	ctaMarkMask        = 21
+	ctaFilter          = 25
+	ctaFilterOrigFlags = 1
+	ctaFilterFlagIPSrc = 1 << 0
+	ctaFilterFlagIPDst = 1 << 1
 )
 
 type ConntrackManager struct {
 	available bool
 	conn      *conntrack.Conn
+	// dumpConn sends the filtered dump requests. unfiltered is set once the
+	// kernel returned flows of other addresses, after which whole table
+	// dumps are used, as they are cheaper than one per address.
+	dumpConn   *netfilter.Conn
+	unfiltered atomic.Bool
+
+	batchOnce sync.Once
+	requests  chan conntrackDropRequest
+}
+
+type conntrackDropRequest struct {
+	addr  netip.Addr
+	reply chan conntrackDropResult
+}
+
+type conntrackDropResult struct {
+	dropped int
+	err     error
 }
 
 var conntrackManager *ConntrackManager
 
+var conntrackStats struct {
+	dumps        atomic.Int64
+	flowsScanned atomic.Int64
+	ipsDropped   atomic.Int64
+	flowsDropped atomic.Int64
+}
+
+// Mechanisms used to kill the established connections of a blocked IP.
+const (
+	connectionKillConntrack   = "conntrack"
+	connectionKillSockDestroy = "sock_destroy"
+	connectionKillNone        = "none"
+)
+
+var connectionKill = connectionKillNone
+
+// InitConntrackManager sets up the mechanism for dropping the connections of
+// blocked IPs according to ConntrackMode. Unless conntrack is required, hosts
+// without it fall back to destroying the sockets, so the blocker also runs in
+// containers and with a locked-down module policy.
 func InitConntrackManager() *ConntrackManager {
+	if config.ConntrackMode != "off" {
+		manager, err := newConntrackManager()
+		if err == nil {
+			conntrackManager = manager
+			connectionKill = connectionKillConntrack
+			conntrackLog.Info("Conntrack manager initialized successfully via netlink", "mode", config.ConntrackMode)
+			return manager
+		}
+		if config.ConntrackMode == "required" {
+			logging.Fatal(conntrackLog, "Conntrack is required but unavailable, please ensure proper kernel support and permissions", "error", err)
+		}
+		conntrackLog.Warn("Conntrack is unavailable, continuing without it", "error", err)
+	} else {
+		conntrackLog.Info("Conntrack is disabled by ConntrackMode")
+	}
+
+	if err := socketDestroyAvailable(); err != nil {
+		conntrackLog.Warn("Established connections of blocked IPs will not be dropped", "error", err)
+	} else {
+		connectionKill = connectionKillSockDestroy
+	}
+
+	conntrackLog.Info("Dropping connections of blocked IPs", "mechanism", connectionKill, "mode", config.ConntrackMode)
+	return nil
+}
+
+func newConntrackManager() (*ConntrackManager, error) {
 	manager := &ConntrackManager{}
 
 	if err := manager.ensureKernelModule(); err != nil {
-		log.Fatalf("Error working with nf_conntrack kernel module: %v", err)
+		return nil, fmt.Errorf("error working with nf_conntrack kernel module: %v", err)
 	}
 
-	conn, err := conntrack.Dial(nil)
+	conn, err := conntrack.Dial(&netlink.Config{NetNS: netns.Fd()})
 	if err != nil {
-		log.Fatalf("Failed to connect to conntrack via netlink: %v. Please ensure proper kernel support and permissions.", err)
+		return nil, fmt.Errorf("failed to connect to conntrack via netlink: %v", err)
+	}
+	dumpConn, err := netfilter.Dial(&netlink.Config{NetNS: netns.Fd()})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect to conntrack via netlink: %v", err)
 	}
 
 	manager.available = true
 	manager.conn = conn
-
-	conntrackManager = manager
-	log.Println("Conntrack manager initialized successfully via netlink")
-	return manager
+	manager.dumpConn = dumpConn
+	return manager, nil
 }
 
 func GetConntrackManager() *ConntrackManager {
 	return conntrackManager
 }
 
+// ConnectionKillMechanism returns how connections of blocked IPs are dropped:
+// conntrack, sock_destroy or none.
+func ConnectionKillMechanism() string {
+	return connectionKill
+}
+
+// dropConnections kills the established connections of the IP with the
+// active mechanism and returns how many flows or sockets were dropped.
+func dropConnections(ip string) int {
+	var dropped int
+	var err error
+
+	switch connectionKill {
+	case connectionKillConntrack:
+		dropped, err = conntrackManager.DropConnectionsCount(ip)
+	case connectionKillSockDestroy:
+		dropped, err = destroyIPSockets(ip)
+	default:
+		return 0
+	}
+
+	if err != nil {
+		conntrackLog.Warn("Failed to drop connections", "ip", ip, "error", err)
+	}
+	conntrackStats.ipsDropped.Add(1)
+	conntrackStats.flowsDropped.Add(int64(dropped))
+	conntrackLog.Info("Dropped connections", "ip", ip, "connections", dropped, "mechanism", connectionKill)
+	return dropped
+}
+
 func (cm *ConntrackManager) ensureKernelModule() error {
 	if cm.isModuleLoaded() {
-		log.Println("Kernel module nf_conntrack is already loaded")
+		conntrackLog.Debug("Kernel module nf_conntrack is already loaded")
 		return nil
 	}
 
-	log.Println("Kernel module nf_conntrack not found, attempting to load...")
+	conntrackLog.Info("Kernel module nf_conntrack not found, attempting to load")
 
 	if err := cm.loadModule(); err != nil {
 		return fmt.Errorf("failed to load nf_conntrack module: %v", err)
@@ -58,23 +191,23 @@ func (cm *ConntrackManager) ensureKernelModule() error {
 		return fmt.Errorf("nf_conntrack module failed to load properly")
 	}
 
-	if err := cm.setupAutoload(); err != nil {
-		log.Printf("Warning: failed to setup module autoload: %v", err)
+	// Only a required module is loaded on boot; in optional mode the host
+	// configuration is left alone and the module is loaded on each start.
+	if config.ConntrackMode == "required" {
+		if err := cm.setupAutoload(); err != nil {
+			conntrackLog.Warn("Failed to setup module autoload", "error", err)
+		}
 	}
 
-	log.Println("Kernel module nf_conntrack loaded and configured successfully")
+	conntrackLog.Info("Kernel module nf_conntrack loaded and configured successfully")
 	return nil
 }
 
+// isModuleLoaded checks /sys/module, which unlike lsmod also lists modules
+// built into the kernel and is readable inside containers.
 func (cm *ConntrackManager) isModuleLoaded() bool {
-	cmd := exec.Command("lsmod")
-	output, err := cmd.Output()
-	if err != nil {
-		log.Printf("Warning: failed to check loaded modules: %v", err)
-		return false
-	}
-
-	return strings.Contains(string(output), "nf_conntrack")
+	_, err := os.Stat("/sys/module/nf_conntrack")
+	return err == nil
 }
 
 func (cm *ConntrackManager) loadModule() error {
@@ -86,73 +219,300 @@ func (cm *ConntrackManager) loadModule() error {
 }
 
 func (cm *ConntrackManager) setupAutoload() error {
-	cmd := exec.Command("mkdir", "-p", "/etc/modules-load.d")
-	if err := cmd.Run(); err != nil {
+	if err := os.MkdirAll("/etc/modules-load.d", 0755); err != nil {
 		return fmt.Errorf("failed to create modules-load.d directory: %v", err)
 	}
 
-	cmd = exec.Command("sh", "-c", "echo 'nf_conntrack' > /etc/modules-load.d/conntrack.conf")
-	if err := cmd.Run(); err != nil {
+	if err := os.WriteFile("/etc/modules-load.d/conntrack.conf", []byte("nf_conntrack\n"), 0644); err != nil {
 		return fmt.Errorf("failed to create autoload configuration: %v", err)
 	}
 
-	log.Println("Module autoload configured in /etc/modules-load.d/conntrack.conf")
+	conntrackLog.Info("Module autoload configured", "path", "/etc/modules-load.d/conntrack.conf")
 	return nil
 }
 
 func (cm *ConntrackManager) DropConnections(ip string) error {
+	_, err := cm.DropConnectionsCount(ip)
+	return err
+}
+
+// DropConnectionsCount deletes the conntrack flows of the IP and returns how
+// many were deleted. Concurrent calls are batched into a single table dump.
+func (cm *ConntrackManager) DropConnectionsCount(ip string) (int, error) {
 	if !cm.available || cm.conn == nil {
-		return fmt.Errorf("conntrack is not available")
+		return 0, fmt.Errorf("conntrack is not available")
 	}
 
-	parsedIP := net.ParseIP(ip)
-	if parsedIP == nil {
-		return fmt.Errorf("invalid IP address: %s", ip)
+	addr, err := parseConntrackAddr(ip)
+	if err != nil {
+		return 0, err
 	}
 
-	return cm.dropConnectionsViaLibrary(parsedIP)
+	cm.batchOnce.Do(func() {
+		cm.requests = make(chan conntrackDropRequest, conntrackBatchSize)
+		go cm.batchLoop()
+	})
+
+	reply := make(chan conntrackDropResult, 1)
+	cm.requests <- conntrackDropRequest{addr: addr, reply: reply}
+	result := <-reply
+
+	return result.dropped, result.err
 }
 
-func (cm *ConntrackManager) dropConnectionsViaLibrary(ip net.IP) error {
-	netipAddr, ok := netip.AddrFromSlice(ip)
-	if !ok {
-		return fmt.Errorf("failed to convert IP address: %s", ip.String())
+func (cm *ConntrackManager) batchLoop() {
+	for first := range cm.requests {
+		batch := []conntrackDropRequest{first}
+		timer := time.NewTimer(conntrackBatchDelay)
+
+	collect:
+		for len(batch) < conntrackBatchSize {
+			select {
+			case request := <-cm.requests:
+				batch = append(batch, request)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		counts := make(map[netip.Addr]int, len(batch))
+		for _, request := range batch {
+			counts[request.addr] = 0
+		}
+
+		err := cm.dropFlows(counts)
+		for _, request := range batch {
+			request.reply <- conntrackDropResult{dropped: counts[request.addr], err: err}
+		}
 	}
+}
 
-	flows, err := cm.conn.Dump(nil)
+// dropFlows deletes the flows of all given addresses, counting the deleted
+// flows per address.
+func (cm *ConntrackManager) dropFlows(counts map[netip.Addr]int) error {
+	addrs := make([]netip.Addr, 0, len(counts))
+	for addr := range counts {
+		addrs = append(addrs, addr)
+	}
+	flows, err := cm.dumpFlows(addrs)
 	if err != nil {
-		return fmt.Errorf("failed to dump conntrack table: %v", err)
+		return err
 	}
 
 	for _, flow := range flows {
-		shouldDelete := false
-
-		if flow.TupleOrig.IP.SourceAddress.IsValid() && flow.TupleOrig.IP.SourceAddress == netipAddr {
-			shouldDelete = true
+		addr, matched := matchFlow(flow, counts)
+		if !matched {
+			continue
 		}
 
-		if flow.TupleOrig.IP.DestinationAddress.IsValid() && flow.TupleOrig.IP.DestinationAddress == netipAddr {
-			shouldDelete = true
+		if err := cm.conn.Delete(flow); err != nil {
+			conntrackLog.Warn("Failed to delete connection", "ip", addr.String(), "error", err)
+			continue
 		}
+		counts[addr]++
+	}
+	return nil
+}
+
+// dumpFlows returns the flows of the given addresses. Small batches are
+// filtered by the kernel by address, ConntrackZone and ConntrackMark, with
+// one dump per address and direction. Larger batches and kernels without
+// tuple filters get one dump of the whole table, filtered by zone and mark,
+// and the addresses are matched in matchFlow.
+func (cm *ConntrackManager) dumpFlows(addrs []netip.Addr) ([]conntrack.Flow, error) {
+	if cm.dumpConn == nil || cm.unfiltered.Load() || len(addrs) > conntrackFilteredDumps {
+		return cm.dumpTable()
+	}
 
-		if flow.TupleReply.IP.SourceAddress.IsValid() && flow.TupleReply.IP.SourceAddress == netipAddr {
-			shouldDelete = true
+	var flows []conntrack.Flow
+	seen := make(map[flowKey]struct{})
+	for _, addr := range addrs {
+		for _, flag := range [...]uint32{ctaFilterFlagIPSrc, ctaFilterFlagIPDst} {
+			dumped, err := cm.dump(addrFamily(addr), addrFilter(addr, flag))
+			if err != nil {
+				return nil, err
+			}
+			for _, flow := range dumped {
+				if !flowHasAddr(flow, addr, flag) {
+					conntrackLog.Info("Kernel does not filter conntrack dumps by address, dumping the whole table")
+					cm.unfiltered.Store(true)
+					return cm.dumpTable()
+				}
+				// A flow between two of the addresses is dumped twice.
+				key := flowKeyOf(flow)
+				if _, exists := seen[key]; exists {
+					continue
+				}
+				seen[key] = struct{}{}
+				flows = append(flows, flow)
+			}
 		}
+	}
+	return flows, nil
+}
+
+// flowKey identifies a dumped flow. Flows without an ID, which kernels
+// without CONFIG_NF_CONNTRACK_ID report, are identified by their tuple.
+type flowKey struct {
+	id    uint32
+	tuple conntrack.Tuple
+}
+
+func flowKeyOf(flow conntrack.Flow) flowKey {
+	if flow.ID != 0 {
+		return flowKey{id: flow.ID}
+	}
+	return flowKey{tuple: flow.TupleOrig}
+}
+
+// dump sends a dump request with the given filter attributes.
+func (cm *ConntrackManager) dump(family netfilter.ProtoFamily, attrs []netfilter.Attribute) ([]conntrack.Flow, error) {
+	request, err := netfilter.MarshalNetlink(netfilter.Header{
+		SubsystemID: netfilter.NFSubsysCTNetlink,
+		MessageType: ctnlMsgGet,
+		Family:      family,
+		Flags:       netlink.Request | netlink.Dump,
+	}, attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	messages, err := cm.dumpConn.Query(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump conntrack table: %v", err)
+	}
 
-		if flow.TupleReply.IP.DestinationAddress.IsValid() && flow.TupleReply.IP.DestinationAddress == netipAddr {
-			shouldDelete = true
+	flows := make([]conntrack.Flow, 0, len(messages))
+	for _, message := range messages {
+		var event conntrack.Event
+		if err := event.Unmarshal(message); err != nil {
+			return nil, fmt.Errorf("failed to parse conntrack flow: %v", err)
+		}
+		if event.Flow != nil {
+			flows = append(flows, *event.Flow)
 		}
+	}
 
-		if shouldDelete {
-			err := cm.conn.Delete(flow)
-			if err != nil {
-				log.Printf("Warning: failed to delete connection for IP %s: %v", ip.String(), err)
-			}
+	conntrackStats.dumps.Add(1)
+	conntrackStats.flowsScanned.Add(int64(len(flows)))
+	return flows, nil
+}
+
+// addrFilter returns the attributes of a dump request for the flows of addr,
+// restricted to ConntrackZone and ConntrackMark when configured.
+func addrFilter(addr netip.Addr, flag uint32) []netfilter.Attribute {
+	ipType := uint16(ctaIPv4Src)
+	if addr.Is6() {
+		ipType = ctaIPv6Src
+	}
+	if flag == ctaFilterFlagIPDst {
+		ipType++
+	}
+
+	// Filter flags are in host byte order, unlike the other attributes.
+	flags := make([]byte, 4)
+	binary.NativeEndian.PutUint32(flags, flag)
+
+	attrs := []netfilter.Attribute{
+		{Type: ctaTupleOrig, Nested: true, Children: []netfilter.Attribute{
+			{Type: ctaTupleIP, Nested: true, Children: []netfilter.Attribute{
+				{Type: ipType, Data: addr.AsSlice()},
+			}},
+		}},
+		{Type: ctaFilter, Nested: true, Children: []netfilter.Attribute{
+			{Type: ctaFilterOrigFlags, Data: flags},
+		}},
+	}
+	return append(attrs, scopeFilter()...)
+}
+
+// scopeFilter returns the attributes restricting a dump to ConntrackZone and
+// ConntrackMark when configured.
+func scopeFilter() []netfilter.Attribute {
+	var attrs []netfilter.Attribute
+	if config.ConntrackZone != 0 {
+		attrs = append(attrs, netfilter.Attribute{Type: ctaZone, Data: netfilter.Uint16Bytes(config.ConntrackZone)})
+	}
+	if config.ConntrackMarkMask != 0 {
+		attrs = append(attrs,
+			netfilter.Attribute{Type: ctaMark, Data: netfilter.Uint32Bytes(config.ConntrackMark)},
+			netfilter.Attribute{Type: ctaMarkMask, Data: netfilter.Uint32Bytes(config.ConntrackMarkMask)})
+	}
+	return attrs
+}
+
+func addrFamily(addr netip.Addr) netfilter.ProtoFamily {
+	if addr.Is6() {
+		return netfilter.ProtoIPv6
+	}
+	return netfilter.ProtoIPv4
+}
+
+// flowHasAddr reports whether the original source or destination of the
+// flow, as given by flag, is addr.
+func flowHasAddr(flow conntrack.Flow, addr netip.Addr, flag uint32) bool {
+	if flag == ctaFilterFlagIPDst {
+		return flow.TupleOrig.IP.DestinationAddress.Unmap() == addr
+	}
+	return flow.TupleOrig.IP.SourceAddress.Unmap() == addr
+}
+
+// dumpTable dumps the whole conntrack table, letting the kernel filter by
+// ConntrackZone and ConntrackMark when configured.
+func (cm *ConntrackManager) dumpTable() ([]conntrack.Flow, error) {
+	if cm.dumpConn != nil {
+		return cm.dump(netfilter.ProtoUnspec, scopeFilter())
+	}
+
+	var flows []conntrack.Flow
+	var err error
+
+	if config.ConntrackMarkMask != 0 {
+		flows, err = cm.conn.DumpFilter(conntrack.Filter{Mark: config.ConntrackMark, Mask: config.ConntrackMarkMask}, nil)
+	} else {
+		flows, err = cm.conn.Dump(nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump conntrack table: %v", err)
+	}
+
+	conntrackStats.dumps.Add(1)
+	conntrackStats.flowsScanned.Add(int64(len(flows)))
+	return flows, nil
+}
+
+// matchFlow returns the address among addrs that the flow belongs to,
+// skipping flows outside ConntrackZone when one is configured. It repeats
+// the kernel filters, which older kernels ignore.
+func matchFlow(flow conntrack.Flow, addrs map[netip.Addr]int) (netip.Addr, bool) {
+	if config.ConntrackZone != 0 && flow.Zone != config.ConntrackZone {
+		return netip.Addr{}, false
+	}
+
+	for _, addr := range [...]netip.Addr{
+		flow.TupleOrig.IP.SourceAddress,
+		flow.TupleOrig.IP.DestinationAddress,
+		flow.TupleReply.IP.SourceAddress,
+		flow.TupleReply.IP.DestinationAddress,
+	} {
+		if !addr.IsValid() {
+			continue
+		}
+		if _, exists := addrs[addr.Unmap()]; exists {
+			return addr.Unmap(), true
 		}
 	}
 
-	log.Printf("Connections for IP %s have been dropped via conntrack library", ip.String())
-	return nil
+	return netip.Addr{}, false
+}
+
+func parseConntrackAddr(ip string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid IP address: %s", ip)
+	}
+	return addr.Unmap(), nil
 }
 
 func (cm *ConntrackManager) IsAvailable() bool {
@@ -160,6 +520,9 @@ func (cm *ConntrackManager) IsAvailable() bool {
 }
 
 func (cm *ConntrackManager) Close() error {
+	if cm.dumpConn != nil {
+		cm.dumpConn.Close()
+	}
 	if cm.conn != nil {
 		return cm.conn.Close()
 	}
@@ -171,27 +534,20 @@ func (cm *ConntrackManager) GetConnectionCount(ip string) (int, error) {
 		return 0, fmt.Errorf("conntrack is not available")
 	}
 
-	parsedIP := net.ParseIP(ip)
-	if parsedIP == nil {
-		return 0, fmt.Errorf("invalid IP address: %s", ip)
-	}
-
-	netipAddr, ok := netip.AddrFromSlice(parsedIP)
-	if !ok {
-		return 0, fmt.Errorf("failed to convert IP address: %s", ip)
+	addr, err := parseConntrackAddr(ip)
+	if err != nil {
+		return 0, err
 	}
 
-	flows, err := cm.conn.Dump(nil)
+	flows, err := cm.dumpFlows([]netip.Addr{addr})
 	if err != nil {
-		return 0, fmt.Errorf("failed to dump conntrack table: %v", err)
+		return 0, err
 	}
 
+	addrs := map[netip.Addr]int{addr: 0}
 	count := 0
 	for _, flow := range flows {
-		if (flow.TupleOrig.IP.SourceAddress.IsValid() && flow.TupleOrig.IP.SourceAddress == netipAddr) ||
-			(flow.TupleOrig.IP.DestinationAddress.IsValid() && flow.TupleOrig.IP.DestinationAddress == netipAddr) ||
-			(flow.TupleReply.IP.SourceAddress.IsValid() && flow.TupleReply.IP.SourceAddress == netipAddr) ||
-			(flow.TupleReply.IP.DestinationAddress.IsValid() && flow.TupleReply.IP.DestinationAddress == netipAddr) {
+		if _, matched := matchFlow(flow, addrs); matched {
 			count++
 		}
 	}
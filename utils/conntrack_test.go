@@ -1,7 +1,11 @@
 package utils
 
 import (
+	"net/netip"
+	"tblocker/config"
 	"testing"
+
+	"github.com/ti-mo/conntrack"
 )
 
 func TestNewConntrackManager(t *testing.T) {
@@ -124,3 +128,116 @@ func TestConntrackManager_setupAutoload(t *testing.T) {
 		t.Log("setupAutoload succeeded")
 	}
 }
+
+func TestMatchFlow(t *testing.T) {
+	defer func() { config.ConntrackZone = 0 }()
+
+	flow := conntrack.NewFlow(6, 0, netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("192.168.1.1"), 5555, 443, 60, 0)
+	flow.Zone = 2
+
+	blocked, err := parseConntrackAddr("192.168.1.1")
+	if err != nil {
+		t.Fatalf("Failed to parse address: %v", err)
+	}
+
+	addrs := map[netip.Addr]int{blocked: 0, netip.MustParseAddr("172.16.0.1"): 0}
+	if addr, matched := matchFlow(flow, addrs); !matched || addr != blocked {
+		t.Errorf("Expected flow to match %s, got %s (%v)", blocked, addr, matched)
+	}
+
+	if _, matched := matchFlow(flow, map[netip.Addr]int{netip.MustParseAddr("172.16.0.1"): 0}); matched {
+		t.Error("Expected flow of other addresses not to match")
+	}
+
+	config.ConntrackZone = 3
+	if _, matched := matchFlow(flow, addrs); matched {
+		t.Error("Expected flow outside ConntrackZone not to match")
+	}
+
+	config.ConntrackZone = 2
+	if _, matched := matchFlow(flow, addrs); !matched {
+		t.Error("Expected flow inside ConntrackZone to match")
+	}
+}
+
+func TestAddrFilter(t *testing.T) {
+	defer func() { config.ConntrackZone, config.ConntrackMark, config.ConntrackMarkMask = 0, 0, 0 }()
+
+	attrs := addrFilter(netip.MustParseAddr("2001:db8::1"), ctaFilterFlagIPDst)
+	if len(attrs) != 2 {
+		t.Fatalf("Expected tuple and filter attributes only, got %v", attrs)
+	}
+	ip := attrs[0].Children[0].Children[0]
+	if ip.Type != ctaIPv6Dst || netip.AddrFrom16([16]byte(ip.Data)).String() != "2001:db8::1" {
+		t.Errorf("Expected IPv6 destination filter, got %v", ip)
+	}
+	if attrs[1].Type != ctaFilter || attrs[1].Children[0].Type != ctaFilterOrigFlags {
+		t.Errorf("Expected original tuple filter flags, got %v", attrs[1])
+	}
+
+	config.ConntrackZone = 2
+	config.ConntrackMark, config.ConntrackMarkMask = 0x10, 0xff
+	attrs = addrFilter(netip.MustParseAddr("192.168.1.1"), ctaFilterFlagIPSrc)
+	if ip := attrs[0].Children[0].Children[0]; ip.Type != ctaIPv4Src {
+		t.Errorf("Expected IPv4 source filter, got %v", ip)
+	}
+	if len(attrs) != 5 || attrs[2].Type != ctaZone || attrs[2].Uint16() != 2 || attrs[3].Uint32() != 0x10 || attrs[4].Uint32() != 0xff {
+		t.Errorf("Expected zone and mark filters, got %v", attrs)
+	}
+}
+
+func TestFlowHasAddr(t *testing.T) {
+	flow := conntrack.NewFlow(6, 0, netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("192.168.1.1"), 5555, 443, 60, 0)
+
+	if !flowHasAddr(flow, netip.MustParseAddr("10.0.0.1"), ctaFilterFlagIPSrc) {
+		t.Error("Expected source address to match the source filter")
+	}
+	if !flowHasAddr(flow, netip.MustParseAddr("192.168.1.1"), ctaFilterFlagIPDst) {
+		t.Error("Expected destination address to match the destination filter")
+	}
+	// Flows of other addresses mean the kernel ignored the filter.
+	if flowHasAddr(flow, netip.MustParseAddr("192.168.1.1"), ctaFilterFlagIPSrc) {
+		t.Error("Expected destination address not to match the source filter")
+	}
+}
+
+func TestFlowKeyOf(t *testing.T) {
+	flow := conntrack.NewFlow(6, 0, netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2"), 5555, 443, 60, 0)
+	other := conntrack.NewFlow(6, 0, netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2"), 5556, 443, 60, 0)
+
+	if flowKeyOf(flow) != flowKeyOf(flow) {
+		t.Error("Expected a flow without an ID to be identified by its tuple")
+	}
+	if flowKeyOf(flow) == flowKeyOf(other) {
+		t.Error("Expected flows without an ID and with different tuples to differ")
+	}
+
+	flow.ID, other.ID = 7, 7
+	if flowKeyOf(flow) != flowKeyOf(other) {
+		t.Error("Expected flows with the same ID to be the same flow")
+	}
+}
+
+func TestScopeFilter(t *testing.T) {
+	defer func() { config.ConntrackZone, config.ConntrackMark, config.ConntrackMarkMask = 0, 0, 0 }()
+
+	if attrs := scopeFilter(); len(attrs) != 0 {
+		t.Errorf("Expected no filter without zone and mark, got %v", attrs)
+	}
+
+	config.ConntrackZone = 2
+	if attrs := scopeFilter(); len(attrs) != 1 || attrs[0].Type != ctaZone || attrs[0].Uint16() != 2 {
+		t.Errorf("Expected zone filter, got %v", attrs)
+	}
+}
+
+func TestParseConntrackAddr(t *testing.T) {
+	addr, err := parseConntrackAddr("::ffff:192.168.1.1")
+	if err != nil || !addr.Is4() {
+		t.Errorf("Expected IPv4-mapped address to be unmapped, got %s (%v)", addr, err)
+	}
+
+	if _, err := parseConntrackAddr("invalid-ip"); err == nil {
+		t.Error("Expected error for invalid IP address")
+	}
+}
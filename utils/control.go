@@ -0,0 +1,256 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+	"tblocker/config"
+	"tblocker/logging"
+	"tblocker/storage"
+	"time"
+)
+
+const controlSocketName = "control.sock"
+
+var controlLog = logging.For("control")
+
+// ErrServiceNotRunning is returned by the control client when no service
+// listens on the control socket.
+var ErrServiceNotRunning = errors.New("service is not running")
+
+func controlSocketPath(storageDir string) string {
+	return filepath.Join(storageDir, controlSocketName)
+}
+
+// StartControlServer serves the entry management API of the CLI on a unix
+// socket in StorageDir that only root can connect to.
+func StartControlServer() {
+	path := controlSocketPath(config.StorageDir)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		controlLog.Error("Error removing stale control socket", "path", path, "error", err)
+		return
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		controlLog.Error("Error opening control socket", "path", path, "error", err)
+		return
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		controlLog.Error("Error restricting control socket", "path", path, "error", err)
+	}
+
+	go func() {
+		if err := http.Serve(listener, newControlHandler()); err != nil {
+			controlLog.Error("Control socket stopped", "error", err)
+		}
+	}()
+}
+
+func newControlHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /entries", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ListEntries(ipStorage))
+	})
+	mux.HandleFunc("POST /entries", func(w http.ResponseWriter, r *http.Request) {
+		var entry storage.BlockedIP
+		if err := json.NewDecoder(r.Body).Decode(&entry); err != nil {
+			http.Error(w, fmt.Sprintf("invalid entry: %v", err), http.StatusBadRequest)
+			return
+		}
+		query := r.URL.Query()
+		if err := AddEntry(entry, query.Get("notify") != "false", query.Get("force") == "true"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("DELETE /entries", func(w http.ResponseWriter, r *http.Request) {
+		err := RemoveEntry(r.URL.Query().Get("kind"), r.URL.Query().Get("target"))
+		switch {
+		case errors.Is(err, ErrEntryNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	return mux
+}
+
+// EntryStore manages entries either in the running service or, while it
+// is stopped, directly in the storage files.
+type EntryStore interface {
+	ListEntries() ([]storage.BlockedIP, error)
+	AddEntry(entry storage.BlockedIP, notify, force bool) error
+	RemoveEntry(kind, target string) error
+	Close() error
+}
+
+// OpenEntryStore connects to the running service, falling back to the
+// storage files when it is not running. The second result reports whether
+// the fallback is used.
+func OpenEntryStore(storageDir string) (EntryStore, bool, error) {
+	client := NewControlClient(storageDir)
+	_, err := client.ListEntries()
+	if err == nil {
+		return client, false, nil
+	}
+	if !errors.Is(err, ErrServiceNotRunning) {
+		return nil, false, err
+	}
+
+	store, err := storage.NewIPStorage(storageDir, func(string, time.Duration, string) {})
+	if err != nil {
+		return nil, false, err
+	}
+	offline := offlineEntryStore{store: store}
+	if config.Redis.Addr != "" {
+		offline.shared = newRedisSync(config.Redis, storageDir)
+	}
+	return offline, true, nil
+}
+
+// offlineEntryStore edits the storage files. With Redis configured, blocks
+// and bans are also written to Redis, so the other nodes apply them at once
+// and this node does not restore removed ones from Redis on start.
+type offlineEntryStore struct {
+	store  *storage.IPStorage
+	shared *redisSync
+}
+
+func (s offlineEntryStore) ListEntries() ([]storage.BlockedIP, error) {
+	return ListEntries(s.store), nil
+}
+
+func (s offlineEntryStore) AddEntry(entry storage.BlockedIP, _, force bool) error {
+	if err := NormalizeEntry(&entry, time.Now()); err != nil {
+		return err
+	}
+	if err := checkBanReplace(s.store.GetBlockedIPs(), entry, force); err != nil {
+		return err
+	}
+	if err := SaveEntry(s.store, entry); err != nil {
+		return err
+	}
+	if s.shared != nil && entry.Kind != storage.KindAllow {
+		if _, err := s.shared.writeBlock(entry); err != nil {
+			return fmt.Errorf("entry saved, but not shared through Redis: %v", err)
+		}
+	}
+	return nil
+}
+
+func (s offlineEntryStore) Close() error {
+	if s.shared == nil {
+		return nil
+	}
+	return s.shared.Close()
+}
+
+func (s offlineEntryStore) RemoveEntry(kind, target string) error {
+	info, exists := s.store.GetBlockedIPs()[normalizeIP(target)]
+	if exists && info.Origin != "" && kind != storage.KindAllow {
+		return mirroredEntryError(info)
+	}
+	if err := DeleteEntry(s.store, kind, target); err != nil {
+		return err
+	}
+	if s.shared != nil && exists && kind != storage.KindAllow {
+		if _, err := s.shared.deleteBlock(info); err != nil {
+			// The saved pending delete is retried when the service starts.
+			s.shared.queue(redisUpdate{entry: info, remove: true})
+			return fmt.Errorf("entry removed, but not from Redis yet, the service retries on start: %v", err)
+		}
+	}
+	return nil
+}
+
+// ControlClient manages the entries of the running service over its
+// control socket.
+type ControlClient struct {
+	client *http.Client
+}
+
+func NewControlClient(storageDir string) *ControlClient {
+	path := controlSocketPath(storageDir)
+	return &ControlClient{client: &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", path)
+			},
+		},
+	}}
+}
+
+func (c *ControlClient) ListEntries() ([]storage.BlockedIP, error) {
+	var entries []storage.BlockedIP
+	err := c.do(http.MethodGet, "/entries", nil, &entries)
+	return entries, err
+}
+
+func (c *ControlClient) AddEntry(entry storage.BlockedIP, notify, force bool) error {
+	query := url.Values{"notify": {fmt.Sprint(notify)}, "force": {fmt.Sprint(force)}}
+	return c.do(http.MethodPost, "/entries?"+query.Encode(), entry, nil)
+}
+
+func (c *ControlClient) RemoveEntry(kind, target string) error {
+	query := url.Values{"kind": {kind}, "target": {target}}
+	return c.do(http.MethodDelete, "/entries?"+query.Encode(), nil, nil)
+}
+
+func (c *ControlClient) Close() error {
+	c.client.CloseIdleConnections()
+	return nil
+}
+
+func (c *ControlClient) do(method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, "http://tblocker"+path, reader)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		// Only a missing or stale socket means the service is down. Anything
+		// else must not fall back to editing the storage files, since the
+		// running service would overwrite them.
+		if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED) {
+			return ErrServiceNotRunning
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrEntryNotFound
+	case resp.StatusCode >= 300:
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return errors.New(string(bytes.TrimSpace(message)))
+	case out != nil:
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"tblocker/config"
+	"tblocker/parser"
+	"tblocker/storage"
+	"time"
+)
+
+type verdict int
+
+const (
+	verdictIgnore verdict = iota
+	verdictNotify
+	verdictBlock
+)
+
+// Stages at which a matched line can be rejected.
+const (
+	stageParse      = "parse"
+	stageFilter     = "filter"
+	stageBypass     = "bypass"
+	stageAllowed    = "allowed"
+	stageExempt     = "exempt"
+	stageExpired    = "expired"
+	stageBlocked    = "blocked"
+	stageThreshold  = "threshold"
+	stageSuppressed = "suppressed"
+)
+
+type detection struct {
+	Verdict      verdict
+	Stage        string
+	Reason       string
+	Event        parser.Event
+	Rule         *config.TagRule
+	Policy       *config.UserPolicy
+	Allow        *storage.BlockedIP
+	Action       string
+	Scope        string
+	IPs          []string
+	Duration     int
+	DetectedAt   time.Time
+	BlockedUntil time.Time
+	Trace        []string
+}
+
+// detector decides what a line carrying a configured tag should lead to,
+// without touching the firewall, storage or webhooks. The live monitor and
+// the replay command only differ in their clock and detection state.
+type detector struct {
+	tracker *detectionTracker
+	userIPs *userIPTracker
+	now     func(event parser.Event) time.Time
+	allowed func(ip string, usernames []string, now time.Time) (storage.BlockedIP, bool)
+	blocked func(ip string, now time.Time) bool
+	explain bool
+}
+
+var liveDetector = &detector{
+	tracker: detections,
+	userIPs: recentUserIPs,
+	now:     func(parser.Event) time.Time { return time.Now() },
+	allowed: func(ip string, usernames []string, now time.Time) (storage.BlockedIP, bool) {
+		if ipStorage == nil {
+			return storage.BlockedIP{}, false
+		}
+		return ipStorage.FindAllow(ip, usernames, now)
+	},
+	blocked: func(ip string, _ time.Time) bool {
+		return ipStorage != nil && ipStorage.IsBlocked(ip)
+	},
+}
+
+// evaluate decides on a line in which the tag rules with the given indices
+// were found.
+func (d *detector) evaluate(source *logSource, line string, matched []int) detection {
+	var result detection
+
+	event, valid := source.parser.Parse(line)
+	if !valid {
+		return d.reject(result, stageParse, "parser %s could not extract IP and username", source.parser.GetName())
+	}
+	result.Event = event
+	d.note(&result, "parsed by %s: ip=%s user=%s%s", source.parser.GetName(), event.IP, event.Username, describeEvent(event))
+	d.trackUserIP(event)
+
+	rule := selectTagRule(source, matched, event)
+	result.Rule = rule
+	d.note(&result, "attributed to tag '%s' (reason: %s)", rule.Tag, rule.Reason)
+
+	if reason := checkDetection(source, event); reason != "" {
+		return d.reject(result, stageFilter, "%s", reason)
+	}
+	d.note(&result, "routing and inbound filters passed")
+
+	if IsBypassedIP(event.IP) {
+		return d.reject(result, stageBypass, "IP %s is in BypassIPS", event.IP)
+	}
+
+	now := d.now(event)
+	usernames := []string{event.Username, processUsername(source, event.Username)}
+	if allow, allowed := d.findAllow(event.IP, usernames, now); allowed {
+		result.Allow = &allow
+		return d.reject(result, stageAllowed, "%s", describeAllow(allow))
+	}
+
+	policy := findUserPolicy(source, event.Username)
+	result.Policy = policy
+	if policy != nil {
+		d.note(&result, "user policy %s applies", describePolicy(policy))
+		if policy.Exempt {
+			return d.reject(result, stageExempt, "user is exempt by policy %s", describePolicy(policy))
+		}
+	}
+
+	result.Duration = effectiveBlockDuration(policy)
+	if rule.BlockDuration > 0 {
+		result.Duration = rule.BlockDuration
+	}
+	result.DetectedAt = detectionTime(event, now)
+	result.BlockedUntil = result.DetectedAt.Add(time.Duration(result.Duration) * time.Minute)
+
+	if !result.BlockedUntil.After(now) {
+		return d.reject(result, stageExpired, "block from %s would already have expired", result.DetectedAt.Format(time.RFC3339))
+	}
+
+	// Lines of an IP that is already blocked do not count towards the
+	// threshold, so they cannot trigger a new block once it expires.
+	if d.isBlocked(event.IP, result.DetectedAt) {
+		return d.reject(result, stageBlocked, "IP %s is already blocked", event.IP)
+	}
+
+	threshold := effectiveThreshold(policy)
+	if !d.tracker.hit(event.Username, threshold, result.DetectedAt) {
+		return d.reject(result, stageThreshold, "threshold of %d detections within %d seconds not reached yet", threshold, config.ThresholdWindow)
+	}
+	if threshold > 1 {
+		d.note(&result, "threshold of %d detections reached", threshold)
+	}
+
+	if policy != nil && policy.NotifyOnly {
+		if !d.tracker.shouldNotify(event.Username, time.Duration(result.Duration)*time.Minute, result.DetectedAt) {
+			return d.reject(result, stageSuppressed, "notify-only user was already reported within %d minutes", result.Duration)
+		}
+		result.Verdict = verdictNotify
+		d.note(&result, "notify-only policy: would notify without blocking")
+		return result
+	}
+
+	result.Verdict = verdictBlock
+	result.Action = rule.GetAction()
+	result.Scope = rule.GetScope()
+	result.IPs = d.blockIPs(result)
+	if result.Scope == "user" {
+		d.note(&result, "user scope: blocking %d recent IPs of the user: %s", len(result.IPs), strings.Join(result.IPs, ", "))
+	}
+	if result.Action == "throttle" {
+		d.note(&result, "would throttle to %d kbit/s for %d minutes until %s", config.ThrottleRate, result.Duration, result.BlockedUntil.Format(time.RFC3339))
+	} else {
+		d.note(&result, "would block for %d minutes until %s", result.Duration, result.BlockedUntil.Format(time.RFC3339))
+	}
+	return result
+}
+
+// observe handles a line without a tag: stateful parsers need to see it,
+// and with user scope its IP is remembered for the user.
+func (d *detector) observe(source *logSource, line string) {
+	if config.UserScopeEnabled() {
+		if event, valid := source.parser.Parse(line); valid {
+			d.trackUserIP(event)
+		}
+		return
+	}
+
+	if stateful, ok := source.parser.(parser.StatefulParser); ok {
+		stateful.Observe(line)
+	}
+}
+
+func (d *detector) trackUserIP(event parser.Event) {
+	if config.UserScopeEnabled() {
+		d.userIPs.observe(event.Username, event.IP, detectionTime(event, d.now(event)))
+	}
+}
+
+// blockIPs returns the IPs a block applies to: the IP of the line, followed
+// for user scope by the other recent IPs of the user that are not bypassed.
+func (d *detector) blockIPs(result detection) []string {
+	ips := []string{result.Event.IP}
+	if result.Scope != "user" {
+		return ips
+	}
+
+	for _, ip := range d.userIPs.recent(result.Event.Username, result.DetectedAt) {
+		if ip == result.Event.IP || IsBypassedIP(ip) {
+			continue
+		}
+		if _, allowed := d.findAllow(ip, nil, result.DetectedAt); allowed {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+func (d *detector) findAllow(ip string, usernames []string, now time.Time) (storage.BlockedIP, bool) {
+	if d.allowed == nil {
+		return storage.BlockedIP{}, false
+	}
+	return d.allowed(ip, usernames, now)
+}
+
+func (d *detector) isBlocked(ip string, now time.Time) bool {
+	return d.blocked != nil && d.blocked(ip, now)
+}
+
+func describeAllow(allow storage.BlockedIP) string {
+	target := "IP " + allow.IP
+	if allow.IP == "" {
+		target = "user " + allow.Username
+	}
+	description := fmt.Sprintf("%s is allowed until %s", target, allow.BlockedUntil.Format(time.RFC3339))
+	if allow.Permanent() {
+		description = target + " is allowed"
+	}
+	if allow.Author != "" {
+		description += " by " + allow.Author
+	}
+	if allow.Reason != "" {
+		description += ": " + allow.Reason
+	}
+	return description
+}
+
+func (d *detector) reject(result detection, stage, format string, args ...interface{}) detection {
+	result.Verdict = verdictIgnore
+	result.Stage = stage
+	result.Reason = fmt.Sprintf(format, args...)
+	d.note(&result, "rejected: %s", result.Reason)
+	return result
+}
+
+func (d *detector) note(result *detection, format string, args ...interface{}) {
+	if d.explain {
+		result.Trace = append(result.Trace, fmt.Sprintf(format, args...))
+	}
+}
+
+func describePolicy(policy *config.UserPolicy) string {
+	if policy.Name != "" {
+		return "'" + policy.Name + "'"
+	}
+	return "/" + policy.Regex + "/"
+}
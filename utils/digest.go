@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"tblocker/config"
+	"time"
+)
+
+// digestTopUsers is the number of users listed in a digest.
+const digestTopUsers = 10
+
+var webhookDigest *digestBatcher
+
+// StartWebhookDigest batches webhook events into digests while more than
+// DigestThreshold events arrive within DigestWindow seconds.
+func StartWebhookDigest() {
+	if !config.SendWebhook || config.DigestThreshold <= 0 {
+		return
+	}
+
+	window := time.Duration(config.DigestWindow) * time.Second
+	webhookDigest = newDigestBatcher(config.DigestThreshold, time.Now(), deliverWebhookEvent, func(batch digestBatch) {
+		postWebhook(formatDigest(config.DigestTemplate, batch), "action", "digest", "events", len(batch.Events))
+	})
+	go func() {
+		for now := range time.Tick(window) {
+			webhookDigest.tick(now)
+		}
+	}()
+	webhookLog.Info("Webhook digests enabled", "threshold", config.DigestThreshold, "window", window)
+}
+
+// digestBatch is the events held back during one window.
+type digestBatch struct {
+	Start  time.Time
+	End    time.Time
+	Events []webhookEvent
+}
+
+// digestBatcher counts webhook events per window. Events are delivered one
+// by one until a window has more than threshold of them. Later events are
+// held back and sent as one digest when the window ends, and digests
+// continue until a window stays under the threshold.
+type digestBatcher struct {
+	mu        sync.Mutex
+	threshold int
+	start     time.Time
+	count     int
+	digesting bool
+	pending   []webhookEvent
+
+	deliver       func(webhookEvent)
+	deliverDigest func(digestBatch)
+}
+
+func newDigestBatcher(threshold int, now time.Time, deliver func(webhookEvent), deliverDigest func(digestBatch)) *digestBatcher {
+	return &digestBatcher{threshold: threshold, start: now, deliver: deliver, deliverDigest: deliverDigest}
+}
+
+func (b *digestBatcher) add(event webhookEvent) {
+	b.mu.Lock()
+	b.count++
+	if !b.digesting && b.count > b.threshold {
+		b.digesting = true
+		webhookLog.Warn("Webhook volume above DigestThreshold, sending digests", "events", b.count, "threshold", b.threshold)
+	}
+	if b.digesting {
+		b.pending = append(b.pending, event)
+		b.mu.Unlock()
+		return
+	}
+	b.mu.Unlock()
+
+	b.deliver(event)
+}
+
+// tick ends the current window, sending the digest of its held back events.
+func (b *digestBatcher) tick(now time.Time) {
+	b.mu.Lock()
+	batch := digestBatch{Start: b.start, End: now, Events: b.pending}
+	busy := b.count > b.threshold
+	if b.digesting && !busy {
+		webhookLog.Info("Webhook volume back under DigestThreshold, sending single events", "events", b.count)
+	}
+	b.start, b.count, b.pending, b.digesting = now, 0, nil, busy
+	b.mu.Unlock()
+
+	if len(batch.Events) > 0 {
+		b.deliverDigest(batch)
+	}
+}
+
+type digestUser struct {
+	Username string `json:"username"`
+	Count    int    `json:"count"`
+}
+
+// formatDigest fills the placeholders of DigestTemplate. List placeholders
+// come as JSON ({counts}, {top_users}, {ips}) and as text for use inside
+// JSON strings ({counts_text}, {top_users_text}, {ips_text}).
+func formatDigest(template string, batch digestBatch) string {
+	counts := make(map[string]int)
+	userCounts := make(map[string]int)
+	var ips []string
+	seenIPs := make(map[string]struct{})
+	for _, event := range batch.Events {
+		counts[event.Action]++
+		if event.Username != "" {
+			userCounts[processUsername(findLogSource(event.Source), event.Username)]++
+		}
+		if _, seen := seenIPs[event.IP]; event.IP != "" && !seen {
+			seenIPs[event.IP] = struct{}{}
+			ips = append(ips, event.IP)
+		}
+	}
+
+	users := make([]digestUser, 0, len(userCounts))
+	for username, count := range userCounts {
+		users = append(users, digestUser{Username: username, Count: count})
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].Count != users[j].Count {
+			return users[i].Count > users[j].Count
+		}
+		return users[i].Username < users[j].Username
+	})
+	topUsers := users[:min(len(users), digestTopUsers)]
+
+	actions := make([]string, 0, len(counts))
+	for action := range counts {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+	countsText := make([]string, len(actions))
+	for i, action := range actions {
+		countsText[i] = fmt.Sprintf("%s: %d", action, counts[action])
+	}
+	topUsersText := make([]string, len(topUsers))
+	for i, user := range topUsers {
+		topUsersText[i] = fmt.Sprintf("%s (%d)", user.Username, user.Count)
+	}
+	if ips == nil {
+		ips = []string{}
+	}
+
+	return strings.NewReplacer(
+		"{server}", jsonText(config.Hostname),
+		"{count}", strconv.Itoa(len(batch.Events)),
+		"{counts}", toJSON(counts),
+		"{counts_text}", jsonText(strings.Join(countsText, ", ")),
+		"{users}", strconv.Itoa(len(users)),
+		"{top_users}", toJSON(topUsers),
+		"{top_users_text}", jsonText(strings.Join(topUsersText, ", ")),
+		"{ip_count}", strconv.Itoa(len(ips)),
+		"{ips}", toJSON(ips),
+		"{ips_text}", jsonText(strings.Join(ips, ", ")),
+		"{start}", batch.Start.Format(time.RFC3339),
+		"{end}", batch.End.Format(time.RFC3339),
+		"{window}", strconv.Itoa(int(batch.End.Sub(batch.Start).Round(time.Second)/time.Second)),
+	).Replace(template)
+}
+
+func toJSON(value any) string {
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+// jsonText escapes text for use inside a JSON string of a template.
+func jsonText(text string) string {
+	quoted := toJSON(text)
+	return quoted[1 : len(quoted)-1]
+}
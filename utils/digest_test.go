@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"encoding/json"
+	"tblocker/config"
+	"tblocker/parser"
+	"testing"
+	"time"
+)
+
+func TestDigestBatcher(t *testing.T) {
+	start := time.Now()
+	var delivered []webhookEvent
+	var digests []digestBatch
+	b := newDigestBatcher(2, start,
+		func(event webhookEvent) { delivered = append(delivered, event) },
+		func(batch digestBatch) { digests = append(digests, batch) })
+
+	event := webhookEvent{Event: parser.Event{IP: "1.1.1.1", Username: "bob"}, Action: "block"}
+	for range 5 {
+		b.add(event)
+	}
+	if len(delivered) != 2 {
+		t.Fatalf("Expected the first 2 events to be delivered, got %d", len(delivered))
+	}
+
+	b.tick(start.Add(time.Minute))
+	if len(digests) != 1 || len(digests[0].Events) != 3 || !digests[0].Start.Equal(start) {
+		t.Fatalf("Expected a digest of 3 events, got %+v", digests)
+	}
+
+	// A busy window is followed by digests until a window stays quiet.
+	b.add(event)
+	if len(delivered) != 2 {
+		t.Error("Expected events after a busy window to be held back")
+	}
+	b.tick(start.Add(2 * time.Minute))
+	if len(digests) != 2 || len(digests[1].Events) != 1 {
+		t.Fatalf("Expected a digest of 1 event, got %+v", digests)
+	}
+
+	b.add(event)
+	b.tick(start.Add(3 * time.Minute))
+	if len(delivered) != 3 || len(digests) != 2 {
+		t.Errorf("Expected single delivery once quiet, got %d events and %d digests", len(delivered), len(digests))
+	}
+}
+
+func TestFormatDigest(t *testing.T) {
+	oldHostname := config.Hostname
+	defer func() { config.Hostname = oldHostname }()
+	config.Hostname = `node"a`
+
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	batch := digestBatch{Start: start, End: start.Add(time.Minute), Events: []webhookEvent{
+		{Event: parser.Event{IP: "1.1.1.1", Username: "bob"}, Action: "block"},
+		{Event: parser.Event{IP: "1.1.1.2", Username: "bob"}, Action: "block"},
+		{Event: parser.Event{IP: "2.2.2.2", Username: `al"ice`}, Action: "block"},
+		{Event: parser.Event{IP: "1.1.1.1", Username: "bob"}, Action: "unblock"},
+	}}
+
+	var digest struct {
+		Server   string         `json:"server"`
+		Count    int            `json:"count"`
+		Counts   map[string]int `json:"counts"`
+		Users    int            `json:"users"`
+		TopUsers []digestUser   `json:"top_users"`
+		IPs      []string       `json:"ips"`
+		Start    string         `json:"start"`
+	}
+	defaultTemplate := `{"server":"{server}","action":"digest","count":{count},"counts":{counts},"users":{users},"top_users":{top_users},"ips":{ips},"start":"{start}","end":"{end}"}`
+	if err := json.Unmarshal([]byte(formatDigest(defaultTemplate, batch)), &digest); err != nil {
+		t.Fatalf("Expected valid JSON: %v", err)
+	}
+	if digest.Server != `node"a` || digest.Count != 4 || digest.Counts["block"] != 3 || digest.Counts["unblock"] != 1 || digest.Users != 2 {
+		t.Errorf("Unexpected digest %+v", digest)
+	}
+	if len(digest.TopUsers) != 2 || digest.TopUsers[0] != (digestUser{Username: "bob", Count: 3}) {
+		t.Errorf("Unexpected top users %+v", digest.TopUsers)
+	}
+	if len(digest.IPs) != 3 || digest.IPs[0] != "1.1.1.1" || digest.Start != "2025-01-01T12:00:00Z" {
+		t.Errorf("Unexpected IPs or start %+v", digest)
+	}
+
+	var message struct {
+		Text string `json:"text"`
+	}
+	textTemplate := `{"text":"{count} events on {server} in {window}s: {counts_text}. Top: {top_users_text}. IPs: {ips_text}"}`
+	if err := json.Unmarshal([]byte(formatDigest(textTemplate, batch)), &message); err != nil {
+		t.Fatalf("Expected valid JSON from text placeholders: %v", err)
+	}
+	want := `4 events on node"a in 60s: block: 3, unblock: 1. Top: bob (3), al"ice (1). IPs: 1.1.1.1, 1.1.1.2, 2.2.2.2`
+	if message.Text != want {
+		t.Errorf("Expected %q, got %q", want, message.Text)
+	}
+}
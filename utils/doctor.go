@@ -0,0 +1,394 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"tblocker/config"
+	"tblocker/firewall"
+	"tblocker/netns"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/ti-mo/conntrack"
+)
+
+const (
+	doctorTailBytes      = 1024 * 1024
+	doctorWebhookTimeout = 5 * time.Second
+)
+
+// Results of a doctor check.
+const (
+	CheckPass = "pass"
+	CheckWarn = "warn"
+	CheckFail = "fail"
+	CheckSkip = "skip"
+)
+
+type DoctorCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+	Hint   string `json:"hint,omitempty"`
+}
+
+type doctor struct {
+	wait   time.Duration
+	checks []DoctorCheck
+}
+
+func (d *doctor) add(name, status, detail, hint string) {
+	d.checks = append(d.checks, DoctorCheck{Name: name, Status: status, Detail: detail, Hint: hint})
+}
+
+// RunDoctor checks each piece the service depends on with the loaded
+// configuration. wait is how long log files are watched for new lines.
+func RunDoctor(wait time.Duration) []DoctorCheck {
+	d := &doctor{wait: wait}
+
+	if err := netns.Init(config.NetworkNamespace); err != nil {
+		d.add("network namespace", CheckFail, err.Error(),
+			"Check NetworkNamespace: the path must exist, the PID must be running, the container must be started.")
+	} else if netns.Enabled() {
+		d.add("network namespace", CheckPass, netns.Describe(), "")
+	}
+
+	sizes := make(map[string]int64)
+	for _, cfg := range config.LogSources {
+		source := newLogSource(cfg)
+		if source.sourceType == "file" || source.sourceType == "" {
+			if info, err := os.Stat(source.path); err == nil {
+				sizes[source.path] = info.Size()
+			}
+		}
+	}
+	started := time.Now()
+
+	d.checkFirewall()
+	d.checkConntrack()
+	d.checkStorage()
+	d.checkWebhook()
+	d.checkRedis()
+	d.checkService()
+
+	if remaining := d.wait - time.Since(started); remaining > 0 && len(sizes) > 0 {
+		time.Sleep(remaining)
+	}
+
+	for _, cfg := range config.LogSources {
+		d.checkLogSource(newLogSource(cfg), sizes)
+	}
+	if config.Syslog.Enabled {
+		d.add("syslog receiver", CheckSkip, "lines arrive from remote nodes, run doctor on the nodes to check their logs", "")
+	}
+
+	return d.checks
+}
+
+func (d *doctor) checkLogSource(source *logSource, sizes map[string]int64) {
+	name := "log source " + source.describe() + source.logSuffix()
+
+	var lines []string
+	switch source.sourceType {
+	case "journal":
+		if _, err := exec.LookPath("journalctl"); err != nil {
+			d.add(name, CheckFail, "journalctl not found", "Install systemd's journalctl or read the access log from a file.")
+			return
+		}
+		output, err := exec.Command("journalctl", append(journalFilterArgs(source), "--lines=1000", "--output=cat", "--no-pager")...).Output()
+		if err != nil {
+			d.add(name, CheckFail, fmt.Sprintf("journalctl failed: %v", err), "Check that the unit or identifier exists and the journal is readable.")
+			return
+		}
+		lines = splitLines(output)
+		d.add(name, CheckPass, fmt.Sprintf("journal readable, %d recent entries", len(lines)), "")
+	case "file", "":
+		info, err := os.Stat(source.path)
+		if err != nil {
+			d.add(name, CheckFail, err.Error(),
+				"Enable the Xray access log (log.access in the Xray config) and point LogFile or the source Path at it.")
+			return
+		}
+
+		lines, err = readTailLines(source.path, doctorTailBytes)
+		if err != nil {
+			d.add(name, CheckFail, fmt.Sprintf("log file is not readable: %v", err), "Run tblocker as root or make the log file readable.")
+			return
+		}
+
+		before, sampled := sizes[source.path]
+		switch {
+		case !sampled:
+			d.add(name, CheckPass, "log file readable", "")
+		case info.Size() > before:
+			d.add(name, CheckPass, fmt.Sprintf("log file readable and growing (%d bytes in %s)", info.Size()-before, d.wait), "")
+		default:
+			d.add(name, CheckWarn, fmt.Sprintf("log file readable but did not grow in %s", d.wait),
+				"Make sure Xray writes access logs to this file (loglevel and access path) and clients are connected.")
+		}
+	default:
+		return
+	}
+
+	d.checkTags(source, lines)
+}
+
+func (d *doctor) checkTags(source *logSource, lines []string) {
+	name := "tags " + source.describeTags() + source.logSuffix()
+
+	if len(lines) == 0 {
+		d.add(name, CheckSkip, "no recent lines to look at", "")
+		return
+	}
+
+	matched, parsed := 0, 0
+	for _, line := range lines {
+		if _, valid := source.parser.Parse(line); valid {
+			parsed++
+		}
+		if len(matchTagRules(source, stringToBytes(line))) > 0 {
+			matched++
+		}
+	}
+
+	if parsed == 0 {
+		d.add("parser "+source.parser.GetName()+source.logSuffix(), CheckFail,
+			fmt.Sprintf("none of the last %d lines could be parsed", len(lines)),
+			"Choose the Parser that matches the log format, or set ParserPattern for the regex parser.")
+	}
+
+	if matched == 0 {
+		d.add(name, CheckWarn, fmt.Sprintf("not found in the last %d lines", len(lines)),
+			"Check that TorrentTag equals the outboundTag of the Xray routing rule for bittorrent, and that such traffic occurred recently.")
+		return
+	}
+	d.add(name, CheckPass, fmt.Sprintf("found in %d of the last %d lines, %d lines parsed", matched, len(lines), parsed), "")
+}
+
+func (d *doctor) checkFirewall() {
+	name, err := firewall.Probe(config.BlockMode)
+	if errors.Is(err, firewall.ErrNoBackend) {
+		d.add("firewall", CheckFail, err.Error(), "Install iptables or nftables (nft) and run tblocker as root.")
+		return
+	}
+	if err != nil {
+		d.add("firewall "+name, CheckFail, err.Error(),
+			"Start the tblocker service, which creates the chains and rules, and make sure no other tool flushes them.")
+		return
+	}
+	d.add("firewall "+name, CheckPass, "chains and rules are in place", "")
+}
+
+func (d *doctor) checkConntrack() {
+	if config.ConntrackMode == "off" {
+		d.add("conntrack", CheckSkip, "disabled by ConntrackMode", "")
+		d.checkSocketDestroy()
+		return
+	}
+
+	status := CheckWarn
+	if config.ConntrackMode == "required" {
+		status = CheckFail
+	}
+
+	if !(&ConntrackManager{}).isModuleLoaded() {
+		d.add("conntrack", status, "kernel module nf_conntrack is not loaded",
+			"Run modprobe nf_conntrack, or set ConntrackMode: optional to fall back to socket destroy.")
+		d.checkSocketDestroy()
+		return
+	}
+
+	conn, err := conntrack.Dial(&netlink.Config{NetNS: netns.Fd()})
+	if err != nil {
+		d.add("conntrack", status, fmt.Sprintf("netlink access failed: %v", err),
+			"Run tblocker as root (CAP_NET_ADMIN), or set ConntrackMode: optional to fall back to socket destroy.")
+		d.checkSocketDestroy()
+		return
+	}
+	conn.Close()
+
+	d.add("conntrack", CheckPass, "nf_conntrack loaded and netlink accessible", "")
+}
+
+// checkSocketDestroy checks the fallback used when conntrack is unavailable.
+func (d *doctor) checkSocketDestroy() {
+	if config.ConntrackMode == "required" {
+		return
+	}
+
+	if err := socketDestroyAvailable(); err != nil {
+		d.add("socket destroy", CheckWarn, err.Error(),
+			"Established connections of blocked IPs will stay open; run as root or enable conntrack.")
+		return
+	}
+	d.add("socket destroy", CheckPass, "sock_diag netlink accessible", "")
+}
+
+func (d *doctor) checkStorage() {
+	dir := config.StorageDir
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		d.add("storage", CheckWarn, dir+" does not exist yet", "It is created on the first start; make sure its parent directory is writable.")
+		return
+	}
+	if err != nil || !info.IsDir() {
+		d.add("storage", CheckFail, fmt.Sprintf("%s is not a directory", dir), "Set StorageDir to a writable directory.")
+		return
+	}
+
+	probe := filepath.Join(dir, ".doctor")
+	if err := os.WriteFile(probe, []byte("ok\n"), 0644); err != nil {
+		d.add("storage", CheckFail, fmt.Sprintf("%s is not writable: %v", dir, err), "Run tblocker as root or fix the permissions of StorageDir.")
+		return
+	}
+	os.Remove(probe)
+
+	d.add("storage", CheckPass, dir+" is writable", "")
+}
+
+func (d *doctor) checkWebhook() {
+	if !config.SendWebhook {
+		d.add("webhook", CheckSkip, "SendWebhook is disabled", "")
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodHead, config.WebhookURL, nil)
+	if err != nil {
+		d.add("webhook", CheckFail, fmt.Sprintf("invalid WebhookURL: %v", err), "Set WebhookURL to a full http(s) URL.")
+		return
+	}
+	for key, value := range config.WebhookHeaders {
+		req.Header.Set(key, value)
+	}
+
+	client := &http.Client{Timeout: doctorWebhookTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		d.add("webhook", CheckFail, fmt.Sprintf("%s is not reachable: %v", config.WebhookURL, err),
+			"Check DNS, firewall rules and that the receiving service is running.")
+		return
+	}
+	resp.Body.Close()
+
+	d.add("webhook", CheckPass, fmt.Sprintf("%s reachable (HTTP %d)", config.WebhookURL, resp.StatusCode), "")
+}
+
+func (d *doctor) checkRedis() {
+	if config.Redis.Addr == "" {
+		return
+	}
+
+	shared := newRedisSync(config.Redis, config.StorageDir)
+	defer shared.client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), doctorWebhookTimeout)
+	defer cancel()
+	if err := shared.client.Ping(ctx).Err(); err != nil {
+		d.add("redis", CheckFail, fmt.Sprintf("%s is not reachable: %v", config.Redis.Addr, err),
+			"Check Redis.Addr, the credentials and that Redis accepts connections from this node.")
+		return
+	}
+	entries, err := shared.readAll(ctx)
+	if err != nil {
+		d.add("redis", CheckFail, fmt.Sprintf("failed to read shared blocks: %v", err), "Check that the Redis user may run SCAN and GET.")
+		return
+	}
+	d.add("redis", CheckPass, fmt.Sprintf("%s reachable, %d shared blocks", config.Redis.Addr, len(entries)), "")
+}
+
+func (d *doctor) checkService() {
+	status, err := ReadStatus(config.StorageDir)
+	if err != nil {
+		d.add("service", CheckWarn, "no status file found", "Start the service with systemctl start tblocker.")
+		return
+	}
+
+	if age := time.Since(status.UpdatedAt); age > 3*statusUpdateInterval {
+		d.add("service", CheckWarn, fmt.Sprintf("status last updated %s ago", age.Truncate(time.Second)),
+			"The service does not seem to be running; check systemctl status tblocker.")
+		return
+	}
+	d.add("service", CheckPass, fmt.Sprintf("running as PID %d, version %s", status.PID, status.Version), "")
+}
+
+// readTailLines returns the complete lines in the last maxBytes of a file.
+func readTailLines(path string, maxBytes int64) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	offset := info.Size() - maxBytes
+	if offset < 0 {
+		offset = 0
+	}
+	data, err := io.ReadAll(io.NewSectionReader(file, offset, info.Size()-offset))
+	if err != nil {
+		return nil, err
+	}
+
+	if offset > 0 {
+		if newline := bytes.IndexByte(data, '\n'); newline >= 0 {
+			data = data[newline+1:]
+		}
+	}
+	return splitLines(data), nil
+}
+
+func splitLines(data []byte) []string {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), replayMaxLineSize)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// WriteDoctorReport prints the checks as text or JSON and returns whether
+// none of them failed.
+func WriteDoctorReport(checks []DoctorCheck, asJSON bool, out io.Writer) bool {
+	counts := make(map[string]int)
+	for _, check := range checks {
+		counts[check.Status]++
+	}
+
+	if asJSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(struct {
+			OK     bool          `json:"ok"`
+			Checks []DoctorCheck `json:"checks"`
+		}{counts[CheckFail] == 0, checks})
+		return counts[CheckFail] == 0
+	}
+
+	labels := map[string]string{CheckPass: "PASS", CheckWarn: "WARN", CheckFail: "FAIL", CheckSkip: "SKIP"}
+	for _, check := range checks {
+		fmt.Fprintf(out, "[%s] %s: %s\n", labels[check.Status], check.Name, check.Detail)
+		if check.Hint != "" && check.Status != CheckPass {
+			fmt.Fprintf(out, "       hint: %s\n", check.Hint)
+		}
+	}
+	fmt.Fprintf(out, "\n%d passed, %d warnings, %d failed, %d skipped\n",
+		counts[CheckPass], counts[CheckWarn], counts[CheckFail], counts[CheckSkip])
+
+	return counts[CheckFail] == 0
+}
@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"tblocker/config"
+	"testing"
+)
+
+func findCheck(checks []DoctorCheck, prefix string) *DoctorCheck {
+	for i := range checks {
+		if strings.HasPrefix(checks[i].Name, prefix) {
+			return &checks[i]
+		}
+	}
+	return nil
+}
+
+func TestDoctorLogSource(t *testing.T) {
+	loadPolicyTestConfig(t)
+
+	tempDir, err := os.MkdirTemp("", "doctor_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	logFile := filepath.Join(tempDir, "access.log")
+	if err := os.WriteFile(logFile, []byte(replayTestLog), 0644); err != nil {
+		t.Fatalf("Failed to write log file: %v", err)
+	}
+
+	d := &doctor{}
+	source := newLogSource(config.LogSource{Path: logFile})
+	d.checkLogSource(source, map[string]int64{logFile: int64(len(replayTestLog))})
+
+	if check := findCheck(d.checks, "log source"); check == nil || check.Status != CheckWarn {
+		t.Errorf("Expected warning for a log file that did not grow, got %+v", d.checks)
+	}
+	if check := findCheck(d.checks, "tags"); check == nil || check.Status != CheckPass || !strings.Contains(check.Detail, "found in 4 of the last 5 lines") {
+		t.Errorf("Expected tag to be found, got %+v", d.checks)
+	}
+
+	d = &doctor{}
+	if err := os.WriteFile(logFile, []byte("2024/01/02 15:04:05 from 1.2.3.4:5555 accepted tcp:example.com:443 [inbound >> DIRECT] email: 1.bob\n"), 0644); err != nil {
+		t.Fatalf("Failed to write log file: %v", err)
+	}
+	d.checkLogSource(source, map[string]int64{})
+	if check := findCheck(d.checks, "tags"); check == nil || check.Status != CheckWarn || check.Hint == "" {
+		t.Errorf("Expected warning with hint when the tag is missing, got %+v", d.checks)
+	}
+
+	d = &doctor{}
+	d.checkLogSource(newLogSource(config.LogSource{Path: filepath.Join(tempDir, "missing.log")}), nil)
+	if check := findCheck(d.checks, "log source"); check == nil || check.Status != CheckFail {
+		t.Errorf("Expected failure for a missing log file, got %+v", d.checks)
+	}
+}
+
+func TestReadTailLines(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "doctor_test_*.log")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.WriteString("first line\nsecond line\nthird line\n")
+	tmpFile.Close()
+
+	lines, err := readTailLines(tmpFile.Name(), 16)
+	if err != nil {
+		t.Fatalf("Failed to read lines: %v", err)
+	}
+	if len(lines) != 1 || lines[0] != "third line" {
+		t.Errorf("Expected only the complete last line, got %q", lines)
+	}
+}
+
+func TestDoctorStorageAndWebhook(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "doctor_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+	defer server.Close()
+
+	oldStorageDir, oldSend, oldURL := config.StorageDir, config.SendWebhook, config.WebhookURL
+	defer func() {
+		config.StorageDir, config.SendWebhook, config.WebhookURL = oldStorageDir, oldSend, oldURL
+	}()
+	config.StorageDir = tempDir
+	config.SendWebhook = true
+	config.WebhookURL = server.URL
+
+	d := &doctor{}
+	d.checkStorage()
+	d.checkWebhook()
+
+	if check := findCheck(d.checks, "storage"); check == nil || check.Status != CheckPass {
+		t.Errorf("Expected writable storage, got %+v", d.checks)
+	}
+	if check := findCheck(d.checks, "webhook"); check == nil || check.Status != CheckPass || !strings.Contains(check.Detail, "HTTP 405") {
+		t.Errorf("Expected reachable webhook, got %+v", d.checks)
+	}
+
+	config.WebhookURL = "http://127.0.0.1:1/hook"
+	d = &doctor{}
+	d.checkWebhook()
+	if check := findCheck(d.checks, "webhook"); check == nil || check.Status != CheckFail {
+		t.Errorf("Expected unreachable webhook to fail, got %+v", d.checks)
+	}
+}
+
+func TestWriteDoctorReport(t *testing.T) {
+	checks := []DoctorCheck{
+		{Name: "config", Status: CheckPass, Detail: "loaded"},
+		{Name: "firewall", Status: CheckFail, Detail: "missing", Hint: "start the service"},
+	}
+
+	var out bytes.Buffer
+	if WriteDoctorReport(checks, false, &out) {
+		t.Error("Expected report with a failed check not to be ok")
+	}
+	if !strings.Contains(out.String(), "[FAIL] firewall: missing\n       hint: start the service") {
+		t.Errorf("Unexpected text report:\n%s", out.String())
+	}
+
+	out.Reset()
+	WriteDoctorReport(checks[:1], true, &out)
+	var report struct {
+		OK     bool          `json:"ok"`
+		Checks []DoctorCheck `json:"checks"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+		t.Fatalf("Failed to parse JSON report: %v", err)
+	}
+	if !report.OK || len(report.Checks) != 1 {
+		t.Errorf("Unexpected JSON report: %+v", report)
+	}
+}
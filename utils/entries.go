@@ -0,0 +1,301 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+	"strings"
+	"tblocker/config"
+	"tblocker/parser"
+	"tblocker/storage"
+	"text/tabwriter"
+	"time"
+)
+
+var ErrEntryNotFound = errors.New("entry not found")
+
+// ParseEntryTarget splits a target given on the command line into an IP or,
+// for targets written as user:NAME, a username.
+func ParseEntryTarget(target string) (ip, username string) {
+	if name, isUser := strings.CutPrefix(target, storage.UserKeyPrefix); isUser {
+		return "", name
+	}
+	return target, ""
+}
+
+// NormalizeEntry validates a manually added entry and fills in its kind.
+// Blocks and bans target an IP, allow entries an IP or a user. Manual
+// entries belong to this node, so any origin is cleared.
+func NormalizeEntry(entry *storage.BlockedIP, now time.Time) error {
+	entry.Kind = entry.GetKind()
+	entry.Origin = ""
+
+	switch entry.Kind {
+	case storage.KindBlock, storage.KindBan:
+		if entry.IP == "" {
+			return fmt.Errorf("%s entries need an IP", entry.Kind)
+		}
+		if entry.Action != "" && entry.Action != "drop" && entry.Action != "throttle" {
+			return fmt.Errorf("unknown action %q, expected drop or throttle", entry.Action)
+		}
+	case storage.KindAllow:
+		if (entry.IP == "") == (entry.Username == "") {
+			return fmt.Errorf("allow entries need either an IP or a user")
+		}
+		if entry.Action != "" {
+			return fmt.Errorf("allow entries have no action")
+		}
+	default:
+		return fmt.Errorf("unknown kind %q, expected block, ban or allow", entry.Kind)
+	}
+
+	if entry.IP != "" {
+		addr, err := netip.ParseAddr(entry.IP)
+		if err != nil {
+			return fmt.Errorf("invalid IP address %q", entry.IP)
+		}
+		entry.IP = addr.String()
+	}
+
+	if entry.Kind == storage.KindBan {
+		entry.BlockedUntil = time.Time{}
+	} else if !entry.BlockedUntil.After(now) {
+		return fmt.Errorf("%s entries need an expiry in the future", entry.Kind)
+	}
+	return nil
+}
+
+// SaveEntry stores an entry without applying it, for use while the service
+// is not running. The service applies stored blocks and bans when it starts.
+func SaveEntry(store *storage.IPStorage, entry storage.BlockedIP) error {
+	if err := NormalizeEntry(&entry, time.Now()); err != nil {
+		return err
+	}
+	if entry.Kind == storage.KindAllow {
+		return store.AddAllowEntry(entry)
+	}
+	return store.AddBlockedEntry(entry)
+}
+
+// DeleteEntry removes an entry from storage without touching the firewall.
+func DeleteEntry(store *storage.IPStorage, kind, target string) error {
+	if kind == storage.KindAllow {
+		removed, err := store.RemoveAllowEntry(allowKeyForTarget(target))
+		if err == nil && !removed {
+			return ErrEntryNotFound
+		}
+		return err
+	}
+
+	info, exists := store.GetBlockedIPs()[normalizeIP(target)]
+	if !exists {
+		return ErrEntryNotFound
+	}
+	if err := checkEntryKind(info, kind); err != nil {
+		return err
+	}
+	return store.RemoveBlockedIP(normalizeIP(target))
+}
+
+// checkEntryKind refuses to remove a block or ban as an entry of another
+// kind, so removing a ban does not lift a plain block and the other way round.
+func checkEntryKind(info storage.BlockedIP, kind string) error {
+	if info.GetKind() != kind {
+		return fmt.Errorf("%s has a %s, not a %s", info.IP, info.GetKind(), kind)
+	}
+	return nil
+}
+
+// checkBanReplace refuses to replace a ban with a temporary block unless
+// forced, since the block would expire and lift the ban with it.
+func checkBanReplace(blocked map[string]storage.BlockedIP, entry storage.BlockedIP, force bool) error {
+	existing, exists := blocked[entry.IP]
+	if exists && !force && existing.GetKind() == storage.KindBan && entry.Kind != storage.KindBan {
+		return fmt.Errorf("%s is banned, force the entry to replace the ban with a %s", entry.IP, entry.Kind)
+	}
+	return nil
+}
+
+// ListEntries returns the blocks, bans and allow entries of a storage,
+// ordered by kind and target.
+func ListEntries(store *storage.IPStorage) []storage.BlockedIP {
+	var entries []storage.BlockedIP
+	for _, entry := range store.GetBlockedIPs() {
+		entry.Kind = entry.GetKind()
+		entries = append(entries, entry)
+	}
+	for _, entry := range store.GetAllowEntries() {
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Kind != entries[j].Kind {
+			return entries[i].Kind < entries[j].Kind
+		}
+		return storage.AllowKey(entries[i]) < storage.AllowKey(entries[j])
+	})
+	return entries
+}
+
+// AddEntry stores an entry in the running service and applies it: blocks
+// and bans go to the firewall, an allow entry lifts the temporary blocks of
+// its IP or user. Bans are only lifted by removing them, or replaced by a
+// block when force is set.
+func AddEntry(entry storage.BlockedIP, notify, force bool) error {
+	if err := NormalizeEntry(&entry, time.Now()); err != nil {
+		return err
+	}
+
+	if entry.Kind == storage.KindAllow {
+		if err := ipStorage.AddAllowEntry(entry); err != nil {
+			return err
+		}
+		monitorLog.Info("Allow entry added", entryAttrs(entry)...)
+		liftAllowedBlocks(entry)
+		return nil
+	}
+
+	if err := checkBanReplace(ipStorage.GetBlockedIPs(), entry, force); err != nil {
+		return err
+	}
+	if existing, exists := ipStorage.GetBlockedIPs()[entry.IP]; exists && (existing.Action == "throttle") != (entry.Action == "throttle") {
+		if err := unblockEntry(existing); err != nil {
+			return err
+		}
+	}
+	if err := ipStorage.AddBlockedEntry(entry); err != nil {
+		return err
+	}
+	dropped := applyAction(entry.IP, entry.Action)
+	shareBlock(entry)
+
+	attrs := append(entryAttrs(entry), "connections_dropped", dropped)
+	if entry.Kind == storage.KindBan {
+		monitorLog.Warn("IP banned", attrs...)
+	} else {
+		monitorLog.Warn("IP blocked", attrs...)
+	}
+
+	if notify && config.SendWebhook {
+		duration := 0
+		if !entry.Permanent() {
+			duration = int(time.Until(entry.BlockedUntil).Round(time.Minute) / time.Minute)
+		}
+		go sendWebhookEvent(webhookEvent{
+			Event:    parser.Event{IP: entry.IP, Username: entry.Username},
+			Action:   entry.Kind,
+			Duration: duration,
+			Reason:   entry.Reason,
+		})
+	}
+	return nil
+}
+
+// RemoveEntry removes an entry from the running service, lifting a block or
+// ban from the firewall.
+func RemoveEntry(kind, target string) error {
+	if kind == storage.KindAllow {
+		if err := DeleteEntry(ipStorage, kind, target); err != nil {
+			return err
+		}
+		monitorLog.Info("Allow entry removed", "target", target)
+		return nil
+	}
+
+	info, exists := ipStorage.GetBlockedIPs()[normalizeIP(target)]
+	if !exists {
+		return ErrEntryNotFound
+	}
+	if info.Origin != "" {
+		return mirroredEntryError(info)
+	}
+	if err := checkEntryKind(info, kind); err != nil {
+		return err
+	}
+	return unblockEntry(info)
+}
+
+// mirroredEntryError refuses to remove a block mirrored from another node,
+// which would only be mirrored again.
+func mirroredEntryError(info storage.BlockedIP) error {
+	origin := strings.TrimPrefix(info.Origin, redisOriginPrefix)
+	return fmt.Errorf("%s is mirrored from %s, remove it on that node", info.IP, origin)
+}
+
+func liftAllowedBlocks(allow storage.BlockedIP) {
+	for ip, info := range ipStorage.GetBlockedIPs() {
+		if info.GetKind() != storage.KindBlock {
+			continue
+		}
+		if ip != allow.IP && (allow.Username == "" || !matchesUsername(info, allow.Username)) {
+			continue
+		}
+		if err := unblockEntry(info); err != nil {
+			firewallLog.Error("Error unblocking allowed IP", "ip", ip, "error", err)
+		}
+	}
+}
+
+func matchesUsername(info storage.BlockedIP, username string) bool {
+	return info.Username == username || processUsername(findLogSource(info.Source), info.Username) == username
+}
+
+func allowKeyForTarget(target string) string {
+	ip, username := ParseEntryTarget(target)
+	return storage.AllowKey(storage.BlockedIP{IP: normalizeIP(ip), Username: username})
+}
+
+func normalizeIP(ip string) string {
+	if addr, err := netip.ParseAddr(ip); err == nil {
+		return addr.String()
+	}
+	return ip
+}
+
+func entryAttrs(entry storage.BlockedIP) []any {
+	attrs := []any{"kind", entry.Kind}
+	if entry.IP != "" {
+		attrs = append(attrs, "ip", entry.IP)
+	}
+	if entry.Username != "" {
+		attrs = append(attrs, "user", entry.Username)
+	}
+	if !entry.Permanent() {
+		attrs = append(attrs, "until", entry.BlockedUntil.Format(time.RFC3339))
+	}
+	if entry.Author != "" {
+		attrs = append(attrs, "author", entry.Author)
+	}
+	if entry.Origin != "" {
+		attrs = append(attrs, "origin", entry.Origin)
+	}
+	if entry.Reason != "" {
+		attrs = append(attrs, "reason", entry.Reason)
+	}
+	return attrs
+}
+
+// WriteEntries prints entries as a table.
+func WriteEntries(entries []storage.BlockedIP, now time.Time, out io.Writer) {
+	if len(entries) == 0 {
+		fmt.Fprintln(out, "No entries")
+		return
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tTARGET\tUSER\tEXPIRES\tORIGIN\tAUTHOR\tREASON")
+	for _, entry := range entries {
+		expires := "never"
+		if !entry.Permanent() {
+			expires = fmt.Sprintf("%s (in %s)", entry.BlockedUntil.Format(time.RFC3339), entry.BlockedUntil.Sub(now).Truncate(time.Second))
+		}
+		origin := entry.Origin
+		if origin == "" {
+			origin = "local"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", entry.GetKind(), storage.AllowKey(entry), entry.Username, expires, origin, entry.Author, entry.Reason)
+	}
+	w.Flush()
+}
@@ -0,0 +1,171 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"tblocker/config"
+	"tblocker/storage"
+	"testing"
+	"time"
+)
+
+func TestNormalizeEntry(t *testing.T) {
+	now := time.Now()
+	testCases := []struct {
+		entry storage.BlockedIP
+		valid bool
+	}{
+		{entry: storage.BlockedIP{IP: "1.2.3.4", BlockedUntil: now.Add(time.Hour)}, valid: true},
+		{entry: storage.BlockedIP{IP: "1.2.3.4", Kind: storage.KindBan}, valid: true},
+		{entry: storage.BlockedIP{Username: "bob", Kind: storage.KindAllow, BlockedUntil: now.Add(time.Hour)}, valid: true},
+		{entry: storage.BlockedIP{IP: "1.2.3.4"}, valid: false},
+		{entry: storage.BlockedIP{IP: "1.2.3", Kind: storage.KindBan}, valid: false},
+		{entry: storage.BlockedIP{Username: "bob", Kind: storage.KindBan}, valid: false},
+		{entry: storage.BlockedIP{IP: "1.2.3.4", Username: "bob", Kind: storage.KindAllow, BlockedUntil: now.Add(time.Hour)}, valid: false},
+		{entry: storage.BlockedIP{IP: "1.2.3.4", Kind: "pardon", BlockedUntil: now.Add(time.Hour)}, valid: false},
+		{entry: storage.BlockedIP{IP: "1.2.3.4", Kind: storage.KindBan, Action: "reject"}, valid: false},
+	}
+
+	for _, tc := range testCases {
+		entry := tc.entry
+		err := NormalizeEntry(&entry, now)
+		if tc.valid && err != nil {
+			t.Errorf("Expected %+v to be valid, got %v", tc.entry, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("Expected %+v to be invalid", tc.entry)
+		}
+	}
+
+	entry := storage.BlockedIP{IP: "2001:DB8::1", Kind: storage.KindBan, BlockedUntil: now.Add(time.Hour)}
+	if err := NormalizeEntry(&entry, now); err != nil || entry.IP != "2001:db8::1" || !entry.Permanent() {
+		t.Errorf("Expected normalized permanent ban, got %+v (%v)", entry, err)
+	}
+}
+
+func TestDetectorAllowEntry(t *testing.T) {
+	loadPolicyTestConfig(t)
+
+	source, err := replaySource("")
+	if err != nil {
+		t.Fatalf("Failed to get replay source: %v", err)
+	}
+
+	r := newReplayer(source, true)
+	r.detector.allowed = func(ip string, usernames []string, now time.Time) (storage.BlockedIP, bool) {
+		for _, username := range usernames {
+			if username == "bob" {
+				return storage.BlockedIP{Username: "bob", Kind: storage.KindAllow, Author: "support", Reason: "ticket 42"}, true
+			}
+		}
+		return storage.BlockedIP{}, false
+	}
+
+	result := r.process("2024/01/02 15:04:05 from 1.2.3.4:5555 accepted tcp:example.com:443 [inbound >> TORRENT] email: 1.bob")
+	if result.Verdict != verdictIgnore || result.Stage != stageAllowed {
+		t.Fatalf("Expected allowed user to be ignored, got %+v", result)
+	}
+	if !strings.Contains(result.Reason, "user bob is allowed") || !strings.Contains(result.Reason, "by support: ticket 42") {
+		t.Errorf("Unexpected reason %q", result.Reason)
+	}
+
+	result = r.process("2024/01/02 15:05:05 from 5.6.7.8:5555 accepted tcp:example.com:443 [inbound >> TORRENT] email: 2.alice")
+	if result.Verdict != verdictBlock {
+		t.Errorf("Expected other user to be blocked, got %+v", result)
+	}
+}
+
+func TestControlEntries(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "control_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store, err := storage.NewIPStorage(tempDir, func(string, time.Duration, string) {})
+	if err != nil {
+		t.Fatalf("Failed to create IP storage: %v", err)
+	}
+
+	oldStorage, oldStorageDir := ipStorage, config.StorageDir
+	defer func() { ipStorage, config.StorageDir = oldStorage, oldStorageDir }()
+	ipStorage, config.StorageDir = store, tempDir
+
+	client := NewControlClient(tempDir)
+	if _, err := client.ListEntries(); !errors.Is(err, ErrServiceNotRunning) {
+		t.Fatalf("Expected service not running without a socket, got %v", err)
+	}
+
+	StartControlServer()
+	defer os.Remove(filepath.Join(tempDir, controlSocketName))
+
+	allow := storage.BlockedIP{Username: "bob", Kind: storage.KindAllow, BlockedUntil: time.Now().Add(time.Hour), Author: "support"}
+	if err := client.AddEntry(allow, true, false); err != nil {
+		t.Fatalf("Failed to add allow entry: %v", err)
+	}
+	if err := client.AddEntry(storage.BlockedIP{IP: "bad", Kind: storage.KindBan}, true, false); err == nil || !strings.Contains(err.Error(), "invalid IP address") {
+		t.Errorf("Expected invalid IP error from the service, got %v", err)
+	}
+
+	entries, err := client.ListEntries()
+	if err != nil {
+		t.Fatalf("Failed to list entries: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Username != "bob" || entries[0].Author != "support" {
+		t.Errorf("Unexpected entries: %+v", entries)
+	}
+
+	var out bytes.Buffer
+	WriteEntries(entries, time.Now(), &out)
+	if !strings.Contains(out.String(), "allow  user:bob") {
+		t.Errorf("Unexpected entries table:\n%s", out.String())
+	}
+
+	if err := client.RemoveEntry(storage.KindAllow, "user:bob"); err != nil {
+		t.Fatalf("Failed to remove allow entry: %v", err)
+	}
+	if err := client.RemoveEntry(storage.KindAllow, "user:bob"); !errors.Is(err, ErrEntryNotFound) {
+		t.Errorf("Expected entry not found, got %v", err)
+	}
+}
+
+func TestEntryKindChecks(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "entries_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store, err := storage.NewIPStorage(tempDir, func(string, time.Duration, string) {})
+	if err != nil {
+		t.Fatalf("Failed to create IP storage: %v", err)
+	}
+	entries := offlineEntryStore{store: store}
+	block := storage.BlockedIP{IP: "1.1.1.1", Kind: storage.KindBlock, BlockedUntil: time.Now().Add(time.Hour)}
+
+	if err := entries.AddEntry(storage.BlockedIP{IP: "1.1.1.1", Kind: storage.KindBan}, false, false); err != nil {
+		t.Fatalf("Failed to add ban: %v", err)
+	}
+	if err := entries.AddEntry(block, false, false); err == nil {
+		t.Error("Expected a block not to replace a ban without force")
+	}
+	if err := entries.RemoveEntry(storage.KindBlock, "1.1.1.1"); err == nil {
+		t.Error("Expected removing a block not to lift a ban")
+	}
+	if kind := store.GetBlockedIPs()["1.1.1.1"].GetKind(); kind != storage.KindBan {
+		t.Fatalf("Expected the ban to stay, got %s", kind)
+	}
+
+	if err := entries.AddEntry(block, false, true); err != nil {
+		t.Fatalf("Expected a forced block to replace the ban: %v", err)
+	}
+	if err := entries.RemoveEntry(storage.KindBan, "1.1.1.1"); err == nil {
+		t.Error("Expected removing a ban not to lift a block")
+	}
+	if err := entries.RemoveEntry(storage.KindBlock, "1.1.1.1"); err != nil {
+		t.Errorf("Failed to remove block: %v", err)
+	}
+}
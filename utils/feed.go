@@ -0,0 +1,300 @@
+package utils
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"tblocker/config"
+	"tblocker/logging"
+	"tblocker/storage"
+	"time"
+)
+
+var feedLog = logging.For("feed")
+
+// mirrorTolerance is how far the expiry of a mirrored block may drift from
+// the one announced by its peer before the block is updated.
+const mirrorTolerance = time.Minute
+
+// feedEntry is a block or ban published in a feed. Remaining is the number
+// of seconds the block still lasts, so peers need not share a clock.
+type feedEntry struct {
+	IP        string    `json:"ip"`
+	Username  string    `json:"username,omitempty"`
+	Kind      string    `json:"kind"`
+	Reason    string    `json:"reason,omitempty"`
+	Action    string    `json:"action,omitempty"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+	Remaining int64     `json:"remaining,omitempty"`
+	Origin    string    `json:"origin"`
+}
+
+type feedDocument struct {
+	Origin      string      `json:"origin"`
+	GeneratedAt time.Time   `json:"generated_at"`
+	Entries     []feedEntry `json:"entries"`
+}
+
+// StartFeed removes the blocks mirrored from peers that are no longer
+// configured, serves the feed of this node when Feed.Addr is set and
+// subscribes to the feeds of the configured peers.
+func StartFeed() {
+	removeUnsubscribedMirrors()
+
+	if config.Feed.Addr != "" {
+		go serveFeed()
+	}
+	for _, peer := range config.Feed.Peers {
+		go newFeedSubscriber(peer).run()
+	}
+}
+
+func serveFeed() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /feed", feedHandler)
+	server := &http.Server{Addr: config.Feed.Addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	var err error
+	if config.Feed.TLSCertFile != "" {
+		feedLog.Info("Serving block feed", "url", "https://"+config.Feed.Addr+"/feed", "origin", config.Feed.Origin)
+		err = server.ListenAndServeTLS(config.Feed.TLSCertFile, config.Feed.TLSKeyFile)
+	} else {
+		feedLog.Info("Serving block feed", "url", "http://"+config.Feed.Addr+"/feed", "origin", config.Feed.Origin)
+		err = server.ListenAndServe()
+	}
+	feedLog.Error("Error serving block feed", "error", err)
+}
+
+func feedHandler(w http.ResponseWriter, r *http.Request) {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(config.Feed.Token)) != 1 {
+		feedLog.Warn("Rejected feed request", "remote", r.RemoteAddr)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buildFeed(ipStorage.GetBlockedIPs(), config.Feed.Origin, time.Now()))
+}
+
+// buildFeed lists the active blocks and bans created on this node. Mirrored
+// blocks are left out, so blocks never travel back to where they came from.
+func buildFeed(entries map[string]storage.BlockedIP, origin string, now time.Time) feedDocument {
+	doc := feedDocument{Origin: origin, GeneratedAt: now, Entries: []feedEntry{}}
+	for _, entry := range entries {
+		if entry.Origin != "" || !entry.Active(now) {
+			continue
+		}
+		doc.Entries = append(doc.Entries, publishedEntry(entry, origin, now))
+	}
+
+	sort.Slice(doc.Entries, func(i, j int) bool { return doc.Entries[i].IP < doc.Entries[j].IP })
+	return doc
+}
+
+func publishedEntry(entry storage.BlockedIP, origin string, now time.Time) feedEntry {
+	published := feedEntry{
+		IP:       entry.IP,
+		Username: entry.Username,
+		Kind:     entry.GetKind(),
+		Reason:   entry.Reason,
+		Action:   entry.Action,
+		Origin:   origin,
+	}
+	if !entry.Permanent() {
+		published.ExpiresAt = entry.BlockedUntil
+		published.Remaining = int64(entry.BlockedUntil.Sub(now).Round(time.Second) / time.Second)
+	}
+	return published
+}
+
+type feedSubscriber struct {
+	peer   config.FeedPeer
+	client *http.Client
+}
+
+func newFeedSubscriber(peer config.FeedPeer) *feedSubscriber {
+	return &feedSubscriber{peer: peer, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+func (s *feedSubscriber) run() {
+	feedLog.Info("Subscribed to peer feed", "peer", s.peer.Name, "url", s.peer.URL)
+	failing := false
+	for {
+		if err := s.sync(); err != nil {
+			// Mirrored blocks stay until they expire while the peer is down.
+			if !failing {
+				feedLog.Warn("Error fetching peer feed", "peer", s.peer.Name, "error", err)
+			}
+			failing = true
+		} else if failing {
+			feedLog.Info("Peer feed recovered", "peer", s.peer.Name)
+			failing = false
+		}
+		time.Sleep(time.Duration(config.Feed.Interval) * time.Second)
+	}
+}
+
+func (s *feedSubscriber) sync() error {
+	doc, err := s.fetch()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	add, remove := planMirror(s.peer.Name, doc, ipStorage.GetBlockedIPs(), ipStorage.FindAllow, now)
+	for _, entry := range remove {
+		feedLog.Info("Removing block no longer published by peer", "peer", s.peer.Name, "ip", entry.IP)
+		if err := unblockEntry(entry); err != nil {
+			firewallLog.Error("Error unblocking IP", "ip", entry.IP, "error", err)
+		}
+	}
+	for _, entry := range add {
+		mirrorEntry(entry, feedLog)
+	}
+	return nil
+}
+
+func (s *feedSubscriber) fetch() (feedDocument, error) {
+	var doc feedDocument
+	req, err := http.NewRequest(http.MethodGet, s.peer.URL, nil)
+	if err != nil {
+		return doc, err
+	}
+	if s.peer.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.peer.Token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return doc, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return doc, fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return doc, fmt.Errorf("invalid feed: %v", err)
+	}
+	return doc, nil
+}
+
+// planMirror compares the feed of a peer with the stored blocks. Blocks
+// that originate here, are bypassed or allowed, or that the node already
+// holds from elsewhere are not mirrored. Blocks mirrored from the peer that
+// it no longer publishes are removed.
+func planMirror(peer string, doc feedDocument, existing map[string]storage.BlockedIP,
+	allowed func(ip string, usernames []string, now time.Time) (storage.BlockedIP, bool), now time.Time) (add, remove []storage.BlockedIP) {
+	wanted := make(map[string]struct{}, len(doc.Entries))
+	for _, published := range doc.Entries {
+		if published.Origin == config.Feed.Origin {
+			continue
+		}
+		entry, accepted := acceptMirror(published, peer, allowed, now)
+		if !accepted {
+			continue
+		}
+		wanted[entry.IP] = struct{}{}
+
+		if current, exists := existing[entry.IP]; exists && current.Active(now) {
+			if current.Origin != peer || sameMirror(current, entry) {
+				continue
+			}
+		}
+		add = append(add, entry)
+	}
+
+	for ip, entry := range existing {
+		if _, exists := wanted[ip]; !exists && entry.Origin == peer {
+			remove = append(remove, entry)
+		}
+	}
+	sort.Slice(remove, func(i, j int) bool { return remove[i].IP < remove[j].IP })
+	return add, remove
+}
+
+// acceptMirror turns a published block into a mirrored entry labelled with
+// origin. Expired, invalid, bypassed and allowed blocks are not accepted.
+func acceptMirror(published feedEntry, origin string,
+	allowed func(ip string, usernames []string, now time.Time) (storage.BlockedIP, bool), now time.Time) (storage.BlockedIP, bool) {
+	if published.Kind != storage.KindBlock && published.Kind != storage.KindBan {
+		return storage.BlockedIP{}, false
+	}
+	entry := storage.BlockedIP{
+		IP:       published.IP,
+		Username: published.Username,
+		Kind:     published.Kind,
+		Reason:   published.Reason,
+		Action:   published.Action,
+	}
+	if entry.Kind == storage.KindBlock {
+		if published.Remaining <= 0 {
+			return storage.BlockedIP{}, false
+		}
+		entry.BlockedUntil = now.Add(time.Duration(published.Remaining) * time.Second)
+	}
+	if err := NormalizeEntry(&entry, now); err != nil || IsBypassedIP(entry.IP) {
+		return storage.BlockedIP{}, false
+	}
+	if _, isAllowed := allowed(entry.IP, []string{entry.Username}, now); isAllowed {
+		return storage.BlockedIP{}, false
+	}
+	entry.Origin = origin
+	return entry, true
+}
+
+func sameMirror(current, entry storage.BlockedIP) bool {
+	if current.GetKind() != entry.GetKind() || current.Action != entry.Action || current.Username != entry.Username {
+		return false
+	}
+	drift := current.BlockedUntil.Sub(entry.BlockedUntil)
+	return drift < mirrorTolerance && drift > -mirrorTolerance
+}
+
+// mirrorEntry stores and applies a block published by another node.
+// Mirrored blocks send no webhooks, the node that created them already did.
+func mirrorEntry(entry storage.BlockedIP, logger *slog.Logger) {
+	if existing, exists := ipStorage.GetBlockedIPs()[entry.IP]; exists && (existing.Action == "throttle") != (entry.Action == "throttle") {
+		if err := unblockEntry(existing); err != nil {
+			firewallLog.Error("Error unblocking IP", "ip", entry.IP, "error", err)
+			return
+		}
+	}
+	if err := ipStorage.AddBlockedEntry(entry); err != nil {
+		storageLog.Error("Error storing mirrored block", "ip", entry.IP, "error", err)
+		return
+	}
+	applyAction(entry.IP, entry.Action)
+	logger.Info("Mirrored block", entryAttrs(entry)...)
+}
+
+// removeUnsubscribedMirrors lifts the blocks mirrored from peers that were
+// removed from the configuration, and those mirrored from Redis once it is
+// no longer configured.
+func removeUnsubscribedMirrors() {
+	subscribed := make(map[string]struct{}, len(config.Feed.Peers))
+	for _, peer := range config.Feed.Peers {
+		subscribed[peer.Name] = struct{}{}
+	}
+
+	for ip, entry := range ipStorage.GetBlockedIPs() {
+		if strings.HasPrefix(entry.Origin, redisOriginPrefix) {
+			if config.Redis.Addr != "" {
+				continue
+			}
+		} else if _, exists := subscribed[entry.Origin]; entry.Origin == "" || exists {
+			continue
+		}
+		feedLog.Info("Removing block mirrored from unsubscribed peer", "peer", entry.Origin, "ip", ip)
+		if err := unblockEntry(entry); err != nil {
+			firewallLog.Error("Error unblocking IP", "ip", ip, "error", err)
+		}
+	}
+}
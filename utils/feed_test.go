@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"tblocker/config"
+	"tblocker/storage"
+	"testing"
+	"time"
+)
+
+func noAllows(string, []string, time.Time) (storage.BlockedIP, bool) {
+	return storage.BlockedIP{}, false
+}
+
+func TestBuildFeed(t *testing.T) {
+	now := time.Now()
+	entries := map[string]storage.BlockedIP{
+		"1.1.1.1": {IP: "1.1.1.1", Username: "bob", BlockedUntil: now.Add(10 * time.Minute), Reason: "torrent"},
+		"2.2.2.2": {IP: "2.2.2.2", Kind: storage.KindBan},
+		"3.3.3.3": {IP: "3.3.3.3", BlockedUntil: now.Add(-time.Minute)},
+		"4.4.4.4": {IP: "4.4.4.4", BlockedUntil: now.Add(time.Hour), Origin: "node-b"},
+	}
+
+	doc := buildFeed(entries, "node-a", now)
+	if doc.Origin != "node-a" || len(doc.Entries) != 2 {
+		t.Fatalf("Expected two local entries, got %+v", doc)
+	}
+	block, ban := doc.Entries[0], doc.Entries[1]
+	if block.IP != "1.1.1.1" || block.Username != "bob" || block.Kind != storage.KindBlock || block.Remaining != 600 || block.Origin != "node-a" {
+		t.Errorf("Unexpected block %+v", block)
+	}
+	if ban.IP != "2.2.2.2" || ban.Kind != storage.KindBan || ban.Remaining != 0 || !ban.ExpiresAt.IsZero() {
+		t.Errorf("Unexpected ban %+v", ban)
+	}
+}
+
+func TestPlanMirror(t *testing.T) {
+	oldOrigin := config.Feed.Origin
+	defer func() { config.Feed.Origin = oldOrigin }()
+	config.Feed.Origin = "node-a"
+
+	now := time.Now()
+	doc := feedDocument{Origin: "node-b", Entries: []feedEntry{
+		{IP: "1.1.1.1", Kind: storage.KindBlock, Remaining: 600, Username: "bob", Origin: "node-b"},
+		{IP: "2.2.2.2", Kind: storage.KindBan, Origin: "node-b"},
+		{IP: "3.3.3.3", Kind: storage.KindBlock, Remaining: 600, Origin: "node-b"},
+		{IP: "4.4.4.4", Kind: storage.KindBlock, Remaining: 600, Origin: "node-a"},
+		{IP: "5.5.5.5", Kind: storage.KindBlock, Remaining: 600, Origin: "node-b"},
+		{IP: "6.6.6.6", Kind: storage.KindBlock, Remaining: 600, Origin: "node-b"},
+		{IP: "7.7.7.7", Kind: storage.KindAllow, Remaining: 600, Origin: "node-b"},
+	}}
+	existing := map[string]storage.BlockedIP{
+		"2.2.2.2": {IP: "2.2.2.2", Kind: storage.KindBan, Origin: "node-b"},
+		"3.3.3.3": {IP: "3.3.3.3", Kind: storage.KindBlock, BlockedUntil: now.Add(time.Hour)},
+		"8.8.8.8": {IP: "8.8.8.8", Kind: storage.KindBlock, BlockedUntil: now.Add(time.Hour), Origin: "node-b"},
+		"9.9.9.9": {IP: "9.9.9.9", Kind: storage.KindBlock, BlockedUntil: now.Add(time.Hour), Origin: "node-c"},
+	}
+	allowed := func(ip string, usernames []string, now time.Time) (storage.BlockedIP, bool) {
+		return storage.BlockedIP{}, ip == "6.6.6.6"
+	}
+
+	add, remove := planMirror("node-b", doc, existing, allowed, now)
+	if len(add) != 2 || add[0].IP != "1.1.1.1" || add[1].IP != "5.5.5.5" {
+		t.Fatalf("Expected to mirror 1.1.1.1 and 5.5.5.5, got %+v", add)
+	}
+	if add[0].Origin != "node-b" || add[0].Username != "bob" || add[0].BlockedUntil.Sub(now) != 10*time.Minute {
+		t.Errorf("Unexpected mirrored block %+v", add[0])
+	}
+	if len(remove) != 1 || remove[0].IP != "8.8.8.8" {
+		t.Errorf("Expected to remove 8.8.8.8, got %+v", remove)
+	}
+
+	existing["1.1.1.1"] = add[0]
+	add, _ = planMirror("node-b", doc, existing, allowed, now.Add(5*time.Second))
+	if len(add) != 1 || add[0].IP != "5.5.5.5" {
+		t.Errorf("Expected unchanged mirror to be kept, got %+v", add)
+	}
+
+	_, remove = planMirror("node-b", feedDocument{}, existing, noAllows, now)
+	if len(remove) != 3 {
+		t.Errorf("Expected all node-b mirrors to be removed from an empty feed, got %+v", remove)
+	}
+}
+
+func TestFeedSubscriberFetch(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "feed_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store, err := storage.NewIPStorage(tempDir, func(string, time.Duration, string) {})
+	if err != nil {
+		t.Fatalf("Failed to create IP storage: %v", err)
+	}
+	if err := store.AddBlockedEntry(storage.BlockedIP{IP: "1.1.1.1", Kind: storage.KindBan}); err != nil {
+		t.Fatalf("Failed to add ban: %v", err)
+	}
+
+	oldStorage, oldFeed := ipStorage, config.Feed
+	defer func() { ipStorage, config.Feed = oldStorage, oldFeed }()
+	ipStorage = store
+	config.Feed = config.FeedConfig{Token: "secret", Origin: "node-b"}
+
+	server := httptest.NewServer(http.HandlerFunc(feedHandler))
+	defer server.Close()
+
+	doc, err := newFeedSubscriber(config.FeedPeer{Name: "node-b", URL: server.URL, Token: "secret"}).fetch()
+	if err != nil {
+		t.Fatalf("Failed to fetch feed: %v", err)
+	}
+	if doc.Origin != "node-b" || len(doc.Entries) != 1 || doc.Entries[0].IP != "1.1.1.1" {
+		t.Errorf("Unexpected feed %+v", doc)
+	}
+
+	if _, err := newFeedSubscriber(config.FeedPeer{Name: "node-b", URL: server.URL, Token: "wrong"}).fetch(); err == nil {
+		t.Error("Expected a wrong token to be rejected")
+	}
+	if _, err := newFeedSubscriber(config.FeedPeer{Name: "node-b", URL: server.URL}).fetch(); err == nil {
+		t.Error("Expected a missing token to be rejected")
+	}
+}
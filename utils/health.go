@@ -0,0 +1,276 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"tblocker/config"
+	"tblocker/systemd"
+	"time"
+)
+
+const (
+	healthStallTimeout  = time.Minute
+	healthCheckInterval = 30 * time.Second
+	sourceStartTimeout  = 10 * time.Second
+)
+
+// sourceActivity is updated by the goroutine reading a log source so that
+// health checks can tell a stopped or stuck reader from an idle log.
+type sourceActivity struct {
+	running   atomic.Bool
+	busySince atomic.Int64
+	lastLine  atomic.Int64
+}
+
+func (a *sourceActivity) begin() {
+	a.busySince.Store(time.Now().UnixNano())
+}
+
+func (a *sourceActivity) end() {
+	a.lastLine.Store(time.Now().UnixNano())
+	a.busySince.Store(0)
+}
+
+type componentHealth struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+	Detail  string `json:"detail,omitempty"`
+
+	// waiting marks a problem a restart would not fix: the reader of a
+	// missing log file waits for it to appear.
+	waiting bool
+}
+
+type healthReport struct {
+	Status     string            `json:"status"`
+	Components []componentHealth `json:"components"`
+}
+
+func (r healthReport) healthy() bool {
+	return r.Status == "ok"
+}
+
+// feedsWatchdog reports whether systemd should be told the service works:
+// every component is healthy or only waits for its log file.
+func (r healthReport) feedsWatchdog() bool {
+	for _, component := range r.Components {
+		if !component.Healthy && !component.waiting {
+			return false
+		}
+	}
+	return true
+}
+
+func (r healthReport) describeProblems() string {
+	var problems []string
+	for _, component := range r.Components {
+		if !component.Healthy {
+			problems = append(problems, component.Name+": "+component.Detail)
+		}
+	}
+	return strings.Join(problems, "; ")
+}
+
+func checkHealth(now time.Time) healthReport {
+	var components []componentHealth
+	for _, source := range logSources {
+		components = append(components, checkSourceHealth(source, now))
+	}
+	components = append(components, checkFirewallHealth(), checkStorageHealth())
+
+	report := healthReport{Status: "ok", Components: components}
+	for _, component := range components {
+		if !component.Healthy {
+			report.Status = "unhealthy"
+		}
+	}
+	return report
+}
+
+func checkSourceHealth(source *logSource, now time.Time) componentHealth {
+	health := componentHealth{Name: "source " + source.describe() + source.logSuffix()}
+
+	if !source.activity.running.Load() {
+		health.Detail = "reader is not running"
+		return health
+	}
+
+	if busySince := source.activity.busySince.Load(); busySince != 0 {
+		if busy := now.Sub(time.Unix(0, busySince)); busy > healthStallTimeout {
+			health.Detail = fmt.Sprintf("stalled on a line for %s", busy.Truncate(time.Second))
+			return health
+		}
+	}
+
+	if source.sourceType == "file" || source.sourceType == "" {
+		if _, err := os.Stat(source.path); err != nil {
+			health.Detail = fmt.Sprintf("log file is missing: %v", err)
+			health.waiting = true
+			return health
+		}
+	}
+
+	health.Healthy = true
+	if lastLine := source.activity.lastLine.Load(); lastLine != 0 {
+		health.Detail = "last line at " + time.Unix(0, lastLine).Format(time.RFC3339)
+	}
+	return health
+}
+
+func checkFirewallHealth() componentHealth {
+	health := componentHealth{Name: "firewall"}
+
+	if firewallManager == nil {
+		health.Detail = "firewall manager not initialized"
+		return health
+	}
+	if _, err := firewallManager.GetBlockedIPs(); err != nil {
+		health.Detail = fmt.Sprintf("%s: %v", firewallManager.GetFirewallName(), err)
+		return health
+	}
+
+	health.Healthy = true
+	health.Detail = firewallManager.GetFirewallName()
+	return health
+}
+
+func checkStorageHealth() componentHealth {
+	health := componentHealth{Name: "storage"}
+
+	if ipStorage == nil {
+		health.Detail = "IP storage not initialized"
+		return health
+	}
+
+	info, err := os.Stat(config.StorageDir)
+	if err == nil && !info.IsDir() {
+		err = fmt.Errorf("not a directory")
+	}
+	if err != nil {
+		health.Detail = fmt.Sprintf("storage directory is not accessible: %v", err)
+		return health
+	}
+
+	health.Healthy = true
+	return health
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	report := checkHealth(time.Now())
+
+	w.Header().Set("Content-Type", "application/json")
+	if !report.healthy() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// StartHealthMonitor serves /healthz when HealthAddr is set. Systemd is told
+// the service is ready by StartLogMonitor, once the log sources are started.
+func StartHealthMonitor() {
+	if config.HealthAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/healthz", healthHandler)
+		go func() {
+			monitorLog.Info("Serving health endpoint", "url", "http://"+config.HealthAddr+"/healthz")
+			if err := http.ListenAndServe(config.HealthAddr, mux); err != nil {
+				monitorLog.Error("Error serving health endpoint", "error", err)
+			}
+		}()
+	}
+}
+
+// notifySystemd tells systemd the service is ready and then feeds its
+// watchdog, unless the service does not run under systemd.
+func notifySystemd() {
+	if notifyReady() {
+		feedWatchdog()
+	}
+}
+
+// notifyReady tells systemd the service is ready once the readers of all log
+// sources run, or after sourceStartTimeout, and reports whether systemd was
+// notified.
+func notifyReady() bool {
+	deadline := time.Now().Add(sourceStartTimeout)
+	for !sourcesRunning() && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	sent, err := systemd.Notify("READY=1\nSTATUS=" + describeRunningStatus())
+	if err != nil {
+		monitorLog.Warn("Failed to notify systemd", "error", err)
+	}
+	return sent
+}
+
+// feedWatchdog reports the health to systemd and feeds its watchdog while
+// the log readers, storage and firewall are healthy, so systemd restarts
+// the service when one of them fails or stalls.
+func feedWatchdog() {
+	interval := healthCheckInterval
+	timeout, err := systemd.WatchdogTimeout()
+	if err != nil {
+		monitorLog.Warn("Ignoring systemd watchdog", "error", err)
+	}
+	if timeout > 0 {
+		interval = timeout / 4
+		monitorLog.Info("Feeding systemd watchdog", "interval", interval)
+	}
+
+	watchdogLoop(interval, timeout > 0)
+}
+
+func sourcesRunning() bool {
+	for _, source := range logSources {
+		if !source.activity.running.Load() {
+			return false
+		}
+	}
+	return true
+}
+
+func watchdogLoop(interval time.Duration, watchdog bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	wasHealthy := true
+	for range ticker.C {
+		report := checkHealth(time.Now())
+
+		if report.healthy() && !wasHealthy {
+			monitorLog.Info("All components are healthy again")
+		}
+		if !report.healthy() && wasHealthy {
+			monitorLog.Error("Unhealthy", "problems", report.describeProblems())
+		}
+		wasHealthy = report.healthy()
+
+		if _, err := systemd.Notify(watchdogState(report, watchdog)); err != nil {
+			monitorLog.Warn("Failed to notify systemd", "error", err)
+		}
+	}
+}
+
+func watchdogState(report healthReport, watchdog bool) string {
+	state := "STATUS=" + describeRunningStatus()
+	if !report.healthy() {
+		state = "STATUS=Unhealthy: " + report.describeProblems()
+	}
+	if watchdog && report.feedsWatchdog() {
+		state = "WATCHDOG=1\n" + state
+	}
+	return state
+}
+
+func describeRunningStatus() string {
+	blocked := 0
+	if ipStorage != nil {
+		blocked = len(ipStorage.GetBlockedIPs())
+	}
+	return fmt.Sprintf("Monitoring %d log sources, %d IPs blocked", len(logSources), blocked)
+}
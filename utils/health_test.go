@@ -0,0 +1,157 @@
+package utils
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"tblocker/config"
+	"tblocker/storage"
+	"testing"
+	"time"
+)
+
+func TestCheckSourceHealth(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "health_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	logFile := filepath.Join(tempDir, "access.log")
+	if err := os.WriteFile(logFile, nil, 0644); err != nil {
+		t.Fatalf("Failed to create log file: %v", err)
+	}
+
+	source := &logSource{sourceType: "file", path: logFile}
+	now := time.Now()
+
+	if health := checkSourceHealth(source, now); health.Healthy {
+		t.Error("Expected source whose reader is not running to be unhealthy")
+	}
+
+	source.activity.running.Store(true)
+	if health := checkSourceHealth(source, now); !health.Healthy {
+		t.Errorf("Expected idle source to be healthy, got %s", health.Detail)
+	}
+
+	source.activity.busySince.Store(now.Add(-2 * healthStallTimeout).UnixNano())
+	if health := checkSourceHealth(source, now); health.Healthy || !strings.Contains(health.Detail, "stalled") {
+		t.Errorf("Expected stalled source to be unhealthy, got %+v", health)
+	}
+	source.activity.end()
+
+	os.Remove(logFile)
+	if health := checkSourceHealth(source, now); health.Healthy || !strings.Contains(health.Detail, "missing") {
+		t.Errorf("Expected source with missing log file to be unhealthy, got %+v", health)
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "health_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	oldStorageDir, oldStorage, oldSources := config.StorageDir, ipStorage, logSources
+	defer func() {
+		config.StorageDir, ipStorage, logSources = oldStorageDir, oldStorage, oldSources
+	}()
+
+	config.StorageDir = tempDir
+	logSources = nil
+	ipStorage, err = storage.NewIPStorage(tempDir, func(string, time.Duration, string) {})
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+
+	recorder := httptest.NewRecorder()
+	healthHandler(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 without a firewall manager, got %d", recorder.Code)
+	}
+
+	var report healthReport
+	if err := json.Unmarshal(recorder.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Failed to parse health report: %v", err)
+	}
+
+	healthy := make(map[string]bool)
+	for _, component := range report.Components {
+		healthy[component.Name] = component.Healthy
+	}
+	if report.Status != "unhealthy" || healthy["firewall"] || !healthy["storage"] {
+		t.Errorf("Unexpected health report: %+v", report)
+	}
+}
+
+func TestNotifyReadyWaitsForSources(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "health_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	socket := filepath.Join(tempDir, "notify.sock")
+	listener, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("Failed to listen on %s: %v", socket, err)
+	}
+	defer listener.Close()
+	t.Setenv("NOTIFY_SOCKET", socket)
+	t.Setenv("WATCHDOG_USEC", "")
+
+	oldSources := logSources
+	defer func() { logSources = oldSources }()
+	source := &logSource{sourceType: "file", path: filepath.Join(tempDir, "access.log")}
+	logSources = []*logSource{source}
+
+	done := make(chan bool)
+	go func() { done <- notifyReady() }()
+	// logSources is restored only after notifyReady stopped reading it.
+	defer func() { <-done }()
+
+	buf := make([]byte, 256)
+	listener.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if n, _, err := listener.ReadFrom(buf); err == nil {
+		t.Fatalf("Expected no notification before the source runs, got %q", buf[:n])
+	}
+
+	source.activity.running.Store(true)
+	listener.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := listener.ReadFrom(buf)
+	if err != nil || !strings.HasPrefix(string(buf[:n]), "READY=1") {
+		t.Errorf("Expected READY once the source runs, got %q (%v)", buf[:n], err)
+	}
+}
+
+func TestWatchdogState(t *testing.T) {
+	stalled := healthReport{Status: "unhealthy", Components: []componentHealth{{Name: "source a.log", Detail: "stalled on a line for 2m0s"}}}
+
+	state := watchdogState(stalled, true)
+	if strings.Contains(state, "WATCHDOG=1") || !strings.Contains(state, "stalled on a line") {
+		t.Errorf("Expected no watchdog ping with the problem in the status, got %q", state)
+	}
+
+	missing := healthReport{Status: "unhealthy", Components: []componentHealth{
+		{Name: "source a.log", Detail: "log file is missing", waiting: true},
+		{Name: "storage", Healthy: true},
+	}}
+	if state := watchdogState(missing, true); !strings.HasPrefix(state, "WATCHDOG=1\n") || !strings.Contains(state, "log file is missing") {
+		t.Errorf("Expected the watchdog to be fed while only waiting for a log file, got %q", state)
+	}
+
+	broken := missing
+	broken.Components = append([]componentHealth{{Name: "firewall", Detail: "iptables not available"}}, missing.Components...)
+	if state := watchdogState(broken, true); strings.Contains(state, "WATCHDOG=1") {
+		t.Errorf("Expected no watchdog ping with a failing firewall, got %q", state)
+	}
+	if state := watchdogState(healthReport{Status: "ok"}, false); strings.Contains(state, "WATCHDOG") {
+		t.Errorf("Expected no watchdog ping without a watchdog, got %q", state)
+	}
+}
@@ -0,0 +1,216 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"tblocker/config"
+	"time"
+)
+
+const journalCursorSaveInterval = time.Second
+
+var journalctlCommand = "journalctl"
+
+type journalExportReader struct {
+	r *bufio.Reader
+}
+
+func newJournalExportReader(r io.Reader) *journalExportReader {
+	return &journalExportReader{r: bufio.NewReader(r)}
+}
+
+// Next returns the fields of the next entry in journal export format. Text
+// fields are encoded as KEY=value lines, binary fields as the key name
+// followed by a little-endian 64-bit length and the raw data.
+func (j *journalExportReader) Next() (map[string]string, error) {
+	entry := make(map[string]string)
+
+	for {
+		line, err := j.r.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF && len(entry) > 0 && len(line) == 0 {
+				return entry, nil
+			}
+			if err == io.EOF && len(line) > 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		line = line[:len(line)-1]
+		if len(line) == 0 {
+			if len(entry) == 0 {
+				continue
+			}
+			return entry, nil
+		}
+
+		if eq := bytes.IndexByte(line, '='); eq >= 0 {
+			entry[string(line[:eq])] = string(line[eq+1:])
+			continue
+		}
+
+		var size uint64
+		if err := binary.Read(j.r, binary.LittleEndian, &size); err != nil {
+			return nil, fmt.Errorf("failed to read size of binary field %s: %v", line, err)
+		}
+
+		data := make([]byte, size+1)
+		if _, err := io.ReadFull(j.r, data); err != nil {
+			return nil, fmt.Errorf("failed to read binary field %s: %v", line, err)
+		}
+		if data[size] != '\n' {
+			return nil, fmt.Errorf("binary field %s is not terminated by newline", line)
+		}
+
+		entry[string(line)] = string(data[:size])
+	}
+}
+
+func tailJournalSource(source *logSource) {
+	cursorFile := journalCursorPath(source)
+
+	for {
+		if err := followJournal(source, cursorFile); err != nil {
+			source.logger().Error("Error reading journal", "input", source.describe(), "error", err)
+		}
+		source.logger().Info("Restarting journal reader in 5 seconds", "input", source.describe())
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func followJournal(source *logSource, cursorFile string) error {
+	cursor, err := loadJournalCursor(cursorFile)
+	if err != nil && !os.IsNotExist(err) {
+		source.logger().Warn("Failed to read journal cursor", "path", cursorFile, "error", err)
+	}
+
+	cmd := exec.Command(journalctlCommand, journalctlArgs(source, cursor)...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start journalctl: %v", err)
+	}
+
+	if cursor != "" {
+		source.logger().Info("Following journal after saved cursor", "input", source.describe())
+	} else {
+		source.logger().Info("Following journal from the current end", "input", source.describe())
+	}
+
+	source.activity.running.Store(true)
+	defer source.activity.running.Store(false)
+
+	reader := newJournalExportReader(stdout)
+	lastSave := time.Now()
+
+	var readErr error
+	for {
+		entry, err := reader.Next()
+		if err != nil {
+			if err != io.EOF {
+				readErr = fmt.Errorf("failed to parse journal export stream: %v", err)
+			}
+			break
+		}
+
+		if message, exists := entry["MESSAGE"]; exists {
+			processLogLine(source, message)
+		}
+
+		if entryCursor := entry["__CURSOR"]; entryCursor != "" {
+			cursor = entryCursor
+			if time.Since(lastSave) >= journalCursorSaveInterval {
+				if err := saveJournalCursor(cursorFile, cursor); err != nil {
+					source.logger().Warn("Failed to save journal cursor", "error", err)
+				}
+				lastSave = time.Now()
+			}
+		}
+	}
+
+	if cursor != "" {
+		if err := saveJournalCursor(cursorFile, cursor); err != nil {
+			source.logger().Warn("Failed to save journal cursor", "error", err)
+		}
+	}
+
+	if readErr != nil {
+		// Nobody reads the output any more, so journalctl would never exit.
+		cmd.Process.Kill()
+		cmd.Wait()
+		return readErr
+	}
+	return cmd.Wait()
+}
+
+func journalctlArgs(source *logSource, cursor string) []string {
+	args := append([]string{"--follow", "--output=export", "--no-pager"}, journalFilterArgs(source)...)
+
+	if cursor != "" {
+		args = append(args, "--after-cursor="+cursor)
+	} else {
+		args = append(args, "--lines=0")
+	}
+
+	return args
+}
+
+func journalFilterArgs(source *logSource) []string {
+	var args []string
+	if source.unit != "" {
+		args = append(args, "--unit="+source.unit)
+	}
+	if source.syslogIdentifier != "" {
+		args = append(args, "--identifier="+source.syslogIdentifier)
+	}
+	return args
+}
+
+func journalCursorPath(source *logSource) string {
+	name := source.label
+	if name == "" {
+		name = source.unit
+	}
+	if name == "" {
+		name = source.syslogIdentifier
+	}
+
+	safeName := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+
+	return filepath.Join(config.StorageDir, "journal_"+safeName+".cursor")
+}
+
+func loadJournalCursor(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func saveJournalCursor(path, cursor string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(cursor+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"tblocker/config"
+	"tblocker/parser"
+	"testing"
+	"time"
+)
+
+func TestJournalExportReader(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "journal_export.txt"))
+	if err != nil {
+		t.Fatalf("Failed to read fixture: %v", err)
+	}
+
+	reader := newJournalExportReader(bytes.NewReader(data))
+
+	var entries []map[string]string
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to parse journal export: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(entries))
+	}
+
+	if entries[0]["__CURSOR"] != "s=abc;i=1;b=def;m=1;t=1;x=1" {
+		t.Errorf("Unexpected cursor: %s", entries[0]["__CURSOR"])
+	}
+
+	if entries[1]["SYSLOG_IDENTIFIER"] != "xray" {
+		t.Errorf("Expected text field after binary field to be parsed, got %q", entries[1]["SYSLOG_IDENTIFIER"])
+	}
+
+	event, valid := parser.NewXrayParser().Parse(entries[1]["MESSAGE"])
+	if !valid || event.IP != "5.6.7.8" || event.Username != "bob\x1b[0m" {
+		t.Errorf("Unexpected parse result for binary message: %+v %v", event, valid)
+	}
+
+	if entries[2]["MESSAGE"] != "multi\nline" {
+		t.Errorf("Expected binary field with newline, got %q", entries[2]["MESSAGE"])
+	}
+}
+
+func TestJournalExportReaderTruncated(t *testing.T) {
+	reader := newJournalExportReader(bytes.NewReader([]byte("MESSAGE\n\x10\x00\x00")))
+
+	if _, err := reader.Next(); err == nil || err == io.EOF {
+		t.Errorf("Expected error for truncated binary field, got %v", err)
+	}
+}
+
+func TestFollowJournalMalformedStream(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "journal_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Writes a binary field that is not terminated by a newline and keeps
+	// the output open, like journalctl --follow.
+	script := filepath.Join(tempDir, "journalctl")
+	content := "#!/bin/sh\nprintf 'MESSAGE\\n\\001\\000\\000\\000\\000\\000\\000\\000ab'\nexec sleep 60\n"
+	if err := os.WriteFile(script, []byte(content), 0755); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+
+	oldCommand := journalctlCommand
+	defer func() { journalctlCommand = oldCommand }()
+	journalctlCommand = script
+	config.StorageDir = tempDir
+
+	source := &logSource{sourceType: "journal", unit: "xray.service"}
+	done := make(chan error, 1)
+	go func() { done <- followJournal(source, journalCursorPath(source)) }()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Expected an error for the malformed stream")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the reader to stop after a malformed stream")
+	}
+}
+
+func TestJournalctlArgs(t *testing.T) {
+	source := &logSource{sourceType: "journal", unit: "xray.service"}
+
+	args := journalctlArgs(source, "")
+	if !containsArg(args, "--unit=xray.service") || !containsArg(args, "--lines=0") {
+		t.Errorf("Unexpected args without cursor: %v", args)
+	}
+
+	args = journalctlArgs(source, "s=abc")
+	if !containsArg(args, "--after-cursor=s=abc") || containsArg(args, "--lines=0") {
+		t.Errorf("Unexpected args with cursor: %v", args)
+	}
+}
+
+func TestJournalCursorPersistence(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "journal_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	config.StorageDir = tempDir
+	source := &logSource{sourceType: "journal", syslogIdentifier: "xray/core"}
+
+	path := journalCursorPath(source)
+	if path != filepath.Join(tempDir, "journal_xray_core.cursor") {
+		t.Errorf("Unexpected cursor path: %s", path)
+	}
+
+	if err := saveJournalCursor(path, "s=abc;i=2"); err != nil {
+		t.Fatalf("Failed to save cursor: %v", err)
+	}
+
+	cursor, err := loadJournalCursor(path)
+	if err != nil {
+		t.Fatalf("Failed to load cursor: %v", err)
+	}
+
+	if cursor != "s=abc;i=2" {
+		t.Errorf("Expected saved cursor, got %q", cursor)
+	}
+}
+
+func containsArg(args []string, arg string) bool {
+	for _, a := range args {
+		if a == arg {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"tblocker/config"
+	"tblocker/parser"
+)
+
+// matchTagRules returns the indices of the source's tag rules found in the line.
+func matchTagRules(source *logSource, lineBytes []byte) []int {
+	return source.tagMatcher.Match(lineBytes)
+}
+
+// selectTagRule picks the rule a parsed line is attributed to: the one whose
+// tag is the outbound of the routing segment, or else the first matched rule.
+func selectTagRule(source *logSource, matched []int, event parser.Event) *config.TagRule {
+	rules := source.rules
+	for _, index := range matched {
+		if rules[index].Tag == event.Outbound {
+			return &rules[index]
+		}
+	}
+	return &rules[matched[0]]
+}
+
+// checkDetection applies the routing-segment and inbound rules to a parsed
+// event and returns the reason it was rejected, or an empty string.
+func checkDetection(source *logSource, event parser.Event) string {
+	if config.StrictTagMatch && !source.hasTag(event.Outbound) {
+		return "tag is not the outbound of the routing segment"
+	}
+
+	if len(config.AllowedInbounds) > 0 {
+		if _, allowed := config.AllowedInbounds[event.Inbound]; !allowed {
+			return "inbound " + quoteInbound(event.Inbound) + " is not in AllowedInbounds"
+		}
+	}
+
+	if _, denied := config.DeniedInbounds[event.Inbound]; denied {
+		return "inbound " + quoteInbound(event.Inbound) + " is in DeniedInbounds"
+	}
+
+	return ""
+}
+
+func (s *logSource) hasTag(tag string) bool {
+	if tag == "" {
+		return false
+	}
+	for _, rule := range s.rules {
+		if rule.Tag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func quoteInbound(inbound string) string {
+	if inbound == "" {
+		return "(unknown)"
+	}
+	return "'" + inbound + "'"
+}
@@ -0,0 +1,133 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"tblocker/config"
+	"tblocker/parser"
+	"testing"
+)
+
+func loadMatchTestConfig(t *testing.T, configContent string) {
+	t.Helper()
+
+	tempDir, err := os.MkdirTemp("", "match_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	configFile := filepath.Join(tempDir, "config.yaml")
+	if err := os.WriteFile(configFile, []byte("LogFile: /var/log/xray/access.log\n"+configContent), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	if err := config.LoadConfig(configFile); err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+}
+
+func TestCheckDetection(t *testing.T) {
+	defer func() {
+		config.StrictTagMatch = false
+		config.AllowedInbounds = map[string]struct{}{}
+		config.DeniedInbounds = map[string]struct{}{}
+	}()
+
+	loadMatchTestConfig(t, "BlockDuration: 10\nTorrentTag: TORRENT\n")
+	source := newLogSource(config.LogSource{})
+
+	sniLine := "from 1.2.3.4:5555 accepted tcp:torrent.example.com:443 [public -> direct] email: TORRENT_fan"
+	tagLine := "from 1.2.3.4:5555 accepted tcp:tracker.example:6969 [public -> TORRENT] email: alice"
+	relayLine := "from 10.0.0.2:5555 accepted tcp:tracker.example:6969 [relay -> TORRENT] email: bob"
+
+	parse := func(line string) parser.Event {
+		event, valid := source.parser.Parse(line)
+		if !valid {
+			t.Fatalf("Failed to parse %q", line)
+		}
+		return event
+	}
+
+	config.StrictTagMatch = false
+	config.AllowedInbounds = map[string]struct{}{}
+	config.DeniedInbounds = map[string]struct{}{}
+	if reason := checkDetection(source, parse(sniLine)); reason != "" {
+		t.Errorf("Expected loose matching to accept SNI line, got %q", reason)
+	}
+
+	config.StrictTagMatch = true
+	if reason := checkDetection(source, parse(sniLine)); reason == "" {
+		t.Error("Expected strict matching to reject tag outside the routing segment")
+	}
+	if reason := checkDetection(source, parse(tagLine)); reason != "" {
+		t.Errorf("Expected strict matching to accept outbound tag, got %q", reason)
+	}
+
+	config.AllowedInbounds = map[string]struct{}{"public": {}}
+	if reason := checkDetection(source, parse(relayLine)); reason == "" {
+		t.Error("Expected inbound outside AllowedInbounds to be rejected")
+	}
+	if reason := checkDetection(source, parse(tagLine)); reason != "" {
+		t.Errorf("Expected allowed inbound to be accepted, got %q", reason)
+	}
+
+	config.AllowedInbounds = map[string]struct{}{}
+	config.DeniedInbounds = map[string]struct{}{"relay": {}}
+	if reason := checkDetection(source, parse(relayLine)); reason == "" {
+		t.Error("Expected denied inbound to be rejected")
+	}
+	if reason := checkDetection(source, parse(tagLine)); reason != "" {
+		t.Errorf("Expected inbound not in DeniedInbounds to be accepted, got %q", reason)
+	}
+}
+
+func TestSelectTagRule(t *testing.T) {
+	defer func() { config.StrictTagMatch = false }()
+
+	loadMatchTestConfig(t, `
+BlockDuration: 10
+TorrentTag: TORRENT
+LogSources:
+  - Path: /tmp/a.log
+    TorrentTag: BT
+  - Path: /tmp/b.log
+    Label: b
+TagRules:
+  - Tag: SPAM
+    Scope: ip
+    Reason: spam
+    BlockDuration: 1440
+  - Tag: TORRENT
+    Scope: ip
+    Reason: p2p
+`)
+
+	source := newLogSource(config.LogSources[0])
+	if rules := source.rules; len(rules) != 3 || rules[0].Tag != "BT" || rules[0].Reason != config.TorrentReason {
+		t.Fatalf("Unexpected rules: %+v", rules)
+	}
+
+	override := newLogSource(config.LogSources[1])
+	if rules := override.rules; len(rules) != 2 || rules[1].Reason != "p2p" {
+		t.Errorf("Expected configured rule to replace the implicit one, got %+v", rules)
+	}
+	if override.tagMatcher != config.LogSources[1].GetTagMatcher() {
+		t.Error("Expected the matcher built by LoadConfig to be reused")
+	}
+
+	line := "from 1.2.3.4:5555 accepted tcp:mail.example:25 [public -> SPAM] email: BT_fan"
+	matched := matchTagRules(source, []byte(line))
+	if len(matched) != 2 {
+		t.Fatalf("Expected BT and SPAM to match, got %v", matched)
+	}
+
+	event, _ := source.parser.Parse(line)
+	if rule := selectTagRule(source, matched, event); rule.Reason != "spam" {
+		t.Errorf("Expected outbound tag to select the spam rule, got %s", rule.Reason)
+	}
+
+	config.StrictTagMatch = true
+	if reason := checkDetection(source, event); reason != "" {
+		t.Errorf("Expected strict matching to accept configured outbound tag, got %q", reason)
+	}
+}
@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"tblocker/config"
+	"time"
+
+	"github.com/nxadm/tail"
+)
+
+const offsetFlushInterval = 2 * time.Second
+
+type offsetCheckpoint struct {
+	Device    uint64    `json:"device"`
+	Inode     uint64    `json:"inode"`
+	Offset    int64     `json:"offset"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type offsetStore struct {
+	path        string
+	mu          sync.Mutex
+	checkpoints map[string]offsetCheckpoint
+	dirty       bool
+}
+
+var (
+	logOffsets     *offsetStore
+	logOffsetsOnce sync.Once
+)
+
+func newOffsetStore(storageDir string) *offsetStore {
+	store := &offsetStore{
+		path:        filepath.Join(storageDir, "log_offsets.json"),
+		checkpoints: make(map[string]offsetCheckpoint),
+	}
+
+	data, err := os.ReadFile(store.path)
+	if err == nil {
+		if err := json.Unmarshal(data, &store.checkpoints); err != nil {
+			monitorLog.Warn("Failed to parse log offsets", "path", store.path, "error", err)
+		}
+	} else if !os.IsNotExist(err) {
+		monitorLog.Warn("Failed to read log offsets", "path", store.path, "error", err)
+	}
+
+	return store
+}
+
+func getOffsetStore() *offsetStore {
+	logOffsetsOnce.Do(func() {
+		logOffsets = newOffsetStore(config.StorageDir)
+		go logOffsets.flushRoutine()
+	})
+	return logOffsets
+}
+
+func fileIdentity(info os.FileInfo) (device, inode uint64, ok bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint64(stat.Dev), uint64(stat.Ino), true
+}
+
+// resumeLocation decides where tailing of path starts: at the saved offset if
+// the file is the same one, capped to ResumeMaxBytes of catch-up, or at the
+// end of the file if the checkpoint is missing, stale or for another file.
+func (s *offsetStore) resumeLocation(path string, now time.Time) *tail.SeekInfo {
+	end := &tail.SeekInfo{Offset: 0, Whence: io.SeekEnd}
+
+	if config.DisableResume {
+		return end
+	}
+
+	s.mu.Lock()
+	checkpoint, exists := s.checkpoints[path]
+	s.mu.Unlock()
+	if !exists {
+		return end
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return end
+	}
+
+	device, inode, ok := fileIdentity(info)
+	if !ok || device != checkpoint.Device || inode != checkpoint.Inode {
+		monitorLog.Info("Log file changed since the last checkpoint, starting from the end", "path", path)
+		return end
+	}
+
+	if now.Sub(checkpoint.UpdatedAt) > time.Duration(config.ResumeMaxAge)*time.Minute {
+		monitorLog.Info("Checkpoint is too old, starting from the end", "path", path, "max_age_minutes", config.ResumeMaxAge)
+		return end
+	}
+
+	offset := checkpoint.Offset
+	if offset > info.Size() {
+		monitorLog.Info("Log file was truncated since the last checkpoint, starting from the beginning", "path", path)
+		offset = 0
+	}
+
+	if info.Size()-offset > config.ResumeMaxBytes {
+		offset = info.Size() - config.ResumeMaxBytes
+		monitorLog.Info("Catch-up capped", "path", path, "max_bytes", config.ResumeMaxBytes)
+	}
+
+	monitorLog.Info("Resuming log file", "path", path, "offset", offset, "catch_up_bytes", info.Size()-offset)
+	return &tail.SeekInfo{Offset: offset, Whence: io.SeekStart}
+}
+
+func (s *offsetStore) update(path string, offset int64, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	checkpoint := s.checkpoints[path]
+	checkpoint.Offset = offset
+	checkpoint.UpdatedAt = now
+	s.checkpoints[path] = checkpoint
+	s.dirty = true
+}
+
+func (s *offsetStore) flush() error {
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+
+	for path, checkpoint := range s.checkpoints {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if device, inode, ok := fileIdentity(info); ok {
+			checkpoint.Device = device
+			checkpoint.Inode = inode
+			s.checkpoints[path] = checkpoint
+		}
+	}
+
+	data, err := json.MarshalIndent(s.checkpoints, "", "  ")
+	s.dirty = false
+	s.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
+
+func (s *offsetStore) flushRoutine() {
+	ticker := time.NewTicker(offsetFlushInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := s.flush(); err != nil {
+			monitorLog.Error("Error saving log offsets", "error", err)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"tblocker/config"
+	"tblocker/parser"
+	"testing"
+	"time"
+)
+
+func setupOffsetTest(t *testing.T) (string, string) {
+	tempDir, err := os.MkdirTemp("", "offsets_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tempDir) })
+
+	config.DisableResume = false
+	config.ResumeMaxAge = 60
+	config.ResumeMaxBytes = 1024
+
+	logFile := filepath.Join(tempDir, "access.log")
+	if err := os.WriteFile(logFile, make([]byte, 500), 0644); err != nil {
+		t.Fatalf("Failed to write log file: %v", err)
+	}
+
+	return tempDir, logFile
+}
+
+func TestOffsetStoreResume(t *testing.T) {
+	tempDir, logFile := setupOffsetTest(t)
+	now := time.Now()
+
+	store := newOffsetStore(tempDir)
+	if location := store.resumeLocation(logFile, now); location.Whence != io.SeekEnd {
+		t.Error("Expected tailing from the end without a checkpoint")
+	}
+
+	store.update(logFile, 200, now)
+	if err := store.flush(); err != nil {
+		t.Fatalf("Failed to flush offsets: %v", err)
+	}
+
+	reloaded := newOffsetStore(tempDir)
+	location := reloaded.resumeLocation(logFile, now.Add(time.Minute))
+	if location.Whence != io.SeekStart || location.Offset != 200 {
+		t.Errorf("Expected resume from offset 200, got %+v", location)
+	}
+
+	if location := reloaded.resumeLocation(logFile, now.Add(2*time.Hour)); location.Whence != io.SeekEnd {
+		t.Error("Expected stale checkpoint to start from the end")
+	}
+
+	config.DisableResume = true
+	if location := reloaded.resumeLocation(logFile, now); location.Whence != io.SeekEnd {
+		t.Error("Expected DisableResume to start from the end")
+	}
+}
+
+func TestOffsetStoreFileChanged(t *testing.T) {
+	tempDir, logFile := setupOffsetTest(t)
+	now := time.Now()
+
+	store := newOffsetStore(tempDir)
+	store.update(logFile, 200, now)
+	if err := store.flush(); err != nil {
+		t.Fatalf("Failed to flush offsets: %v", err)
+	}
+
+	rotated := logFile + ".1"
+	if err := os.Rename(logFile, rotated); err != nil {
+		t.Fatalf("Failed to rotate log file: %v", err)
+	}
+	if err := os.WriteFile(logFile, make([]byte, 500), 0644); err != nil {
+		t.Fatalf("Failed to write new log file: %v", err)
+	}
+
+	if location := newOffsetStore(tempDir).resumeLocation(logFile, now); location.Whence != io.SeekEnd {
+		t.Error("Expected a different file to start from the end")
+	}
+}
+
+func TestOffsetStoreCaps(t *testing.T) {
+	tempDir, logFile := setupOffsetTest(t)
+	now := time.Now()
+
+	store := newOffsetStore(tempDir)
+	store.update(logFile, 400, now)
+	if err := store.flush(); err != nil {
+		t.Fatalf("Failed to flush offsets: %v", err)
+	}
+
+	if err := os.Truncate(logFile, 100); err != nil {
+		t.Fatalf("Failed to truncate log file: %v", err)
+	}
+	if location := store.resumeLocation(logFile, now); location.Whence != io.SeekStart || location.Offset != 0 {
+		t.Errorf("Expected truncated file to resume from the beginning, got %+v", location)
+	}
+
+	if err := os.Truncate(logFile, 3000); err != nil {
+		t.Fatalf("Failed to grow log file: %v", err)
+	}
+	if location := store.resumeLocation(logFile, now); location.Whence != io.SeekStart || location.Offset != 3000-1024 {
+		t.Errorf("Expected catch-up to be capped to the last 1024 bytes, got %+v", location)
+	}
+}
+
+func TestDetectionTime(t *testing.T) {
+	now := time.Now()
+
+	if ts := detectionTime(parser.Event{}, now); !ts.Equal(now) {
+		t.Error("Expected now for events without a timestamp")
+	}
+
+	past := now.Add(-3 * time.Minute)
+	if ts := detectionTime(parser.Event{Time: past}, now); !ts.Equal(past) {
+		t.Error("Expected the log line timestamp to be used")
+	}
+
+	if ts := detectionTime(parser.Event{Time: now.Add(time.Hour)}, now); !ts.Equal(now) {
+		t.Error("Expected future timestamps to be replaced by now")
+	}
+}
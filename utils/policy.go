@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"sync"
+	"tblocker/config"
+	"time"
+)
+
+// detectionTracker keeps the recent detections of each user for the
+// threshold, and until when notify-only users are not reported again.
+type detectionTracker struct {
+	mu       sync.Mutex
+	hits     map[string][]time.Time
+	notified map[string]time.Time
+}
+
+var detections = newDetectionTracker()
+
+func newDetectionTracker() *detectionTracker {
+	return &detectionTracker{
+		hits:     make(map[string][]time.Time),
+		notified: make(map[string]time.Time),
+	}
+}
+
+func findUserPolicy(source *logSource, rawUsername string) *config.UserPolicy {
+	processed := processUsername(source, rawUsername)
+
+	for i := range config.UserPolicies {
+		policy := &config.UserPolicies[i]
+		if policy.Matches(rawUsername) || (processed != rawUsername && policy.Matches(processed)) {
+			return policy
+		}
+	}
+
+	return nil
+}
+
+func effectiveBlockDuration(policy *config.UserPolicy) int {
+	if policy != nil && policy.BlockDuration > 0 {
+		return policy.BlockDuration
+	}
+	return config.BlockDuration
+}
+
+func effectiveThreshold(policy *config.UserPolicy) int {
+	if policy != nil && policy.Threshold > 0 {
+		return policy.Threshold
+	}
+	return config.Threshold
+}
+
+// hit records a detection for the user and reports whether the number of
+// detections inside the threshold window has reached the threshold. The
+// counter is reset once the threshold is reached.
+func (d *detectionTracker) hit(username string, threshold int, now time.Time) bool {
+	if threshold <= 1 {
+		return true
+	}
+
+	window := time.Duration(config.ThresholdWindow) * time.Second
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	recent := d.hits[username][:0]
+	for _, ts := range d.hits[username] {
+		if now.Sub(ts) < window {
+			recent = append(recent, ts)
+		}
+	}
+	recent = append(recent, now)
+
+	if len(recent) >= threshold {
+		delete(d.hits, username)
+		return true
+	}
+
+	d.hits[username] = recent
+	return false
+}
+
+// shouldNotify reports whether a notify-only user should produce another
+// notification, suppressing repeats for the given duration.
+func (d *detectionTracker) shouldNotify(username string, suppress time.Duration, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if until, exists := d.notified[username]; exists && now.Before(until) {
+		return false
+	}
+
+	d.notified[username] = now.Add(suppress)
+	return true
+}
+
+// prune forgets the users whose detections all left the threshold window
+// and whose notifications are no longer suppressed.
+func (d *detectionTracker) prune(now time.Time) {
+	window := time.Duration(config.ThresholdWindow) * time.Second
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for username, hits := range d.hits {
+		if len(hits) == 0 || now.Sub(hits[len(hits)-1]) >= window {
+			delete(d.hits, username)
+		}
+	}
+	for username, until := range d.notified {
+		if !now.Before(until) {
+			delete(d.notified, username)
+		}
+	}
+}
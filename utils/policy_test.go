@@ -0,0 +1,193 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"tblocker/config"
+	"tblocker/parser"
+	"testing"
+	"time"
+)
+
+func loadPolicyTestConfig(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "policy_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	configContent := `
+LogFile: "/var/log/test.log"
+BlockDuration: 10
+TorrentTag: "TORRENT"
+UsernameRegex: "^\\d+\\.(.+)$"
+ThresholdWindow: 60
+UserPolicies:
+  - Name: "staff"
+    Exempt: true
+  - Regex: "^premium_"
+    BlockDuration: 2
+  - Name: "watched"
+    NotifyOnly: true
+  - Name: "noisy"
+    Threshold: 3
+`
+
+	configFile := filepath.Join(tempDir, "config.yaml")
+	if err := os.WriteFile(configFile, []byte(configContent), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	if err := config.LoadConfig(configFile); err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+}
+
+func TestFindUserPolicy(t *testing.T) {
+	loadPolicyTestConfig(t)
+
+	testCases := []struct {
+		username   string
+		exempt     bool
+		duration   int
+		notifyOnly bool
+		found      bool
+	}{
+		{username: "staff", exempt: true, duration: 10, found: true},
+		{username: "12.staff", exempt: true, duration: 10, found: true},
+		{username: "premium_bob", duration: 2, found: true},
+		{username: "7.premium_bob", duration: 2, found: true},
+		{username: "watched", duration: 10, notifyOnly: true, found: true},
+		{username: "regular", duration: 10, found: false},
+	}
+
+	for _, tc := range testCases {
+		policy := findUserPolicy(nil, tc.username)
+		if (policy != nil) != tc.found {
+			t.Errorf("%s: expected policy found=%v, got %v", tc.username, tc.found, policy != nil)
+			continue
+		}
+
+		if duration := effectiveBlockDuration(policy); duration != tc.duration {
+			t.Errorf("%s: expected duration %d, got %d", tc.username, tc.duration, duration)
+		}
+
+		if policy == nil {
+			continue
+		}
+
+		if policy.Exempt != tc.exempt {
+			t.Errorf("%s: expected exempt %v, got %v", tc.username, tc.exempt, policy.Exempt)
+		}
+
+		if policy.NotifyOnly != tc.notifyOnly {
+			t.Errorf("%s: expected notify-only %v, got %v", tc.username, tc.notifyOnly, policy.NotifyOnly)
+		}
+	}
+}
+
+func TestDetectionTrackerThreshold(t *testing.T) {
+	loadPolicyTestConfig(t)
+
+	tracker := newDetectionTracker()
+	policy := findUserPolicy(nil, "noisy")
+	threshold := effectiveThreshold(policy)
+	if threshold != 3 {
+		t.Fatalf("Expected threshold 3, got %d", threshold)
+	}
+
+	now := time.Now()
+	if tracker.hit("noisy", threshold, now) {
+		t.Error("First detection should not reach threshold")
+	}
+	if tracker.hit("noisy", threshold, now.Add(time.Second)) {
+		t.Error("Second detection should not reach threshold")
+	}
+	if !tracker.hit("noisy", threshold, now.Add(2*time.Second)) {
+		t.Error("Third detection should reach threshold")
+	}
+	if tracker.hit("noisy", threshold, now.Add(3*time.Second)) {
+		t.Error("Counter should be reset after reaching threshold")
+	}
+
+	later := now.Add(5 * time.Minute)
+	if tracker.hit("noisy", threshold, later) || tracker.hit("noisy", threshold, later.Add(time.Second)) {
+		t.Error("Detections outside the window should not be counted")
+	}
+
+	if !tracker.hit("regular", effectiveThreshold(nil), now) {
+		t.Error("Default threshold should block on first detection")
+	}
+}
+
+func TestDetectionTrackerShouldNotify(t *testing.T) {
+	tracker := newDetectionTracker()
+	now := time.Now()
+
+	if !tracker.shouldNotify("watched", time.Minute, now) {
+		t.Error("First notification should be sent")
+	}
+	if tracker.shouldNotify("watched", time.Minute, now.Add(30*time.Second)) {
+		t.Error("Repeated notification should be suppressed")
+	}
+	if !tracker.shouldNotify("watched", time.Minute, now.Add(2*time.Minute)) {
+		t.Error("Notification should be sent after suppression period")
+	}
+}
+
+func TestDetectionTrackerPrune(t *testing.T) {
+	loadPolicyTestConfig(t)
+
+	tracker := newDetectionTracker()
+	now := time.Now()
+	tracker.hit("noisy", 3, now)
+	tracker.hit("recent", 3, now.Add(50*time.Second))
+	tracker.shouldNotify("watched", time.Minute, now)
+	tracker.shouldNotify("suppressed", 5*time.Minute, now)
+
+	tracker.prune(now.Add(90 * time.Second))
+
+	if _, exists := tracker.hits["noisy"]; exists {
+		t.Error("Expected detections outside the window to be pruned")
+	}
+	if _, exists := tracker.hits["recent"]; !exists {
+		t.Error("Expected detections inside the window to be kept")
+	}
+	if _, exists := tracker.notified["watched"]; exists {
+		t.Error("Expected expired notification suppression to be pruned")
+	}
+	if _, exists := tracker.notified["suppressed"]; !exists {
+		t.Error("Expected active notification suppression to be kept")
+	}
+}
+
+func TestDetectorSkipsBlockedIP(t *testing.T) {
+	loadPolicyTestConfig(t)
+
+	blocked := map[string]bool{"1.2.3.4": true}
+	d := &detector{
+		tracker: newDetectionTracker(),
+		userIPs: newUserIPTracker(),
+		now:     func(event parser.Event) time.Time { return event.Time },
+		blocked: func(ip string, _ time.Time) bool { return blocked[ip] },
+	}
+	source := newLogSource(config.LogSource{})
+	line := func(ip string, second int) string {
+		return fmt.Sprintf("2024/01/02 15:04:%02d from %s:5555 accepted tcp:tracker.example:6969 [inbound >> TORRENT] email: 1.noisy", second, ip)
+	}
+
+	for second := 0; second < 3; second++ {
+		if result := d.evaluate(source, line("1.2.3.4", second), []int{0}); result.Stage != stageBlocked {
+			t.Fatalf("Expected line of a blocked IP to be skipped, got stage %q", result.Stage)
+		}
+	}
+	if _, exists := d.tracker.hits["noisy"]; exists {
+		t.Error("Expected lines of a blocked IP not to count towards the threshold")
+	}
+
+	delete(blocked, "1.2.3.4")
+	if result := d.evaluate(source, line("1.2.3.4", 10), []int{0}); result.Stage != stageThreshold {
+		t.Errorf("Expected the first line after the block to start counting, got stage %q", result.Stage)
+	}
+}
@@ -0,0 +1,657 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"tblocker/config"
+	"tblocker/logging"
+	"tblocker/storage"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var redisLog = logging.For("redis")
+
+const (
+	// redisOriginPrefix marks the origin of blocks mirrored from Redis, so
+	// they are told apart from the blocks of feed peers.
+	redisOriginPrefix = "redis:"
+
+	redisResyncInterval = time.Minute
+	redisTimeout        = 10 * time.Second
+	redisQueueSize      = 1024
+	redisWatchRetries   = 3
+	redisMaxRetryDelay  = 30 * time.Second
+)
+
+// redisMessage announces a block or unblock to the other nodes.
+type redisMessage struct {
+	Op    string    `json:"op"`
+	Entry feedEntry `json:"entry"`
+}
+
+type redisUpdate struct {
+	entry  storage.BlockedIP
+	remove bool
+	seq    uint64
+}
+
+// redisSync shares the blocks of this node through Redis. Every IP has one
+// key holding the longest block announced for it, with the remaining time
+// of the block as TTL, so expired blocks disappear by themselves.
+//
+// Unblocks of this node are kept in deletes until Redis confirms them, so a
+// failed delete is retried by resync instead of restoring the block. They
+// are saved in StorageDir, as a restart would otherwise restore the block.
+type redisSync struct {
+	client  *redis.Client
+	prefix  string
+	origin  string
+	mu      sync.Mutex
+	updates chan redisUpdate
+
+	deletesMu   sync.Mutex
+	deletes     map[string]redisUpdate
+	deletesPath string
+	seq         uint64
+}
+
+var sharedState *redisSync
+
+func newRedisSync(cfg config.RedisConfig, storageDir string) *redisSync {
+	options := &redis.Options{
+		Addr:     cfg.Addr,
+		Username: cfg.Username,
+		Password: cfg.Password,
+		DB:       cfg.DB,
+	}
+	if cfg.TLS {
+		options.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	s := &redisSync{
+		client:      redis.NewClient(options),
+		prefix:      cfg.Prefix,
+		origin:      cfg.Origin,
+		updates:     make(chan redisUpdate, redisQueueSize),
+		deletes:     make(map[string]redisUpdate),
+		deletesPath: filepath.Join(storageDir, "redis_deletes.json"),
+	}
+	s.loadDeletes()
+	return s
+}
+
+func (s *redisSync) Close() error {
+	return s.client.Close()
+}
+
+// StartRedisSync subscribes to the blocks of the other nodes and rebuilds
+// the shared state from Redis when Redis.Addr is set. The state is compared
+// again every minute to catch up on messages missed while disconnected.
+func StartRedisSync() {
+	if config.Redis.Addr == "" {
+		return
+	}
+
+	sharedState = newRedisSync(config.Redis, config.StorageDir)
+	pubsub := sharedState.client.Subscribe(context.Background(), sharedState.channel())
+	redisLog.Info("Sharing blocks through Redis", "addr", config.Redis.Addr, "origin", sharedState.origin)
+
+	resyncs := make(chan struct{}, 1)
+	requestResync := func() {
+		select {
+		case resyncs <- struct{}{}:
+		default:
+		}
+	}
+
+	go sharedState.listen(context.Background(), pubsub, sharedState.handle, requestResync)
+	go sharedState.publishUpdates()
+	go func() {
+		failing := false
+		ticker := time.NewTicker(redisResyncInterval)
+		defer ticker.Stop()
+		for {
+			if err := sharedState.resync(); err != nil {
+				if !failing {
+					redisLog.Warn("Error syncing blocks with Redis", "error", err)
+				}
+				failing = true
+			} else if failing {
+				redisLog.Info("Redis sync recovered")
+				failing = false
+			}
+			select {
+			case <-ticker.C:
+			case <-resyncs:
+			}
+		}
+	}()
+}
+
+// shareBlock queues a block created on this node for the other nodes.
+func shareBlock(entry storage.BlockedIP) {
+	sharedState.queue(redisUpdate{entry: entry})
+}
+
+// shareUnblock queues the removal of a block created on this node.
+func shareUnblock(entry storage.BlockedIP) {
+	sharedState.queue(redisUpdate{entry: entry, remove: true})
+}
+
+func (s *redisSync) queue(update redisUpdate) {
+	if s == nil || update.entry.Origin != "" {
+		return
+	}
+
+	ip := normalizeIP(update.entry.IP)
+	s.deletesMu.Lock()
+	s.seq++
+	update.seq = s.seq
+	_, pending := s.deletes[ip]
+	if update.remove {
+		s.deletes[ip] = update
+	} else {
+		delete(s.deletes, ip)
+	}
+	if update.remove || pending {
+		s.saveDeletes()
+	}
+	s.deletesMu.Unlock()
+
+	select {
+	case s.updates <- update:
+	default:
+		redisLog.Warn("Redis update queue is full, the next sync will catch up", "ip", update.entry.IP)
+	}
+}
+
+// publishUpdates writes queued updates in order, so that an unblock never
+// overtakes the block that replaced it.
+func (s *redisSync) publishUpdates() {
+	for update := range s.updates {
+		var err error
+		if update.remove {
+			err = s.retryDelete(update)
+		} else {
+			_, err = s.writeBlock(update.entry)
+		}
+		if err != nil {
+			redisLog.Warn("Error updating Redis, retrying on the next sync", "ip", update.entry.IP, "error", err)
+		}
+	}
+}
+
+// retryDelete deletes a block of this node and forgets the pending delete,
+// unless a newer update of the IP replaced it meanwhile.
+func (s *redisSync) retryDelete(update redisUpdate) error {
+	if _, err := s.deleteBlock(update.entry); err != nil {
+		return err
+	}
+	ip := normalizeIP(update.entry.IP)
+	s.deletesMu.Lock()
+	if pending, exists := s.deletes[ip]; exists && pending.seq == update.seq {
+		delete(s.deletes, ip)
+		s.saveDeletes()
+	}
+	s.deletesMu.Unlock()
+	return nil
+}
+
+// loadDeletes restores the unblocks not confirmed by Redis before the last
+// shutdown, to be retried by the first resync.
+func (s *redisSync) loadDeletes() {
+	data, err := os.ReadFile(s.deletesPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			redisLog.Warn("Failed to read pending Redis deletes", "path", s.deletesPath, "error", err)
+		}
+		return
+	}
+
+	var entries map[string]storage.BlockedIP
+	if err := json.Unmarshal(data, &entries); err != nil {
+		redisLog.Warn("Failed to parse pending Redis deletes", "path", s.deletesPath, "error", err)
+		return
+	}
+	for ip, entry := range entries {
+		s.seq++
+		s.deletes[ip] = redisUpdate{entry: entry, remove: true, seq: s.seq}
+	}
+}
+
+// saveDeletes writes the pending deletes to StorageDir. deletesMu must be
+// held, so that the file follows the order of the updates.
+func (s *redisSync) saveDeletes() {
+	if err := s.writeDeletes(); err != nil {
+		redisLog.Error("Error saving pending Redis deletes", "path", s.deletesPath, "error", err)
+	}
+}
+
+func (s *redisSync) writeDeletes() error {
+	entries := make(map[string]storage.BlockedIP, len(s.deletes))
+	for ip, update := range s.deletes {
+		entries[ip] = update.entry
+	}
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.deletesPath), 0755); err != nil {
+		return err
+	}
+
+	tmpPath := s.deletesPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.deletesPath)
+}
+
+// pendingDeletes returns the unblocks of this node not yet confirmed by Redis.
+func (s *redisSync) pendingDeletes() []redisUpdate {
+	s.deletesMu.Lock()
+	defer s.deletesMu.Unlock()
+
+	updates := make([]redisUpdate, 0, len(s.deletes))
+	for _, update := range s.deletes {
+		updates = append(updates, update)
+	}
+	return updates
+}
+
+func (s *redisSync) key(ip string) string {
+	return s.prefix + ":block:" + normalizeIP(ip)
+}
+
+func (s *redisSync) channel() string {
+	return s.prefix + ":events"
+}
+
+// writeBlock stores a block of this node unless Redis holds a longer block
+// of another node or the same block already, and announces it.
+func (s *redisSync) writeBlock(entry storage.BlockedIP) (bool, error) {
+	now := time.Now()
+	if !entry.Active(now) {
+		return false, nil
+	}
+	published := publishedEntry(entry, s.origin, now)
+	published.IP = normalizeIP(published.IP)
+	var ttl time.Duration
+	if !entry.Permanent() {
+		ttl = entry.BlockedUntil.Sub(now)
+	}
+
+	value, err := json.Marshal(published)
+	if err != nil {
+		return false, err
+	}
+	message, err := json.Marshal(redisMessage{Op: "block", Entry: published})
+	if err != nil {
+		return false, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	key := s.key(entry.IP)
+	written := false
+	err = s.watch(ctx, key, func(tx *redis.Tx) error {
+		current, exists, err := readShared(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+		if exists {
+			held, wanted := sharedEntry(current, now), sharedEntry(published, now)
+			if current.Origin == s.origin && sameMirror(held, wanted) || current.Origin != s.origin && !outlasts(wanted, held) {
+				return nil
+			}
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, value, ttl)
+			pipe.Publish(ctx, s.channel(), message)
+			return nil
+		})
+		written = err == nil
+		return err
+	})
+	return written, err
+}
+
+// deleteBlock removes a block of this node from Redis and announces it.
+// Blocks held for the IP by other nodes are left alone.
+func (s *redisSync) deleteBlock(entry storage.BlockedIP) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	key := s.key(entry.IP)
+	message, err := json.Marshal(redisMessage{Op: "unblock", Entry: feedEntry{IP: normalizeIP(entry.IP), Kind: entry.GetKind(), Origin: s.origin}})
+	if err != nil {
+		return false, err
+	}
+
+	deleted := false
+	err = s.watch(ctx, key, func(tx *redis.Tx) error {
+		current, exists, err := readShared(ctx, tx, key)
+		if err != nil || !exists || current.Origin != s.origin {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			pipe.Publish(ctx, s.channel(), message)
+			return nil
+		})
+		deleted = err == nil
+		return err
+	})
+	return deleted, err
+}
+
+func (s *redisSync) watch(ctx context.Context, key string, fn func(tx *redis.Tx) error) error {
+	var err error
+	for range redisWatchRetries {
+		if err = s.client.Watch(ctx, fn, key); !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+	return err
+}
+
+// readShared returns the block stored under a key with its remaining time.
+func readShared(ctx context.Context, client redis.Cmdable, key string) (feedEntry, bool, error) {
+	var published feedEntry
+	value, err := client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return published, false, nil
+	}
+	if err != nil {
+		return published, false, err
+	}
+	ttl, err := client.PTTL(ctx, key).Result()
+	if err != nil {
+		return published, false, err
+	}
+	if err := json.Unmarshal(value, &published); err != nil {
+		return published, false, fmt.Errorf("invalid entry in %s: %v", key, err)
+	}
+	setRemaining(&published, ttl)
+	return published, true, nil
+}
+
+func setRemaining(published *feedEntry, ttl time.Duration) {
+	published.Remaining = 0
+	if ttl > 0 {
+		published.Remaining = int64((ttl + time.Second - 1) / time.Second)
+	}
+}
+
+// readAll returns the blocks of all nodes keyed by IP.
+func (s *redisSync) readAll(ctx context.Context) (map[string]feedEntry, error) {
+	shared := make(map[string]feedEntry)
+	iter := s.client.Scan(ctx, 0, s.prefix+":block:*", 1000).Iterator()
+	var keys []string
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	for start := 0; start < len(keys); start += 1000 {
+		batch := keys[start:min(start+1000, len(keys))]
+		values := make([]*redis.StringCmd, len(batch))
+		ttls := make([]*redis.DurationCmd, len(batch))
+		_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, key := range batch {
+				values[i] = pipe.Get(ctx, key)
+				ttls[i] = pipe.PTTL(ctx, key)
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return nil, err
+		}
+
+		for i, key := range batch {
+			value, err := values[i].Bytes()
+			if err != nil {
+				// The key expired since it was listed.
+				continue
+			}
+			var published feedEntry
+			if err := json.Unmarshal(value, &published); err != nil {
+				redisLog.Warn("Ignoring invalid entry", "key", key, "error", err)
+				continue
+			}
+			setRemaining(&published, ttls[i].Val())
+			shared[normalizeIP(published.IP)] = published
+		}
+	}
+	return shared, nil
+}
+
+// listen passes the announcements of the other nodes to handle until ctx
+// ends. A lost connection is retried with a growing delay, and resync is
+// requested once the subscription is back, to catch up on the messages
+// missed meanwhile. Idle subscriptions are pinged to notice dead connections.
+func (s *redisSync) listen(ctx context.Context, pubsub *redis.PubSub, handle func(redisMessage), resync func()) {
+	failing := false
+	var delay time.Duration
+	for ctx.Err() == nil {
+		received, err := pubsub.ReceiveTimeout(ctx, redisResyncInterval)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			err = pubsub.Ping(ctx)
+		}
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, redis.ErrClosed) {
+				return
+			}
+			if !failing {
+				redisLog.Warn("Lost Redis subscription, reconnecting", "error", err)
+			}
+			failing = true
+			delay = min(max(2*delay, time.Second), redisMaxRetryDelay)
+			time.Sleep(delay)
+			continue
+		}
+
+		switch received := received.(type) {
+		case *redis.Subscription:
+			if failing {
+				redisLog.Info("Redis subscription restored")
+				failing, delay = false, 0
+				resync()
+			}
+		case *redis.Message:
+			var message redisMessage
+			if err := json.Unmarshal([]byte(received.Payload), &message); err != nil {
+				redisLog.Warn("Ignoring invalid message", "error", err)
+				continue
+			}
+			if message.Entry.Origin != s.origin {
+				handle(message)
+			}
+		}
+	}
+}
+
+func (s *redisSync) handle(message redisMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	origin := redisOriginPrefix + message.Entry.Origin
+	current, exists := ipStorage.GetBlockedIPs()[normalizeIP(message.Entry.IP)]
+
+	switch message.Op {
+	case "block":
+		entry, accepted := acceptMirror(message.Entry, origin, ipStorage.FindAllow, now)
+		if accepted && (!exists || replacesRedisMirror(current, entry, now)) {
+			mirrorEntry(entry, redisLog)
+		}
+	case "unblock":
+		if exists && current.Origin == origin {
+			redisLog.Info("Removing block lifted by another node", "origin", message.Entry.Origin, "ip", current.IP)
+			if err := unblockEntry(current); err != nil {
+				firewallLog.Error("Error unblocking IP", "ip", current.IP, "error", err)
+			}
+		}
+	}
+}
+
+// resync compares the stored blocks with Redis: blocks of this node missing
+// from Redis are written, blocks of this node missing locally are restored
+// and the blocks of the other nodes are mirrored.
+func (s *redisSync) resync() error {
+	var errs []error
+	for _, update := range s.pendingDeletes() {
+		if err := s.retryDelete(update); err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete %s: %v", update.entry.IP, err))
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	shared, err := s.readAll(ctx)
+	cancel()
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+	// Blocks whose delete is still pending must not come back.
+	for _, update := range s.pendingDeletes() {
+		delete(shared, normalizeIP(update.entry.IP))
+	}
+
+	s.mu.Lock()
+	plan := planRedisSync(s.origin, shared, ipStorage.GetBlockedIPs(), ipStorage.FindAllow, time.Now())
+	for _, entry := range plan.remove {
+		redisLog.Info("Removing block no longer in Redis", "origin", strings.TrimPrefix(entry.Origin, redisOriginPrefix), "ip", entry.IP)
+		if err := unblockEntry(entry); err != nil {
+			firewallLog.Error("Error unblocking IP", "ip", entry.IP, "error", err)
+		}
+	}
+	for _, entry := range plan.restore {
+		redisLog.Info("Restoring block of this node from Redis", entryAttrs(entry)...)
+		if err := ipStorage.AddBlockedEntry(entry); err != nil {
+			storageLog.Error("Error saving blocked IP", "ip", entry.IP, "error", err)
+			continue
+		}
+		applyAction(entry.IP, entry.Action)
+	}
+	for _, entry := range plan.mirror {
+		mirrorEntry(entry, redisLog)
+	}
+	s.mu.Unlock()
+
+	for _, entry := range plan.publish {
+		if _, err := s.writeBlock(entry); err != nil {
+			errs = append(errs, fmt.Errorf("failed to publish %s: %v", entry.IP, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+type redisPlan struct {
+	publish []storage.BlockedIP
+	restore []storage.BlockedIP
+	mirror  []storage.BlockedIP
+	remove  []storage.BlockedIP
+}
+
+// planRedisSync compares the blocks in Redis with the stored ones. Blocks
+// of this node win over those mirrored from Redis, and feed mirrors are left
+// to their feeds.
+func planRedisSync(origin string, shared map[string]feedEntry, existing map[string]storage.BlockedIP,
+	allowed func(ip string, usernames []string, now time.Time) (storage.BlockedIP, bool), now time.Time) redisPlan {
+	var plan redisPlan
+	wanted := make(map[string]struct{}, len(shared))
+
+	for ip, published := range shared {
+		current, exists := existing[ip]
+		exists = exists && current.Active(now)
+
+		if published.Origin == origin {
+			if !exists {
+				if entry, accepted := acceptMirror(published, "", allowed, now); accepted {
+					plan.restore = append(plan.restore, entry)
+				}
+			}
+			continue
+		}
+
+		entry, accepted := acceptMirror(published, redisOriginPrefix+published.Origin, allowed, now)
+		if !accepted {
+			continue
+		}
+		wanted[ip] = struct{}{}
+		if !exists || replacesRedisMirror(current, entry, now) {
+			plan.mirror = append(plan.mirror, entry)
+		}
+	}
+
+	for ip, entry := range existing {
+		if !entry.Active(now) {
+			continue
+		}
+		if strings.HasPrefix(entry.Origin, redisOriginPrefix) {
+			if _, exists := wanted[ip]; !exists {
+				plan.remove = append(plan.remove, entry)
+			}
+			continue
+		}
+		if entry.Origin != "" {
+			continue
+		}
+
+		published, exists := shared[normalizeIP(ip)]
+		switch {
+		case !exists,
+			published.Origin == origin && !sameMirror(sharedEntry(published, now), entry),
+			published.Origin != origin && outlasts(entry, sharedEntry(published, now)):
+			plan.publish = append(plan.publish, entry)
+		}
+	}
+
+	for _, entries := range [][]storage.BlockedIP{plan.publish, plan.restore, plan.mirror, plan.remove} {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].IP < entries[j].IP })
+	}
+	return plan
+}
+
+// replacesRedisMirror reports whether a block announced through Redis takes
+// the place of the stored one. Redis holds the longest block of every IP,
+// so it replaces any other Redis mirror, but never local or feed blocks.
+func replacesRedisMirror(current, entry storage.BlockedIP, now time.Time) bool {
+	if !current.Active(now) {
+		return true
+	}
+	if !strings.HasPrefix(current.Origin, redisOriginPrefix) {
+		return false
+	}
+	return current.Origin != entry.Origin || !sameMirror(current, entry)
+}
+
+// sharedEntry converts a block read from Redis for comparisons.
+func sharedEntry(published feedEntry, now time.Time) storage.BlockedIP {
+	entry := storage.BlockedIP{
+		IP:       published.IP,
+		Username: published.Username,
+		Kind:     published.Kind,
+		Reason:   published.Reason,
+		Action:   published.Action,
+	}
+	if published.Remaining > 0 {
+		entry.BlockedUntil = now.Add(time.Duration(published.Remaining) * time.Second)
+	}
+	return entry
+}
@@ -0,0 +1,210 @@
+package utils
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"tblocker/config"
+	"tblocker/storage"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newTestRedisSync(t *testing.T, server *miniredis.Miniredis, origin string) *redisSync {
+	s := newRedisSync(config.RedisConfig{Addr: server.Addr(), Prefix: "tb", Origin: origin}, t.TempDir())
+	t.Cleanup(func() { s.client.Close() })
+	return s
+}
+
+func receiveMessage(t *testing.T, messages <-chan redisMessage) redisMessage {
+	t.Helper()
+	select {
+	case message := <-messages:
+		return message
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a message within 2 seconds")
+	}
+	return redisMessage{}
+}
+
+func TestRedisWriteAndDelete(t *testing.T) {
+	server := miniredis.RunT(t)
+	a := newTestRedisSync(t, server, "node-a")
+	b := newTestRedisSync(t, server, "node-b")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pubsub := b.client.Subscribe(ctx, b.channel())
+	defer pubsub.Close()
+	if _, err := pubsub.Receive(ctx); err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	messages := make(chan redisMessage, 10)
+	go b.listen(ctx, pubsub, func(message redisMessage) { messages <- message }, func() {})
+
+	block := storage.BlockedIP{IP: "1.1.1.1", Username: "bob", BlockedUntil: time.Now().Add(10 * time.Minute), Reason: "torrent"}
+	if written, err := a.writeBlock(block); !written || err != nil {
+		t.Fatalf("Expected block to be written, got %v (%v)", written, err)
+	}
+	if ttl := server.TTL("tb:block:1.1.1.1"); ttl < 9*time.Minute || ttl > 10*time.Minute {
+		t.Errorf("Expected a TTL of about 10 minutes, got %s", ttl)
+	}
+	message := receiveMessage(t, messages)
+	if message.Op != "block" || message.Entry.IP != "1.1.1.1" || message.Entry.Origin != "node-a" || message.Entry.Username != "bob" || message.Entry.Remaining < 590 {
+		t.Errorf("Unexpected block message %+v", message)
+	}
+
+	if written, _ := a.writeBlock(block); written {
+		t.Error("Expected an unchanged block not to be written again")
+	}
+	if written, _ := b.writeBlock(storage.BlockedIP{IP: "1.1.1.1", BlockedUntil: time.Now().Add(time.Minute)}); written {
+		t.Error("Expected a shorter block not to replace a longer one")
+	}
+	if written, err := b.writeBlock(storage.BlockedIP{IP: "1.1.1.1", Kind: storage.KindBan}); !written || err != nil {
+		t.Fatalf("Expected a ban to replace the block, got %v (%v)", written, err)
+	}
+	if ttl := server.TTL("tb:block:1.1.1.1"); ttl != 0 {
+		t.Errorf("Expected a ban without TTL, got %s", ttl)
+	}
+
+	if deleted, _ := a.deleteBlock(block); deleted {
+		t.Error("Expected the ban of node-b to survive the unblock of node-a")
+	}
+
+	shared, err := a.readAll(ctx)
+	if err != nil {
+		t.Fatalf("Failed to read shared blocks: %v", err)
+	}
+	if entry := shared["1.1.1.1"]; len(shared) != 1 || entry.Origin != "node-b" || entry.Kind != storage.KindBan || entry.Remaining != 0 {
+		t.Errorf("Unexpected shared blocks %+v", shared)
+	}
+
+	if deleted, err := b.deleteBlock(storage.BlockedIP{IP: "1.1.1.1", Kind: storage.KindBan}); !deleted || err != nil {
+		t.Fatalf("Expected ban to be deleted, got %v (%v)", deleted, err)
+	}
+	if server.Exists("tb:block:1.1.1.1") {
+		t.Error("Expected the key to be deleted")
+	}
+}
+
+func TestPlanRedisSync(t *testing.T) {
+	now := time.Now()
+	shared := map[string]feedEntry{
+		"1.1.1.1": {IP: "1.1.1.1", Kind: storage.KindBlock, Remaining: 600, Origin: "node-b"},
+		"2.2.2.2": {IP: "2.2.2.2", Kind: storage.KindBan, Origin: "node-a"},
+		"3.3.3.3": {IP: "3.3.3.3", Kind: storage.KindBlock, Remaining: 600, Origin: "node-b"},
+		"4.4.4.4": {IP: "4.4.4.4", Kind: storage.KindBlock, Remaining: 600, Origin: "node-c"},
+		"6.6.6.6": {IP: "6.6.6.6", Kind: storage.KindBlock, Remaining: 60, Origin: "node-b"},
+	}
+	existing := map[string]storage.BlockedIP{
+		"3.3.3.3": {IP: "3.3.3.3", BlockedUntil: now.Add(time.Hour)},
+		"4.4.4.4": {IP: "4.4.4.4", Kind: storage.KindBlock, BlockedUntil: now.Add(600 * time.Second), Origin: "redis:node-c"},
+		"5.5.5.5": {IP: "5.5.5.5", Kind: storage.KindBlock, BlockedUntil: now.Add(time.Hour), Origin: "redis:node-b"},
+		"6.6.6.6": {IP: "6.6.6.6", BlockedUntil: now.Add(time.Hour)},
+		"7.7.7.7": {IP: "7.7.7.7", Kind: storage.KindBan},
+		"8.8.8.8": {IP: "8.8.8.8", Kind: storage.KindBlock, BlockedUntil: now.Add(time.Hour), Origin: "node-d"},
+	}
+
+	plan := planRedisSync("node-a", shared, existing, noAllows, now)
+	if got := entryIPs(plan.mirror); got != "1.1.1.1" {
+		t.Errorf("Expected to mirror 1.1.1.1, got %s", got)
+	}
+	if plan.mirror[0].Origin != "redis:node-b" {
+		t.Errorf("Expected mirror to be labelled redis:node-b, got %q", plan.mirror[0].Origin)
+	}
+	if got := entryIPs(plan.restore); got != "2.2.2.2" || plan.restore[0].Origin != "" {
+		t.Errorf("Expected to restore the ban of this node, got %+v", plan.restore)
+	}
+	if got := entryIPs(plan.remove); got != "5.5.5.5" {
+		t.Errorf("Expected to remove the stale mirror 5.5.5.5, got %s", got)
+	}
+	if got := entryIPs(plan.publish); got != "3.3.3.3 6.6.6.6 7.7.7.7" {
+		t.Errorf("Expected to publish the longer local blocks, got %s", got)
+	}
+}
+
+func TestRedisHandleBlock(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "redis_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store, err := storage.NewIPStorage(tempDir, func(string, time.Duration, string) {})
+	if err != nil {
+		t.Fatalf("Failed to create IP storage: %v", err)
+	}
+	oldStorage := ipStorage
+	defer func() { ipStorage = oldStorage }()
+	ipStorage = store
+
+	s := &redisSync{origin: "node-a"}
+	s.handle(redisMessage{Op: "block", Entry: feedEntry{IP: "1.1.1.1", Kind: storage.KindBlock, Remaining: 600, Origin: "node-b"}})
+	s.handle(redisMessage{Op: "block", Entry: feedEntry{IP: "2.2.2.2", Kind: storage.KindBlock, Origin: "node-b"}})
+
+	entries := store.GetBlockedIPs()
+	if len(entries) != 1 || entries["1.1.1.1"].Origin != "redis:node-b" {
+		t.Errorf("Expected one mirrored block, got %+v", entries)
+	}
+	if err := RemoveEntry(storage.KindBlock, "1.1.1.1"); err == nil {
+		t.Error("Expected removing a mirrored block to be refused")
+	}
+}
+
+func TestRedisResyncRetriesDeletes(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "redis_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store, err := storage.NewIPStorage(tempDir, func(string, time.Duration, string) {})
+	if err != nil {
+		t.Fatalf("Failed to create IP storage: %v", err)
+	}
+	oldStorage := ipStorage
+	defer func() { ipStorage = oldStorage }()
+	ipStorage = store
+
+	server := miniredis.RunT(t)
+	s := newTestRedisSync(t, server, "node-a")
+	ban := storage.BlockedIP{IP: "2.2.2.2", Kind: storage.KindBan, Reason: "abuse"}
+	if written, err := s.writeBlock(ban); !written || err != nil {
+		t.Fatalf("Expected ban to be written, got %v (%v)", written, err)
+	}
+
+	// The unblock is queued but Redis fails before publishUpdates gets to it.
+	server.SetError("LOADING Redis is loading the dataset in memory")
+	s.queue(redisUpdate{entry: ban, remove: true})
+	if err := s.resync(); err == nil {
+		t.Error("Expected resync to fail while Redis is down")
+	}
+
+	// The pending delete survives a restart.
+	s = newRedisSync(config.RedisConfig{Addr: server.Addr(), Prefix: "tb", Origin: "node-a"}, filepath.Dir(s.deletesPath))
+	t.Cleanup(func() { s.client.Close() })
+	if pending := s.pendingDeletes(); len(pending) != 1 || pending[0].entry.IP != "2.2.2.2" || !pending[0].remove {
+		t.Fatalf("Expected the pending delete to be loaded, got %+v", pending)
+	}
+
+	server.SetError("")
+	if err := s.resync(); err != nil {
+		t.Fatalf("Expected resync to succeed, got %v", err)
+	}
+	if server.Exists("tb:block:2.2.2.2") {
+		t.Error("Expected the pending delete to be retried")
+	}
+	if _, exists := store.GetBlockedIPs()["2.2.2.2"]; exists {
+		t.Error("Expected the removed ban not to be restored from Redis")
+	}
+	if pending := s.pendingDeletes(); len(pending) != 0 {
+		t.Errorf("Expected no pending deletes, got %+v", pending)
+	}
+	restarted := newRedisSync(config.RedisConfig{Addr: server.Addr(), Prefix: "tb", Origin: "node-a"}, filepath.Dir(s.deletesPath))
+	defer restarted.client.Close()
+	if pending := restarted.pendingDeletes(); len(pending) != 0 {
+		t.Errorf("Expected the confirmed delete to be forgotten, got %+v", pending)
+	}
+}
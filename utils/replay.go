@@ -0,0 +1,329 @@
+package utils
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"tblocker/config"
+	"tblocker/parser"
+	"text/tabwriter"
+	"time"
+)
+
+const replayMaxLineSize = 1024 * 1024
+
+type replayAction struct {
+	Action       string
+	Reason       string
+	Username     string
+	Event        parser.Event
+	Duration     int
+	DetectedAt   time.Time
+	BlockedUntil time.Time
+}
+
+type replayUserSummary struct {
+	Username      string
+	Blocks        int
+	Notifications int
+	Minutes       int
+	IPs           map[string]struct{}
+	First         time.Time
+	Last          time.Time
+}
+
+// replayer runs log lines through the detection pipeline with its own state
+// and a clock driven by the line timestamps, recording what would happen.
+type replayer struct {
+	source         *logSource
+	detector       *detector
+	blocked        map[string]time.Time
+	last           time.Time
+	lines          int
+	matched        int
+	alreadyBlocked int
+	ignored        map[string]int
+	actions        []replayAction
+}
+
+func newReplayer(source *logSource, explain bool) *replayer {
+	r := &replayer{
+		source:  source,
+		blocked: make(map[string]time.Time),
+		ignored: make(map[string]int),
+	}
+	r.detector = &detector{
+		tracker: newDetectionTracker(),
+		userIPs: newUserIPTracker(),
+		now:     r.clock,
+		blocked: r.isBlocked,
+		explain: explain,
+	}
+	return r
+}
+
+func (r *replayer) isBlocked(ip string, now time.Time) bool {
+	until, exists := r.blocked[ip]
+	return exists && until.After(now)
+}
+
+func (r *replayer) clock(event parser.Event) time.Time {
+	if !event.Time.IsZero() {
+		r.last = event.Time
+	}
+	if r.last.IsZero() {
+		return time.Now()
+	}
+	return r.last
+}
+
+// process handles one line and returns the detection result, or nil if the
+// line carries none of the configured tags.
+func (r *replayer) process(text string) *detection {
+	r.lines++
+
+	matched := matchTagRules(r.source, stringToBytes(text))
+	if len(matched) == 0 {
+		r.detector.observe(r.source, text)
+		return nil
+	}
+	r.matched++
+
+	result := r.detector.evaluate(r.source, text, matched)
+	if result.Stage == stageBlocked {
+		r.alreadyBlocked++
+		return &result
+	}
+	if result.Verdict == verdictIgnore {
+		r.ignored[result.Stage]++
+		return &result
+	}
+
+	action := replayAction{
+		Action:       "notify",
+		Reason:       result.Rule.Reason,
+		Username:     processUsername(r.source, result.Event.Username),
+		Event:        result.Event,
+		Duration:     result.Duration,
+		DetectedAt:   result.DetectedAt,
+		BlockedUntil: result.BlockedUntil,
+	}
+
+	if result.Verdict == verdictNotify {
+		r.actions = append(r.actions, action)
+		return &result
+	}
+
+	action.Action = "block"
+	if result.Action == "throttle" {
+		action.Action = "throttle"
+	}
+
+	for _, ip := range result.IPs {
+		if r.isBlocked(ip, result.DetectedAt) {
+			r.detector.note(&result, "IP %s is already blocked until %s by an earlier line", ip, r.blocked[ip].Format(time.RFC3339))
+			continue
+		}
+		r.blocked[ip] = result.BlockedUntil
+
+		ipAction := action
+		ipAction.Event.IP = ip
+		r.actions = append(r.actions, ipAction)
+	}
+
+	return &result
+}
+
+func (r *replayer) readFile(path string) error {
+	var input io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		input = file
+	}
+
+	buffered := bufio.NewReader(input)
+	var reader io.Reader = buffered
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return fmt.Errorf("failed to open gzip stream %s: %v", path, err)
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), replayMaxLineSize)
+	for scanner.Scan() {
+		r.process(scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return nil
+}
+
+func (r *replayer) summaries() []*replayUserSummary {
+	byUser := make(map[string]*replayUserSummary)
+
+	for _, action := range r.actions {
+		summary, exists := byUser[action.Username]
+		if !exists {
+			summary = &replayUserSummary{Username: action.Username, IPs: make(map[string]struct{}), First: action.DetectedAt}
+			byUser[action.Username] = summary
+		}
+
+		if action.Action != "notify" {
+			summary.Blocks++
+			summary.Minutes += action.Duration
+		} else {
+			summary.Notifications++
+		}
+		summary.IPs[action.Event.IP] = struct{}{}
+		if action.DetectedAt.Before(summary.First) {
+			summary.First = action.DetectedAt
+		}
+		if action.DetectedAt.After(summary.Last) {
+			summary.Last = action.DetectedAt
+		}
+	}
+
+	result := make([]*replayUserSummary, 0, len(byUser))
+	for _, summary := range byUser {
+		result = append(result, summary)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Blocks != result[j].Blocks {
+			return result[i].Blocks > result[j].Blocks
+		}
+		return result[i].Username < result[j].Username
+	})
+
+	return result
+}
+
+func (r *replayer) writeReport(out io.Writer) {
+	for _, action := range r.actions {
+		if action.Action != "notify" {
+			fmt.Fprintf(out, "%s %-6s user=%s ip=%s reason=%s for %d minutes until %s%s\n",
+				action.DetectedAt.Format(time.RFC3339), action.Action, action.Username, action.Event.IP, action.Reason,
+				action.Duration, action.BlockedUntil.Format(time.RFC3339), describeEvent(action.Event))
+		} else {
+			fmt.Fprintf(out, "%s notify user=%s ip=%s reason=%s%s\n",
+				action.DetectedAt.Format(time.RFC3339), action.Username, action.Event.IP, action.Reason, describeEvent(action.Event))
+		}
+	}
+
+	summaries := r.summaries()
+	blocks, notifications := 0, 0
+	for _, summary := range summaries {
+		blocks += summary.Blocks
+		notifications += summary.Notifications
+	}
+
+	fmt.Fprintf(out, "\n%d lines read, %d with tags %s: %d blocks, %d notifications, %d while already blocked\n",
+		r.lines, r.matched, r.source.describeTags(), blocks, notifications, r.alreadyBlocked)
+
+	if len(r.ignored) > 0 {
+		stages := make([]string, 0, len(r.ignored))
+		for stage, count := range r.ignored {
+			stages = append(stages, fmt.Sprintf("%s=%d", stage, count))
+		}
+		sort.Strings(stages)
+		fmt.Fprintf(out, "Ignored: %s\n", strings.Join(stages, " "))
+	}
+
+	if len(summaries) == 0 {
+		return
+	}
+
+	fmt.Fprintln(out)
+	table := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "USER\tBLOCKS\tNOTIFY\tMINUTES\tIPS\tFIRST\tLAST")
+	for _, summary := range summaries {
+		fmt.Fprintf(table, "%s\t%d\t%d\t%d\t%d\t%s\t%s\n",
+			summary.Username, summary.Blocks, summary.Notifications, summary.Minutes, len(summary.IPs),
+			summary.First.Format(time.RFC3339), summary.Last.Format(time.RFC3339))
+	}
+	table.Flush()
+}
+
+// replaySource returns the configured log source with the given label, the
+// first configured source if the label is empty, or a syslog node source.
+func replaySource(label string) (*logSource, error) {
+	if label == "" {
+		if len(config.LogSources) > 0 {
+			return newLogSource(config.LogSources[0]), nil
+		}
+		return newLogSource(config.LogSource{}), nil
+	}
+
+	for _, cfg := range config.LogSources {
+		if cfg.Label == label {
+			return newLogSource(cfg), nil
+		}
+	}
+
+	if config.Syslog.Enabled {
+		return newLogSource(config.Syslog.SourceFor(label)), nil
+	}
+
+	return nil, fmt.Errorf("unknown log source %q", label)
+}
+
+// Replay runs historical log files (plain or gzip, "-" for stdin) through
+// the detection rules and reports who would have been blocked, without
+// touching the firewall, storage or webhooks.
+func Replay(paths []string, sourceLabel string, out io.Writer) error {
+	source, err := replaySource(sourceLabel)
+	if err != nil {
+		return err
+	}
+
+	r := newReplayer(source, false)
+	for _, path := range paths {
+		if err := r.readFile(path); err != nil {
+			return err
+		}
+	}
+
+	r.writeReport(out)
+	return nil
+}
+
+// Explain shows for each line why it would or would not cause a block.
+// Lines are evaluated in order, so thresholds accumulate across them.
+func Explain(lines []string, sourceLabel string, out io.Writer) error {
+	source, err := replaySource(sourceLabel)
+	if err != nil {
+		return err
+	}
+
+	r := newReplayer(source, true)
+	for i, line := range lines {
+		if i > 0 {
+			fmt.Fprintln(out)
+		}
+		fmt.Fprintf(out, "Line: %s\n", line)
+
+		result := r.process(line)
+		if result == nil {
+			fmt.Fprintf(out, "  none of the tags %s found in line, ignored\n", source.describeTags())
+			continue
+		}
+
+		for _, step := range result.Trace {
+			fmt.Fprintf(out, "  %s\n", step)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,149 @@
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"tblocker/config"
+	"testing"
+)
+
+const replayTestLog = `2024/01/02 15:04:05 from 1.2.3.4:5555 accepted tcp:example.com:443 [inbound >> TORRENT] email: 1.bob
+2024/01/02 15:05:05 from 1.2.3.4:5555 accepted tcp:example.com:443 [inbound >> TORRENT] email: 1.bob
+2024/01/02 15:06:00 from 9.9.9.9:5555 accepted tcp:example.com:443 [inbound >> TORRENT] email: 3.staff
+2024/01/02 15:20:05 from 1.2.3.4:5555 accepted tcp:example.com:443 [inbound >> TORRENT] email: 1.bob
+2024/01/02 15:20:06 from 5.6.7.8:5555 accepted tcp:example.com:443 [inbound >> DIRECT] email: 2.alice
+`
+
+func TestReplayGzip(t *testing.T) {
+	loadPolicyTestConfig(t)
+
+	tempDir, err := os.MkdirTemp("", "replay_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte(replayTestLog))
+	gz.Close()
+
+	logFile := filepath.Join(tempDir, "access.log.1.gz")
+	if err := os.WriteFile(logFile, compressed.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write log file: %v", err)
+	}
+
+	source, err := replaySource("")
+	if err != nil {
+		t.Fatalf("Failed to get replay source: %v", err)
+	}
+
+	r := newReplayer(source, false)
+	if err := r.readFile(logFile); err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+
+	if r.lines != 5 || r.matched != 4 {
+		t.Errorf("Expected 5 lines with 4 matched, got %d and %d", r.lines, r.matched)
+	}
+	if r.alreadyBlocked != 1 {
+		t.Errorf("Expected 1 detection while already blocked, got %d", r.alreadyBlocked)
+	}
+	if r.ignored[stageExempt] != 1 {
+		t.Errorf("Expected 1 exempt detection, got %d", r.ignored[stageExempt])
+	}
+
+	summaries := r.summaries()
+	if len(summaries) != 1 || summaries[0].Username != "bob" || summaries[0].Blocks != 2 || summaries[0].Minutes != 20 {
+		t.Fatalf("Unexpected summaries: %+v", summaries)
+	}
+
+	var out bytes.Buffer
+	r.writeReport(&out)
+	if !strings.Contains(out.String(), "block  user=bob ip=1.2.3.4 reason=torrent for 10 minutes until 2024-01-02T15:30:05") {
+		t.Errorf("Report does not contain the second block:\n%s", out.String())
+	}
+}
+
+func TestExplain(t *testing.T) {
+	loadPolicyTestConfig(t)
+
+	lines := strings.Split(strings.TrimSpace(replayTestLog), "\n")
+
+	var out bytes.Buffer
+	if err := Explain([]string{lines[0], lines[2], lines[4]}, "", &out); err != nil {
+		t.Fatalf("Explain failed: %v", err)
+	}
+
+	for _, expected := range []string{
+		"would block for 10 minutes",
+		"rejected: user is exempt by policy 'staff'",
+		"attributed to tag 'TORRENT' (reason: torrent)",
+		"none of the tags 'TORRENT' (torrent) found in line, ignored",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Explain output does not contain %q:\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestReplaySourceUnknown(t *testing.T) {
+	loadPolicyTestConfig(t)
+
+	if _, err := replaySource("missing"); err == nil {
+		t.Error("Expected error for unknown log source")
+	}
+}
+
+func TestReplayThrottleRule(t *testing.T) {
+	loadMatchTestConfig(t, `
+BlockDuration: 10
+TorrentTag: TORRENT
+UsernameRegex: "^\\d+\\.(.+)$"
+TagRules:
+  - Tag: SPAM
+    Scope: ip
+    Reason: spam
+    Action: throttle
+    BlockDuration: 30
+`)
+
+	source, err := replaySource("")
+	if err != nil {
+		t.Fatalf("Failed to get replay source: %v", err)
+	}
+
+	r := newReplayer(source, false)
+	r.process("2024/01/02 15:04:05 from 1.2.3.4:5555 accepted tcp:mail.example:25 [inbound >> SPAM] email: 1.bob")
+
+	if len(r.actions) != 1 || r.actions[0].Action != "throttle" || r.actions[0].Duration != 30 || r.actions[0].Reason != "spam" {
+		t.Fatalf("Unexpected replay actions: %+v", r.actions)
+	}
+}
+
+func TestReplayUserScope(t *testing.T) {
+	loadPolicyTestConfig(t)
+	defer func() { config.BlockScope = "ip" }()
+	config.BlockScope = "user"
+
+	source, err := replaySource("")
+	if err != nil {
+		t.Fatalf("Failed to get replay source: %v", err)
+	}
+
+	r := newReplayer(source, false)
+	r.process("2024/01/02 15:00:00 from 10.0.0.1:5555 accepted tcp:example.com:443 [inbound >> direct] email: 1.bob")
+	r.process("2024/01/02 15:01:00 from 10.0.0.2:5555 accepted tcp:example.com:443 [inbound >> direct] email: 1.bob")
+	r.process("2024/01/02 15:01:30 from 10.0.0.9:5555 accepted tcp:example.com:443 [inbound >> direct] email: 2.alice")
+	r.process("2024/01/02 15:02:00 from 10.0.0.2:5555 accepted tcp:tracker.example:6969 [inbound >> TORRENT] email: 1.bob")
+
+	if len(r.actions) != 2 {
+		t.Fatalf("Expected both IPs of bob to be blocked, got %+v", r.actions)
+	}
+	if r.actions[0].Event.IP != "10.0.0.2" || r.actions[1].Event.IP != "10.0.0.1" {
+		t.Errorf("Expected triggering IP first, got %s and %s", r.actions[0].Event.IP, r.actions[1].Event.IP)
+	}
+}
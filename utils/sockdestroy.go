@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"sync"
+	"tblocker/netns"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+var sockDestroyMu sync.Mutex
+
+const (
+	inetDiagReqSize = 56
+	inetDiagMsgSize = 72
+	tcpListenState  = 10
+)
+
+// inetDiagSockID mirrors struct inet_diag_sockid. Ports and addresses are in
+// network byte order, the cookie is opaque. Family is not part of the kernel
+// struct but is needed to address the socket again.
+type inetDiagSockID struct {
+	Family          uint8
+	SourcePort      uint16
+	DestinationPort uint16
+	Source          [16]byte
+	Destination     [16]byte
+	Interface       uint32
+	Cookie          [8]byte
+}
+
+func (id inetDiagSockID) marshal(b []byte) {
+	binary.BigEndian.PutUint16(b[0:2], id.SourcePort)
+	binary.BigEndian.PutUint16(b[2:4], id.DestinationPort)
+	copy(b[4:20], id.Source[:])
+	copy(b[20:36], id.Destination[:])
+	binary.NativeEndian.PutUint32(b[36:40], id.Interface)
+	copy(b[40:48], id.Cookie[:])
+}
+
+func unmarshalInetDiagSockID(b []byte) inetDiagSockID {
+	var id inetDiagSockID
+	id.SourcePort = binary.BigEndian.Uint16(b[0:2])
+	id.DestinationPort = binary.BigEndian.Uint16(b[2:4])
+	copy(id.Source[:], b[4:20])
+	copy(id.Destination[:], b[20:36])
+	id.Interface = binary.NativeEndian.Uint32(b[36:40])
+	copy(id.Cookie[:], b[40:48])
+	return id
+}
+
+// marshalInetDiagReq builds a struct inet_diag_req_v2 for TCP sockets of the
+// id's family in every state except LISTEN.
+func marshalInetDiagReq(id inetDiagSockID) []byte {
+	b := make([]byte, inetDiagReqSize)
+	b[0] = id.Family
+	b[1] = unix.IPPROTO_TCP
+	binary.NativeEndian.PutUint32(b[4:8], 0xffffffff&^(1<<tcpListenState))
+	id.marshal(b[8:])
+	return b
+}
+
+// remoteAddr returns the remote address of a socket, which for the proxy's
+// accepted connections is the client address. IPv4 clients of a dual-stack
+// listener show up as IPv4-mapped addresses and are unmapped.
+func (id inetDiagSockID) remoteAddr() netip.Addr {
+	if id.Family == unix.AF_INET {
+		return netip.AddrFrom4([4]byte(id.Destination[:4]))
+	}
+	return netip.AddrFrom16(id.Destination).Unmap()
+}
+
+// destroySockets kills the local TCP sockets connected to any of the given
+// addresses with SOCK_DESTROY, counting the destroyed sockets per address.
+// It needs CAP_NET_ADMIN and a kernel built with CONFIG_INET_DIAG_DESTROY.
+func destroySockets(counts map[netip.Addr]int) error {
+	conn, err := netlink.Dial(unix.NETLINK_SOCK_DIAG, &netlink.Config{NetNS: netns.Fd()})
+	if err != nil {
+		return fmt.Errorf("failed to open sock_diag netlink socket: %v", err)
+	}
+	defer conn.Close()
+
+	ids, err := dumpSockets(conn)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		addr := id.remoteAddr()
+		if _, exists := counts[addr]; !exists {
+			continue
+		}
+
+		_, err := conn.Execute(netlink.Message{
+			Header: netlink.Header{
+				Type:  netlink.HeaderType(unix.SOCK_DESTROY),
+				Flags: netlink.Request | netlink.Acknowledge,
+			},
+			Data: marshalInetDiagReq(id),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to destroy socket of %s: %v", addr, err)
+		}
+		counts[addr]++
+	}
+
+	return nil
+}
+
+func dumpSockets(conn *netlink.Conn) ([]inetDiagSockID, error) {
+	var ids []inetDiagSockID
+
+	for _, family := range []uint8{unix.AF_INET, unix.AF_INET6} {
+		messages, err := conn.Execute(netlink.Message{
+			Header: netlink.Header{
+				Type:  netlink.HeaderType(unix.SOCK_DIAG_BY_FAMILY),
+				Flags: netlink.Request | netlink.Dump,
+			},
+			Data: marshalInetDiagReq(inetDiagSockID{Family: family}),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to dump sockets: %v", err)
+		}
+
+		for _, message := range messages {
+			if id, ok := parseInetDiagMsg(message.Data); ok {
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	return ids, nil
+}
+
+// parseInetDiagMsg extracts the socket id from a struct inet_diag_msg.
+func parseInetDiagMsg(data []byte) (inetDiagSockID, bool) {
+	if len(data) < inetDiagMsgSize {
+		return inetDiagSockID{}, false
+	}
+	id := unmarshalInetDiagSockID(data[4:52])
+	id.Family = data[0]
+	return id, true
+}
+
+func destroyIPSockets(ip string) (int, error) {
+	addr, err := parseConntrackAddr(ip)
+	if err != nil {
+		return 0, err
+	}
+
+	sockDestroyMu.Lock()
+	defer sockDestroyMu.Unlock()
+
+	counts := map[netip.Addr]int{addr: 0}
+	err = destroySockets(counts)
+	return counts[addr], err
+}
+
+// socketDestroyAvailable checks that sockets can be listed over sock_diag.
+// Whether the kernel supports SOCK_DESTROY is only known on first use.
+func socketDestroyAvailable() error {
+	conn, err := netlink.Dial(unix.NETLINK_SOCK_DIAG, &netlink.Config{NetNS: netns.Fd()})
+	if err != nil {
+		return fmt.Errorf("failed to open sock_diag netlink socket: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := dumpSockets(conn); err != nil {
+		return err
+	}
+
+	conntrackLog.Info("Socket destroy via sock_diag netlink is available")
+	return nil
+}
@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"net/netip"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestInetDiagSockIDRoundTrip(t *testing.T) {
+	id := inetDiagSockID{
+		Family:          unix.AF_INET6,
+		SourcePort:      443,
+		DestinationPort: 51234,
+		Interface:       2,
+		Cookie:          [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	copy(id.Destination[:], netip.MustParseAddr("::ffff:1.2.3.4").AsSlice())
+
+	req := marshalInetDiagReq(id)
+	if len(req) != inetDiagReqSize || req[0] != unix.AF_INET6 || req[1] != unix.IPPROTO_TCP {
+		t.Fatalf("Unexpected request header: %v", req[:8])
+	}
+	if req[8] != 0x01 || req[9] != 0xbb {
+		t.Errorf("Expected source port in network byte order, got %v", req[8:10])
+	}
+
+	msg := make([]byte, inetDiagMsgSize)
+	msg[0] = unix.AF_INET6
+	copy(msg[4:52], req[8:56])
+
+	parsed, ok := parseInetDiagMsg(msg)
+	if !ok {
+		t.Fatal("Failed to parse inet_diag_msg")
+	}
+	if parsed != id {
+		t.Errorf("Expected %+v, got %+v", id, parsed)
+	}
+	if addr := parsed.remoteAddr(); addr != netip.MustParseAddr("1.2.3.4") {
+		t.Errorf("Expected unmapped remote address 1.2.3.4, got %s", addr)
+	}
+
+	if _, ok := parseInetDiagMsg(msg[:10]); ok {
+		t.Error("Expected short message to be rejected")
+	}
+}
@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"tblocker/config"
+	"tblocker/parser"
+)
+
+type logSource struct {
+	sourceType       string
+	label            string
+	path             string
+	unit             string
+	syslogIdentifier string
+	torrentTag       []byte
+	usernameRegex    *regexp.Regexp
+	parser           parser.Parser
+	rules            []config.TagRule
+	tagMatcher       *parser.TagMatcher
+	activity         sourceActivity
+}
+
+var logSources []*logSource
+
+func newLogSource(cfg config.LogSource) *logSource {
+	logParser, err := parser.New(cfg.Parser, cfg.ParserPattern)
+	if err != nil {
+		monitorLog.Error("Error creating parser for log source, falling back to xray", "source", cfg.Label, "error", err)
+		logParser = parser.NewXrayParser()
+	}
+
+	return &logSource{
+		sourceType:       cfg.Type,
+		label:            cfg.Label,
+		path:             cfg.Path,
+		unit:             cfg.Unit,
+		syslogIdentifier: cfg.SyslogIdentifier,
+		torrentTag:       []byte(cfg.GetTorrentTag()),
+		usernameRegex:    cfg.GetUsernameRegex(),
+		parser:           logParser,
+		rules:            cfg.GetTagRules(),
+		tagMatcher:       cfg.GetTagMatcher(),
+	}
+}
+
+func initializeLogSources() {
+	logSources = make([]*logSource, 0, len(config.LogSources))
+
+	for _, cfg := range config.LogSources {
+		source := newLogSource(cfg)
+		logSources = append(logSources, source)
+
+		source.logger().Info("Initialized log source", "input", source.describe(), "tag", string(source.torrentTag), "parser", source.parser.GetName())
+		if len(source.rules) > 1 || (len(source.rules) == 1 && source.rules[0].Reason != config.TorrentReason) {
+			source.logger().Info("Log source matches tags", "input", source.describe(), "tags", source.describeTags())
+		}
+		if len(source.rules) == 0 {
+			source.logger().Warn("Log source has an empty TorrentTag and no TagRules and will not detect anything", "input", source.describe())
+		}
+	}
+}
+
+func findLogSource(label string) *logSource {
+	for _, source := range logSources {
+		if source.label == label {
+			return source
+		}
+	}
+
+	syslogSourcesMu.RLock()
+	defer syslogSourcesMu.RUnlock()
+
+	return syslogSources[label]
+}
+
+// logger returns the monitor logger, labelled with the source if it has one.
+func (s *logSource) logger() *slog.Logger {
+	if s == nil || s.label == "" {
+		return monitorLog
+	}
+	return monitorLog.With("source", s.label)
+}
+
+func (s *logSource) logSuffix() string {
+	if s == nil || s.label == "" {
+		return ""
+	}
+	return fmt.Sprintf(" [%s]", s.label)
+}
+
+func (s *logSource) describe() string {
+	switch s.sourceType {
+	case "syslog":
+		return "syslog node " + s.label
+	case "file", "":
+		return s.path
+	}
+	if s.unit != "" {
+		return "journal unit " + s.unit
+	}
+	return "journal identifier " + s.syslogIdentifier
+}
+
+func (s *logSource) describeTags() string {
+	tags := make([]string, 0, len(s.rules))
+	for _, rule := range s.rules {
+		tags = append(tags, fmt.Sprintf("'%s' (%s)", rule.Tag, rule.Reason))
+	}
+	return strings.Join(tags, ", ")
+}
@@ -0,0 +1,141 @@
+package utils
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"tblocker/config"
+	"tblocker/parser"
+	"testing"
+)
+
+func TestLogSources(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "sources_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	configContent := `
+BlockDuration: 10
+TorrentTag: "TORRENT"
+LogSources:
+  - Path: "/var/log/xray/access.log"
+    Label: "main"
+  - Path: "/var/log/second/access.log"
+    Label: "second"
+    TorrentTag: "BT"
+    UsernameRegex: "^\\d+\\.(.+)$"
+`
+
+	configFile := filepath.Join(tempDir, "config.yaml")
+	if err := os.WriteFile(configFile, []byte(configContent), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	if err := config.LoadConfig(configFile); err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	initializeLogSources()
+
+	main := findLogSource("main")
+	second := findLogSource("second")
+	if main == nil || second == nil {
+		t.Fatal("Expected both log sources to be registered")
+	}
+
+	if findLogSource("missing") != nil {
+		t.Error("Expected unknown label to return nil")
+	}
+
+	line := "2025/01/01 00:00:00 from 1.2.3.4:5555 accepted tcp:example.com:443 [in -> BT] email: 42.alice"
+
+	if containsBytes([]byte(line), main.torrentTag) {
+		t.Error("Expected line without TORRENT tag to be ignored by main source")
+	}
+
+	if !containsBytes([]byte(line), second.torrentTag) {
+		t.Error("Expected line with BT tag to be matched by second source")
+	}
+
+	event, valid := second.parser.Parse(line)
+	if !valid || event.IP != "1.2.3.4" || event.Username != "42.alice" {
+		t.Errorf("Unexpected parse result: %+v %v", event, valid)
+	}
+	username := event.Username
+
+	if processed := processUsername(second, username); processed != "alice" {
+		t.Errorf("Expected source regex to produce 'alice', got '%s'", processed)
+	}
+
+	if processed := processUsername(main, username); processed != "42.alice" {
+		t.Errorf("Expected default regex to keep '42.alice', got '%s'", processed)
+	}
+
+	if second.logSuffix() != " [second]" {
+		t.Errorf("Unexpected log suffix: '%s'", second.logSuffix())
+	}
+}
+
+func TestExpandWebhookPlaceholders(t *testing.T) {
+	event := webhookEvent{
+		Event: parser.Event{
+			Network:     "udp",
+			Destination: "tracker.example:6969",
+			Inbound:     "vless-in",
+			Outbound:    "TORRENT",
+		},
+		Source: "node-1",
+	}
+
+	payload := expandWebhookPlaceholders(`{"source":"{source}","dest":"{network}:{destination}","route":"{inbound}->{outbound}"}`, event)
+	if payload != `{"source":"node-1","dest":"udp:tracker.example:6969","route":"vless-in->TORRENT"}` {
+		t.Errorf("Unexpected payload: %s", payload)
+	}
+
+	event.Destination = `evil.example","injected":"1\\`
+	payload = expandWebhookPlaceholders(`{"dest":"{destination}"}`, event)
+	var decoded map[string]string
+	if err := json.Unmarshal([]byte(payload), &decoded); err != nil {
+		t.Fatalf("Expected valid JSON, got %s: %v", payload, err)
+	}
+	if len(decoded) != 1 || decoded["dest"] != event.Destination {
+		t.Errorf("Expected the destination to stay in its field, got %v", decoded)
+	}
+}
+
+func TestFormatWebhookPayload(t *testing.T) {
+	event := webhookEvent{
+		Event: parser.Event{
+			IP:          "1.2.3.4",
+			Username:    "{ip}",
+			Destination: "100%s.example",
+		},
+		Action: "block",
+	}
+
+	payload := formatWebhookPayload(`{"username":"%s","ip":"%s","server":"%s","action":"%s","duration":%d,"timestamp":"%s","dest":"{destination}"}`, event)
+	if !strings.HasPrefix(payload, `{"username":"{ip}","ip":"1.2.3.4",`) || !strings.HasSuffix(payload, `"dest":"100%s.example"}`) {
+		t.Errorf("Expected values to stay literal, got %s", payload)
+	}
+}
+
+func TestDescribeEvent(t *testing.T) {
+	event := parser.Event{
+		Network:     "tcp",
+		Destination: "tracker.example:6969",
+		Inbound:     "vless-in",
+		Outbound:    "TORRENT",
+	}
+
+	expected := " (destination: tcp:tracker.example:6969, route: vless-in -> TORRENT)"
+	if description := describeEvent(event); description != expected {
+		t.Errorf("Expected %q, got %q", expected, description)
+	}
+
+	if description := describeEvent(parser.Event{IP: "1.2.3.4"}); description != "" {
+		t.Errorf("Expected empty description, got %q", description)
+	}
+}
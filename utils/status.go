@@ -0,0 +1,142 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"tblocker/config"
+	"tblocker/netns"
+	"time"
+)
+
+const (
+	statusFileName       = "status.json"
+	statusUpdateInterval = 30 * time.Second
+)
+
+// Status describes the running service. It is written to StorageDir so the
+// status command can report on it from a separate process.
+type Status struct {
+	Version        string    `json:"version"`
+	PID            int       `json:"pid"`
+	Hostname       string    `json:"hostname"`
+	StartedAt      time.Time `json:"started_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+	Firewall       string    `json:"firewall"`
+	ConntrackMode  string    `json:"conntrack_mode"`
+	ConnectionKill string    `json:"connection_kill"`
+	NetNS          string    `json:"network_namespace,omitempty"`
+	LogSources     []string  `json:"log_sources"`
+	BlockedIPs     int       `json:"blocked_ips"`
+}
+
+// StartStatusReporter writes the status file now and then periodically.
+func StartStatusReporter(version string) {
+	status := Status{
+		Version:   version,
+		PID:       os.Getpid(),
+		Hostname:  config.Hostname,
+		StartedAt: time.Now(),
+	}
+
+	write := func() {
+		status.UpdatedAt = time.Now()
+		status.ConntrackMode = config.ConntrackMode
+		status.ConnectionKill = connectionKill
+		status.NetNS = netns.Describe()
+		status.LogSources = describeLogSources()
+		if firewallManager != nil {
+			status.Firewall = firewallManager.GetFirewallName()
+		}
+		if ipStorage != nil {
+			status.BlockedIPs = len(ipStorage.GetBlockedIPs())
+		}
+
+		if err := writeStatus(config.StorageDir, status); err != nil {
+			monitorLog.Error("Error saving status", "error", err)
+		}
+	}
+
+	write()
+	go func() {
+		ticker := time.NewTicker(statusUpdateInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			write()
+		}
+	}()
+}
+
+func describeLogSources() []string {
+	sources := make([]string, 0, len(logSources)+1)
+	for _, source := range logSources {
+		sources = append(sources, source.describe()+source.logSuffix())
+	}
+	for _, addr := range []string{config.Syslog.UDPAddr, config.Syslog.TCPAddr, config.Syslog.TLSAddr} {
+		if config.Syslog.Enabled && addr != "" {
+			sources = append(sources, "syslog receiver "+addr)
+		}
+	}
+	return sources
+}
+
+func writeStatus(storageDir string, status Status) error {
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(storageDir, 0755); err != nil {
+		return err
+	}
+
+	path := filepath.Join(storageDir, statusFileName)
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// ReadStatus reads the status file the service keeps in storageDir.
+func ReadStatus(storageDir string) (*Status, error) {
+	data, err := os.ReadFile(filepath.Join(storageDir, statusFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	var status Status
+	if err := json.Unmarshal(data, &status); err != nil {
+		return nil, fmt.Errorf("failed to parse status: %v", err)
+	}
+	return &status, nil
+}
+
+// WriteStatusReport prints the status, flagging it as stale when the service
+// has not refreshed it for a few update intervals.
+func WriteStatusReport(status *Status, now time.Time, out io.Writer) {
+	fmt.Fprintf(out, "Version:          %s\n", status.Version)
+	fmt.Fprintf(out, "PID:              %d\n", status.PID)
+	fmt.Fprintf(out, "Hostname:         %s\n", status.Hostname)
+	fmt.Fprintf(out, "Started:          %s\n", status.StartedAt.Format(time.RFC3339))
+	fmt.Fprintf(out, "Updated:          %s\n", status.UpdatedAt.Format(time.RFC3339))
+	fmt.Fprintf(out, "Firewall:         %s\n", status.Firewall)
+	if status.NetNS != "" {
+		fmt.Fprintf(out, "Namespace:        %s\n", status.NetNS)
+	} else {
+		fmt.Fprintf(out, "Namespace:        host\n")
+	}
+	fmt.Fprintf(out, "Conntrack mode:   %s\n", status.ConntrackMode)
+	fmt.Fprintf(out, "Connection kill:  %s\n", status.ConnectionKill)
+	fmt.Fprintf(out, "Blocked IPs:      %d\n", status.BlockedIPs)
+	for _, source := range status.LogSources {
+		fmt.Fprintf(out, "Log source:       %s\n", source)
+	}
+
+	if age := now.Sub(status.UpdatedAt); age > 3*statusUpdateInterval {
+		fmt.Fprintf(out, "\nWarning: status was last updated %s ago, the service may not be running\n", age.Truncate(time.Second))
+	}
+}
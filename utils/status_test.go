@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatusRoundTrip(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "status_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	updated := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	status := Status{
+		Version:        "v1.2.3",
+		PID:            42,
+		UpdatedAt:      updated,
+		ConntrackMode:  "optional",
+		ConnectionKill: connectionKillSockDestroy,
+		BlockedIPs:     3,
+	}
+	if err := writeStatus(tempDir, status); err != nil {
+		t.Fatalf("Failed to write status: %v", err)
+	}
+
+	read, err := ReadStatus(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to read status: %v", err)
+	}
+	if read.Version != "v1.2.3" || read.ConnectionKill != "sock_destroy" || read.BlockedIPs != 3 || !read.UpdatedAt.Equal(updated) {
+		t.Errorf("Unexpected status: %+v", read)
+	}
+
+	var out bytes.Buffer
+	WriteStatusReport(read, updated.Add(time.Minute), &out)
+	if !strings.Contains(out.String(), "Connection kill:  sock_destroy") || strings.Contains(out.String(), "Warning") {
+		t.Errorf("Unexpected report for fresh status:\n%s", out.String())
+	}
+
+	out.Reset()
+	WriteStatusReport(read, updated.Add(time.Hour), &out)
+	if !strings.Contains(out.String(), "may not be running") {
+		t.Errorf("Expected stale status warning:\n%s", out.String())
+	}
+}
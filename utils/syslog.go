@@ -0,0 +1,341 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"tblocker/config"
+	"time"
+)
+
+const maxSyslogMessageSize = 64 * 1024
+
+type syslogMessage struct {
+	Hostname string
+	AppName  string
+	Message  string
+}
+
+var (
+	syslogSources     = make(map[string]*logSource)
+	syslogSourcesMu   sync.RWMutex
+	syslogLimitLogged bool
+)
+
+func StartSyslogReceiver() error {
+	cfg := config.Syslog
+
+	if cfg.UDPAddr != "" {
+		conn, err := net.ListenPacket("udp", cfg.UDPAddr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on UDP %s: %v", cfg.UDPAddr, err)
+		}
+		monitorLog.Info("Syslog receiver listening", "protocol", "udp", "address", cfg.UDPAddr)
+		go serveSyslogUDP(conn)
+	}
+
+	if cfg.TCPAddr != "" {
+		listener, err := net.Listen("tcp", cfg.TCPAddr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on TCP %s: %v", cfg.TCPAddr, err)
+		}
+		monitorLog.Info("Syslog receiver listening", "protocol", "tcp", "address", cfg.TCPAddr)
+		go serveSyslogStream(listener)
+	}
+
+	if cfg.TLSAddr != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load syslog TLS certificate: %v", err)
+		}
+		listener, err := tls.Listen("tcp", cfg.TLSAddr, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to listen on TLS %s: %v", cfg.TLSAddr, err)
+		}
+		monitorLog.Info("Syslog receiver listening", "protocol", "tls", "address", cfg.TLSAddr)
+		go serveSyslogStream(listener)
+	}
+
+	return nil
+}
+
+func serveSyslogUDP(conn net.PacketConn) {
+	buf := make([]byte, maxSyslogMessageSize)
+
+	var delay time.Duration
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			delay = syslogRetryDelay(delay)
+			monitorLog.Error("Error reading syslog UDP packet", "error", err, "retry_in", delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		handleSyslogPayload(string(buf[:n]), addr)
+	}
+}
+
+func serveSyslogStream(listener net.Listener) {
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			delay = syslogRetryDelay(delay)
+			monitorLog.Error("Error accepting syslog connection", "error", err, "retry_in", delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+
+		go func(conn net.Conn) {
+			defer conn.Close()
+
+			err := readSyslogFrames(conn, func(frame string) {
+				handleSyslogPayload(frame, conn.RemoteAddr())
+			})
+			if err != nil && err != io.EOF {
+				monitorLog.Warn("Syslog connection closed", "remote", conn.RemoteAddr().String(), "error", err)
+			}
+		}(conn)
+	}
+}
+
+// syslogRetryDelay doubles the pause after repeated read or accept errors,
+// from 5ms up to one second.
+func syslogRetryDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return 5 * time.Millisecond
+	}
+	return min(2*delay, time.Second)
+}
+
+// readSyslogFrames splits a syslog stream into messages, supporting both
+// octet-counting (RFC 6587 "LEN MSG") and newline-delimited framing.
+func readSyslogFrames(r io.Reader, handle func(frame string)) error {
+	reader := bufio.NewReaderSize(r, maxSyslogMessageSize)
+
+	for {
+		first, err := reader.Peek(1)
+		if err != nil {
+			return err
+		}
+
+		if first[0] >= '0' && first[0] <= '9' {
+			lengthStr, err := reader.ReadString(' ')
+			if err != nil {
+				return err
+			}
+
+			length, err := strconv.Atoi(strings.TrimSuffix(lengthStr, " "))
+			if err != nil || length <= 0 || length > maxSyslogMessageSize {
+				return fmt.Errorf("invalid syslog frame length %q", lengthStr)
+			}
+
+			frame := make([]byte, length)
+			if _, err := io.ReadFull(reader, frame); err != nil {
+				return err
+			}
+			handle(strings.TrimRight(string(frame), "\r\n"))
+			continue
+		}
+
+		line, err := reader.ReadString('\n')
+		if trimmed := strings.TrimRight(line, "\r\n"); trimmed != "" {
+			handle(trimmed)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func handleSyslogPayload(payload string, addr net.Addr) {
+	node, allowed := syslogNodeFor(addr)
+	if !allowed {
+		monitorLog.Debug("Dropping syslog message from unknown sender", "remote", remoteHost(addr))
+		return
+	}
+
+	msg, err := parseSyslogMessage(payload)
+	if err != nil {
+		monitorLog.Warn("Invalid syslog message", "remote", remoteHost(addr), "error", err)
+		return
+	}
+
+	if source := syslogSourceFor(node); source != nil {
+		processLogLine(source, msg.Message)
+	}
+}
+
+// syslogNodeFor names the node of a sender. With Syslog.Nodes configured
+// only their addresses are accepted, otherwise the sender address is the
+// node; LoadConfig then allows only loopback listeners. The hostname in the
+// message is not trusted, anyone can forge it.
+func syslogNodeFor(addr net.Addr) (string, bool) {
+	host := remoteHost(addr)
+	if len(config.Syslog.Nodes) == 0 {
+		return host, host != ""
+	}
+	return config.Syslog.NodeFor(net.ParseIP(host))
+}
+
+// syslogSourceFor returns the source of a node, creating it on first use.
+// Without configured nodes at most Syslog.MaxNodes sources are created, and
+// nil is returned for the senders over the limit.
+func syslogSourceFor(node string) *logSource {
+	syslogSourcesMu.RLock()
+	source, exists := syslogSources[node]
+	syslogSourcesMu.RUnlock()
+	if exists {
+		return source
+	}
+
+	syslogSourcesMu.Lock()
+	defer syslogSourcesMu.Unlock()
+
+	if source, exists := syslogSources[node]; exists {
+		return source
+	}
+
+	if len(config.Syslog.Nodes) == 0 && config.Syslog.MaxNodes > 0 && len(syslogSources) >= config.Syslog.MaxNodes {
+		if !syslogLimitLogged {
+			monitorLog.Warn("Syslog.MaxNodes reached, dropping messages from new senders", "max_nodes", config.Syslog.MaxNodes, "remote", node)
+			syslogLimitLogged = true
+		}
+		return nil
+	}
+
+	source = newLogSource(config.Syslog.SourceFor(node))
+	syslogSources[node] = source
+	monitorLog.Info("Receiving syslog from new node", "source", node)
+
+	return source
+}
+
+func remoteHost(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func parseSyslogMessage(data string) (syslogMessage, error) {
+	if len(data) < 3 || data[0] != '<' {
+		return syslogMessage{}, fmt.Errorf("missing priority")
+	}
+
+	end := strings.IndexByte(data, '>')
+	if end < 2 || end > 4 {
+		return syslogMessage{}, fmt.Errorf("invalid priority")
+	}
+	if _, err := strconv.Atoi(data[1:end]); err != nil {
+		return syslogMessage{}, fmt.Errorf("invalid priority: %v", err)
+	}
+
+	rest := data[end+1:]
+	if strings.HasPrefix(rest, "1 ") {
+		return parseRFC5424(rest[2:])
+	}
+	return parseRFC3164(rest), nil
+}
+
+func parseRFC5424(data string) (syslogMessage, error) {
+	fields := strings.SplitN(data, " ", 6)
+	if len(fields) < 6 {
+		return syslogMessage{}, fmt.Errorf("truncated RFC 5424 header")
+	}
+
+	msg := syslogMessage{
+		Hostname: nilValue(fields[1]),
+		AppName:  nilValue(fields[2]),
+	}
+
+	rest := fields[5]
+	if strings.HasPrefix(rest, "-") {
+		rest = rest[1:]
+	} else {
+		for strings.HasPrefix(rest, "[") {
+			closing := structuredDataEnd(rest)
+			if closing < 0 {
+				return syslogMessage{}, fmt.Errorf("unterminated structured data")
+			}
+			rest = rest[closing+1:]
+		}
+	}
+
+	rest = strings.TrimPrefix(rest, " ")
+	msg.Message = strings.TrimPrefix(rest, "\xef\xbb\xbf")
+
+	return msg, nil
+}
+
+func structuredDataEnd(data string) int {
+	escaped := false
+	for i := 1; i < len(data); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case data[i] == '\\':
+			escaped = true
+		case data[i] == ']':
+			return i
+		}
+	}
+	return -1
+}
+
+func parseRFC3164(data string) syslogMessage {
+	var msg syslogMessage
+
+	if len(data) >= 16 && data[3] == ' ' && data[9] == ':' && data[12] == ':' && data[15] == ' ' {
+		data = data[16:]
+	} else if space := strings.IndexByte(data, ' '); space > 0 && strings.Contains(data[:space], "T") && strings.Contains(data[:space], ":") {
+		data = data[space+1:]
+	}
+
+	if space := strings.IndexByte(data, ' '); space > 0 {
+		token := data[:space]
+		if !strings.HasSuffix(token, ":") && !strings.Contains(token, "[") {
+			msg.Hostname = token
+			data = data[space+1:]
+		}
+	}
+
+	if colon := strings.Index(data, ": "); colon > 0 && !strings.Contains(data[:colon], " ") {
+		msg.AppName = data[:colon]
+		if bracket := strings.IndexByte(msg.AppName, '['); bracket > 0 {
+			msg.AppName = msg.AppName[:bracket]
+		}
+		data = data[colon+2:]
+	}
+
+	msg.Message = data
+	return msg
+}
+
+func nilValue(value string) string {
+	if value == "-" {
+		return ""
+	}
+	return value
+}
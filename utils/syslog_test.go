@@ -0,0 +1,167 @@
+package utils
+
+import (
+	"net"
+	"os"
+	"strings"
+	"tblocker/config"
+	"testing"
+)
+
+func TestParseSyslogMessage(t *testing.T) {
+	accessLine := "2025/01/01 00:00:00 from 1.2.3.4:5555 accepted tcp:example.com:443 [in -> TORRENT] email: alice"
+
+	testCases := []struct {
+		name     string
+		data     string
+		hostname string
+		appName  string
+		message  string
+	}{
+		{
+			name:     "rfc5424 without structured data",
+			data:     "<14>1 2025-01-01T00:00:00Z node-1 xray 123 - - " + accessLine,
+			hostname: "node-1",
+			appName:  "xray",
+			message:  accessLine,
+		},
+		{
+			name:     "rfc5424 with structured data and BOM",
+			data:     `<14>1 2025-01-01T00:00:00Z node-2 xray - ID1 [meta a="b\]c"][x@1 y="z"] ` + "\xef\xbb\xbf" + accessLine,
+			hostname: "node-2",
+			appName:  "xray",
+			message:  accessLine,
+		},
+		{
+			name:     "rfc5424 nil hostname",
+			data:     "<14>1 - - - - - - " + accessLine,
+			hostname: "",
+			message:  accessLine,
+		},
+		{
+			name:     "rfc3164",
+			data:     "<13>Jan  1 00:00:00 node-3 xray[99]: " + accessLine,
+			hostname: "node-3",
+			appName:  "xray",
+			message:  accessLine,
+		},
+		{
+			name:    "rfc3164 without hostname",
+			data:    "<13>Jan  1 00:00:00 xray: " + accessLine,
+			appName: "xray",
+			message: accessLine,
+		},
+	}
+
+	for _, tc := range testCases {
+		msg, err := parseSyslogMessage(tc.data)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+
+		if msg.Hostname != tc.hostname || msg.AppName != tc.appName || msg.Message != tc.message {
+			t.Errorf("%s: unexpected result %+v", tc.name, msg)
+		}
+	}
+
+	for _, invalid := range []string{"", "no priority", "<abc>1 x", "<14>1 2025-01-01T00:00:00Z host app"} {
+		if _, err := parseSyslogMessage(invalid); err == nil {
+			t.Errorf("Expected error for %q", invalid)
+		}
+	}
+}
+
+func TestReadSyslogFrames(t *testing.T) {
+	first := "<14>1 - node-1 xray - - - first"
+	second := "<13>Jan  1 00:00:00 node-2 xray: second"
+	stream := "31 " + first + "<13>Jan  1 00:00:00 node-2 xray: second\r\n"
+
+	if len(first) != 31 {
+		t.Fatalf("Fixture length mismatch: %d", len(first))
+	}
+
+	var frames []string
+	err := readSyslogFrames(strings.NewReader(stream), func(frame string) {
+		frames = append(frames, frame)
+	})
+	if err == nil {
+		t.Error("Expected EOF at the end of the stream")
+	}
+
+	if len(frames) != 2 || frames[0] != first || frames[1] != second {
+		t.Errorf("Unexpected frames: %q", frames)
+	}
+}
+
+func TestSyslogSourceFor(t *testing.T) {
+	config.Syslog = config.SyslogConfig{TorrentTag: "BT"}
+	config.TorrentTag = "TORRENT"
+
+	source := syslogSourceFor("node-9")
+	if source.label != "node-9" || string(source.torrentTag) != "BT" {
+		t.Errorf("Unexpected syslog source: %+v", source)
+	}
+
+	if syslogSourceFor("node-9") != source {
+		t.Error("Expected syslog source to be reused for the same node")
+	}
+
+	if findLogSource("node-9") != source {
+		t.Error("Expected syslog source to be found by label")
+	}
+
+	if remoteHost(&net.UDPAddr{IP: net.ParseIP("10.0.0.5"), Port: 514}) != "10.0.0.5" {
+		t.Error("Expected remote host to strip the port")
+	}
+}
+
+func TestSyslogNodeFor(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "syslog_test_*.yaml")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	content := "BlockDuration: 10\nTorrentTag: TORRENT\nSyslog:\n  Enabled: true\n  UDPAddr: \":5514\"\n  Nodes:\n    - Name: edge-1\n      Addresses: [10.0.0.5, \"10.1.0.0/16\"]\n"
+	if _, err := tmpFile.WriteString(content); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	tmpFile.Close()
+	if err := config.LoadConfig(tmpFile.Name()); err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	defer func() { config.Syslog = config.SyslogConfig{} }()
+
+	if node, allowed := syslogNodeFor(&net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 514}); !allowed || node != "edge-1" {
+		t.Errorf("Expected a sender in 10.1.0.0/16 to be edge-1, got %q %v", node, allowed)
+	}
+	if _, allowed := syslogNodeFor(&net.UDPAddr{IP: net.ParseIP("10.0.0.6"), Port: 514}); allowed {
+		t.Error("Expected an unknown sender to be dropped")
+	}
+
+	config.Syslog = config.SyslogConfig{}
+	if node, allowed := syslogNodeFor(&net.UDPAddr{IP: net.ParseIP("10.0.0.6"), Port: 514}); !allowed || node != "10.0.0.6" {
+		t.Errorf("Expected the sender address without configured nodes, got %q %v", node, allowed)
+	}
+}
+
+func TestSyslogSourceLimit(t *testing.T) {
+	syslogSourcesMu.Lock()
+	oldSources := syslogSources
+	syslogSources = make(map[string]*logSource)
+	syslogSourcesMu.Unlock()
+	defer func() { syslogSources = oldSources }()
+
+	config.Syslog = config.SyslogConfig{MaxNodes: 2}
+	defer func() { config.Syslog = config.SyslogConfig{} }()
+
+	if syslogSourceFor("10.0.0.1") == nil || syslogSourceFor("10.0.0.2") == nil {
+		t.Fatal("Expected sources up to MaxNodes to be created")
+	}
+	if syslogSourceFor("10.0.0.3") != nil {
+		t.Error("Expected no source over MaxNodes")
+	}
+	if syslogSourceFor("10.0.0.1") == nil {
+		t.Error("Expected known senders to keep their source")
+	}
+}
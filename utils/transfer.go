@@ -0,0 +1,335 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"path/filepath"
+	"sort"
+	"strings"
+	"tblocker/storage"
+	"time"
+)
+
+// Formats of exported and imported entry lists.
+const (
+	FormatJSON = "json"
+	FormatCSV  = "csv"
+	FormatText = "txt"
+)
+
+// Import modes and the policies for entries that exist on both sides.
+const (
+	ImportMerge   = "merge"
+	ImportReplace = "replace"
+
+	ConflictLonger   = "longer"
+	ConflictExisting = "existing"
+	ConflictImported = "imported"
+)
+
+var csvColumns = []string{"kind", "ip", "username", "expires", "reason", "author", "created_at", "source", "action", "origin"}
+
+// FormatFromPath guesses the format of a file from its extension.
+func FormatFromPath(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return FormatCSV
+	case ".txt", ".list":
+		return FormatText
+	}
+	return FormatJSON
+}
+
+// ExportEntries writes entries in the given format. The text format is a
+// plain list of the blocked and banned IPs.
+func ExportEntries(entries []storage.BlockedIP, format string, out io.Writer) error {
+	switch format {
+	case FormatJSON:
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	case FormatCSV:
+		w := csv.NewWriter(out)
+		w.Write(csvColumns)
+		for _, entry := range entries {
+			w.Write([]string{
+				entry.GetKind(),
+				entry.IP,
+				entry.Username,
+				formatOptionalTime(entry.BlockedUntil),
+				entry.Reason,
+				entry.Author,
+				formatOptionalTime(entry.CreatedAt),
+				entry.Source,
+				entry.Action,
+				entry.Origin,
+			})
+		}
+		w.Flush()
+		return w.Error()
+	case FormatText:
+		for _, entry := range entries {
+			if entry.IP != "" && entry.GetKind() != storage.KindAllow {
+				if _, err := fmt.Fprintln(out, entry.IP); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown format %q, expected json, csv or txt", format)
+}
+
+// ParseEntries reads entries in the given format. JSON may be a list as
+// written by export or the map kept in blocked_ips.json and allowed.json.
+// Text lists hold one IP per line with optional # comments.
+func ParseEntries(in io.Reader, format string) ([]storage.BlockedIP, error) {
+	switch format {
+	case FormatJSON:
+		return parseJSONEntries(in)
+	case FormatCSV:
+		return parseCSVEntries(in)
+	case FormatText:
+		return parseTextEntries(in)
+	}
+	return nil, fmt.Errorf("unknown format %q, expected json, csv or txt", format)
+}
+
+func parseJSONEntries(in io.Reader) ([]storage.BlockedIP, error) {
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []storage.BlockedIP
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var stored map[string]storage.BlockedIP
+		if err := json.Unmarshal(trimmed, &stored); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %v", err)
+		}
+		for _, entry := range stored {
+			entries = append(entries, entry)
+		}
+		return entries, nil
+	}
+
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+	return entries, nil
+}
+
+func parseCSVEntries(in io.Reader) ([]storage.BlockedIP, error) {
+	r := csv.NewReader(in)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %v", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, hasIP := columns["ip"]; !hasIP {
+		if _, hasUser := columns["username"]; !hasUser {
+			return nil, fmt.Errorf("CSV header needs an ip or username column")
+		}
+	}
+
+	var entries []storage.BlockedIP
+	for line := 2; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		field := func(name string) string {
+			if i, exists := columns[name]; exists && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		entry := storage.BlockedIP{
+			Kind:     field("kind"),
+			IP:       field("ip"),
+			Username: field("username"),
+			Reason:   field("reason"),
+			Author:   field("author"),
+			Source:   field("source"),
+			Action:   field("action"),
+			Origin:   field("origin"),
+		}
+		if entry.BlockedUntil, err = parseOptionalTime(field("expires")); err != nil {
+			return nil, fmt.Errorf("line %d: invalid expires: %v", line, err)
+		}
+		if entry.CreatedAt, err = parseOptionalTime(field("created_at")); err != nil {
+			return nil, fmt.Errorf("line %d: invalid created_at: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+func parseTextEntries(in io.Reader) ([]storage.BlockedIP, error) {
+	var entries []storage.BlockedIP
+	scanner := bufio.NewScanner(in)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		if _, err := netip.ParseAddr(text); err != nil {
+			return nil, fmt.Errorf("line %d: invalid IP address %q", line, text)
+		}
+		entries = append(entries, storage.BlockedIP{IP: text})
+	}
+	return entries, scanner.Err()
+}
+
+func formatOptionalTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func parseOptionalTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// ImportPlan is the set of changes an import makes to the existing entries.
+type ImportPlan struct {
+	Add     []storage.BlockedIP
+	Remove  []storage.BlockedIP
+	Kept    int
+	Expired int
+	Invalid []error
+}
+
+// PlanImport compares imported entries with the existing ones. Expired and
+// invalid entries are skipped. When an entry exists on both sides, the
+// conflict policy keeps the one lasting longer, the existing or the imported
+// one. In replace mode existing entries missing from the import are removed,
+// except for those mirrored from peers, which their feeds manage.
+func PlanImport(existing, imported []storage.BlockedIP, mode, conflict string, now time.Time) (ImportPlan, error) {
+	var plan ImportPlan
+	if mode != ImportMerge && mode != ImportReplace {
+		return plan, fmt.Errorf("unknown mode %q, expected merge or replace", mode)
+	}
+	if conflict != ConflictLonger && conflict != ConflictExisting && conflict != ConflictImported {
+		return plan, fmt.Errorf("unknown conflict policy %q, expected longer, existing or imported", conflict)
+	}
+
+	current := make(map[string]storage.BlockedIP, len(existing))
+	for _, entry := range existing {
+		current[entryKey(entry)] = entry
+	}
+
+	// seen holds every imported key, so replace mode keeps the entries whose
+	// import was expired or invalid instead of removing them.
+	seen := make(map[string]struct{}, len(imported))
+	wanted := make(map[string]storage.BlockedIP, len(imported))
+	for _, entry := range imported {
+		seen[entryKey(entry)] = struct{}{}
+		if entry.GetKind() != storage.KindBan && !entry.Permanent() && !entry.BlockedUntil.After(now) {
+			plan.Expired++
+			continue
+		}
+		if err := NormalizeEntry(&entry, now); err != nil {
+			plan.Invalid = append(plan.Invalid, fmt.Errorf("%s: %v", describeTarget(entry), err))
+			continue
+		}
+		key := entryKey(entry)
+		if previous, exists := wanted[key]; exists && outlasts(previous, entry) {
+			continue
+		}
+		wanted[key] = entry
+	}
+
+	keys := make([]string, 0, len(wanted))
+	for key := range wanted {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		entry := wanted[key]
+		if old, exists := current[key]; exists && old.Active(now) {
+			switch {
+			case conflict == ConflictExisting,
+				conflict == ConflictLonger && !outlasts(entry, old),
+				sameEntry(old, entry):
+				plan.Kept++
+				continue
+			}
+		}
+		plan.Add = append(plan.Add, entry)
+	}
+
+	if mode == ImportReplace {
+		for _, entry := range existing {
+			if _, exists := seen[entryKey(entry)]; !exists && entry.Origin == "" {
+				plan.Remove = append(plan.Remove, entry)
+			}
+		}
+	}
+	return plan, nil
+}
+
+// ApplyImport applies a plan, returning the errors of the entries that could
+// not be changed. Imported blocks do not trigger webhooks, and may replace
+// bans since PlanImport already resolved the conflicts.
+func ApplyImport(store EntryStore, plan ImportPlan) []error {
+	var errs []error
+	for _, entry := range plan.Remove {
+		if err := store.RemoveEntry(entry.GetKind(), storage.AllowKey(entry)); err != nil && err != ErrEntryNotFound {
+			errs = append(errs, fmt.Errorf("failed to remove %s: %v", describeTarget(entry), err))
+		}
+	}
+	for _, entry := range plan.Add {
+		if err := store.AddEntry(entry, false, true); err != nil {
+			errs = append(errs, fmt.Errorf("failed to add %s: %v", describeTarget(entry), err))
+		}
+	}
+	return errs
+}
+
+// entryKey identifies an entry: blocks and bans share the key of their IP,
+// allow entries are kept apart.
+func entryKey(entry storage.BlockedIP) string {
+	if entry.GetKind() == storage.KindAllow {
+		return storage.KindAllow + "/" + storage.AllowKey(entry)
+	}
+	return storage.KindBlock + "/" + normalizeIP(entry.IP)
+}
+
+// outlasts reports whether a ends later than b, a ban outlasting any block.
+func outlasts(a, b storage.BlockedIP) bool {
+	if a.Permanent() || b.Permanent() {
+		return a.Permanent() && !b.Permanent()
+	}
+	return a.BlockedUntil.After(b.BlockedUntil)
+}
+
+func sameEntry(a, b storage.BlockedIP) bool {
+	return a.GetKind() == b.GetKind() && a.BlockedUntil.Equal(b.BlockedUntil) &&
+		a.Username == b.Username && a.Reason == b.Reason && a.Action == b.Action
+}
+
+func describeTarget(entry storage.BlockedIP) string {
+	return entry.GetKind() + " " + storage.AllowKey(entry)
+}
@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"bytes"
+	"strings"
+	"tblocker/storage"
+	"testing"
+	"time"
+)
+
+func TestExportImportRoundTrip(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	entries := []storage.BlockedIP{
+		{IP: "1.2.3.4", Kind: storage.KindBan, Reason: "spam, again", Author: "root", CreatedAt: now},
+		{IP: "5.6.7.8", Kind: storage.KindBlock, Username: "bob", BlockedUntil: now.Add(time.Hour), Action: "throttle"},
+		{Username: "alice", Kind: storage.KindAllow, BlockedUntil: now.Add(time.Hour)},
+	}
+
+	for _, format := range []string{FormatJSON, FormatCSV} {
+		var buf bytes.Buffer
+		if err := ExportEntries(entries, format, &buf); err != nil {
+			t.Fatalf("Failed to export %s: %v", format, err)
+		}
+		parsed, err := ParseEntries(&buf, format)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", format, err)
+		}
+		if len(parsed) != len(entries) {
+			t.Fatalf("Expected %d %s entries, got %d", len(entries), format, len(parsed))
+		}
+		for i, entry := range parsed {
+			want := entries[i]
+			if entry.Kind != want.Kind || entry.IP != want.IP || entry.Username != want.Username ||
+				entry.Reason != want.Reason || entry.Action != want.Action ||
+				!entry.BlockedUntil.Equal(want.BlockedUntil) || !entry.CreatedAt.Equal(want.CreatedAt) {
+				t.Errorf("%s: expected %+v, got %+v", format, want, entry)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := ExportEntries(entries, FormatText, &buf); err != nil {
+		t.Fatalf("Failed to export text: %v", err)
+	}
+	if buf.String() != "1.2.3.4\n5.6.7.8\n" {
+		t.Errorf("Unexpected text export %q", buf.String())
+	}
+}
+
+func TestParseEntries(t *testing.T) {
+	stored := `{"1.2.3.4": {"ip": "1.2.3.4", "blocked_until": "2030-01-01T00:00:00Z"}}`
+	entries, err := ParseEntries(strings.NewReader(stored), FormatJSON)
+	if err != nil || len(entries) != 1 || entries[0].IP != "1.2.3.4" {
+		t.Errorf("Expected the storage file to be read, got %+v (%v)", entries, err)
+	}
+
+	entries, err = ParseEntries(strings.NewReader("IP,Reason\n1.2.3.4,scan\n"), FormatCSV)
+	if err != nil || len(entries) != 1 || entries[0].Reason != "scan" {
+		t.Errorf("Expected partial CSV to be read, got %+v (%v)", entries, err)
+	}
+
+	entries, err = ParseEntries(strings.NewReader("# bad hosts\n\n1.2.3.4\n2001:db8::1 # v6\n"), FormatText)
+	if err != nil || len(entries) != 2 || entries[1].IP != "2001:db8::1" {
+		t.Errorf("Expected two IPs, got %+v (%v)", entries, err)
+	}
+
+	if _, err := ParseEntries(strings.NewReader("1.2.3.4\nnot-an-ip\n"), FormatText); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("Expected an error on line 2, got %v", err)
+	}
+	if _, err := ParseEntries(strings.NewReader("reason\nx\n"), FormatCSV); err == nil {
+		t.Error("Expected an error for CSV without ip column")
+	}
+
+	if FormatFromPath("/tmp/list.CSV") != FormatCSV || FormatFromPath("list.txt") != FormatText || FormatFromPath("x") != FormatJSON {
+		t.Error("Unexpected format detected from path")
+	}
+}
+
+func TestPlanImport(t *testing.T) {
+	now := time.Now()
+	existing := []storage.BlockedIP{
+		{IP: "1.1.1.1", Kind: storage.KindBlock, BlockedUntil: now.Add(time.Hour)},
+		{IP: "2.2.2.2", Kind: storage.KindBlock, BlockedUntil: now.Add(time.Hour)},
+		{IP: "3.3.3.3", Kind: storage.KindBan},
+		{IP: "4.4.4.4", Kind: storage.KindBlock, BlockedUntil: now.Add(time.Hour)},
+	}
+	imported := []storage.BlockedIP{
+		{IP: "1.1.1.1", Kind: storage.KindBlock, BlockedUntil: now.Add(2 * time.Hour)},
+		{IP: "2.2.2.2", Kind: storage.KindBlock, BlockedUntil: now.Add(time.Minute)},
+		{IP: "4.4.4.4", Kind: storage.KindBlock, BlockedUntil: now.Add(-time.Minute)},
+		{IP: "5.5.5.5", Kind: storage.KindBan},
+		{IP: "bad", Kind: storage.KindBan},
+	}
+
+	testCases := []struct {
+		mode, conflict string
+		add            []string
+		remove         []string
+		kept           int
+	}{
+		{mode: ImportMerge, conflict: ConflictLonger, add: []string{"1.1.1.1", "5.5.5.5"}, kept: 1},
+		{mode: ImportMerge, conflict: ConflictExisting, add: []string{"5.5.5.5"}, kept: 2},
+		{mode: ImportMerge, conflict: ConflictImported, add: []string{"1.1.1.1", "2.2.2.2", "5.5.5.5"}},
+		{mode: ImportReplace, conflict: ConflictLonger, add: []string{"1.1.1.1", "5.5.5.5"}, remove: []string{"3.3.3.3"}, kept: 1},
+	}
+
+	for _, tc := range testCases {
+		plan, err := PlanImport(existing, imported, tc.mode, tc.conflict, now)
+		if err != nil {
+			t.Fatalf("%s/%s: unexpected error: %v", tc.mode, tc.conflict, err)
+		}
+		if got := entryIPs(plan.Add); got != strings.Join(tc.add, " ") {
+			t.Errorf("%s/%s: expected to add %v, got %s", tc.mode, tc.conflict, tc.add, got)
+		}
+		if got := entryIPs(plan.Remove); got != strings.Join(tc.remove, " ") {
+			t.Errorf("%s/%s: expected to remove %v, got %s", tc.mode, tc.conflict, tc.remove, got)
+		}
+		if plan.Kept != tc.kept || plan.Expired != 1 || len(plan.Invalid) != 1 {
+			t.Errorf("%s/%s: unexpected counts kept=%d expired=%d invalid=%d", tc.mode, tc.conflict, plan.Kept, plan.Expired, len(plan.Invalid))
+		}
+	}
+
+	if _, err := PlanImport(existing, imported, "overwrite", ConflictLonger, now); err == nil {
+		t.Error("Expected an error for an unknown mode")
+	}
+}
+
+func entryIPs(entries []storage.BlockedIP) string {
+	var ips []string
+	for _, entry := range entries {
+		ips = append(ips, entry.IP)
+	}
+	return strings.Join(ips, " ")
+}
@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"tblocker/config"
+	"time"
+)
+
+const maxIPsPerUser = 32
+
+// userIPTracker remembers the source IPs each user was seen with inside a
+// time window, bounded in the number of users and IPs per user.
+type userIPTracker struct {
+	mu    sync.Mutex
+	users map[string]*userIPs
+}
+
+type userIPs struct {
+	lastSeen time.Time
+	ips      map[string]time.Time
+}
+
+var recentUserIPs = newUserIPTracker()
+
+func newUserIPTracker() *userIPTracker {
+	return &userIPTracker{
+		users: make(map[string]*userIPs),
+	}
+}
+
+func userIPWindow() time.Duration {
+	return time.Duration(config.UserIPWindow) * time.Second
+}
+
+func (t *userIPTracker) observe(username, ip string, seen time.Time) {
+	if username == "" || ip == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry, exists := t.users[username]
+	if !exists {
+		if len(t.users) >= config.UserIPMaxUsers {
+			t.evict(seen)
+		}
+		entry = &userIPs{ips: make(map[string]time.Time)}
+		t.users[username] = entry
+	}
+
+	if _, known := entry.ips[ip]; !known && len(entry.ips) >= maxIPsPerUser {
+		oldest := ""
+		for candidate, ts := range entry.ips {
+			if oldest == "" || ts.Before(entry.ips[oldest]) {
+				oldest = candidate
+			}
+		}
+		delete(entry.ips, oldest)
+	}
+
+	if seen.After(entry.ips[ip]) {
+		entry.ips[ip] = seen
+	}
+	if seen.After(entry.lastSeen) {
+		entry.lastSeen = seen
+	}
+}
+
+// evict drops users not seen inside the window, or the least recently seen
+// user if all of them are recent. Must be called with the lock held.
+func (t *userIPTracker) evict(now time.Time) {
+	var oldestUser string
+	var oldestSeen time.Time
+
+	for username, entry := range t.users {
+		if now.Sub(entry.lastSeen) >= userIPWindow() {
+			delete(t.users, username)
+			continue
+		}
+		if oldestUser == "" || entry.lastSeen.Before(oldestSeen) {
+			oldestUser, oldestSeen = username, entry.lastSeen
+		}
+	}
+
+	if len(t.users) >= config.UserIPMaxUsers && oldestUser != "" {
+		delete(t.users, oldestUser)
+	}
+}
+
+// recent returns the IPs the user was seen with inside the window before
+// now, most recently seen first.
+func (t *userIPTracker) recent(username string, now time.Time) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry, exists := t.users[username]
+	if !exists {
+		return nil
+	}
+
+	ips := make([]string, 0, len(entry.ips))
+	for ip, seen := range entry.ips {
+		if now.Sub(seen) < userIPWindow() {
+			ips = append(ips, ip)
+		}
+	}
+	sort.Slice(ips, func(i, j int) bool {
+		return entry.ips[ips[i]].After(entry.ips[ips[j]])
+	})
+
+	return ips
+}
+
+func newBlockGroupID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return time.Now().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(buf)
+}
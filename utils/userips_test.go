@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"fmt"
+	"tblocker/config"
+	"testing"
+	"time"
+)
+
+func TestUserIPTrackerWindow(t *testing.T) {
+	defer func(window, maxUsers int) {
+		config.UserIPWindow, config.UserIPMaxUsers = window, maxUsers
+	}(config.UserIPWindow, config.UserIPMaxUsers)
+	config.UserIPWindow = 60
+	config.UserIPMaxUsers = 100
+
+	tracker := newUserIPTracker()
+	now := time.Now()
+
+	tracker.observe("bob", "1.1.1.1", now.Add(-2*time.Minute))
+	tracker.observe("bob", "2.2.2.2", now.Add(-30*time.Second))
+	tracker.observe("bob", "3.3.3.3", now.Add(-10*time.Second))
+	tracker.observe("alice", "4.4.4.4", now)
+
+	ips := tracker.recent("bob", now)
+	if len(ips) != 2 || ips[0] != "3.3.3.3" || ips[1] != "2.2.2.2" {
+		t.Errorf("Expected recent IPs [3.3.3.3 2.2.2.2], got %v", ips)
+	}
+
+	if ips := tracker.recent("carol", now); len(ips) != 0 {
+		t.Errorf("Expected no IPs for unknown user, got %v", ips)
+	}
+}
+
+func TestUserIPTrackerBounds(t *testing.T) {
+	defer func(window, maxUsers int) {
+		config.UserIPWindow, config.UserIPMaxUsers = window, maxUsers
+	}(config.UserIPWindow, config.UserIPMaxUsers)
+	config.UserIPWindow = 600
+	config.UserIPMaxUsers = 2
+
+	tracker := newUserIPTracker()
+	now := time.Now()
+
+	tracker.observe("first", "1.1.1.1", now)
+	tracker.observe("second", "2.2.2.2", now.Add(time.Second))
+	tracker.observe("third", "3.3.3.3", now.Add(2*time.Second))
+
+	if len(tracker.users) != 2 {
+		t.Errorf("Expected 2 tracked users, got %d", len(tracker.users))
+	}
+	if _, exists := tracker.users["first"]; exists {
+		t.Error("Expected least recently seen user to be evicted")
+	}
+
+	for i := 0; i < maxIPsPerUser+5; i++ {
+		tracker.observe("third", fmt.Sprintf("10.0.0.%d", i), now.Add(time.Duration(i+3)*time.Second))
+	}
+	if count := len(tracker.users["third"].ips); count != maxIPsPerUser {
+		t.Errorf("Expected at most %d IPs per user, got %d", maxIPsPerUser, count)
+	}
+}
@@ -2,13 +2,15 @@ package utils
 
 import (
 	"fmt"
-	"log"
 	"net/http"
+	"regexp"
 	"runtime"
 	"strings"
 	"sync"
 	"tblocker/config"
 	"tblocker/firewall"
+	"tblocker/logging"
+	"tblocker/parser"
 	"tblocker/storage"
 	"time"
 	"unsafe"
@@ -19,6 +21,14 @@ import (
 var ipStorage *storage.IPStorage
 var firewallManager *firewall.Manager
 
+var (
+	monitorLog   = logging.For("monitor")
+	firewallLog  = logging.For("firewall")
+	storageLog   = logging.For("storage")
+	webhookLog   = logging.For("webhook")
+	conntrackLog = logging.For("conntrack")
+)
+
 var (
 	parseStats struct {
 		totalLines   int64
@@ -30,174 +40,286 @@ var (
 	metricsStartTime time.Time
 )
 
-var (
-	torrentTagBytes []byte
-	fromBytes       []byte
-	emailBytes      []byte
-)
-
 func init() {
 	metricsStartTime = time.Now()
 }
 
-func initializeByteSearchPatterns() {
-	torrentTagBytes = []byte(config.TorrentTag)
-	fromBytes = []byte("from ")
-	emailBytes = []byte("email: ")
+func StartLogMonitor() {
+	var wg sync.WaitGroup
 
-	log.Printf("Initialized byte search patterns: TorrentTag='%s' (%d bytes)",
-		config.TorrentTag, len(torrentTagBytes))
+	if config.Syslog.Enabled {
+		if err := StartSyslogReceiver(); err != nil {
+			logging.Fatal(monitorLog, "Error starting syslog receiver", "error", err)
+		}
+	}
+
+	for _, source := range logSources {
+		wg.Add(1)
+		go func(source *logSource) {
+			defer wg.Done()
+			switch source.sourceType {
+			case "journal":
+				tailJournalSource(source)
+			default:
+				tailLogSource(source)
+			}
+		}(source)
+	}
+	go notifySystemd()
+
+	wg.Wait()
+
+	if config.Syslog.Enabled {
+		select {}
+	}
 }
 
-func StartLogMonitor() {
-	t, err := tail.TailFile(config.LogFile, tail.Config{
+func tailLogSource(source *logSource) {
+	offsets := getOffsetStore()
+
+	t, err := tail.TailFile(source.path, tail.Config{
 		Follow:    true,
 		ReOpen:    true,
-		Location:  &tail.SeekInfo{Offset: 0, Whence: 2},
+		Location:  offsets.resumeLocation(source.path, time.Now()),
 		MustExist: false,
 	})
 	if err != nil {
-		log.Fatalf("Error opening log file: %v", err)
+		logging.Fatal(source.logger(), "Error opening log file", "path", source.path, "error", err)
 	}
 
+	source.activity.running.Store(true)
 	for line := range t.Lines {
-		lineBytes := stringToBytes(line.Text)
+		processLogLine(source, line.Text)
+		offsets.update(source.path, line.SeekInfo.Offset, line.Time)
+	}
+	source.activity.running.Store(false)
 
-		hasTorrentTag := containsBytes(lineBytes, torrentTagBytes)
+	source.logger().Error("Stopped reading log file", "path", source.path, "error", t.Err())
+}
 
-		if config.EnablePerformanceMetrics {
-			parseStart := time.Now()
-			parseDuration := time.Since(parseStart)
+func processLogLine(source *logSource, text string) {
+	source.activity.begin()
+	defer source.activity.end()
 
-			updateParseStats(parseDuration, hasTorrentTag)
-		}
+	lineBytes := stringToBytes(text)
 
-		if hasTorrentTag {
-			handleLogEntry(line.Text)
-		}
+	matched := matchTagRules(source, lineBytes)
+	hasTorrentTag := len(matched) > 0
+
+	if config.EnablePerformanceMetrics {
+		parseStart := time.Now()
+		parseDuration := time.Since(parseStart)
+
+		updateParseStats(parseDuration, hasTorrentTag)
+	}
+
+	if hasTorrentTag {
+		handleLogEntry(source, text, matched)
+	} else {
+		liveDetector.observe(source, text)
 	}
 }
 
-func parseLogEntryFast(line string) (ip, username string, valid bool) {
-	lineBytes := stringToBytes(line)
+func handleLogEntry(source *logSource, line string, matched []int) {
+	result := liveDetector.evaluate(source, line, matched)
+	event := result.Event
+	ip, usernameStr := event.IP, event.Username
 
-	if !containsBytes(lineBytes, torrentTagBytes) {
-		return "", "", false
-	}
+	logger := source.logger()
 
-	fromIndex := indexBytes(lineBytes, fromBytes)
-	if fromIndex == -1 {
-		return "", "", false
+	switch result.Stage {
+	case stageParse:
+		logger.Warn("Invalid log entry format: IP or username missing")
+		return
+	case stageFilter:
+		logger.Debug("Ignoring entry", "user", usernameStr, "ip", ip, "cause", result.Reason)
+		return
+	case stageExempt:
+		logger.Debug("User is exempt by user policy, skipping", "user", usernameStr, "ip", ip)
+		return
+	case stageAllowed:
+		logger.Debug("User is allowed by an allow entry, skipping", "user", usernameStr, "ip", ip,
+			"author", result.Allow.Author, "allow_reason", result.Allow.Reason)
+		return
+	case stageExpired:
+		logger.Debug("Skipping detection, block would already have expired", "user", usernameStr, "ip", ip,
+			"detected_at", result.DetectedAt.Format(time.RFC3339))
+		return
+	case stageBlocked:
+		logger.Debug("IP is already blocked, skipping", "user", usernameStr, "ip", ip)
+		return
 	}
 
-	ipStart := fromIndex + len(fromBytes)
-	if ipStart >= len(line) {
-		return "", "", false
+	notification := webhookEvent{
+		Event:    event,
+		Duration: result.Duration,
+		Source:   source.label,
+		Reason:   result.Rule.Reason,
+		Template: result.Rule.WebhookTemplate,
 	}
 
-	if ipStart+4 < len(line) {
-		if (line[ipStart] == 't' && line[ipStart+1] == 'c' && line[ipStart+2] == 'p' && line[ipStart+3] == ':') ||
-			(line[ipStart] == 'u' && line[ipStart+1] == 'd' && line[ipStart+2] == 'p' && line[ipStart+3] == ':') {
-			ipStart += 4
+	switch result.Verdict {
+	case verdictIgnore:
+		return
+	case verdictNotify:
+		logger.Info("User detected, notify-only policy, not blocking", append([]any{"user", usernameStr, "ip", ip, "reason", result.Rule.Reason}, eventAttrs(event)...)...)
+		if config.SendWebhook {
+			notification.Action = "notify"
+			go sendWebhookEvent(notification)
 		}
+		return
 	}
 
-	if ipStart >= len(line) {
-		return "", "", false
+	if result.Scope == "user" {
+		notification.GroupID = newBlockGroupID()
+		logger.Info("User triggered a user-scope block", "user", usernameStr, "ips", len(result.IPs), "group", notification.GroupID)
 	}
 
-	ipEnd := ipStart
-	for ipEnd < len(line) && line[ipEnd] != ':' {
-		ipEnd++
-	}
+	for _, blockIP := range result.IPs {
+		if ipStorage.IsBlocked(blockIP) {
+			logger.Debug("IP is already blocked, skipping", "user", usernameStr, "ip", blockIP)
+			continue
+		}
 
-	if ipEnd <= ipStart {
-		return "", "", false
-	}
+		blocked := storage.BlockedIP{
+			IP:           blockIP,
+			Username:     usernameStr,
+			BlockedUntil: result.BlockedUntil,
+			CreatedAt:    result.DetectedAt,
+			Source:       source.label,
+			Network:      event.Network,
+			Destination:  event.Destination,
+			Inbound:      event.Inbound,
+			Outbound:     event.Outbound,
+			Reason:       result.Rule.Reason,
+			Action:       result.Action,
+			GroupID:      notification.GroupID,
+		}
+		if err := ipStorage.AddBlockedEntry(blocked); err != nil {
+			storageLog.Error("Error saving blocked IP", "ip", blockIP, "error", err)
+		}
+		shareBlock(blocked)
 
-	ip = line[ipStart:ipEnd]
+		go applyAction(blockIP, result.Action)
+		attrs := append([]any{"user", usernameStr, "ip", blockIP, "duration", result.Duration, "reason", result.Rule.Reason}, eventAttrs(event)...)
+		if result.Action == "throttle" {
+			logger.Warn("User throttled", append(attrs, "rate_kbit", config.ThrottleRate)...)
+		} else {
+			logger.Warn("User blocked", attrs...)
+		}
 
-	if !isValidIPFormat(ip) {
-		return "", "", false
+		if config.SendWebhook {
+			ipNotification := notification
+			ipNotification.IP = blockIP
+			ipNotification.Action = "block"
+			if result.Action == "throttle" {
+				ipNotification.Action = "throttle"
+			}
+			go sendWebhookEvent(ipNotification)
+		}
 	}
+}
 
-	emailIndex := indexBytes(lineBytes, emailBytes)
-	if emailIndex == -1 {
-		return "", "", false
+// detectionTime returns the timestamp of the log line, falling back to now
+// for lines without one or with a timestamp in the future.
+func detectionTime(event parser.Event, now time.Time) time.Time {
+	if event.Time.IsZero() || event.Time.After(now) {
+		return now
 	}
+	return event.Time
+}
 
-	userStart := emailIndex + len(emailBytes)
-	if userStart >= len(line) {
-		return "", "", false
-	}
+func describeEvent(event parser.Event) string {
+	var details []string
 
-	userEnd := userStart
-	for userEnd < len(line) && line[userEnd] != ' ' && line[userEnd] != '\t' && line[userEnd] != '\n' {
-		userEnd++
+	if event.Destination != "" {
+		destination := event.Destination
+		if event.Network != "" {
+			destination = event.Network + ":" + destination
+		}
+		details = append(details, "destination: "+destination)
 	}
-
-	if userEnd <= userStart {
-		return "", "", false
+	if route := event.Route(); route != "" {
+		details = append(details, "route: "+route)
 	}
 
-	username = line[userStart:userEnd]
-	return ip, username, true
+	if len(details) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(details, ", ") + ")"
 }
 
-func handleLogEntry(line string) {
-	ip, usernameStr, valid := parseLogEntryFast(line)
-
-	if !valid {
-		log.Println("Invalid log entry format: IP or username missing")
-		return
+// eventAttrs returns the details of an event as log attributes.
+func eventAttrs(event parser.Event) []any {
+	var attrs []any
+	if event.Network != "" {
+		attrs = append(attrs, "network", event.Network)
 	}
-
-	if IsBypassedIP(ip) {
-		return
+	if event.Destination != "" {
+		attrs = append(attrs, "destination", event.Destination)
 	}
-
-	if ipStorage.IsBlocked(ip) {
-		log.Printf("User %s with IP: %s is already blocked. Skipping...\n", usernameStr, ip)
-		return
+	if event.Inbound != "" {
+		attrs = append(attrs, "inbound", event.Inbound)
 	}
-
-	if err := ipStorage.AddBlockedIP(ip, usernameStr, time.Duration(config.BlockDuration)*time.Minute); err != nil {
-		log.Printf("Error saving blocked IP to storage: %v", err)
+	if event.Outbound != "" {
+		attrs = append(attrs, "outbound", event.Outbound)
 	}
+	return attrs
+}
 
-	go BlockIP(ip)
-	log.Printf("User %s with IP: %s blocked for %d minutes\n", usernameStr, ip, config.BlockDuration)
-
-	if config.SendWebhook {
-		go SendWebhook(usernameStr, ip, "block")
+func eventFromBlockedIP(info storage.BlockedIP) parser.Event {
+	return parser.Event{
+		IP:          info.IP,
+		Username:    info.Username,
+		Network:     info.Network,
+		Destination: info.Destination,
+		Inbound:     info.Inbound,
+		Outbound:    info.Outbound,
 	}
 }
 
-func BlockIP(ip string) {
+// BlockIP blocks the IP in the firewall and drops its established
+// connections, returning how many were dropped.
+func BlockIP(ip string) int {
 	if firewallManager == nil {
-		log.Printf("Firewall manager not initialized")
-		return
+		firewallLog.Error("Firewall manager not initialized")
+		return 0
 	}
 
 	err := firewallManager.BlockIP(ip)
 	if err != nil {
-		log.Printf("Error blocking IP %s: %v", ip, err)
-		return
+		firewallLog.Error("Error blocking IP", "ip", ip, "error", err)
+		return 0
 	}
 
-	if conntrackManager != nil && conntrackManager.IsAvailable() {
-		if err := conntrackManager.DropConnections(ip); err != nil {
-			log.Printf("Warning: failed to drop connections for IP %s: %v", ip, err)
-		}
+	return dropConnections(ip)
+}
+
+// applyAction applies a block entry's action to the firewall and returns
+// how many connections were dropped. Throttled IPs keep their connections,
+// so they are only dropped for a drop.
+func applyAction(ip, action string) int {
+	if action != "throttle" {
+		return BlockIP(ip)
+	}
+
+	if firewallManager == nil {
+		firewallLog.Error("Firewall manager not initialized")
+		return 0
 	}
+
+	if err := firewallManager.ThrottleIP(ip, config.ThrottleRate); err != nil {
+		firewallLog.Error("Error throttling IP", "ip", ip, "error", err)
+	}
+	return 0
 }
 
 func SetFirewallManager(manager *firewall.Manager) {
 	firewallManager = manager
-	initializeByteSearchPatterns()
+	initializeLogSources()
 
 	if config.EnablePerformanceMetrics {
-		log.Printf("Performance metrics enabled - starting metrics collection")
+		monitorLog.Info("Performance metrics enabled, starting metrics collection")
 		go reportPerformanceMetrics()
 	}
 }
@@ -208,24 +330,61 @@ func SetIPStorage(storage *storage.IPStorage) {
 
 func UpdateBlockedIPs() {
 	if firewallManager == nil {
-		log.Printf("Firewall manager not initialized")
+		firewallLog.Error("Firewall manager not initialized")
 		return
 	}
 
 	currentBlockedIPs, err := firewallManager.GetBlockedIPs()
 	if err != nil {
-		log.Printf("Error checking firewall status: %v", err)
+		firewallLog.Error("Error checking firewall status", "error", err)
+		return
+	}
+
+	currentThrottledIPs, err := firewallManager.GetThrottledIPs()
+	if err != nil {
+		firewallLog.Error("Error checking firewall status", "error", err)
 		return
 	}
 
 	blockedInStorage := ipStorage.GetBlockedIPs()
 
 	for ip, info := range blockedInStorage {
-		if time.Now().Before(info.BlockedUntil) && !currentBlockedIPs[ip] {
-			log.Printf("Restoring block for IP: %s (user: %s) using %s", ip, info.Username, firewallManager.GetFirewallName())
+		if !info.Active(time.Now()) {
+			continue
+		}
+
+		if info.Action == "throttle" {
+			if !currentThrottledIPs[ip] {
+				firewallLog.Info("Restoring throttle", "ip", ip, "user", info.Username, "reason", info.Reason, "firewall", firewallManager.GetFirewallName())
+				go applyAction(ip, info.Action)
+			}
+		} else if !currentBlockedIPs[ip] {
+			firewallLog.Info("Restoring block", "ip", ip, "user", info.Username, "reason", info.Reason, "firewall", firewallManager.GetFirewallName())
 			go BlockIP(ip)
 		}
 	}
+
+	// Entries removed while the service was stopped leave their rules behind.
+	stored := make(map[string]struct{}, len(blockedInStorage))
+	for ip := range blockedInStorage {
+		stored[normalizeIP(ip)] = struct{}{}
+	}
+	for ip := range currentBlockedIPs {
+		if _, exists := stored[normalizeIP(ip)]; !exists {
+			firewallLog.Info("Removing block without a storage entry", "ip", ip)
+			if err := firewallManager.UnblockIP(ip); err != nil {
+				firewallLog.Error("Error unblocking IP", "ip", ip, "error", err)
+			}
+		}
+	}
+	for ip := range currentThrottledIPs {
+		if _, exists := stored[normalizeIP(ip)]; !exists {
+			firewallLog.Info("Removing throttle without a storage entry", "ip", ip)
+			if err := firewallManager.UnthrottleIP(ip); err != nil {
+				firewallLog.Error("Error unthrottling IP", "ip", ip, "error", err)
+			}
+		}
+	}
 }
 
 func ScheduleBlockedIPsUpdate() {
@@ -233,6 +392,7 @@ func ScheduleBlockedIPsUpdate() {
 	go func() {
 		for range time.Tick(time.Duration(config.BlockDuration) * time.Minute) {
 			UpdateBlockedIPs()
+			detections.prune(time.Now())
 		}
 	}()
 }
@@ -241,40 +401,86 @@ func UnblockIPAfterDelay(ip string, delay time.Duration, username string) {
 	time.Sleep(delay)
 
 	if ipStorage.IsBlocked(ip) {
-		log.Printf("Skipping unblock for IP %s as it has an active block", ip)
+		monitorLog.Debug("Skipping unblock, IP has an active block", "ip", ip, "user", username)
 		return
 	}
 
-	if firewallManager == nil {
-		log.Printf("Firewall manager not initialized")
+	blockedIPs := ipStorage.GetBlockedIPs()
+	info, exists := blockedIPs[ip]
+	if !exists {
+		storageLog.Warn("IP not found in storage, skipping unblock", "ip", ip, "user", username)
 		return
 	}
 
-	blockedIPs := ipStorage.GetBlockedIPs()
-	if _, exists := blockedIPs[ip]; !exists {
-		log.Printf("IP %s not found in storage, skipping unblock", ip)
-		return
+	if err := unblockEntry(info); err != nil {
+		firewallLog.Error("Error unblocking IP", "ip", ip, "error", err)
 	}
+}
+
+// unblockEntry lifts a block or ban from the firewall, removes it from
+// storage and sends the unblock webhook.
+func unblockEntry(info storage.BlockedIP) error {
+	if firewallManager == nil {
+		return fmt.Errorf("firewall manager not initialized")
+	}
+
+	ip, username := info.IP, info.Username
 
-	err := firewallManager.UnblockIP(ip)
+	var err error
+	if info.Action == "throttle" {
+		err = firewallManager.UnthrottleIP(ip)
+	} else {
+		err = firewallManager.UnblockIP(ip)
+	}
 	if err != nil {
 		if strings.Contains(err.Error(), "no rule found") || strings.Contains(err.Error(), "exit status 1") {
-			log.Printf("IP %s already unblocked or rule not found, continuing...", ip)
+			firewallLog.Debug("IP already unblocked or rule not found, continuing", "ip", ip)
 		} else {
-			log.Printf("Error unblocking IP %s: %v", ip, err)
-			return
+			return err
 		}
 	}
 
 	if err := ipStorage.RemoveBlockedIP(ip); err != nil {
-		log.Printf("Error removing IP from storage: %v", err)
+		storageLog.Error("Error removing IP", "ip", ip, "error", err)
+	}
+	shareUnblock(info)
+
+	source := findLogSource(info.Source)
+	duration := blockMinutes(info)
+	source.logger().Info("User unblocked", "user", username, "ip", ip, "duration", duration, "reason", info.Reason)
+
+	// Mirrored blocks were announced by the node that created them.
+	if config.SendWebhook && info.Origin == "" {
+		notification := webhookEvent{
+			Event:    eventFromBlockedIP(info),
+			Action:   "unblock",
+			Duration: duration,
+			Source:   info.Source,
+			Reason:   info.Reason,
+			GroupID:  info.GroupID,
+		}
+		if info.Action == "throttle" {
+			notification.Action = "unthrottle"
+		}
+		if rule := config.FindTagRule(info.Reason); rule != nil {
+			notification.Template = rule.WebhookTemplate
+		}
+		go sendWebhookEvent(notification)
 	}
 
-	log.Printf("User %s with IP: %s has been unblocked\n", username, ip)
+	return nil
+}
 
-	if config.SendWebhook {
-		go SendWebhook(username, ip, "unblock")
+// blockMinutes returns the length of a block in minutes. Bans have none, and
+// entries saved without a creation time are assumed to last BlockDuration.
+func blockMinutes(info storage.BlockedIP) int {
+	if info.Permanent() {
+		return 0
+	}
+	if info.CreatedAt.IsZero() {
+		return config.BlockDuration
 	}
+	return int(info.BlockedUntil.Sub(info.CreatedAt).Round(time.Minute) / time.Minute)
 }
 
 func IsBypassedIP(ip string) bool {
@@ -282,27 +488,6 @@ func IsBypassedIP(ip string) bool {
 	return exists
 }
 
-func isValidIPFormat(ip string) bool {
-	parts := strings.Split(ip, ".")
-	if len(parts) != 4 {
-		return false
-	}
-
-	for _, part := range parts {
-		if len(part) == 0 || len(part) > 3 {
-			return false
-		}
-
-		for _, ch := range part {
-			if ch < '0' || ch > '9' {
-				return false
-			}
-		}
-	}
-
-	return true
-}
-
 func containsBytes(haystack, needle []byte) bool {
 	if len(needle) == 0 {
 		return true
@@ -329,32 +514,6 @@ func containsBytes(haystack, needle []byte) bool {
 	return false
 }
 
-func indexBytes(haystack, needle []byte) int {
-	if len(needle) == 0 {
-		return 0
-	}
-	if len(needle) > len(haystack) {
-		return -1
-	}
-
-	first := needle[0]
-	for i := 0; i <= len(haystack)-len(needle); i++ {
-		if haystack[i] == first {
-			match := true
-			for j := 1; j < len(needle); j++ {
-				if haystack[i+j] != needle[j] {
-					match = false
-					break
-				}
-			}
-			if match {
-				return i
-			}
-		}
-	}
-	return -1
-}
-
 func stringToBytes(s string) []byte {
 	return *(*[]byte)(unsafe.Pointer(&struct {
 		string
@@ -362,26 +521,67 @@ func stringToBytes(s string) []byte {
 	}{s, len(s)}))
 }
 
+type webhookEvent struct {
+	parser.Event
+	Action   string
+	Duration int
+	Source   string
+	Reason   string
+	Template string
+	GroupID  string
+}
+
 func SendWebhook(username string, ip string, action string) {
+	sendWebhookEvent(webhookEvent{
+		Event:    parser.Event{IP: ip, Username: username},
+		Action:   action,
+		Duration: config.BlockDuration,
+	})
+}
+
+func sendWebhookEvent(event webhookEvent) {
 	if !config.SendWebhook || config.WebhookURL == "" {
 		return
 	}
+	if webhookDigest != nil {
+		webhookDigest.add(event)
+		return
+	}
+	deliverWebhookEvent(event)
+}
+
+func deliverWebhookEvent(event webhookEvent) {
+	template := event.Template
+	if template == "" {
+		template = config.WebhookTemplate
+	}
+
+	postWebhook(formatWebhookPayload(template, event), "action", event.Action, "ip", event.IP)
+}
 
-	cleanUsername := processUsernameForWebhook(username)
+// formatWebhookPayload fills a webhook template. The named placeholders are
+// replaced in the template before its printf verbs are filled, so neither
+// kind of value is scanned for placeholders again.
+func formatWebhookPayload(template string, event webhookEvent) string {
+	cleanUsername := processUsername(findLogSource(event.Source), event.Username)
 
-	payload := fmt.Sprintf(
-		config.WebhookTemplate,
+	return fmt.Sprintf(
+		expandWebhookPlaceholders(template, event),
 		cleanUsername,
-		ip,
+		event.IP,
 		config.Hostname,
-		action,
-		config.BlockDuration,
+		event.Action,
+		event.Duration,
 		time.Now().Format(time.RFC3339),
 	)
+}
 
+// postWebhook sends a payload to WebhookURL. attrs describe the payload in
+// log records about failures.
+func postWebhook(payload string, attrs ...any) {
 	req, err := http.NewRequest("POST", config.WebhookURL, strings.NewReader(payload))
 	if err != nil {
-		log.Printf("Error creating webhook request: %v", err)
+		webhookLog.Error("Error creating webhook request", "error", err)
 		return
 	}
 
@@ -393,22 +593,52 @@ func SendWebhook(username string, ip string, action string) {
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Printf("Error sending webhook: %v", err)
+		webhookLog.Error("Error sending webhook", append(attrs, "error", err)...)
 		return
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		log.Printf("Webhook returned unexpected status code: %d", resp.StatusCode)
+		webhookLog.Warn("Webhook returned unexpected status code", append(attrs, "status", resp.StatusCode)...)
 	}
 }
 
+// expandWebhookPlaceholders fills the named placeholders of a template,
+// escaped for use inside JSON strings since sniffed domains and tags come
+// from clients, and with % doubled so the values stay literal in Sprintf.
+func expandWebhookPlaceholders(template string, event webhookEvent) string {
+	return strings.NewReplacer(
+		"{source}", webhookText(event.Source),
+		"{network}", webhookText(event.Network),
+		"{destination}", webhookText(event.Destination),
+		"{inbound}", webhookText(event.Inbound),
+		"{outbound}", webhookText(event.Outbound),
+		"{reason}", webhookText(event.Reason),
+		"{group}", webhookText(event.GroupID),
+	).Replace(template)
+}
+
+func webhookText(text string) string {
+	return strings.ReplaceAll(jsonText(text), "%", "%%")
+}
+
 func processUsernameForWebhook(rawUsername string) string {
-	if config.UsernameRegex == nil {
+	return processUsernameWithRegex(config.UsernameRegex, rawUsername)
+}
+
+func processUsername(source *logSource, rawUsername string) string {
+	if source == nil {
+		return processUsernameForWebhook(rawUsername)
+	}
+	return processUsernameWithRegex(source.usernameRegex, rawUsername)
+}
+
+func processUsernameWithRegex(usernameRegex *regexp.Regexp, rawUsername string) string {
+	if usernameRegex == nil {
 		return rawUsername
 	}
 
-	matches := config.UsernameRegex.FindStringSubmatch(rawUsername)
+	matches := usernameRegex.FindStringSubmatch(rawUsername)
 	if len(matches) > 1 {
 		return matches[1]
 	}
@@ -460,21 +690,27 @@ func reportPerformanceMetrics() {
 			gcDiff := m2.NumGC - m1.NumGC
 			heapInUse := m2.HeapInuse / 1024 / 1024
 
-			log.Printf("PERFORMANCE METRICS: Total Lines: %d, Torrent Lines: %.1f%% (%d/%d), Avg parse time: %v, Lines/sec: %.0f, Allocs: %d bytes, GC: %d, Heap: %d MB, Uptime: %v",
-				parseStats.totalLines,
-				torrentRate,
-				parseStats.validLines,
-				parseStats.totalLines,
-				avgTime,
-				linesPerSec,
-				allocDiff,
-				gcDiff,
-				heapInUse,
-				uptime.Truncate(time.Second))
+			monitorLog.Info("Performance metrics",
+				"total_lines", parseStats.totalLines,
+				"torrent_percent", fmt.Sprintf("%.1f", torrentRate),
+				"torrent_lines", parseStats.validLines,
+				"avg_parse_time", avgTime,
+				"lines_per_sec", fmt.Sprintf("%.0f", linesPerSec),
+				"alloc_bytes", allocDiff,
+				"gc", gcDiff,
+				"heap_mb", heapInUse,
+				"uptime", uptime.Truncate(time.Second))
 
 			m1 = m2
 		}
 
 		parseStats.mu.RUnlock()
+
+		if ips := conntrackStats.ipsDropped.Load(); ips > 0 || conntrackStats.dumps.Load() > 0 {
+			flowsDropped := conntrackStats.flowsDropped.Load()
+			conntrackLog.Info("Conntrack metrics", "dumps", conntrackStats.dumps.Load(),
+				"flows_scanned", conntrackStats.flowsScanned.Load(), "ips", ips, "flows_dropped", flowsDropped,
+				"flows_per_ip", fmt.Sprintf("%.1f", float64(flowsDropped)/float64(max(ips, 1))))
+		}
 	}
 }
@@ -4,7 +4,9 @@ import (
 	"os"
 	"path/filepath"
 	"tblocker/config"
+	"tblocker/storage"
 	"testing"
+	"time"
 )
 
 func TestIsBypassedIP(t *testing.T) {
@@ -104,3 +106,22 @@ SendWebhook: false
 
 	SendWebhook("testuser", "192.168.1.100", "block")
 }
+
+func TestBlockMinutes(t *testing.T) {
+	config.BlockDuration = 10
+	created := time.Now()
+
+	testCases := []struct {
+		entry storage.BlockedIP
+		want  int
+	}{
+		{storage.BlockedIP{CreatedAt: created, BlockedUntil: created.Add(45 * time.Minute)}, 45},
+		{storage.BlockedIP{BlockedUntil: created.Add(45 * time.Minute)}, 10},
+		{storage.BlockedIP{Kind: storage.KindBan, CreatedAt: created}, 0},
+	}
+	for _, tc := range testCases {
+		if got := blockMinutes(tc.entry); got != tc.want {
+			t.Errorf("Expected %d minutes for %+v, got %d", tc.want, tc.entry, got)
+		}
+	}
+}